@@ -11,6 +11,8 @@ type Mount struct {
 	WherePath    string   // Absolute path to mount point.
 	FSType       string   // Optional file-system path.
 	MountOptions []string // Options to use when mounting.
+
+	Extra []Option // Keys written after the others.
 }
 
 // String returns the configuration as a valid mount stanza.
@@ -30,6 +32,7 @@ func (s *Mount) String() string {
 	if len(s.MountOptions) > 0 {
 		out.WriteString(fmt.Sprintf("Options=%s\n", strings.Join(s.MountOptions, ",")))
 	}
+	writeOptions(&out, s.Extra)
 
 	return out.String()
 }
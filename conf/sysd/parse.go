@@ -0,0 +1,373 @@
+package sysd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse parses the contents of a unit file. Keys in the [Unit], [Install],
+// [Service] and [Mount] sections are read into their fields. Keys without a
+// field and values a field cannot represent are kept in order as Extra
+// options, and other sections are kept in Sections, so the unit is written
+// back with the same settings. Comments are discarded.
+//
+// As Extra options are written after the fields, a key which is given more
+// than once (such as multiple ExecStartPre lines), or which is reset with an
+// empty value, is kept entirely in Extra so its values stay in order. Keys
+// holding lists, such as After, are only kept in Extra if they are reset.
+//
+// A service which does not set IgnoreSIGPIPE has it set, as that is the
+// default used by systemd.
+func Parse(data []byte) (*Unit, error) {
+	type line struct {
+		section    string // Set for a section header.
+		key, value string
+	}
+	var (
+		parsed  []line
+		section string
+		keys    = map[string]int{}  // Number of times each key is given, as Section.Key.
+		resets  = map[string]bool{} // Keys given an empty value.
+	)
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNum, l := i+1, strings.TrimSpace(lines[i])
+		if l == "" || isComment(l) {
+			continue
+		}
+		if l[0] == '[' {
+			if len(l) < 3 || l[len(l)-1] != ']' {
+				return nil, fmt.Errorf("line %d: invalid section header %q", lineNum, l)
+			}
+			section = l[1 : len(l)-1]
+			parsed = append(parsed, line{section: section})
+			continue
+		}
+
+		// A trailing backslash continues the value onto the next line,
+		// skipping any comments in between.
+		for strings.HasSuffix(l, "\\") {
+			l = strings.TrimSuffix(l, "\\") + " "
+			for i++; i < len(lines) && isComment(strings.TrimSpace(lines[i])); i++ {
+			}
+			if i == len(lines) {
+				break
+			}
+			l += strings.TrimSpace(lines[i])
+		}
+
+		eq := strings.IndexByte(l, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key=value, got %q", lineNum, l)
+		}
+		key, value := strings.TrimSpace(l[:eq]), strings.TrimSpace(l[eq+1:])
+		if section == "" {
+			return nil, fmt.Errorf("line %d: %s is not in a section", lineNum, key)
+		}
+		parsed = append(parsed, line{key: key, value: value})
+		keys[section+"."+key]++
+		if value == "" {
+			resets[section+"."+key] = true
+		}
+	}
+
+	p := parser{u: &Unit{}, raw: -1, keys: keys, resets: resets}
+	for _, l := range parsed {
+		if l.section != "" {
+			p.startSection(l.section)
+		} else {
+			p.add(l.key, l.value)
+		}
+	}
+
+	if p.u.Service != nil && keys["Service.IgnoreSIGPIPE"] == 0 {
+		p.u.Service.IgnoreSigpipe = true
+	}
+	return p.u, nil
+}
+
+func isComment(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";")
+}
+
+type parser struct {
+	u       *Unit
+	section string
+	raw     int // Index into u.Sections of the current section, or -1.
+
+	// The number of times each key is given, and the keys which are reset
+	// with an empty value, as Section.Key.
+	keys   map[string]int
+	resets map[string]bool
+}
+
+// startSection starts parsing the named section. [Service] and [Mount] are
+// kept as is if the unit already has the other, as it can only have one.
+func (p *parser) startSection(name string) {
+	p.section, p.raw = name, -1
+	switch {
+	case name == "Unit", name == "Install":
+		return
+	case name == "Service" && p.u.Mount == nil:
+		if p.u.Service == nil {
+			p.u.Service = &Service{}
+		}
+		return
+	case name == "Mount" && p.u.Service == nil:
+		if p.u.Mount == nil {
+			p.u.Mount = &Mount{}
+		}
+		return
+	}
+
+	for i := range p.u.Sections {
+		if p.u.Sections[i].Name == name {
+			p.raw = i
+			return
+		}
+	}
+	p.u.Sections = append(p.u.Sections, Section{Name: name})
+	p.raw = len(p.u.Sections) - 1
+}
+
+// add sets the field for a key of the current section, or keeps it as an
+// extra option if it cannot be set.
+func (p *parser) add(key, value string) {
+	opt := Option{Key: key, Value: value}
+	if p.raw >= 0 {
+		p.u.Sections[p.raw].Options = append(p.u.Sections[p.raw].Options, opt)
+		return
+	}
+
+	switch p.section {
+	case "Unit":
+		if !p.setUnit(key, value) {
+			p.u.Extra = append(p.u.Extra, opt)
+		}
+	case "Install":
+		if !p.setInstall(key, value) {
+			p.u.InstallExtra = append(p.u.InstallExtra, opt)
+		}
+	case "Service":
+		if !p.setService(key, value) {
+			p.u.Service.Extra = append(p.u.Service.Extra, opt)
+		}
+	case "Mount":
+		if !p.setMount(key, value) {
+			p.u.Mount.Extra = append(p.u.Mount.Extra, opt)
+		}
+	}
+}
+
+// single returns true if a key is given once in the current section, with
+// a value. Otherwise, its values are kept as extra options.
+func (p *parser) single(key string) bool {
+	id := p.section + "." + key
+	return p.keys[id] == 1 && !p.resets[id]
+}
+
+// list returns true if the values of a list key can be appended to its
+// field, which is the case unless the list is reset.
+func (p *parser) list(key string) bool {
+	return !p.resets[p.section+"."+key]
+}
+
+func (p *parser) setUnit(key, value string) bool {
+	switch key {
+	case "Description":
+		if !p.single(key) {
+			return false
+		}
+		p.u.Description = value
+	case "After":
+		if !p.list(key) {
+			return false
+		}
+		p.u.After = append(p.u.After, strings.Fields(value)...)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *parser) setInstall(key, value string) bool {
+	switch key {
+	case "WantedBy":
+		if !p.list(key) {
+			return false
+		}
+		p.u.WantedBy = append(p.u.WantedBy, strings.Fields(value)...)
+	case "RequiredBy":
+		if !p.list(key) {
+			return false
+		}
+		p.u.RequiredBy = append(p.u.RequiredBy, strings.Fields(value)...)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *parser) setService(key, value string) bool {
+	if !p.single(key) {
+		return false
+	}
+
+	s := p.u.Service
+	durations := map[string]*time.Duration{
+		"TimeoutStopSec": &s.TimeoutStopSec,
+		"RestartSec":     &s.RestartSec,
+		"WatchdogSec":    &s.WatchdogSec,
+	}
+	if d, ok := durations[key]; ok {
+		v, err := parseTimespan(value)
+		if err != nil || v <= 0 {
+			return false
+		}
+		*d = v
+		return true
+	}
+
+	switch key {
+	case "Type":
+		s.Type = ServiceType(value)
+	case "ExecStart":
+		s.ExecStart = value
+	case "RootDirectory":
+		s.RootDir = value
+	case "WorkingDirectory":
+		s.WorkingDir = value
+	case "KillMode":
+		s.KillMode = KillMode(value)
+	case "User":
+		s.User = value
+	case "Group":
+		s.Group = value
+	case "ExecReload":
+		s.ExecReload = value
+	case "ExecStop":
+		s.ExecStop = value
+	case "ExecStartPre":
+		s.ExecStartPre = value
+	case "ExecStopPost":
+		s.ExecStopPost = value
+	case "Restart":
+		s.Restart = RestartMode(value)
+	case "NotifyAccess":
+		s.NotifyAccess = NotifySockMode(value)
+	case "IgnoreSIGPIPE":
+		b, ok := parseBool(value)
+		if !ok {
+			return false
+		}
+		s.IgnoreSigpipe = b
+	case "StandardOutput":
+		o, ok := parseOutputSinks(value)
+		if !ok {
+			return false
+		}
+		s.Stdout = o
+	case "StandardError":
+		o, ok := parseOutputSinks(value)
+		if !ok {
+			return false
+		}
+		s.Stderr = o
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *parser) setMount(key, value string) bool {
+	if !p.single(key) {
+		return false
+	}
+
+	m := p.u.Mount
+	switch key {
+	case "What":
+		m.WhatPath = value
+	case "Where":
+		m.WherePath = value
+	case "Type":
+		m.FSType = value
+	case "Options":
+		m.MountOptions = strings.Split(value, ",")
+	default:
+		return false
+	}
+	return true
+}
+
+func parseBool(s string) (bool, bool) {
+	switch s {
+	case "yes", "true", "on", "1":
+		return true, true
+	case "no", "false", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+func parseOutputSinks(s string) (OutputSinks, bool) {
+	var out OutputSinks
+outer:
+	for _, ident := range strings.Split(s, "+") {
+		for _, opt := range outputSinkIdents {
+			if opt.ident == ident {
+				out |= opt.mask
+				continue outer
+			}
+		}
+		return 0, false
+	}
+	return out, true
+}
+
+// timespanUnits are the units systemd accepts in time spans. Numbers
+// without a unit are in seconds.
+var timespanUnits = map[string]time.Duration{
+	"us": time.Microsecond, "usec": time.Microsecond, "µs": time.Microsecond,
+	"ms": time.Millisecond, "msec": time.Millisecond,
+	"": time.Second, "s": time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// parseTimespan parses a systemd time span, such as 90, 5s or 1min 30s.
+func parseTimespan(s string) (time.Duration, error) {
+	var out time.Duration
+	rest := strings.TrimSpace(s)
+	if rest == "" {
+		return 0, fmt.Errorf("invalid time span %q", s)
+	}
+	for rest != "" {
+		i := strings.IndexFunc(rest, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i < 0 {
+			i = len(rest)
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time span %q", s)
+		}
+		rest = strings.TrimLeft(rest[i:], " ")
+
+		j := strings.IndexFunc(rest, func(r rune) bool { return r == ' ' || r >= '0' && r <= '9' })
+		if j < 0 {
+			j = len(rest)
+		}
+		unit, ok := timespanUnits[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid time span %q: unknown unit %q", s, rest[:j])
+		}
+		out += time.Duration(n * float64(unit))
+		rest = strings.TrimLeft(rest[j:], " ")
+	}
+	return out, nil
+}
@@ -0,0 +1,103 @@
+package sysd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Path describes a path unit, which activates another unit when files or
+// directories change.
+type Path struct {
+	PathExists        []string // Activates when any of the paths exist.
+	PathExistsGlob    []string // Activates when any file matches one of the globs.
+	PathChanged       []string // Activates when a file is closed after being written, or is renamed or removed.
+	PathModified      []string // Like PathChanged, but also activates on each write.
+	DirectoryNotEmpty []string // Activates when any of the directories contain a file.
+
+	// MakeDirectory creates the watched directories if they do not exist.
+	MakeDirectory bool
+
+	// Unit is the unit to activate. If empty, the service with the same
+	// name as the path unit is activated.
+	Unit string
+}
+
+// Validate returns an error if the path unit watches nothing, or watches a
+// relative path.
+func (p *Path) Validate() error {
+	var watched int
+	for _, paths := range []struct {
+		key   string
+		paths []string
+	}{
+		{"PathExists", p.PathExists},
+		{"PathExistsGlob", p.PathExistsGlob},
+		{"PathChanged", p.PathChanged},
+		{"PathModified", p.PathModified},
+		{"DirectoryNotEmpty", p.DirectoryNotEmpty},
+	} {
+		for _, path := range paths.paths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("%s: %q is not an absolute path", paths.key, path)
+			}
+			watched++
+		}
+	}
+	if watched == 0 {
+		return errors.New("path unit must watch at least one path")
+	}
+	return nil
+}
+
+// String returns the configuration as a valid path stanza.
+func (p *Path) String() string {
+	return p.stanza(false)
+}
+
+// stanza returns the configuration as a path stanza. If dropIn is set,
+// the watched paths are cleared before they are set, so they replace those of
+// an existing path.
+func (p *Path) stanza(dropIn bool) string {
+	var out strings.Builder
+	out.WriteString("[Path]\n")
+
+	if len(p.PathExists) > 0 {
+		writeReset(&out, dropIn, "PathExists")
+	}
+	for _, path := range p.PathExists {
+		out.WriteString(fmt.Sprintf("PathExists=%s\n", path))
+	}
+	if len(p.PathExistsGlob) > 0 {
+		writeReset(&out, dropIn, "PathExistsGlob")
+	}
+	for _, path := range p.PathExistsGlob {
+		out.WriteString(fmt.Sprintf("PathExistsGlob=%s\n", path))
+	}
+	if len(p.PathChanged) > 0 {
+		writeReset(&out, dropIn, "PathChanged")
+	}
+	for _, path := range p.PathChanged {
+		out.WriteString(fmt.Sprintf("PathChanged=%s\n", path))
+	}
+	if len(p.PathModified) > 0 {
+		writeReset(&out, dropIn, "PathModified")
+	}
+	for _, path := range p.PathModified {
+		out.WriteString(fmt.Sprintf("PathModified=%s\n", path))
+	}
+	if len(p.DirectoryNotEmpty) > 0 {
+		writeReset(&out, dropIn, "DirectoryNotEmpty")
+	}
+	for _, path := range p.DirectoryNotEmpty {
+		out.WriteString(fmt.Sprintf("DirectoryNotEmpty=%s\n", path))
+	}
+	if p.MakeDirectory {
+		out.WriteString("MakeDirectory=yes\n")
+	}
+	if p.Unit != "" {
+		out.WriteString(fmt.Sprintf("Unit=%s\n", p.Unit))
+	}
+
+	return out.String()
+}
@@ -68,37 +68,41 @@ const (
 // OutputSinks describes where standard output should be written.
 type OutputSinks uint8
 
+// outputSinkIdents are the names of each output sink, in the order they
+// are written.
+var outputSinkIdents = []struct {
+	mask  OutputSinks
+	ident string
+}{
+	{
+		mask:  OutputSyslog,
+		ident: "syslog",
+	},
+	{
+		mask:  OutputKmsg,
+		ident: "kmsg",
+	},
+	{
+		mask:  OutputJournal,
+		ident: "journal",
+	},
+	{
+		mask:  OutputConsole,
+		ident: "console",
+	},
+	{
+		mask:  OutputInherit,
+		ident: "inherit",
+	},
+}
+
 func (o OutputSinks) String() string {
 	var (
 		out strings.Builder
 		i   int
 	)
 
-	for _, opt := range []struct {
-		mask  OutputSinks
-		ident string
-	}{
-		{
-			mask:  OutputSyslog,
-			ident: "syslog",
-		},
-		{
-			mask:  OutputKmsg,
-			ident: "kmsg",
-		},
-		{
-			mask:  OutputJournal,
-			ident: "journal",
-		},
-		{
-			mask:  OutputConsole,
-			ident: "console",
-		},
-		{
-			mask:  OutputInherit,
-			ident: "inherit",
-		},
-	} {
+	for _, opt := range outputSinkIdents {
 		if opt.mask&o != 0 {
 			if i > 0 {
 				out.WriteString("+")
@@ -146,10 +150,22 @@ type Service struct {
 	Stderr        OutputSinks
 
 	Conditions Conditions
+
+	// Extra holds keys which are written after the others, such as those
+	// without a field when the service was parsed.
+	Extra []Option
 }
 
 // String returns the configuration as a valid service stanza.
 func (s *Service) String() string {
+	return s.stanza(false)
+}
+
+// stanza returns the configuration as a service stanza. If dropIn is set,
+// the stanza is written to override an existing service: the Exec commands
+// are cleared before they are set, and IgnoreSIGPIPE is omitted unless it is
+// set.
+func (s *Service) stanza(dropIn bool) string {
 	var out strings.Builder
 	out.WriteString("[Service]\n")
 
@@ -158,18 +174,23 @@ func (s *Service) String() string {
 	}
 
 	if s.ExecStartPre != "" {
+		writeReset(&out, dropIn, "ExecStartPre")
 		out.WriteString(fmt.Sprintf("ExecStartPre=%s\n", s.ExecStartPre))
 	}
 	if s.ExecStart != "" {
+		writeReset(&out, dropIn, "ExecStart")
 		out.WriteString(fmt.Sprintf("ExecStart=%s\n", s.ExecStart))
 	}
 	if s.ExecReload != "" {
+		writeReset(&out, dropIn, "ExecReload")
 		out.WriteString(fmt.Sprintf("ExecReload=%s\n", s.ExecReload))
 	}
 	if s.ExecStop != "" {
+		writeReset(&out, dropIn, "ExecStop")
 		out.WriteString(fmt.Sprintf("ExecStop=%s\n", s.ExecStop))
 	}
 	if s.ExecStopPost != "" {
+		writeReset(&out, dropIn, "ExecStopPost")
 		out.WriteString(fmt.Sprintf("ExecStopPost=%s\n", s.ExecStopPost))
 	}
 
@@ -209,7 +230,7 @@ func (s *Service) String() string {
 
 	if s.IgnoreSigpipe {
 		out.WriteString("IgnoreSIGPIPE=yes\n")
-	} else {
+	} else if !dropIn {
 		out.WriteString("IgnoreSIGPIPE=no\n")
 	}
 
@@ -223,6 +244,7 @@ func (s *Service) String() string {
 	if cond := s.Conditions.String(); len(cond) > 0 {
 		out.WriteString(cond)
 	}
+	writeOptions(&out, s.Extra)
 
 	return out.String()
 }
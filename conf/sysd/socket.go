@@ -0,0 +1,159 @@
+package sysd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BindIPv6Mode describes whether IPv6 sockets also accept IPv4 connections.
+type BindIPv6Mode string
+
+// Valid BindIPv6Mode values.
+const (
+	BindIPv6Default BindIPv6Mode = "default"
+	BindIPv6Both    BindIPv6Mode = "both"
+	BindIPv6Only    BindIPv6Mode = "ipv6-only"
+)
+
+// Socket describes a socket unit, which starts a service when a connection
+// or datagram arrives on one of the sockets it listens on.
+type Socket struct {
+	ListenStream   []string // Addresses to accept stream connections on, such as 80, [::]:80 or /run/app.sock.
+	ListenDatagram []string // Addresses to receive datagrams on.
+	ListenFIFO     []string // Paths of FIFOs to read from.
+
+	// Accept starts an instance of the service for each connection, rather
+	// than passing the listening sockets to a single instance.
+	Accept bool
+
+	SocketUser, SocketGroup string      // Owner of filesystem sockets and FIFOs.
+	SocketMode              os.FileMode // Permissions of filesystem sockets and FIFOs, if non-zero.
+	BindIPv6Only            BindIPv6Mode
+
+	// Service is the service to activate. If empty, the service with the
+	// same name as the socket is activated.
+	Service string
+}
+
+// Validate returns an error if the socket does not listen on anything, or
+// its configuration would be rejected by systemd.
+func (s *Socket) Validate() error {
+	if len(s.ListenStream) == 0 && len(s.ListenDatagram) == 0 && len(s.ListenFIFO) == 0 {
+		return errors.New("socket must listen on at least one address")
+	}
+	for _, addr := range s.ListenStream {
+		if err := validateListenAddress(addr); err != nil {
+			return fmt.Errorf("ListenStream: %v", err)
+		}
+	}
+	for _, addr := range s.ListenDatagram {
+		if err := validateListenAddress(addr); err != nil {
+			return fmt.Errorf("ListenDatagram: %v", err)
+		}
+	}
+	for _, p := range s.ListenFIFO {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("ListenFIFO: %q is not an absolute path", p)
+		}
+	}
+
+	switch s.BindIPv6Only {
+	case "", BindIPv6Default, BindIPv6Both, BindIPv6Only:
+	default:
+		return fmt.Errorf("invalid BindIPv6Only mode %q", s.BindIPv6Only)
+	}
+	if s.SocketMode&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid SocketMode %v, only permission bits may be set", s.SocketMode)
+	}
+	if s.Accept && s.Service != "" {
+		return errors.New("cannot set Service when Accept is true, as a service instance is started for each connection")
+	}
+	return nil
+}
+
+// validateListenAddress checks an address is a port, an IP address and port,
+// an absolute path to a unix socket or the name of an abstract socket.
+func validateListenAddress(addr string) error {
+	switch {
+	case strings.HasPrefix(addr, "/"):
+		return nil
+	case strings.HasPrefix(addr, "@"):
+		if len(addr) == 1 {
+			return errors.New("abstract socket name is empty")
+		}
+		return nil
+	}
+
+	port := addr
+	if strings.Contains(addr, ":") {
+		host, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %v", addr, err)
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid address %q: %q is not an IP address", addr, host)
+		}
+		port = p
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid address %q: %q is not a port number", addr, port)
+	}
+	return nil
+}
+
+// String returns the configuration as a valid socket stanza.
+func (s *Socket) String() string {
+	return s.stanza(false)
+}
+
+// stanza returns the configuration as a socket stanza. If dropIn is set,
+// the listeners are cleared before they are set, so they replace those of
+// an existing socket.
+func (s *Socket) stanza(dropIn bool) string {
+	var out strings.Builder
+	out.WriteString("[Socket]\n")
+
+	if len(s.ListenStream) > 0 {
+		writeReset(&out, dropIn, "ListenStream")
+	}
+	for _, addr := range s.ListenStream {
+		out.WriteString(fmt.Sprintf("ListenStream=%s\n", addr))
+	}
+	if len(s.ListenDatagram) > 0 {
+		writeReset(&out, dropIn, "ListenDatagram")
+	}
+	for _, addr := range s.ListenDatagram {
+		out.WriteString(fmt.Sprintf("ListenDatagram=%s\n", addr))
+	}
+	if len(s.ListenFIFO) > 0 {
+		writeReset(&out, dropIn, "ListenFIFO")
+	}
+	for _, p := range s.ListenFIFO {
+		out.WriteString(fmt.Sprintf("ListenFIFO=%s\n", p))
+	}
+	if s.Accept {
+		out.WriteString("Accept=yes\n")
+	}
+
+	if s.SocketUser != "" {
+		out.WriteString(fmt.Sprintf("SocketUser=%s\n", s.SocketUser))
+	}
+	if s.SocketGroup != "" {
+		out.WriteString(fmt.Sprintf("SocketGroup=%s\n", s.SocketGroup))
+	}
+	if s.SocketMode != 0 {
+		out.WriteString(fmt.Sprintf("SocketMode=%04o\n", uint32(s.SocketMode)))
+	}
+	if s.BindIPv6Only != "" {
+		out.WriteString(fmt.Sprintf("BindIPv6Only=%s\n", s.BindIPv6Only))
+	}
+	if s.Service != "" {
+		out.WriteString(fmt.Sprintf("Service=%s\n", s.Service))
+	}
+
+	return out.String()
+}
@@ -13,41 +13,144 @@ type Unit struct {
 
 	Service *Service
 	Mount   *Mount
+	Timer   *Timer
+	Socket  *Socket
+	Path    *Path
 
 	WantedBy   []string
 	RequiredBy []string
+
+	// Extra and InstallExtra hold keys written after the others in the
+	// [Unit] and [Install] sections, and Sections holds any other sections.
+	// They are populated with the keys and sections a parsed unit has no
+	// fields for.
+	Extra        []Option
+	InstallExtra []Option
+	Sections     []Section
+}
+
+// Option is a key and its value.
+type Option struct {
+	Key, Value string
+}
+
+// Section is a named section of options.
+type Section struct {
+	Name    string
+	Options []Option
+}
+
+// String returns the section in the correct file format.
+func (s *Section) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("[%s]\n", s.Name))
+	writeOptions(&out, s.Options)
+	return out.String()
+}
+
+// writeReset clears key in a drop-in, so the values which follow replace
+// those of the existing unit rather than being added to them.
+func writeReset(out *strings.Builder, dropIn bool, key string) {
+	if dropIn {
+		out.WriteString(key + "=\n")
+	}
+}
+
+func writeOptions(out *strings.Builder, opts []Option) {
+	for _, opt := range opts {
+		out.WriteString(fmt.Sprintf("%s=%s\n", opt.Key, opt.Value))
+	}
 }
 
 // String returns the structure represent in the correct file format.
 func (u *Unit) String() string {
+	var out strings.Builder
+	out.WriteString(u.unitSection(false))
+	out.WriteString("\n")
+	if section := u.typeSection(false); section != "" {
+		out.WriteString(section)
+		out.WriteString("\n")
+	}
+	for _, section := range u.Sections {
+		out.WriteString(section.String())
+		out.WriteString("\n")
+	}
+	if section := u.installSection(); hasKeys(section) {
+		out.WriteString(section)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// DropIn returns the structure in the format of a drop-in file, which
+// overrides the keys it sets in an existing unit. Sections without any keys
+// set are omitted, and a service only writes IgnoreSIGPIPE if it is set.
+// Keys which systemd accumulates, such as After, the Exec commands, timer
+// triggers and socket or path listeners, are cleared before they are set,
+// so they replace the values in the existing unit.
+func (u *Unit) DropIn() string {
+	var out strings.Builder
+	sections := []string{u.unitSection(true), u.typeSection(true)}
+	for _, section := range u.Sections {
+		sections = append(sections, section.String())
+	}
+	for _, section := range append(sections, u.installSection()) {
+		if hasKeys(section) {
+			if out.Len() > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString(section)
+		}
+	}
+	return out.String()
+}
+
+func (u *Unit) unitSection(dropIn bool) string {
 	var out strings.Builder
 	out.WriteString("[Unit]\n")
 	if u.Description != "" {
 		out.WriteString(fmt.Sprintf("Description=%s\n", u.Description))
 	}
 	if len(u.After) > 0 {
+		writeReset(&out, dropIn, "After")
 		out.WriteString(fmt.Sprintf("After=%s\n", strings.Join(u.After, " ")))
 	}
-	out.WriteString("\n")
+	writeOptions(&out, u.Extra)
+	return out.String()
+}
 
-	if u.Service != nil {
-		out.WriteString(u.Service.String())
-		out.WriteString("\n")
-	} else if u.Mount != nil {
-		out.WriteString(u.Mount.String())
-		out.WriteString("\n")
+// typeSection returns the section which determines the type of the unit,
+// or the empty string if it has none.
+func (u *Unit) typeSection(dropIn bool) string {
+	switch {
+	case u.Service != nil:
+		return u.Service.stanza(dropIn)
+	case u.Mount != nil:
+		return u.Mount.String()
+	case u.Timer != nil:
+		return u.Timer.stanza(dropIn)
+	case u.Socket != nil:
+		return u.Socket.stanza(dropIn)
+	case u.Path != nil:
+		return u.Path.stanza(dropIn)
 	}
+	return ""
+}
 
-	if len(u.WantedBy) > 0 || len(u.RequiredBy) > 0 {
-		out.WriteString("[Install]\n")
-		if len(u.WantedBy) > 0 {
-			out.WriteString(fmt.Sprintf("WantedBy=%s\n", strings.Join(u.WantedBy, " ")))
-		}
-		if len(u.RequiredBy) > 0 {
-			out.WriteString(fmt.Sprintf("RequiredBy=%s\n", strings.Join(u.RequiredBy, " ")))
-		}
-		out.WriteString("\n")
+func (u *Unit) installSection() string {
+	var out strings.Builder
+	out.WriteString("[Install]\n")
+	if len(u.WantedBy) > 0 {
+		out.WriteString(fmt.Sprintf("WantedBy=%s\n", strings.Join(u.WantedBy, " ")))
 	}
-
+	if len(u.RequiredBy) > 0 {
+		out.WriteString(fmt.Sprintf("RequiredBy=%s\n", strings.Join(u.RequiredBy, " ")))
+	}
+	writeOptions(&out, u.InstallExtra)
 	return out.String()
 }
+
+// hasKeys returns true if a section has any lines after its header.
+func hasKeys(section string) bool {
+	return strings.Count(section, "\n") > 1
+}
@@ -1,6 +1,8 @@
 package sysd
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -92,6 +94,15 @@ func TestSystemdUnit(t *testing.T) {
 			},
 			out: "[Unit]\nDescription=yolo\n\n",
 		},
+		{
+			name: "timer",
+			inp: Unit{
+				Description: "Nightly backup",
+				Timer:       &Timer{OnCalendar: "daily"},
+				WantedBy:    []string{"timers.target"},
+			},
+			out: "[Unit]\nDescription=Nightly backup\n\n[Timer]\nOnCalendar=daily\n\n[Install]\nWantedBy=timers.target\n\n",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -103,6 +114,70 @@ func TestSystemdUnit(t *testing.T) {
 	}
 }
 
+func TestSystemdDropIn(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  Unit
+		out  string
+	}{
+		{
+			name: "empty",
+			inp:  Unit{Service: &Service{}},
+			out:  "",
+		},
+		{
+			name: "restart",
+			inp: Unit{
+				Service: &Service{Restart: RestartOnFailure, RestartSec: 5 * time.Second},
+			},
+			out: "[Service]\nRestart=on-failure\nRestartSec=5s\n",
+		},
+		{
+			name: "exec start",
+			inp: Unit{
+				Description: "Autologin",
+				Service:     &Service{ExecStart: "-/sbin/agetty --autologin pi --noclear %I $TERM", IgnoreSigpipe: true},
+				WantedBy:    []string{"getty.target"},
+			},
+			out: "[Unit]\nDescription=Autologin\n\n[Service]\nExecStart=\nExecStart=-/sbin/agetty --autologin pi --noclear %I $TERM\nIgnoreSIGPIPE=yes\n\n[Install]\nWantedBy=getty.target\n",
+		},
+		{
+			name: "after",
+			inp:  Unit{After: []string{"network-online.target"}},
+			out:  "[Unit]\nAfter=\nAfter=network-online.target\n",
+		},
+		{
+			name: "exec start pre",
+			inp: Unit{
+				Service: &Service{ExecStartPre: "/bin/mkdir -p /run/app", ExecStopPost: "/bin/rm -rf /run/app"},
+			},
+			out: "[Service]\nExecStartPre=\nExecStartPre=/bin/mkdir -p /run/app\nExecStopPost=\nExecStopPost=/bin/rm -rf /run/app\n",
+		},
+		{
+			name: "on calendar",
+			inp: Unit{
+				Timer: &Timer{OnCalendar: "weekly", Persistent: true},
+			},
+			out: "[Timer]\nOnCalendar=\nOnCalendar=weekly\nPersistent=true\n",
+		},
+		{
+			name: "listen stream",
+			inp: Unit{
+				Socket: &Socket{ListenStream: []string{"8080", "8443"}},
+			},
+			out: "[Socket]\nListenStream=\nListenStream=8080\nListenStream=8443\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.out != tc.inp.DropIn() {
+				t.Errorf("out = %q, want %q", tc.inp.DropIn(), tc.out)
+			}
+		})
+	}
+}
+
 func TestSystemdMount(t *testing.T) {
 	tcs := []struct {
 		name string
@@ -131,3 +206,441 @@ func TestSystemdMount(t *testing.T) {
 		})
 	}
 }
+
+func TestSystemdTimer(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  Timer
+		out  string
+	}{
+		{
+			name: "empty",
+			out:  "[Timer]\n",
+		},
+		{
+			name: "calendar",
+			inp: Timer{
+				OnCalendar:         "Mon *-*-* 04:00:00",
+				Persistent:         true,
+				RandomizedDelaySec: 30 * time.Minute,
+			},
+			out: "[Timer]\nOnCalendar=Mon *-*-* 04:00:00\nPersistent=true\nRandomizedDelaySec=30m0s\n",
+		},
+		{
+			name: "monotonic",
+			inp: Timer{
+				OnBootSec:       5 * time.Minute,
+				OnUnitActiveSec: time.Hour,
+				AccuracySec:     time.Second,
+				Unit:            "backup.service",
+			},
+			out: "[Timer]\nOnBootSec=5m0s\nOnUnitActiveSec=1h0m0s\nAccuracySec=1s\nUnit=backup.service\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.out != tc.inp.String() {
+				t.Errorf("out = %q, want %q", tc.inp.String(), tc.out)
+			}
+			if err := tc.inp.Validate(); (err == nil) != (tc.name != "empty") {
+				t.Errorf("Validate() = %v", err)
+			}
+		})
+	}
+}
+
+func TestSystemdSocket(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  Socket
+		out  string
+	}{
+		{
+			name: "empty",
+			out:  "[Socket]\n",
+		},
+		{
+			name: "stream",
+			inp: Socket{
+				ListenStream: []string{"8080", "[::]:8081"},
+				BindIPv6Only: BindIPv6Both,
+				Service:      "app.service",
+			},
+			out: "[Socket]\nListenStream=8080\nListenStream=[::]:8081\nBindIPv6Only=both\nService=app.service\n",
+		},
+		{
+			name: "unix",
+			inp: Socket{
+				ListenStream:   []string{"/run/app.sock"},
+				ListenDatagram: []string{"@app-log"},
+				ListenFIFO:     []string{"/run/app.fifo"},
+				Accept:         true,
+				SocketUser:     "app",
+				SocketGroup:    "www-data",
+				SocketMode:     0660,
+			},
+			out: "[Socket]\nListenStream=/run/app.sock\nListenDatagram=@app-log\nListenFIFO=/run/app.fifo\nAccept=yes\nSocketUser=app\nSocketGroup=www-data\nSocketMode=0660\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.out != tc.inp.String() {
+				t.Errorf("out = %q, want %q", tc.inp.String(), tc.out)
+			}
+		})
+	}
+}
+
+func TestSystemdSocketValidate(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  Socket
+		err  string
+	}{
+		{
+			name: "valid",
+			inp: Socket{
+				ListenStream:   []string{"22", "0.0.0.0:80", "[::1]:443", "/run/app.sock", "@app"},
+				ListenDatagram: []string{"127.0.0.1:53"},
+				ListenFIFO:     []string{"/run/app.fifo"},
+				BindIPv6Only:   BindIPv6Only,
+				SocketMode:     0600,
+			},
+		},
+		{
+			name: "empty",
+			err:  "socket must listen on at least one address",
+		},
+		{
+			name: "port out of range",
+			inp:  Socket{ListenStream: []string{"65536"}},
+			err:  `ListenStream: invalid address "65536": "65536" is not a port number`,
+		},
+		{
+			name: "hostname",
+			inp:  Socket{ListenDatagram: []string{"localhost:53"}},
+			err:  `ListenDatagram: invalid address "localhost:53": "localhost" is not an IP address`,
+		},
+		{
+			name: "relative fifo",
+			inp:  Socket{ListenFIFO: []string{"app.fifo"}},
+			err:  `ListenFIFO: "app.fifo" is not an absolute path`,
+		},
+		{
+			name: "bind mode",
+			inp:  Socket{ListenStream: []string{"80"}, BindIPv6Only: "ipv4"},
+			err:  `invalid BindIPv6Only mode "ipv4"`,
+		},
+		{
+			name: "accept with service",
+			inp:  Socket{ListenStream: []string{"80"}, Accept: true, Service: "app.service"},
+			err:  "cannot set Service when Accept is true, as a service instance is started for each connection",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.inp.Validate()
+			switch {
+			case err == nil && tc.err != "":
+				t.Errorf("Validate() succeeded, want error %q", tc.err)
+			case err != nil && err.Error() != tc.err:
+				t.Errorf("Validate() = %q, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSystemdPath(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  Path
+		out  string
+	}{
+		{
+			name: "empty",
+			out:  "[Path]\n",
+		},
+		{
+			name: "provision",
+			inp: Path{
+				DirectoryNotEmpty: []string{"/boot/firmware/provision"},
+				PathExistsGlob:    []string{"/boot/firmware/provision/*.json"},
+				MakeDirectory:     true,
+				Unit:              "provision.service",
+			},
+			out: "[Path]\nPathExistsGlob=/boot/firmware/provision/*.json\nDirectoryNotEmpty=/boot/firmware/provision\nMakeDirectory=yes\nUnit=provision.service\n",
+		},
+		{
+			name: "changes",
+			inp: Path{
+				PathExists:   []string{"/etc/app.conf"},
+				PathChanged:  []string{"/etc/app.conf"},
+				PathModified: []string{"/var/lib/app/state"},
+			},
+			out: "[Path]\nPathExists=/etc/app.conf\nPathChanged=/etc/app.conf\nPathModified=/var/lib/app/state\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.out != tc.inp.String() {
+				t.Errorf("out = %q, want %q", tc.inp.String(), tc.out)
+			}
+			if err := tc.inp.Validate(); (err == nil) != (tc.name != "empty") {
+				t.Errorf("Validate() = %v", err)
+			}
+		})
+	}
+
+	if err, want := (&Path{PathChanged: []string{"app.conf"}}).Validate(), `PathChanged: "app.conf" is not an absolute path`; err == nil || err.Error() != want {
+		t.Errorf("Validate() = %v, want %q", err, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tcs := []struct {
+		name string
+		inp  string
+		want Unit
+		out  string
+	}{
+		{
+			name: "ssh",
+			inp: `[Unit]
+Description=OpenBSD Secure Shell server
+Documentation=man:sshd(8) man:sshd_config(5)
+After=network.target auditd.service
+ConditionPathExists=!/etc/ssh/sshd_not_to_be_run
+
+[Service]
+EnvironmentFile=-/etc/default/ssh
+ExecStartPre=/usr/sbin/sshd -t
+ExecStart=/usr/sbin/sshd -D $SSHD_OPTS
+ExecReload=/usr/sbin/sshd -t
+ExecReload=/bin/kill -HUP $MAINPID
+KillMode=process
+Restart=on-failure
+RestartPreventExitStatus=255
+Type=notify
+RuntimeDirectory=sshd
+RuntimeDirectoryMode=0755
+
+[Install]
+WantedBy=multi-user.target
+Alias=sshd.service
+`,
+			want: Unit{
+				Description: "OpenBSD Secure Shell server",
+				After:       []string{"network.target", "auditd.service"},
+				Extra: []Option{
+					{"Documentation", "man:sshd(8) man:sshd_config(5)"},
+					{"ConditionPathExists", "!/etc/ssh/sshd_not_to_be_run"},
+				},
+				Service: &Service{
+					Type:          NotifyService,
+					ExecStartPre:  "/usr/sbin/sshd -t",
+					ExecStart:     "/usr/sbin/sshd -D $SSHD_OPTS",
+					KillMode:      "process",
+					Restart:       RestartOnFailure,
+					IgnoreSigpipe: true,
+					Extra: []Option{
+						{"EnvironmentFile", "-/etc/default/ssh"},
+						{"ExecReload", "/usr/sbin/sshd -t"},
+						{"ExecReload", "/bin/kill -HUP $MAINPID"},
+						{"RestartPreventExitStatus", "255"},
+						{"RuntimeDirectory", "sshd"},
+						{"RuntimeDirectoryMode", "0755"},
+					},
+				},
+				WantedBy:     []string{"multi-user.target"},
+				InstallExtra: []Option{{"Alias", "sshd.service"}},
+			},
+			out: "[Unit]\nDescription=OpenBSD Secure Shell server\nAfter=network.target auditd.service\n" +
+				"Documentation=man:sshd(8) man:sshd_config(5)\nConditionPathExists=!/etc/ssh/sshd_not_to_be_run\n\n" +
+				"[Service]\nType=notify\nExecStartPre=/usr/sbin/sshd -t\nExecStart=/usr/sbin/sshd -D $SSHD_OPTS\n" +
+				"KillMode=process\nRestart=on-failure\nIgnoreSIGPIPE=yes\nEnvironmentFile=-/etc/default/ssh\n" +
+				"ExecReload=/usr/sbin/sshd -t\nExecReload=/bin/kill -HUP $MAINPID\nRestartPreventExitStatus=255\n" +
+				"RuntimeDirectory=sshd\nRuntimeDirectoryMode=0755\n\n" +
+				"[Install]\nWantedBy=multi-user.target\nAlias=sshd.service\n\n",
+		},
+		{
+			name: "values",
+			inp: `# A comment.
+[Unit]
+After=a.target
+After=b.target c.target
+
+[Service]
+ExecStartPre=/bin/true
+ExecStartPre=/bin/echo \
+  ; A comment within a continued line.
+  hello
+RestartSec=1min 30s
+TimeoutStopSec=infinity
+WatchdogSec=0
+IgnoreSIGPIPE=false
+StandardOutput=journal+console
+StandardError=file:/var/log/app.log
+`,
+			want: Unit{
+				After: []string{"a.target", "b.target", "c.target"},
+				Service: &Service{
+					RestartSec: 90 * time.Second,
+					Stdout:     OutputJournal | OutputConsole,
+					Extra: []Option{
+						{"ExecStartPre", "/bin/true"},
+						{"ExecStartPre", "/bin/echo  hello"},
+						{"TimeoutStopSec", "infinity"},
+						{"WatchdogSec", "0"},
+						{"StandardError", "file:/var/log/app.log"},
+					},
+				},
+			},
+			out: "[Unit]\nAfter=a.target b.target c.target\n\n" +
+				"[Service]\nRestartSec=1m30s\nIgnoreSIGPIPE=no\nStandardOutput=journal+console\n" +
+				"ExecStartPre=/bin/true\nExecStartPre=/bin/echo  hello\nTimeoutStopSec=infinity\nWatchdogSec=0\nStandardError=file:/var/log/app.log\n\n",
+		},
+		{
+			name: "resets",
+			inp: `[Unit]
+After=
+After=network-online.target
+
+[Service]
+ExecStartPre=/bin/mkdir -p /run/app
+ExecStart=
+ExecStart=/usr/local/bin/app --verbose
+ExecStartPre=/bin/chown app /run/app
+User=app
+
+[Install]
+WantedBy=
+`,
+			want: Unit{
+				Extra: []Option{{"After", ""}, {"After", "network-online.target"}},
+				Service: &Service{
+					User:          "app",
+					IgnoreSigpipe: true,
+					Extra: []Option{
+						{"ExecStartPre", "/bin/mkdir -p /run/app"},
+						{"ExecStart", ""},
+						{"ExecStart", "/usr/local/bin/app --verbose"},
+						{"ExecStartPre", "/bin/chown app /run/app"},
+					},
+				},
+				InstallExtra: []Option{{"WantedBy", ""}},
+			},
+			out: "[Unit]\nAfter=\nAfter=network-online.target\n\n" +
+				"[Service]\nUser=app\nIgnoreSIGPIPE=yes\nExecStartPre=/bin/mkdir -p /run/app\nExecStart=\n" +
+				"ExecStart=/usr/local/bin/app --verbose\nExecStartPre=/bin/chown app /run/app\n\n" +
+				"[Install]\nWantedBy=\n\n",
+		},
+		{
+			name: "sections",
+			inp: `[Unit]
+Description=Boot partition
+
+[Mount]
+What=/dev/mmcblk0p1
+Where=/boot/firmware
+Options=defaults,noatime
+DirectoryMode=0755
+
+[X-Custom]
+Key=value
+
+[Service]
+ExecStart=/bin/true
+`,
+			want: Unit{
+				Description: "Boot partition",
+				Mount: &Mount{
+					WhatPath:     "/dev/mmcblk0p1",
+					WherePath:    "/boot/firmware",
+					MountOptions: []string{"defaults", "noatime"},
+					Extra:        []Option{{"DirectoryMode", "0755"}},
+				},
+				Sections: []Section{
+					{Name: "X-Custom", Options: []Option{{"Key", "value"}}},
+					{Name: "Service", Options: []Option{{"ExecStart", "/bin/true"}}},
+				},
+			},
+			out: "[Unit]\nDescription=Boot partition\n\n" +
+				"[Mount]\nWhat=/dev/mmcblk0p1\nWhere=/boot/firmware\nOptions=defaults,noatime\nDirectoryMode=0755\n\n" +
+				"[X-Custom]\nKey=value\n\n[Service]\nExecStart=/bin/true\n\n",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := Parse([]byte(tc.inp))
+			if err != nil {
+				t.Fatalf("Parse() failed: %v", err)
+			}
+			if !reflect.DeepEqual(*u, tc.want) {
+				t.Errorf("Parse() = %+v, want %+v", *u, tc.want)
+			}
+			if u.String() != tc.out {
+				t.Errorf("out = %q, want %q", u.String(), tc.out)
+			}
+
+			// Parsing the output should give the same unit.
+			again, err := Parse([]byte(u.String()))
+			if err != nil {
+				t.Fatalf("Parse() of output failed: %v", err)
+			}
+			if !reflect.DeepEqual(again, u) {
+				t.Errorf("Parse() of output = %+v, want %+v", again, u)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		inp, want string
+	}{
+		{"Description=orphan\n", "line 1: Description is not in a section"},
+		{"[Unit]\n\n[Service\n", `line 3: invalid section header "[Service"`},
+		{"[Unit]\nDescription\n", `line 2: expected key=value, got "Description"`},
+	} {
+		_, err := Parse([]byte(tc.inp))
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("Parse(%q) returned %v, want %q", tc.inp, err, tc.want)
+		}
+	}
+}
+
+func TestParseTimespan(t *testing.T) {
+	for _, tc := range []struct {
+		inp  string
+		want time.Duration
+	}{
+		{"90", 90 * time.Second},
+		{"5s", 5 * time.Second},
+		{"1min 30s", 90 * time.Second},
+		{"2h30min", 150 * time.Minute},
+		{"1.5s", 1500 * time.Millisecond},
+		{"500ms", 500 * time.Millisecond},
+		{"1w 1d", 8 * 24 * time.Hour},
+		{"1h0m0s", time.Hour},
+	} {
+		d, err := parseTimespan(tc.inp)
+		if err != nil {
+			t.Errorf("parseTimespan(%q) failed: %v", tc.inp, err)
+			continue
+		}
+		if d != tc.want {
+			t.Errorf("parseTimespan(%q) = %v, want %v", tc.inp, d, tc.want)
+		}
+	}
+
+	for _, inp := range []string{"", "infinity", "5 parsecs", "1..2s"} {
+		if _, err := parseTimespan(inp); err == nil || !strings.HasPrefix(err.Error(), "invalid time span") {
+			t.Errorf("parseTimespan(%q) returned %v, want error", inp, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package sysd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Timer describes a timer unit, which activates another unit on a schedule.
+type Timer struct {
+	OnCalendar         string        // Calendar event to activate on, such as daily or Mon *-*-* 04:00:00.
+	OnBootSec          time.Duration // Time after boot to activate.
+	OnUnitActiveSec    time.Duration // Time after the unit was last activated to activate it again.
+	Persistent         bool          // Activates on boot if an OnCalendar event was missed while powered off.
+	RandomizedDelaySec time.Duration // Upper bound on a random delay added to each activation.
+	AccuracySec        time.Duration // How much activations may be coalesced by.
+
+	// Unit is the unit to activate. If empty, the service with the same
+	// name as the timer is activated.
+	Unit string
+}
+
+// Validate returns an error if the timer has nothing to activate it.
+func (t *Timer) Validate() error {
+	if t.OnCalendar == "" && t.OnBootSec <= 0 && t.OnUnitActiveSec <= 0 {
+		return errors.New("timer must have at least one of OnCalendar, OnBootSec or OnUnitActiveSec")
+	}
+	return nil
+}
+
+// String returns the configuration as a valid timer stanza.
+func (t *Timer) String() string {
+	return t.stanza(false)
+}
+
+// stanza returns the configuration as a timer stanza. If dropIn is set,
+// the triggers are cleared before they are set, so they replace those of
+// an existing timer.
+func (t *Timer) stanza(dropIn bool) string {
+	var out strings.Builder
+	out.WriteString("[Timer]\n")
+
+	if t.OnCalendar != "" {
+		writeReset(&out, dropIn, "OnCalendar")
+		out.WriteString(fmt.Sprintf("OnCalendar=%s\n", t.OnCalendar))
+	}
+	if t.OnBootSec > 0 {
+		writeReset(&out, dropIn, "OnBootSec")
+		out.WriteString(fmt.Sprintf("OnBootSec=%s\n", t.OnBootSec.String()))
+	}
+	if t.OnUnitActiveSec > 0 {
+		writeReset(&out, dropIn, "OnUnitActiveSec")
+		out.WriteString(fmt.Sprintf("OnUnitActiveSec=%s\n", t.OnUnitActiveSec.String()))
+	}
+	if t.Persistent {
+		out.WriteString("Persistent=true\n")
+	}
+	if t.RandomizedDelaySec > 0 {
+		out.WriteString(fmt.Sprintf("RandomizedDelaySec=%s\n", t.RandomizedDelaySec.String()))
+	}
+	if t.AccuracySec > 0 {
+		out.WriteString(fmt.Sprintf("AccuracySec=%s\n", t.AccuracySec.String()))
+	}
+	if t.Unit != "" {
+		out.WriteString(fmt.Sprintf("Unit=%s\n", t.Unit))
+	}
+
+	return out.String()
+}
@@ -0,0 +1,265 @@
+// Package unix reads and generates config files for core unix services.
+package unix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prefixes which identify a filesystem by a tag rather than a device path.
+const (
+	SourcePartUUID = "PARTUUID"
+	SourceLabel    = "LABEL"
+	SourceUUID     = "UUID"
+)
+
+// FstabEntry describes a filesystem to be mounted.
+type FstabEntry struct {
+	Source     string   // Device, or a tag such as PARTUUID=<id>.
+	Mountpoint string   // Path to mount the filesystem on, or none for swap.
+	Type       string   // Filesystem type.
+	Options    []string // Mount options. If empty, defaults is written.
+	Dump       int      // Whether the filesystem should be dumped.
+	Pass       int      // Order in which filesystems are checked at boot.
+}
+
+// SourceTag returns the tag and value of the source, if the filesystem is
+// identified by a tag such as PARTUUID. Otherwise, the tag is empty and the
+// value is the source.
+func (e *FstabEntry) SourceTag() (string, string) {
+	for _, tag := range []string{SourcePartUUID, SourceLabel, SourceUUID} {
+		if strings.HasPrefix(e.Source, tag+"=") {
+			return tag, e.Source[len(tag)+1:]
+		}
+	}
+	return "", e.Source
+}
+
+func (e *FstabEntry) equal(o *FstabEntry) bool {
+	if e.Source != o.Source || e.Mountpoint != o.Mountpoint || e.Type != o.Type ||
+		e.Dump != o.Dump || e.Pass != o.Pass || len(e.Options) != len(o.Options) {
+		return false
+	}
+	for i := range e.Options {
+		if e.Options[i] != o.Options[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the entry as a line of an fstab file, without the trailing
+// newline.
+func (e *FstabEntry) String() string {
+	opts := strings.Join(e.Options, ",")
+	if opts == "" {
+		opts = "defaults"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d", fstabEscape(e.Source), fstabEscape(e.Mountpoint),
+		fstabEscape(e.Type), fstabEscape(opts), e.Dump, e.Pass)
+}
+
+// fstabLine is a line of an fstab file. Lines which are not entries, such as
+// comments, are kept verbatim.
+type fstabLine struct {
+	raw   string
+	entry *FstabEntry
+	orig  FstabEntry // Entry as parsed, to detect modification.
+}
+
+// Fstab represents the contents of /etc/fstab. Comments, blank lines and
+// lines which cannot be parsed are preserved, as is the formatting of
+// entries which are not modified.
+type Fstab struct {
+	lines []fstabLine
+}
+
+// ParseFstab parses the contents of an fstab file.
+func ParseFstab(data string) *Fstab {
+	t := &Fstab{}
+	data = strings.TrimSuffix(data, "\n")
+	if data == "" {
+		return t
+	}
+	for _, line := range strings.Split(data, "\n") {
+		l := fstabLine{raw: line}
+		if e, ok := parseFstabEntry(line); ok {
+			l.entry, l.orig = e, *e
+			l.orig.Options = append([]string(nil), e.Options...)
+		}
+		t.lines = append(t.lines, l)
+	}
+	return t
+}
+
+func parseFstabEntry(line string) (*FstabEntry, bool) {
+	if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil, false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || len(fields) > 6 {
+		return nil, false
+	}
+	e := &FstabEntry{
+		Source:     fstabUnescape(fields[0]),
+		Mountpoint: fstabUnescape(fields[1]),
+		Type:       fstabUnescape(fields[2]),
+	}
+	if len(fields) > 3 && fields[3] != "defaults" {
+		e.Options = strings.Split(fstabUnescape(fields[3]), ",")
+	}
+	var err error
+	if len(fields) > 4 {
+		if e.Dump, err = strconv.Atoi(fields[4]); err != nil {
+			return nil, false
+		}
+	}
+	if len(fields) > 5 {
+		if e.Pass, err = strconv.Atoi(fields[5]); err != nil {
+			return nil, false
+		}
+	}
+	return e, true
+}
+
+// fstabEscape encodes whitespace and backslashes as octal escapes, as
+// described in fstab(5).
+func fstabEscape(s string) string {
+	var out strings.Builder
+	for _, c := range []byte(s) {
+		switch c {
+		case ' ', '\t', '\n', '\\':
+			out.WriteString(fmt.Sprintf("\\%03o", c))
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+func fstabUnescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// Entries returns the entries in the file, in order.
+func (t *Fstab) Entries() []*FstabEntry {
+	var out []*FstabEntry
+	for _, l := range t.lines {
+		if l.entry != nil {
+			out = append(out, l.entry)
+		}
+	}
+	return out
+}
+
+// keyedBySource returns true if entries like e are told apart by their
+// source as well as their mountpoint, as several swap entries may share a
+// mountpoint of none.
+func keyedBySource(e *FstabEntry) bool {
+	return e.Mountpoint == "none" || e.Type == "swap"
+}
+
+// matches returns true if e is identified by the mountpoint and source.
+// Entries which are keyed by source must also have the source, unless it is
+// empty, in which case the first of them matches. Other entries are
+// identified by their mountpoint alone.
+func (e *FstabEntry) matches(mountpoint, source string) bool {
+	if e.Mountpoint != mountpoint {
+		return false
+	}
+	return source == "" || !keyedBySource(e) || e.Source == source
+}
+
+// find returns the index of the line holding the first entry identified by
+// the mountpoint and source, or -1 if there is none.
+func (t *Fstab) find(mountpoint, source string) int {
+	for i, l := range t.lines {
+		if l.entry != nil && l.entry.matches(mountpoint, source) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the entry for the given mountpoint, or nil if there is none.
+// If source is not empty, it picks between swap entries and those with a
+// mountpoint of none, which may share a mountpoint.
+func (t *Fstab) Get(mountpoint, source string) *FstabEntry {
+	if i := t.find(mountpoint, source); i >= 0 {
+		return t.lines[i].entry
+	}
+	return nil
+}
+
+// Add appends an entry. An error is returned if there is already an entry for
+// the mountpoint, or for swap entries and those with a mountpoint of none, an
+// entry with the same mountpoint and source.
+func (t *Fstab) Add(e *FstabEntry) error {
+	if e.Mountpoint == "" {
+		return fmt.Errorf("entry for %q has no mountpoint", e.Source)
+	}
+	if t.find(e.Mountpoint, e.Source) >= 0 {
+		if keyedBySource(e) {
+			return fmt.Errorf("an entry for %s on %s already exists", e.Source, e.Mountpoint)
+		}
+		return fmt.Errorf("an entry for %s already exists", e.Mountpoint)
+	}
+	t.lines = append(t.lines, fstabLine{entry: e})
+	return nil
+}
+
+// Replace replaces the entry for the mountpoint of e, keeping its position in
+// the file. Swap entries and those with a mountpoint of none replace the
+// entry with the same source. If there is no such entry, e is appended.
+func (t *Fstab) Replace(e *FstabEntry) error {
+	if e.Mountpoint == "" {
+		return fmt.Errorf("entry for %q has no mountpoint", e.Source)
+	}
+	if i := t.find(e.Mountpoint, e.Source); i >= 0 {
+		t.lines[i] = fstabLine{entry: e}
+		return nil
+	}
+	t.lines = append(t.lines, fstabLine{entry: e})
+	return nil
+}
+
+// Remove deletes the entry for the given mountpoint, returning false if
+// there was no such entry. As with Get, source picks between swap entries
+// and those with a mountpoint of none.
+func (t *Fstab) Remove(mountpoint, source string) bool {
+	i := t.find(mountpoint, source)
+	if i < 0 {
+		return false
+	}
+	t.lines = append(t.lines[:i], t.lines[i+1:]...)
+	return true
+}
+
+// String returns a representation ready to use in a config file.
+func (t *Fstab) String() string {
+	var out strings.Builder
+	for _, l := range t.lines {
+		if l.entry == nil || (l.raw != "" && l.entry.equal(&l.orig)) {
+			out.WriteString(l.raw)
+		} else {
+			out.WriteString(l.entry.String())
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
@@ -0,0 +1,153 @@
+package unix
+
+import (
+	"reflect"
+	"testing"
+)
+
+const raspbianFstab = `proc            /proc           proc    defaults          0       0
+PARTUUID=738a4d67-01  /boot           vfat    defaults          0       2
+PARTUUID=738a4d67-02  /               ext4    defaults,noatime  0       1
+# a swapfile is not a swap partition, no line here
+#   use  dphys-swapfile swap[on|off]  for that
+`
+
+func TestParseFstab(t *testing.T) {
+	tab := ParseFstab(raspbianFstab)
+	if got := tab.String(); got != raspbianFstab {
+		t.Errorf("String() = %q, want %q", got, raspbianFstab)
+	}
+
+	entries := tab.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("len(Entries()) = %d, want 3", len(entries))
+	}
+	want := &FstabEntry{Source: "PARTUUID=738a4d67-02", Mountpoint: "/", Type: "ext4", Options: []string{"defaults", "noatime"}, Pass: 1}
+	if !reflect.DeepEqual(entries[2], want) {
+		t.Errorf("Entries()[2] = %+v, want %+v", entries[2], want)
+	}
+	if tag, val := entries[1].SourceTag(); tag != SourcePartUUID || val != "738a4d67-01" {
+		t.Errorf("SourceTag() = %q, %q, want %q, %q", tag, val, SourcePartUUID, "738a4d67-01")
+	}
+	if tag, val := entries[0].SourceTag(); tag != "" || val != "proc" {
+		t.Errorf("SourceTag() = %q, %q, want %q, %q", tag, val, "", "proc")
+	}
+	if tab.Get("/boot", "") != entries[1] || tab.Get("/data", "") != nil {
+		t.Error("Get() returned the wrong entry")
+	}
+
+	unknown := "/dev/sda1 /mnt ext4 defaults zero 0\nnot-an-entry\n"
+	if tab := ParseFstab(unknown); len(tab.Entries()) != 0 || tab.String() != unknown {
+		t.Errorf("ParseFstab(%q) = %q with %d entries", unknown, tab.String(), len(tab.Entries()))
+	}
+
+	tab = ParseFstab(`LABEL=My\040Disk /mnt/my\040disk ext4`)
+	e := tab.Get("/mnt/my disk", "")
+	if e == nil || e.Source != "LABEL=My Disk" {
+		t.Fatalf("Get() = %+v", e)
+	}
+	e.Pass = 2
+	if got, want := tab.String(), "LABEL=My\\040Disk\t/mnt/my\\040disk\text4\tdefaults\t0\t2\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestEditFstab(t *testing.T) {
+	tab := ParseFstab(raspbianFstab)
+
+	data := &FstabEntry{Source: "UUID=2b5b2a0e-6e0c-4cfd-9c62-3f6b0d6a5c11", Mountpoint: "/data", Type: "ext4", Options: []string{"noatime", "nofail"}, Pass: 2}
+	if err := tab.Add(data); err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if err := tab.Add(&FstabEntry{Mountpoint: "/data"}); err == nil {
+		t.Error("Add() succeeded for an existing mountpoint")
+	}
+	if err := tab.Replace(&FstabEntry{Source: "PARTUUID=738a4d67-02", Mountpoint: "/", Type: "ext4", Options: []string{"ro"}, Pass: 1}); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+	if err := tab.Replace(&FstabEntry{Source: "tmpfs", Mountpoint: "/var/log", Type: "tmpfs", Options: []string{"size=16m"}}); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+	if err := tab.Replace(&FstabEntry{Source: "tmpfs"}); err == nil {
+		t.Error("Replace() succeeded without a mountpoint")
+	}
+	if !tab.Remove("/proc", "") || tab.Remove("/proc", "") {
+		t.Error("Remove() = false for the first call or true for the second")
+	}
+
+	want := `PARTUUID=738a4d67-01  /boot           vfat    defaults          0       2
+PARTUUID=738a4d67-02	/	ext4	ro	0	1
+# a swapfile is not a swap partition, no line here
+#   use  dphys-swapfile swap[on|off]  for that
+UUID=2b5b2a0e-6e0c-4cfd-9c62-3f6b0d6a5c11	/data	ext4	noatime,nofail	0	2
+tmpfs	/var/log	tmpfs	size=16m	0	0
+`
+	if got := tab.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestEditFstabSwap(t *testing.T) {
+	tab := ParseFstab("/dev/sda2 none swap sw 0 0\n")
+
+	// Swap entries are told apart by their source.
+	if err := tab.Add(&FstabEntry{Source: "/dev/sdb2", Mountpoint: "none", Type: "swap", Options: []string{"sw"}}); err != nil {
+		t.Fatalf("Add() of a second swap entry failed: %v", err)
+	}
+	if err := tab.Add(&FstabEntry{Source: "/dev/sdb2", Mountpoint: "none", Type: "swap"}); err == nil {
+		t.Error("Add() succeeded for an existing swap entry")
+	}
+	if err := tab.Replace(&FstabEntry{Source: "/dev/sdb2", Mountpoint: "none", Type: "swap", Options: []string{"sw", "pri=10"}}); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+	if e := tab.Get("none", "/dev/sdb2"); e == nil || len(e.Options) != 2 {
+		t.Errorf("Get(none, /dev/sdb2) = %+v, want the replaced entry", e)
+	}
+	if e := tab.Get("none", ""); e == nil || e.Source != "/dev/sda2" {
+		t.Errorf("Get(none) = %+v, want the first entry", e)
+	}
+	if tab.Remove("none", "/dev/sdc2") || !tab.Remove("none", "/dev/sda2") {
+		t.Error("Remove() removed a missing swap entry, or did not remove an existing one")
+	}
+
+	if want := "/dev/sdb2\tnone\tswap\tsw,pri=10\t0\t0\n"; tab.String() != want {
+		t.Errorf("String() = %q, want %q", tab.String(), want)
+	}
+}
+
+func TestFstabLookupKeying(t *testing.T) {
+	tab := ParseFstab("/dev/sda2 swap swap defaults 0 0\n/dev/sdb2 swap swap defaults 0 0\nPARTUUID=738a4d67-02 / ext4 defaults 0 1\n")
+
+	// Each operation finds the same entry for a mountpoint and source.
+	if e := tab.Get("swap", "/dev/sdb2"); e == nil || e.Source != "/dev/sdb2" {
+		t.Errorf("Get(swap, /dev/sdb2) = %+v, want the second swap entry", e)
+	}
+	if err := tab.Add(&FstabEntry{Source: "/dev/sdb2", Mountpoint: "swap", Type: "swap"}); err == nil {
+		t.Error("Add() succeeded for the second swap entry")
+	}
+	if err := tab.Replace(&FstabEntry{Source: "/dev/sdb2", Mountpoint: "swap", Type: "swap", Options: []string{"pri=10"}}); err != nil {
+		t.Fatalf("Replace() failed: %v", err)
+	}
+	if e := tab.Get("swap", "/dev/sda2"); e == nil || len(e.Options) != 0 {
+		t.Errorf("Get(swap, /dev/sda2) = %+v, want the unchanged first swap entry", e)
+	}
+	if !tab.Remove("swap", "/dev/sdb2") || tab.Get("swap", "/dev/sdb2") != nil {
+		t.Error("Remove(swap, /dev/sdb2) did not remove the second swap entry")
+	}
+
+	// Other entries are keyed by mountpoint alone, so a source does not
+	// change which is found.
+	if e := tab.Get("/", "/dev/mmcblk0p2"); e == nil || e.Source != "PARTUUID=738a4d67-02" {
+		t.Errorf("Get(/, /dev/mmcblk0p2) = %+v, want the root entry", e)
+	}
+	if err := tab.Add(&FstabEntry{Source: "/dev/mmcblk0p2", Mountpoint: "/", Type: "ext4"}); err == nil {
+		t.Error("Add() succeeded for an existing mountpoint with a different source")
+	}
+	if !tab.Remove("/", "/dev/mmcblk0p2") {
+		t.Error("Remove(/, /dev/mmcblk0p2) = false, want the root entry removed")
+	}
+
+	if want := "/dev/sda2 swap swap defaults 0 0\n"; tab.String() != want {
+		t.Errorf("String() = %q, want %q", tab.String(), want)
+	}
+}
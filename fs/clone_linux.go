@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whence values for lseek(2) which locate data & holes in sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// CloneFile copies the file at src to dst, replacing dst if it exists.
+// Where the host filesystem supports it the copy shares storage with the
+// original (a reflink), otherwise holes in src are preserved in dst.
+func CloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(s.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		if err := sparseCopy(out, in, 0, s.Size()); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// sparseCopy copies size bytes of in starting at base to the start of out,
+// skipping over any holes in in.
+func sparseCopy(out, in *os.File, base, size int64) error {
+	buf := make([]byte, 1024*1024)
+	for off := int64(0); off < size; {
+		start, err := in.Seek(base+off, seekData)
+		switch {
+		case err == nil:
+		case isErrno(err, syscall.ENXIO):
+			// No data remains after off.
+			return out.Truncate(size)
+		case isErrno(err, syscall.EINVAL):
+			// Holes cannot be detected, so copy everything.
+			start = base + off
+		default:
+			return err
+		}
+		end, err := in.Seek(start, seekHole)
+		if err != nil {
+			end = base + size
+		}
+		start, end = start-base, end-base
+		if end > size {
+			end = size
+		}
+
+		for off = start; off < end; {
+			n := int64(len(buf))
+			if end-off < n {
+				n = end - off
+			}
+			if _, err := in.ReadAt(buf[:n], base+off); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := out.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+			off += n
+		}
+	}
+	return out.Truncate(size)
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == errno
+}
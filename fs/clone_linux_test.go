@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCloneFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.img"), filepath.Join(dir, "dst.img")
+
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("boot sector"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("partition data"), 64*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(128 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := ioutil.WriteFile(dst, []byte("existing contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CloneFile(src, dst); err != nil {
+		t.Fatalf("CloneFile() failed: %v", err)
+	}
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("cloned file contents differ")
+	}
+
+	s, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks := s.Sys().(*syscall.Stat_t).Blocks; blocks*512 > 16*1024*1024 {
+		t.Errorf("clone uses %d bytes on disk, want it to be sparse", blocks*512)
+	}
+}
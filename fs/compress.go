@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// xzChunkSize is the amount of input compressed into each xz stream when
+// compressing in parallel.
+const xzChunkSize = 32 * 1024 * 1024
+
+// Compress writes the image at src to dst using the given compression
+// format, replacing dst if it exists. Compression is performed using all
+// available CPUs. If no compression format is given, dst is a sparse copy
+// of src.
+func Compress(src, dst, format string) error {
+	if format == CompressionNone {
+		return CloneFile(src, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(s.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+
+	switch format {
+	case CompressionXZ:
+		err = compressXZ(out, in, runtime.NumCPU())
+	case CompressionGzip:
+		err = compressGzip(out, in, runtime.NumCPU())
+	case CompressionZstd:
+		err = compressZstd(out, in, runtime.NumCPU())
+	default:
+		err = fmt.Errorf("cannot compress to %q", format)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func compressGzip(w io.Writer, r io.Reader, workers int) error {
+	gw := pgzip.NewWriter(w)
+	if err := gw.SetConcurrency(1024*1024, 2*workers); err != nil {
+		return err
+	}
+	if _, err := io.Copy(gw, r); err != nil {
+		gw.Close()
+		return err
+	}
+	return gw.Close()
+}
+
+func compressZstd(w io.Writer, r io.Reader, workers int) error {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(workers))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// compressXZ compresses chunks of the input as independent xz streams in
+// parallel, writing them out in order. The concatenation of xz streams is
+// itself a valid xz file.
+func compressXZ(w io.Writer, r io.Reader, workers int) error {
+	type result struct {
+		data []byte
+		err  error
+	}
+	var (
+		results = make(chan chan result, workers)
+		readErr = make(chan error, 1)
+	)
+
+	go func() {
+		defer close(results)
+		for {
+			chunk := make([]byte, xzChunkSize)
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				res := make(chan result, 1)
+				results <- res
+				go func(chunk []byte) {
+					var buf bytes.Buffer
+					xw, err := xz.NewWriter(&buf)
+					if err == nil {
+						if _, err = xw.Write(chunk); err == nil {
+							err = xw.Close()
+						}
+					}
+					res <- result{data: buf.Bytes(), err: err}
+				}(chunk[:n])
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var err error
+	for res := range results {
+		r := <-res
+		if err != nil {
+			continue
+		}
+		if err = r.err; err == nil {
+			_, err = w.Write(r.data)
+		}
+	}
+	if rErr := <-readErr; err == nil {
+		err = rErr
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	raw := make([]byte, xzChunkSize+5*1024*1024)
+	rand.New(rand.NewSource(1)).Read(raw[:64*1024])
+	copy(raw[xzChunkSize-3:], "spans a chunk boundary")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "built.img")
+	if err := ioutil.WriteFile(src, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{CompressionNone, CompressionXZ, CompressionGzip, CompressionZstd} {
+		t.Run("format="+format, func(t *testing.T) {
+			dst := filepath.Join(dir, "out.img."+format)
+			if err := Compress(src, dst, format); err != nil {
+				t.Fatalf("Compress() failed: %v", err)
+			}
+			if f, err := DetectCompression(dst); err != nil || f != format {
+				t.Errorf("DetectCompression() = %q, %v, want %q", f, err, format)
+			}
+
+			rt := dst
+			if format != CompressionNone {
+				rt = filepath.Join(dir, "roundtrip.img")
+				if err := Decompress(dst, rt); err != nil {
+					t.Fatalf("Decompress() failed: %v", err)
+				}
+			}
+			got, err := ioutil.ReadFile(rt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Error("round-tripped contents differ")
+			}
+		})
+	}
+
+	if err := Compress(src, filepath.Join(dir, "out.zip"), CompressionZip); err == nil {
+		t.Error("Compress() succeeded for zip")
+	}
+}
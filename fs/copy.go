@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// treeWriter is the subset of filesystem operations needed to copy
+// files from the host into an image.
+type treeWriter interface {
+	Stat(path string) (os.FileInfo, error)
+	Mkdir(at string) error
+	Write(path string, data []byte, perms os.FileMode) error
+	Symlink(at, to string) error
+}
+
+// copyInto copies the file or directory at sysPath on the host into the
+// filesystem, following the semantics of cp -R: if dst is an existing
+// directory, the source is copied inside it.
+func copyInto(fs treeWriter, sysPath, dst string) error {
+	if s, err := fs.Stat(dst); err == nil && s.IsDir() {
+		dst = path.Join(dst, filepath.Base(sysPath))
+	}
+	return copyTree(fs, sysPath, dst)
+}
+
+func copyTree(fs treeWriter, sysPath, dst string) error {
+	s, err := os.Lstat(sysPath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case s.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(sysPath)
+		if err != nil {
+			return err
+		}
+		return fs.Symlink(dst, target)
+
+	case s.IsDir():
+		if err := fs.Mkdir(dst); err != nil {
+			if existing, err2 := fs.Stat(dst); err2 != nil || !existing.IsDir() {
+				return err
+			}
+		}
+		entries, err := ioutil.ReadDir(sysPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := copyTree(fs, filepath.Join(sysPath, e.Name()), path.Join(dst, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		d, err := ioutil.ReadFile(sysPath)
+		if err != nil {
+			return err
+		}
+		return fs.Write(dst, d, s.Mode())
+	}
+}
@@ -0,0 +1,42 @@
+package fs
+
+import (
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c computes the crc32c of p, continuing from seed, without the
+// pre/post inversion the standard library applies. This matches the
+// behaviour of the kernel's crc32c_le(), which is what ext4 uses for
+// metadata checksums.
+func crc32c(seed uint32, p []byte) uint32 {
+	return ^crc32.Update(^seed, castagnoli, p)
+}
+
+var crc16Table = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		c := uint16(i)
+		for j := 0; j < 8; j++ {
+			if c&1 != 0 {
+				c = (c >> 1) ^ 0xA001
+			} else {
+				c >>= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// crc16 computes the ANSI crc16 (poly 0x8005, reflected) of p, continuing
+// from seed. This is used for group descriptor checksums on filesystems
+// with uninit_bg but not metadata_csum.
+func crc16(seed uint16, p []byte) uint16 {
+	c := seed
+	for _, b := range p {
+		c = (c >> 8) ^ crc16Table[byte(c)^b]
+	}
+	return c
+}
@@ -0,0 +1,206 @@
+package fs
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats understood by Decompress.
+const (
+	CompressionNone = ""
+	CompressionXZ   = "xz"
+	CompressionGzip = "gz"
+	CompressionZstd = "zst"
+	CompressionZip  = "zip"
+)
+
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{CompressionXZ, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionGzip, []byte{0x1F, 0x8B}},
+	{CompressionZstd, []byte{0x28, 0xB5, 0x2F, 0xFD}},
+	{CompressionZip, []byte{'P', 'K', 0x03, 0x04}},
+}
+
+// DetectCompression returns the compression format of the file at path,
+// based on its contents. CompressionNone is returned for files which are
+// not compressed.
+func DetectCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 8)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(hdr[:n], m.magic) {
+			return m.format, nil
+		}
+	}
+	return CompressionNone, nil
+}
+
+// Decompress decompresses the image at src into dst, replacing dst if it
+// exists. Runs of zeros are written as holes, so the resulting image is
+// sparse. Zip archives must contain a single image.
+func Decompress(src, dst string) error {
+	format, err := DetectCompression(src)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader
+	switch format {
+	case CompressionNone:
+		return fmt.Errorf("%s is not compressed", src)
+	case CompressionZip:
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		zf, err := zipImage(zr.File)
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	default:
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dr, err := newDecompressor(f, format)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		r = dr
+	}
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := &sparseWriter{f: out}
+	if _, err := io.CopyBuffer(w, r, make([]byte, 1024*1024)); err != nil {
+		out.Close()
+		return fmt.Errorf("decompressing %s: %v", src, err)
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// newDecompressor returns a reader of the decompressed contents of r, which
+// is compressed with one of the stream formats: xz, gzip or zstd.
+func newDecompressor(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case CompressionXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case CompressionGzip:
+		return pgzip.NewReader(r)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression format %q", format)
+}
+
+// zipImage returns the image contained in a zip archive: either the only
+// file in the archive, or the only file with a .img extension.
+func zipImage(files []*zip.File) (*zip.File, error) {
+	var regular, images []*zip.File
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		regular = append(regular, f)
+		if strings.EqualFold(filepath.Ext(f.Name), ".img") {
+			images = append(images, f)
+		}
+	}
+	switch {
+	case len(regular) == 1:
+		return regular[0], nil
+	case len(images) == 1:
+		return images[0], nil
+	case len(regular) == 0:
+		return nil, errors.New("archive is empty")
+	}
+	return nil, errors.New("archive contains multiple files")
+}
+
+// sparseWriter writes sequentially to a file, skipping over blocks which
+// are entirely zero so they are left as holes.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+const sparseBlockSize = 4096
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > sparseBlockSize {
+			chunk = chunk[:sparseBlockSize]
+		}
+		if !isZero(chunk) {
+			if _, err := w.f.WriteAt(chunk, w.off); err != nil {
+				return n - len(p), err
+			}
+		}
+		w.off += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close sets the size of the file to the amount of data written, which
+// accounts for any trailing holes.
+func (w *sparseWriter) Close() error {
+	return w.f.Truncate(w.off)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompress(t *testing.T) {
+	raw := make([]byte, 32*1024*1024)
+	copy(raw, "boot sector")
+	copy(raw[16*1024*1024+5:], "partition data")
+
+	tcs := []struct {
+		name   string
+		format string
+		writer func(w io.Writer) (io.WriteCloser, error)
+	}{
+		{
+			name:   "img.xz",
+			format: CompressionXZ,
+			writer: func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		},
+		{
+			name:   "img.gz",
+			format: CompressionGzip,
+			writer: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		},
+		{
+			name:   "img.zst",
+			format: CompressionZstd,
+			writer: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		},
+		{
+			name:   "zip",
+			format: CompressionZip,
+			writer: func(w io.Writer) (io.WriteCloser, error) {
+				zw := zip.NewWriter(w)
+				if _, err := zw.Create("README.txt"); err != nil {
+					return nil, err
+				}
+				f, err := zw.Create("2020-02-13-raspbian-buster-lite.img")
+				if err != nil {
+					return nil, err
+				}
+				return &zipImageWriter{Writer: f, zw: zw}, nil
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "base."+tc.name), filepath.Join(dir, "base.img")
+
+			var buf bytes.Buffer
+			w, err := tc.writer(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(raw); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(src, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, err := DetectCompression(src); err != nil || f != tc.format {
+				t.Errorf("DetectCompression() = %q, %v, want %q", f, err, tc.format)
+			}
+			if err := Decompress(src, dst); err != nil {
+				t.Fatalf("Decompress() failed: %v", err)
+			}
+			got, err := ioutil.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Error("decompressed contents differ")
+			}
+			s, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocks := s.Sys().(*syscall.Stat_t).Blocks; blocks*512 > 1024*1024 {
+				t.Errorf("decompressed image uses %d bytes on disk, want it to be sparse", blocks*512)
+			}
+			if f, err := DetectCompression(dst); err != nil || f != CompressionNone {
+				t.Errorf("DetectCompression(decompressed) = %q, %v, want none", f, err)
+			}
+		})
+	}
+}
+
+type zipImageWriter struct {
+	io.Writer
+	zw *zip.Writer
+}
+
+func (w *zipImageWriter) Close() error {
+	return w.zw.Close()
+}
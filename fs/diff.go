@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// MaxDiffSize is the largest file for which DiffImages returns contents.
+const MaxDiffSize = 1024 * 1024
+
+// FileState describes a file within an image.
+type FileState struct {
+	Mode     os.FileMode
+	UID, GID uint32
+	Size     int64    // Regular files and symlinks only.
+	SHA256   [32]byte // Regular files only.
+	Target   string   // Symlinks only.
+}
+
+// FileDiff describes a file which differs between two images.
+type FileDiff struct {
+	Partition int
+	FS        string // ext4 or vfat.
+	Path      string
+	// Old is nil if the file was added, and New is nil if it was removed.
+	Old, New *FileState
+	// OldData and NewData hold the contents of regular files whose contents
+	// changed, if no larger than MaxDiffSize.
+	OldData, NewData []byte
+}
+
+// ContentChanged returns true if the contents of a regular file differ.
+func (d *FileDiff) ContentChanged() bool {
+	if d.Old == nil || d.New == nil {
+		return (d.Old != nil && d.Old.Mode.IsRegular()) || (d.New != nil && d.New.Mode.IsRegular())
+	}
+	if !d.Old.Mode.IsRegular() || !d.New.Mode.IsRegular() {
+		return d.Old.Mode.IsRegular() != d.New.Mode.IsRegular()
+	}
+	return d.Old.SHA256 != d.New.SHA256
+}
+
+func newFileState(fi os.FileInfo) *FileState {
+	st := fileStat(fi)
+	s := &FileState{Mode: fi.Mode(), UID: st.Uid, GID: st.Gid}
+	if fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+		s.Size = fi.Size()
+	}
+	return s
+}
+
+// FileReader is the subset of filesystem operations needed by StatFile.
+type FileReader interface {
+	Cat(path string) ([]byte, error)
+	LStat(path string) (os.FileInfo, error)
+}
+
+// StatFile returns the state of the file at p, without following a symlink
+// in the final path component. The contents of regular files are hashed: if
+// data is not nil, it is used as the contents of the file rather than
+// reading it again. Symlink targets are not read.
+func StatFile(fs FileReader, p string, data []byte) (*FileState, error) {
+	fi, err := fs.LStat(p)
+	if err != nil {
+		return nil, err
+	}
+	s := newFileState(fi)
+	if fi.Mode().IsRegular() {
+		if data == nil {
+			if data, err = fs.Cat(p); err != nil {
+				return nil, err
+			}
+		}
+		s.SHA256 = sha256.Sum256(data)
+	}
+	return s, nil
+}
+
+// StatFileSum is like StatFile, but uses sum as the hash of a regular file
+// rather than reading its contents.
+func StatFileSum(fs FileReader, p string, sum [32]byte) (*FileState, error) {
+	fi, err := fs.LStat(p)
+	if err != nil {
+		return nil, err
+	}
+	s := newFileState(fi)
+	if fi.Mode().IsRegular() {
+		s.SHA256 = sum
+	}
+	return s, nil
+}
+
+// treeReader is implemented by the userspace filesystems.
+type treeReader interface {
+	FileReader
+	ReadDir(path string) ([]os.FileInfo, error)
+	Readlink(path string) (string, error)
+	Close() error
+}
+
+// DiffImages compares the filesystems in two images, returning the files
+// which were added, removed or modified, ordered by partition and path.
+// Partitions are matched by number, and those which do not contain an ext4
+// or FAT filesystem are ignored. Both images are opened read-only.
+func DiffImages(a, b string) ([]FileDiff, error) {
+	partsA, err := ReadPartitionExtents(a)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a, err)
+	}
+	partsB, err := ReadPartitionExtents(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b, err)
+	}
+	nums := map[int]bool{}
+	for _, p := range append(partsA, partsB...) {
+		nums[p.Num] = true
+	}
+	var order []int
+	for n := range nums {
+		order = append(order, n)
+	}
+	sort.Ints(order)
+
+	var out []FileDiff
+	for _, num := range order {
+		diffs, err := diffPartition(num, a, partsA, b, partsB)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %v", num, err)
+		}
+		out = append(out, diffs...)
+	}
+	return out, nil
+}
+
+// openPartition opens the filesystem in the given partition read-only,
+// returning nil if the partition does not exist or has no filesystem which
+// can be read.
+func openPartition(img string, parts []PartitionExtent, num int) (treeReader, string, error) {
+	for _, p := range parts {
+		if p.Num != num {
+			continue
+		}
+		start, length := p.Start*sectorSize, p.Length*sectorSize
+		isExt4, err := hasExt4Magic(img, start)
+		if err != nil {
+			return nil, "", err
+		}
+		f, err := os.Open(img)
+		if err != nil {
+			return nil, "", err
+		}
+		if isExt4 {
+			fs, err := LoadExt4(f, start, length)
+			if err != nil {
+				f.Close()
+				return nil, "", fmt.Errorf("%s: %v", img, err)
+			}
+			return fs, "ext4", nil
+		}
+		fs, err := LoadFAT(f, start, length)
+		if err != nil {
+			f.Close()
+			return nil, "", nil
+		}
+		return fs, "vfat", nil
+	}
+	return nil, "", nil
+}
+
+func diffPartition(num int, a string, partsA []PartitionExtent, b string, partsB []PartitionExtent) ([]FileDiff, error) {
+	fsA, kindA, err := openPartition(a, partsA, num)
+	if err != nil {
+		return nil, err
+	}
+	if fsA != nil {
+		defer fsA.Close()
+	}
+	fsB, kindB, err := openPartition(b, partsB, num)
+	if err != nil {
+		return nil, err
+	}
+	if fsB != nil {
+		defer fsB.Close()
+	}
+	kind := kindB
+	if kind == "" {
+		kind = kindA
+	}
+
+	filesA, err := listFiles(fsA)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a, err)
+	}
+	filesB, err := listFiles(fsB)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b, err)
+	}
+	paths := make([]string, 0, len(filesB))
+	for p := range filesB {
+		paths = append(paths, p)
+	}
+	for p := range filesA {
+		if _, ok := filesB[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var out []FileDiff
+	for _, p := range paths {
+		d := FileDiff{Partition: num, FS: kind, Path: p, Old: filesA[p], New: filesB[p]}
+		if d.Old != nil && d.New != nil && *d.Old == *d.New {
+			continue
+		}
+		if d.ContentChanged() {
+			if d.OldData, err = smallContents(fsA, p, d.Old); err != nil {
+				return nil, fmt.Errorf("%s: %v", a, err)
+			}
+			if d.NewData, err = smallContents(fsB, p, d.New); err != nil {
+				return nil, fmt.Errorf("%s: %v", b, err)
+			}
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// smallContents returns the contents of a regular file, if it is no larger
+// than MaxDiffSize.
+func smallContents(fs treeReader, p string, st *FileState) ([]byte, error) {
+	if st == nil || !st.Mode.IsRegular() || st.Size > MaxDiffSize {
+		return nil, nil
+	}
+	return fs.Cat(p)
+}
+
+// listFiles walks a filesystem, returning the state of every file beneath
+// the root directory.
+func listFiles(fs treeReader) (map[string]*FileState, error) {
+	out := map[string]*FileState{}
+	if fs == nil {
+		return out, nil
+	}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		ents, err := fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range ents {
+			p := path.Join(dir, fi.Name())
+			s := newFileState(fi)
+			switch {
+			case fi.Mode().IsRegular():
+				d, err := fs.Cat(p)
+				if err != nil {
+					return err
+				}
+				s.SHA256 = sha256.Sum256(d)
+			case fi.Mode()&os.ModeSymlink != 0:
+				if s.Target, err = fs.Readlink(p); err != nil {
+					return err
+				}
+			}
+			out[p] = s
+			if fi.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return out, walk("/")
+}
@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	const bootStart, bootLen, rootStart, rootLen = 2048, 16384, 18432, 65536
+	table := make([]byte, sectorSize)
+	table[mbrTableOffset+4] = PartitionTypeFAT32LBA
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+8:], bootStart)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+12:], bootLen)
+	table[mbrTableOffset+16+4] = PartitionTypeLinuxNativePartition
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+8:], rootStart)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+12:], rootLen)
+	table[510], table[511] = 0x55, 0xAA
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.img"), filepath.Join(dir, "b.img")
+	if err := ioutil.WriteFile(a, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(a, (rootStart+rootLen)*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := FormatFAT(a, bootStart*sectorSize, bootLen*sectorSize, "boot", 0); err != nil {
+		t.Fatalf("FormatFAT() failed: %v", err)
+	}
+	boot, err := OpenFAT(a, bootStart*sectorSize, bootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot.Write("/cmdline.txt", []byte("console=tty1 rootwait\n"), 0755)
+	if err := boot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := FormatExt4(a, rootStart*sectorSize, rootLen*sectorSize, "rootfs", ""); err != nil {
+		t.Fatalf("FormatExt4() failed: %v", err)
+	}
+	root, err := OpenExt4(a, rootStart*sectorSize, rootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Mkdir("/etc")
+	root.Write("/etc/hostname", []byte("raspberrypi\n"), 0644)
+	root.Write("/etc/motd", []byte("hello\n"), 0644)
+	root.Symlink("/etc/localtime", "/usr/share/zoneinfo/UTC")
+	if err := root.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloneFile(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if diffs, err := DiffImages(a, b); err != nil || len(diffs) != 0 {
+		t.Errorf("DiffImages() of identical images = %+v, %v", diffs, err)
+	}
+
+	boot, err = OpenFAT(b, bootStart*sectorSize, bootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot.Write("/ssh", nil, 0755)
+	if err := boot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	root, err = OpenExt4(b, rootStart*sectorSize, rootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Write("/etc/hostname", []byte("mypi\n"), 0644)
+	root.Chown("/etc/hostname", 1000, 1000)
+	root.Chmod("/etc/motd", 0600)
+	root.Remove("/etc/localtime")
+	root.Symlink("/etc/localtime", "/usr/share/zoneinfo/Europe/London")
+	root.Mkdir("/opt")
+	if err := root.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := DiffImages(a, b)
+	if err != nil {
+		t.Fatalf("DiffImages() failed: %v", err)
+	}
+	type summary struct {
+		Partition     int
+		FS, Path      string
+		Old, New      bool
+		ContentChange bool
+		OldData       string
+		NewData       string
+	}
+	var got []summary
+	for _, d := range diffs {
+		got = append(got, summary{d.Partition, d.FS, d.Path, d.Old != nil, d.New != nil, d.ContentChanged(), string(d.OldData), string(d.NewData)})
+	}
+	want := []summary{
+		{1, "vfat", "/ssh", false, true, true, "", ""},
+		{2, "ext4", "/etc/hostname", true, true, true, "raspberrypi\n", "mypi\n"},
+		{2, "ext4", "/etc/localtime", true, true, false, "", ""},
+		{2, "ext4", "/etc/motd", true, true, false, "", ""},
+		{2, "ext4", "/opt", false, true, false, "", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffImages() = %+v\nwant %+v", got, want)
+	}
+	if len(diffs) == len(want) {
+		if n := diffs[1].New; n.UID != 1000 || n.GID != 1000 {
+			t.Errorf("owner of /etc/hostname = %d:%d, want 1000:1000", n.UID, n.GID)
+		}
+		if o, n := diffs[2].Old, diffs[2].New; o.Target != "/usr/share/zoneinfo/UTC" || n.Target != "/usr/share/zoneinfo/Europe/London" {
+			t.Errorf("/etc/localtime target changed from %q to %q", o.Target, n.Target)
+		}
+		if o, n := diffs[3].Old, diffs[3].New; o.Mode != 0644 || n.Mode != 0600 {
+			t.Errorf("/etc/motd mode changed from %v to %v", o.Mode, n.Mode)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rekby/mbr"
+	"github.com/twitchyliquid64/raspberry-box/conf/unix"
+)
+
+// NewDiskID returns a random, non-zero MBR disk identifier.
+func NewDiskID() (uint32, error) {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := binary.LittleEndian.Uint32(b[:]); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// MBRPartUUID returns the PARTUUID which Linux assigns to a partition in an
+// image with an MBR partition table.
+func MBRPartUUID(diskID uint32, num int) string {
+	return fmt.Sprintf("%08x-%02x", diskID, num)
+}
+
+// SetDiskID changes the MBR disk identifier of the image at path. As the
+// PARTUUIDs of the partitions are derived from the disk identifier,
+// references to them in the kernel command line (cmdline.txt) and
+// /etc/fstab of the filesystems within the image are updated to match.
+// The partitions must not be mounted.
+func SetDiskID(path string, id uint32) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sector := make([]byte, sectorSize)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return fmt.Errorf("reading partition table: %v", err)
+	}
+	if IsProtectiveMBR(sector) {
+		return errors.New("images with a GUID partition table do not have an MBR disk identifier")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	tab, err := mbr.Read(f)
+	if err != nil {
+		return fmt.Errorf("reading partition table: %v", err)
+	}
+
+	// Every change is prepared before any is made, so a filesystem which
+	// cannot be updated leaves the image as it was.
+	old := MBRDiskID(sector)
+	var edits []*partUUIDEdit
+	for i, p := range tab.GetAllPartitions() {
+		if p.IsEmpty() {
+			continue
+		}
+		start, length := uint64(p.GetLBAStart())*sectorSize, uint64(p.GetLBALen())*sectorSize
+		e, err := planPartUUIDs(path, start, length, old, id)
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", i+1, err)
+		}
+		if e != nil {
+			e.num = i + 1
+			edits = append(edits, e)
+		}
+	}
+
+	for i, e := range edits {
+		if err := e.apply(path, e.after); err != nil {
+			restorePartUUIDs(path, edits[:i])
+			return fmt.Errorf("partition %d: %v", e.num, err)
+		}
+	}
+	binary.LittleEndian.PutUint32(sector[mbrDiskIDOffset:], id)
+	if _, err := f.WriteAt(sector[mbrDiskIDOffset:mbrDiskIDOffset+4], mbrDiskIDOffset); err != nil {
+		restorePartUUIDs(path, edits)
+		return fmt.Errorf("writing disk identifier: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		restorePartUUIDs(path, edits)
+		return err
+	}
+	return nil
+}
+
+// fileEditor is implemented by the userspace filesystems.
+type fileEditor interface {
+	Cat(path string) ([]byte, error)
+	Stat(path string) (os.FileInfo, error)
+	Write(path string, data []byte, perms os.FileMode) error
+	Close() error
+}
+
+// partUUIDEdit is a change to the file referring to PARTUUIDs in the
+// filesystem within a region of an image.
+type partUUIDEdit struct {
+	num           int
+	start, length uint64
+	path          string
+	mode          os.FileMode
+	before, after []byte
+}
+
+// openPartUUIDFile opens the filesystem within the given region of an image,
+// returning it and the path of the file in it which refers to PARTUUIDs. A
+// nil filesystem is returned if the region does not contain a FAT or ext4
+// filesystem.
+func openPartUUIDFile(img string, start, length uint64) (fileEditor, string, error) {
+	isExt4, err := hasExt4Magic(img, start)
+	if err != nil {
+		return nil, "", err
+	}
+	isFAT, err := hasFATBootSector(img, start)
+	switch {
+	case err != nil:
+		return nil, "", err
+	case isExt4:
+		mnt, err := OpenExt4(img, start, length)
+		if err != nil {
+			return nil, "", err
+		}
+		return mnt, "/etc/fstab", nil
+	case isFAT:
+		mnt, err := OpenFAT(img, start, length)
+		if err != nil {
+			return nil, "", err
+		}
+		return mnt, "/cmdline.txt", nil
+	}
+	return nil, "", nil
+}
+
+// planPartUUIDs returns the change needed to rewrite PARTUUIDs derived from
+// the old disk identifier in the filesystem within the given region of an
+// image, or nil if none is needed. Regions which do not contain a FAT or
+// ext4 filesystem are ignored.
+func planPartUUIDs(img string, start, length uint64, old, id uint32) (*partUUIDEdit, error) {
+	mnt, path, err := openPartUUIDFile(img, start, length)
+	if err != nil || mnt == nil {
+		return nil, err
+	}
+	defer mnt.Close()
+
+	st, err := mnt.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := mnt.Cat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated string
+	if path == "/etc/fstab" {
+		tab := unix.ParseFstab(string(data))
+		for _, e := range tab.Entries() {
+			e.Source = replacePartUUIDs(e.Source, old, id)
+		}
+		updated = tab.String()
+	} else {
+		updated = replacePartUUIDs(string(data), old, id)
+	}
+	if updated == string(data) {
+		return nil, nil
+	}
+	return &partUUIDEdit{start: start, length: length, path: path, mode: st.Mode(), before: data, after: []byte(updated)}, nil
+}
+
+// apply writes data to the file changed by the edit.
+func (e *partUUIDEdit) apply(img string, data []byte) error {
+	mnt, _, err := openPartUUIDFile(img, e.start, e.length)
+	if err != nil {
+		return err
+	}
+	if mnt == nil {
+		return errors.New("filesystem has disappeared")
+	}
+	if err := mnt.Write(e.path, data, e.mode); err != nil {
+		mnt.Close()
+		return err
+	}
+	return mnt.Close()
+}
+
+// restorePartUUIDs reverts edits which have been applied, on a best-effort
+// basis, after a later step of SetDiskID has failed.
+func restorePartUUIDs(img string, edits []*partUUIDEdit) {
+	for _, e := range edits {
+		e.apply(img, e.before)
+	}
+}
+
+func hasExt4Magic(img string, start uint64) (bool, error) {
+	f, err := os.Open(img)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var magic [2]byte
+	if _, err := f.ReadAt(magic[:], int64(start)+ext4SuperblockOff+0x38); err != nil {
+		return false, nil
+	}
+	return binary.LittleEndian.Uint16(magic[:]) == ext4Magic, nil
+}
+
+// hasFATBootSector returns true if the region starting at start begins with
+// a boot sector, as found at the start of a FAT filesystem.
+func hasFATBootSector(img string, start uint64) (bool, error) {
+	f, err := os.Open(img)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	bs := make([]byte, sectorSize)
+	if _, err := f.ReadAt(bs, int64(start)); err != nil {
+		return false, nil
+	}
+	// The boot sector starts with a jump over the BIOS parameter block.
+	return (bs[0] == 0xEB || bs[0] == 0xE9) && bs[510] == 0x55 && bs[511] == 0xAA, nil
+}
+
+// replacePartUUIDs replaces references of the form PARTUUID=<id>-<n> which
+// use the old disk identifier with ones using the new identifier.
+func replacePartUUIDs(s string, old, id uint32) string {
+	re := regexp.MustCompile(fmt.Sprintf(`(?i)\bPARTUUID=%08x-([0-9a-f]{2})\b`, old))
+	return re.ReplaceAllStringFunc(s, func(m string) string {
+		return fmt.Sprintf("PARTUUID=%08x%s", id, strings.ToLower(m[len(m)-3:]))
+	})
+}
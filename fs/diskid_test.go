@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const bootStart, bootLen, rootStart, rootLen = 2048, 16384, 18432, 65536
+
+// makeDiskIDImage creates an image with a boot and root partition, whose
+// cmdline.txt and /etc/fstab refer to them by PARTUUID.
+func makeDiskIDImage(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	table := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(table[mbrDiskIDOffset:], 0x738a4d67)
+	table[mbrTableOffset+4] = PartitionTypeFAT32LBA
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+8:], bootStart)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+12:], bootLen)
+	table[mbrTableOffset+16+4] = PartitionTypeLinuxNativePartition
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+8:], rootStart)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+12:], rootLen)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "pi.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, (rootStart+rootLen)*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FormatFAT(img, bootStart*sectorSize, bootLen*sectorSize, "boot", 0); err != nil {
+		t.Fatalf("FormatFAT() failed: %v", err)
+	}
+	boot, err := OpenFAT(img, bootStart*sectorSize, bootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot.Write("/cmdline.txt", []byte("console=tty1 root=PARTUUID=738A4D67-02 rootfstype=ext4 fsck.repair=yes rootwait\n"), 0755)
+	if err := boot.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FormatExt4(img, rootStart*sectorSize, rootLen*sectorSize, "rootfs", ""); err != nil {
+		t.Fatalf("FormatExt4() failed: %v", err)
+	}
+	root, err := OpenExt4(img, rootStart*sectorSize, rootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Mkdir("/etc")
+	root.Write("/etc/fstab", []byte("proc            /proc           proc    defaults          0       0\n"+
+		"PARTUUID=738a4d67-01  /boot           vfat    defaults          0       2\n"+
+		"PARTUUID=738a4d67-02  /               ext4    defaults,noatime  0       1\n"+
+		"# PARTUUID=738a4d67-03 is not used\n"), 0640)
+	if err := root.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestSetDiskID(t *testing.T) {
+	img := makeDiskIDImage(t)
+	if err := SetDiskID(img, 0xCAFEF00D); err != nil {
+		t.Fatalf("SetDiskID() failed: %v", err)
+	}
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sector := make([]byte, sectorSize)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		t.Fatal(err)
+	}
+	if id := MBRDiskID(sector); id != 0xCAFEF00D {
+		t.Errorf("disk ID = %#x, want 0xcafef00d", id)
+	}
+	if binary.LittleEndian.Uint32(sector[mbrTableOffset+16+8:]) != rootStart {
+		t.Error("partition table was modified")
+	}
+
+	boot, err := LoadFAT(f, bootStart*sectorSize, bootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "console=tty1 root=PARTUUID=cafef00d-02 rootfstype=ext4 fsck.repair=yes rootwait\n"
+	if d, err := boot.Cat("/cmdline.txt"); err != nil || string(d) != want {
+		t.Errorf("cmdline.txt = %q, %v, want %q", d, err, want)
+	}
+	root, err := LoadExt4(f, rootStart*sectorSize, rootLen*sectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "proc            /proc           proc    defaults          0       0\n" +
+		"PARTUUID=cafef00d-01\t/boot\tvfat\tdefaults\t0\t2\n" +
+		"PARTUUID=cafef00d-02\t/\text4\tdefaults,noatime\t0\t1\n" +
+		"# PARTUUID=738a4d67-03 is not used\n"
+	if d, err := root.Cat("/etc/fstab"); err != nil || string(d) != want {
+		t.Errorf("fstab = %q, %v, want %q", d, err, want)
+	}
+	if st, err := root.Stat("/etc/fstab"); err != nil || st.Mode().Perm() != 0640 {
+		t.Errorf("Stat(/etc/fstab) = %v, %v, want mode 0640", st, err)
+	}
+}
+
+func TestSetDiskIDBadRoot(t *testing.T) {
+	img := makeDiskIDImage(t)
+	// Mark the root filesystem as needing journal recovery, so it cannot be
+	// written once cmdline.txt in the boot partition could have been.
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(rootStart*sectorSize + ext4SuperblockOff + 0x60)
+	var incompat [4]byte
+	f.ReadAt(incompat[:], off)
+	binary.LittleEndian.PutUint32(incompat[:], binary.LittleEndian.Uint32(incompat[:])|ext4IncompatRecover)
+	f.WriteAt(incompat[:], off)
+	f.Close()
+	before, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetDiskID(img, 0xCAFEF00D); err == nil {
+		t.Fatal("SetDiskID() succeeded with a root filesystem which cannot be written")
+	}
+	after, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("SetDiskID() modified the image before failing")
+	}
+}
+
+func TestSetDiskIDBadFAT(t *testing.T) {
+	table := make([]byte, sectorSize)
+	table[mbrTableOffset+4] = PartitionTypeFAT32LBA
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+8:], bootStart)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+12:], bootLen)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "pi.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, (bootStart+bootLen)*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := FormatFAT(img, bootStart*sectorSize, bootLen*sectorSize, "boot", 0); err != nil {
+		t.Fatalf("FormatFAT() failed: %v", err)
+	}
+
+	// Corrupt the sector size in the boot sector.
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0x03, 0x00}, bootStart*sectorSize+11)
+	f.Close()
+
+	if err := SetDiskID(img, 0xCAFEF00D); err == nil {
+		t.Error("SetDiskID() succeeded with a damaged FAT filesystem")
+	}
+}
@@ -1,49 +1,455 @@
 package fs
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
-
-	ext4 "github.com/dsoprea/go-ext4"
+	"time"
 )
 
 const sectorSize = 512
 
-// Ext4FS represents access to an ext4 fileystem.
+// Superblock feature flags.
+const (
+	ext4CompatSparseSuper2 = 0x200
+
+	ext4IncompatFiletype  = 0x2
+	ext4IncompatRecover   = 0x4
+	ext4IncompatMetaBG    = 0x10
+	ext4IncompatExtents   = 0x40
+	ext4Incompat64Bit     = 0x80
+	ext4IncompatMMP       = 0x100
+	ext4IncompatFlexBG    = 0x200
+	ext4IncompatEAInode   = 0x400
+	ext4IncompatCsumSeed  = 0x2000
+	ext4IncompatLargeDir  = 0x4000
+	ext4IncompatInline    = 0x8000
+	ext4IncompatSupported = ext4IncompatFiletype | ext4IncompatRecover | ext4IncompatExtents |
+		ext4Incompat64Bit | ext4IncompatMMP | ext4IncompatFlexBG | ext4IncompatEAInode |
+		ext4IncompatCsumSeed | ext4IncompatLargeDir | ext4IncompatInline
+	ext4IncompatWritable = ext4IncompatFiletype | ext4IncompatExtents | ext4Incompat64Bit |
+		ext4IncompatFlexBG | ext4IncompatCsumSeed | ext4IncompatLargeDir
+
+	ext4RoCompatSparseSuper   = 0x1
+	ext4RoCompatGdtCsum       = 0x10
+	ext4RoCompatDirNlink      = 0x20
+	ext4RoCompatQuota         = 0x100
+	ext4RoCompatBigalloc      = 0x200
+	ext4RoCompatMetadataCsum  = 0x400
+	ext4RoCompatReadonly      = 0x1000
+	ext4RoCompatOrphanPresent = 0x10000
+	ext4RoCompatUnwritable    = ext4RoCompatQuota | ext4RoCompatBigalloc | ext4RoCompatReadonly |
+		ext4RoCompatOrphanPresent
+)
+
+// Block group flags.
+const (
+	ext4BGInodeUninit = 0x1
+	ext4BGBlockUninit = 0x2
+)
+
+const (
+	ext4Magic         = 0xEF53
+	ext4SuperblockOff = 1024
+	ext4RootInode     = 2
+)
+
+// Ext4FS represents access to an ext4 fileystem contained within an image
+// file. Changes are written directly into the image, so the filesystem must
+// not be mounted elsewhere while in use.
 type Ext4FS struct {
 	f             *os.File
 	start, length uint64
+	writable      bool
 
-	sb   *ext4.Superblock
-	bgdl *ext4.BlockGroupDescriptorList
-	root *ext4.BlockGroupDescriptor
+	sb          []byte
+	blockSize   uint64
+	groupCount  uint32
+	descSize    uint64
+	gdt         []byte
+	dirtyGroups map[uint32]bool
+	csumSeed    uint32
+
+	blockBitmaps map[uint32]*ext4Bitmap
+	inodeBitmaps map[uint32]*ext4Bitmap
+}
+
+type ext4Bitmap struct {
+	data  []byte
+	dirty bool
 }
 
 // LoadExt4 loads an ext4 filesystem.
 func LoadExt4(f *os.File, start, length uint64) (*Ext4FS, error) {
-	if _, err := f.Seek(int64(start)+ext4.Superblock0Offset, 0); err != nil {
-		return nil, fmt.Errorf("seek failed: %v", err)
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, int64(start)+ext4SuperblockOff); err != nil {
+		return nil, fmt.Errorf("loading superblock: %v", err)
+	}
+	if m := binary.LittleEndian.Uint16(sb[0x38:]); m != ext4Magic {
+		return nil, fmt.Errorf("bad superblock magic: %#x", m)
 	}
 
-	sb, err := ext4.NewSuperblockWithReader(f)
+	fs := &Ext4FS{
+		f:            f,
+		start:        start,
+		length:       length,
+		sb:           sb,
+		blockSize:    1024 << binary.LittleEndian.Uint32(sb[0x18:]),
+		descSize:     32,
+		dirtyGroups:  map[uint32]bool{},
+		blockBitmaps: map[uint32]*ext4Bitmap{},
+		inodeBitmaps: map[uint32]*ext4Bitmap{},
+	}
+	if unsupported := fs.incompat() &^ ext4IncompatSupported; unsupported != 0 {
+		return nil, fmt.Errorf("unsupported incompatible features: %#x", unsupported)
+	}
+	if fs.hasIncompat(ext4Incompat64Bit) {
+		fs.descSize = uint64(binary.LittleEndian.Uint16(sb[0xFE:]))
+	}
+	if fs.metadataCsum() {
+		if c := crc32c(^uint32(0), sb[:0x3FC]); c != binary.LittleEndian.Uint32(sb[0x3FC:]) {
+			return nil, errors.New("superblock checksum mismatch")
+		}
+		if fs.hasIncompat(ext4IncompatCsumSeed) {
+			fs.csumSeed = binary.LittleEndian.Uint32(sb[0x270:])
+		} else {
+			fs.csumSeed = crc32c(^uint32(0), sb[0x68:0x78])
+		}
+	}
+
+	dataBlocks := fs.blocksCount() - uint64(fs.firstDataBlock())
+	fs.groupCount = uint32((dataBlocks + uint64(fs.blocksPerGroup()) - 1) / uint64(fs.blocksPerGroup()))
+
+	gdtLen := ((uint64(fs.groupCount)*fs.descSize + fs.blockSize - 1) / fs.blockSize) * fs.blockSize
+	fs.gdt = make([]byte, gdtLen)
+	if _, err := f.ReadAt(fs.gdt, fs.blockOffset(uint64(fs.firstDataBlock())+1)); err != nil {
+		return nil, fmt.Errorf("loading block group descriptors: %v", err)
+	}
+	return fs, nil
+}
+
+// OpenExt4 opens the ext4 filesystem within the given image for reading and
+// writing, entirely in userspace.
+func OpenExt4(img string, start, length uint64) (*Ext4FS, error) {
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
 	if err != nil {
-		return nil, fmt.Errorf("loading superblock: %v", err)
+		return nil, err
 	}
-	bgdl, err := ext4.NewBlockGroupDescriptorListWithReadSeeker(f, sb)
+	fs, err := LoadExt4(f, start, length)
 	if err != nil {
-		return nil, fmt.Errorf("loading block group descriptor: %v", err)
+		f.Close()
+		return nil, err
+	}
+	if err := fs.checkWritable(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	fs.writable = true
+	return fs, nil
+}
+
+func (fs *Ext4FS) checkWritable() error {
+	if fs.hasIncompat(ext4IncompatRecover) {
+		return errors.New("filesystem journal needs recovery")
+	}
+	if unsupported := fs.incompat() &^ ext4IncompatWritable; unsupported != 0 {
+		return fmt.Errorf("cannot write filesystem with incompatible features %#x", unsupported)
+	}
+	if !fs.hasIncompat(ext4IncompatExtents) {
+		return errors.New("cannot write filesystem without the extent feature")
+	}
+	if unsupported := fs.roCompat() & ext4RoCompatUnwritable; unsupported != 0 {
+		return fmt.Errorf("cannot write filesystem with read-only compatible features %#x", unsupported)
+	}
+	return nil
+}
+
+func (fs *Ext4FS) incompat() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x60:])
+}
+
+func (fs *Ext4FS) roCompat() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x64:])
+}
+
+func (fs *Ext4FS) hasIncompat(mask uint32) bool {
+	return fs.incompat()&mask != 0
+}
+
+func (fs *Ext4FS) hasRoCompat(mask uint32) bool {
+	return fs.roCompat()&mask != 0
+}
+
+func (fs *Ext4FS) metadataCsum() bool {
+	return fs.hasRoCompat(ext4RoCompatMetadataCsum)
+}
+
+func (fs *Ext4FS) inodesCount() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x0:])
+}
+
+func (fs *Ext4FS) blocksCount() uint64 {
+	n := uint64(binary.LittleEndian.Uint32(fs.sb[0x4:]))
+	if fs.hasIncompat(ext4Incompat64Bit) {
+		n |= uint64(binary.LittleEndian.Uint32(fs.sb[0x150:])) << 32
+	}
+	return n
+}
+
+func (fs *Ext4FS) addFreeBlocks(delta int64) {
+	n := uint64(binary.LittleEndian.Uint32(fs.sb[0xC:]))
+	if fs.hasIncompat(ext4Incompat64Bit) {
+		n |= uint64(binary.LittleEndian.Uint32(fs.sb[0x158:])) << 32
+	}
+	n = uint64(int64(n) + delta)
+	binary.LittleEndian.PutUint32(fs.sb[0xC:], uint32(n))
+	if fs.hasIncompat(ext4Incompat64Bit) {
+		binary.LittleEndian.PutUint32(fs.sb[0x158:], uint32(n>>32))
+	}
+}
+
+func (fs *Ext4FS) addFreeInodes(delta int64) {
+	n := binary.LittleEndian.Uint32(fs.sb[0x10:])
+	binary.LittleEndian.PutUint32(fs.sb[0x10:], uint32(int64(n)+delta))
+}
+
+func (fs *Ext4FS) firstDataBlock() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x14:])
+}
+
+func (fs *Ext4FS) blocksPerGroup() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x20:])
+}
+
+func (fs *Ext4FS) inodesPerGroup() uint32 {
+	return binary.LittleEndian.Uint32(fs.sb[0x28:])
+}
+
+func (fs *Ext4FS) firstInode() uint32 {
+	if binary.LittleEndian.Uint32(fs.sb[0x4C:]) == 0 {
+		return 11
+	}
+	return binary.LittleEndian.Uint32(fs.sb[0x54:])
+}
+
+func (fs *Ext4FS) inodeSize() uint64 {
+	if binary.LittleEndian.Uint32(fs.sb[0x4C:]) == 0 {
+		return 128
+	}
+	return uint64(binary.LittleEndian.Uint16(fs.sb[0x58:]))
+}
+
+func (fs *Ext4FS) blockOffset(block uint64) int64 {
+	return int64(fs.start + block*fs.blockSize)
+}
+
+func (fs *Ext4FS) readBlock(block uint64) ([]byte, error) {
+	if block >= fs.blocksCount() {
+		return nil, fmt.Errorf("block %d out of range", block)
+	}
+	b := make([]byte, fs.blockSize)
+	if _, err := fs.f.ReadAt(b, fs.blockOffset(block)); err != nil {
+		return nil, fmt.Errorf("reading block %d: %v", block, err)
+	}
+	return b, nil
+}
+
+func (fs *Ext4FS) writeBlock(block uint64, data []byte) error {
+	if block >= fs.blocksCount() {
+		return fmt.Errorf("block %d out of range", block)
+	}
+	if _, err := fs.f.WriteAt(data, fs.blockOffset(block)); err != nil {
+		return fmt.Errorf("writing block %d: %v", block, err)
+	}
+	return nil
+}
+
+// groupDesc returns the raw block group descriptor for the given group.
+func (fs *Ext4FS) groupDesc(group uint32) []byte {
+	off := uint64(group) * fs.descSize
+	return fs.gdt[off : off+fs.descSize]
+}
+
+func (fs *Ext4FS) descField(group uint32, loOff, hiOff int, wide bool) uint64 {
+	d := fs.groupDesc(group)
+	var v uint64
+	if wide {
+		v = uint64(binary.LittleEndian.Uint32(d[loOff:]))
+		if fs.descSize >= 64 {
+			v |= uint64(binary.LittleEndian.Uint32(d[hiOff:])) << 32
+		}
+	} else {
+		v = uint64(binary.LittleEndian.Uint16(d[loOff:]))
+		if fs.descSize >= 64 {
+			v |= uint64(binary.LittleEndian.Uint16(d[hiOff:])) << 16
+		}
+	}
+	return v
+}
+
+func (fs *Ext4FS) setDescField(group uint32, loOff, hiOff int, wide bool, v uint64) {
+	d := fs.groupDesc(group)
+	if wide {
+		binary.LittleEndian.PutUint32(d[loOff:], uint32(v))
+		if fs.descSize >= 64 {
+			binary.LittleEndian.PutUint32(d[hiOff:], uint32(v>>32))
+		}
+	} else {
+		binary.LittleEndian.PutUint16(d[loOff:], uint16(v))
+		if fs.descSize >= 64 {
+			binary.LittleEndian.PutUint16(d[hiOff:], uint16(v>>16))
+		}
+	}
+	fs.dirtyGroups[group] = true
+}
+
+func (fs *Ext4FS) groupBlockBitmap(g uint32) uint64 { return fs.descField(g, 0x0, 0x20, true) }
+func (fs *Ext4FS) groupInodeBitmap(g uint32) uint64 { return fs.descField(g, 0x4, 0x24, true) }
+func (fs *Ext4FS) groupInodeTable(g uint32) uint64  { return fs.descField(g, 0x8, 0x28, true) }
+func (fs *Ext4FS) groupFreeBlocks(g uint32) uint64  { return fs.descField(g, 0xC, 0x2C, false) }
+func (fs *Ext4FS) groupFreeInodes(g uint32) uint64  { return fs.descField(g, 0xE, 0x2E, false) }
+func (fs *Ext4FS) groupUsedDirs(g uint32) uint64    { return fs.descField(g, 0x10, 0x30, false) }
+func (fs *Ext4FS) groupItableUnused(g uint32) uint64 {
+	return fs.descField(g, 0x1C, 0x32, false)
+}
+
+func (fs *Ext4FS) groupFlags(g uint32) uint16 {
+	return binary.LittleEndian.Uint16(fs.groupDesc(g)[0x12:])
+}
+
+func (fs *Ext4FS) clearGroupFlag(g uint32, flag uint16) {
+	binary.LittleEndian.PutUint16(fs.groupDesc(g)[0x12:], fs.groupFlags(g)&^flag)
+	fs.dirtyGroups[g] = true
+}
+
+func (fs *Ext4FS) groupHasSuper(g uint32) bool {
+	if g == 0 {
+		return true
+	}
+	if binary.LittleEndian.Uint32(fs.sb[0x5C:])&ext4CompatSparseSuper2 != 0 {
+		return g == binary.LittleEndian.Uint32(fs.sb[0x24C:]) || g == binary.LittleEndian.Uint32(fs.sb[0x250:])
+	}
+	if g == 1 || !fs.hasRoCompat(ext4RoCompatSparseSuper) {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *Ext4FS) groupDescChecksum(g uint32) uint16 {
+	d := fs.groupDesc(g)
+	var le [4]byte
+	binary.LittleEndian.PutUint32(le[:], g)
+
+	if fs.metadataCsum() {
+		c := crc32c(fs.csumSeed, le[:])
+		c = crc32c(c, d[:0x1E])
+		c = crc32c(c, []byte{0, 0})
+		if fs.descSize > 0x20 {
+			c = crc32c(c, d[0x20:])
+		}
+		return uint16(c)
+	}
+	if fs.hasRoCompat(ext4RoCompatGdtCsum) {
+		c := crc16(0xFFFF, fs.sb[0x68:0x78])
+		c = crc16(c, le[:])
+		c = crc16(c, d[:0x1E])
+		if fs.descSize > 0x20 {
+			c = crc16(c, d[0x20:])
+		}
+		return c
+	}
+	return 0
+}
+
+// flush writes any modified metadata back to the image.
+// Operations which allocate or free space flush when they finish, so the
+// image is consistent between them even if it is never closed.
+func (fs *Ext4FS) flush() error {
+	if !fs.writable {
+		return nil
+	}
+	for g, bm := range fs.blockBitmaps {
+		if !bm.dirty {
+			continue
+		}
+		if err := fs.writeBlock(fs.groupBlockBitmap(g), bm.data); err != nil {
+			return err
+		}
+		if fs.metadataCsum() {
+			c := crc32c(fs.csumSeed, bm.data[:binary.LittleEndian.Uint32(fs.sb[0x24:])/8])
+			d := fs.groupDesc(g)
+			binary.LittleEndian.PutUint16(d[0x18:], uint16(c))
+			if fs.descSize >= 0x3A {
+				binary.LittleEndian.PutUint16(d[0x38:], uint16(c>>16))
+			}
+		}
+		fs.dirtyGroups[g] = true
+		bm.dirty = false
+	}
+	for g, bm := range fs.inodeBitmaps {
+		if !bm.dirty {
+			continue
+		}
+		if err := fs.writeBlock(fs.groupInodeBitmap(g), bm.data); err != nil {
+			return err
+		}
+		if fs.metadataCsum() {
+			c := crc32c(fs.csumSeed, bm.data[:fs.inodesPerGroup()/8])
+			d := fs.groupDesc(g)
+			binary.LittleEndian.PutUint16(d[0x1A:], uint16(c))
+			if fs.descSize >= 0x3C {
+				binary.LittleEndian.PutUint16(d[0x3A:], uint16(c>>16))
+			}
+		}
+		fs.dirtyGroups[g] = true
+		bm.dirty = false
+	}
+
+	if len(fs.dirtyGroups) > 0 {
+		for g := range fs.dirtyGroups {
+			binary.LittleEndian.PutUint16(fs.groupDesc(g)[0x1E:], fs.groupDescChecksum(g))
+		}
+		if _, err := fs.f.WriteAt(fs.gdt, fs.blockOffset(uint64(fs.firstDataBlock())+1)); err != nil {
+			return fmt.Errorf("writing block group descriptors: %v", err)
+		}
+		fs.dirtyGroups = map[uint32]bool{}
+
+		binary.LittleEndian.PutUint32(fs.sb[0x30:], uint32(time.Now().Unix()))
+		if fs.metadataCsum() {
+			binary.LittleEndian.PutUint32(fs.sb[0x3FC:], crc32c(^uint32(0), fs.sb[:0x3FC]))
+		}
+		if _, err := fs.f.WriteAt(fs.sb, int64(fs.start)+ext4SuperblockOff); err != nil {
+			return fmt.Errorf("writing superblock: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close writes out any pending changes and closes the underlying image.
+func (fs *Ext4FS) Close() error {
+	err := fs.flush()
+	if err == nil && fs.writable {
+		err = fs.f.Sync()
 	}
-	root, err := bgdl.GetWithAbsoluteInode(ext4.InodeRootDirectory)
 	if err != nil {
-		return nil, fmt.Errorf("loading root directory: %v", err)
+		fs.f.Close()
+		return err
 	}
+	return fs.f.Close()
+}
 
-	return &Ext4FS{
-		f:      f,
-		start:  start,
-		length: length,
-		sb:     sb,
-		bgdl:   bgdl,
-		root:   root,
-	}, nil
+// Mountpoint implements interpreter.FS. Userspace filesystems are not
+// mounted anywhere, so an empty string is returned.
+func (fs *Ext4FS) Mountpoint() string {
+	return ""
 }
@@ -0,0 +1,230 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+// blockRun describes a contiguous range of blocks.
+type blockRun struct {
+	start, length uint64
+}
+
+func bitSet(b []byte, i uint64) bool { return b[i/8]&(1<<(i%8)) != 0 }
+func setBit(b []byte, i uint64)      { b[i/8] |= 1 << (i % 8) }
+func clearBit(b []byte, i uint64)    { b[i/8] &^= 1 << (i % 8) }
+
+func (fs *Ext4FS) groupOfBlock(block uint64) (uint32, uint64) {
+	rel := block - uint64(fs.firstDataBlock())
+	return uint32(rel / uint64(fs.blocksPerGroup())), rel % uint64(fs.blocksPerGroup())
+}
+
+func (fs *Ext4FS) groupFirstBlock(g uint32) uint64 {
+	return uint64(fs.firstDataBlock()) + uint64(g)*uint64(fs.blocksPerGroup())
+}
+
+func (fs *Ext4FS) inodeTableBlocks() uint64 {
+	return (uint64(fs.inodesPerGroup())*fs.inodeSize() + fs.blockSize - 1) / fs.blockSize
+}
+
+// blockBitmap returns the block bitmap for the given group, constructing
+// it if the group has never been initialized.
+func (fs *Ext4FS) blockBitmap(g uint32) (*ext4Bitmap, error) {
+	if bm, ok := fs.blockBitmaps[g]; ok {
+		return bm, nil
+	}
+	if fs.groupFlags(g)&ext4BGBlockUninit == 0 {
+		d, err := fs.readBlock(fs.groupBlockBitmap(g))
+		if err != nil {
+			return nil, err
+		}
+		fs.blockBitmaps[g] = &ext4Bitmap{data: d}
+		return fs.blockBitmaps[g], nil
+	}
+
+	d := make([]byte, fs.blockSize)
+	first := fs.groupFirstBlock(g)
+	bpg := uint64(fs.blocksPerGroup())
+	mark := func(block, count uint64) {
+		for b := block; b < block+count; b++ {
+			if b >= first && b < first+bpg {
+				setBit(d, b-first)
+			}
+		}
+	}
+	if fs.groupHasSuper(g) {
+		gdtBlocks := uint64(len(fs.gdt)) / fs.blockSize
+		reserved := uint64(binary.LittleEndian.Uint16(fs.sb[0xCE:]))
+		mark(first, 1+gdtBlocks+reserved)
+	}
+	for h := uint32(0); h < fs.groupCount; h++ {
+		mark(fs.groupBlockBitmap(h), 1)
+		mark(fs.groupInodeBitmap(h), 1)
+		mark(fs.groupInodeTable(h), fs.inodeTableBlocks())
+	}
+	for i := uint64(0); i < fs.blockSize*8; i++ {
+		if i >= bpg || first+i >= fs.blocksCount() {
+			setBit(d, i)
+		}
+	}
+	fs.blockBitmaps[g] = &ext4Bitmap{data: d}
+	return fs.blockBitmaps[g], nil
+}
+
+// inodeBitmap returns the inode bitmap for the given group, constructing
+// it if the group has never been initialized.
+func (fs *Ext4FS) inodeBitmap(g uint32) (*ext4Bitmap, error) {
+	if bm, ok := fs.inodeBitmaps[g]; ok {
+		return bm, nil
+	}
+	var d []byte
+	if fs.groupFlags(g)&ext4BGInodeUninit == 0 {
+		var err error
+		if d, err = fs.readBlock(fs.groupInodeBitmap(g)); err != nil {
+			return nil, err
+		}
+	} else {
+		d = make([]byte, fs.blockSize)
+		for i := uint64(fs.inodesPerGroup()); i < fs.blockSize*8; i++ {
+			setBit(d, i)
+		}
+	}
+	fs.inodeBitmaps[g] = &ext4Bitmap{data: d}
+	return fs.inodeBitmaps[g], nil
+}
+
+// allocBlocks allocates count blocks, preferring the given group. The
+// allocated blocks are returned as a list of contiguous runs.
+func (fs *Ext4FS) allocBlocks(goal uint32, count uint64) ([]blockRun, error) {
+	var out []blockRun
+	if count == 0 {
+		return nil, nil
+	}
+	if goal >= fs.groupCount {
+		goal = 0
+	}
+
+	remaining := count
+	for i := uint32(0); i < fs.groupCount && remaining > 0; i++ {
+		g := (goal + i) % fs.groupCount
+		if fs.groupFreeBlocks(g) == 0 {
+			continue
+		}
+		bm, err := fs.blockBitmap(g)
+		if err != nil {
+			return nil, err
+		}
+		first := fs.groupFirstBlock(g)
+		var taken uint64
+		for bit := uint64(0); bit < uint64(fs.blocksPerGroup()) && remaining > 0; bit++ {
+			if bitSet(bm.data, bit) {
+				continue
+			}
+			setBit(bm.data, bit)
+			taken++
+			remaining--
+			if n := len(out); n > 0 && out[n-1].start+out[n-1].length == first+bit {
+				out[n-1].length++
+			} else {
+				out = append(out, blockRun{start: first + bit, length: 1})
+			}
+		}
+		if taken > 0 {
+			bm.dirty = true
+			fs.clearGroupFlag(g, ext4BGBlockUninit)
+			fs.setDescField(g, 0xC, 0x2C, false, fs.groupFreeBlocks(g)-taken)
+			fs.addFreeBlocks(-int64(taken))
+		}
+	}
+
+	if remaining > 0 {
+		for _, r := range out {
+			fs.freeBlocks(r.start, r.length)
+		}
+		return nil, syscall.ENOSPC
+	}
+	return out, nil
+}
+
+// freeBlocks releases the given range of blocks.
+func (fs *Ext4FS) freeBlocks(start, count uint64) error {
+	for b := start; b < start+count; b++ {
+		g, bit := fs.groupOfBlock(b)
+		if g >= fs.groupCount {
+			return errors.New("attempted to free block beyond end of filesystem")
+		}
+		bm, err := fs.blockBitmap(g)
+		if err != nil {
+			return err
+		}
+		if !bitSet(bm.data, bit) {
+			continue
+		}
+		clearBit(bm.data, bit)
+		bm.dirty = true
+		fs.clearGroupFlag(g, ext4BGBlockUninit)
+		fs.setDescField(g, 0xC, 0x2C, false, fs.groupFreeBlocks(g)+1)
+		fs.addFreeBlocks(1)
+	}
+	return nil
+}
+
+// allocInode allocates an inode number, preferring the given group.
+func (fs *Ext4FS) allocInode(goal uint32, dir bool) (uint32, error) {
+	if goal >= fs.groupCount {
+		goal = 0
+	}
+	ipg := fs.inodesPerGroup()
+	for i := uint32(0); i < fs.groupCount; i++ {
+		g := (goal + i) % fs.groupCount
+		if fs.groupFreeInodes(g) == 0 {
+			continue
+		}
+		bm, err := fs.inodeBitmap(g)
+		if err != nil {
+			return 0, err
+		}
+		for idx := uint32(0); idx < ipg; idx++ {
+			num := g*ipg + idx + 1
+			if num < fs.firstInode() || bitSet(bm.data, uint64(idx)) {
+				continue
+			}
+			setBit(bm.data, uint64(idx))
+			bm.dirty = true
+			fs.clearGroupFlag(g, ext4BGInodeUninit)
+			fs.setDescField(g, 0xE, 0x2E, false, fs.groupFreeInodes(g)-1)
+			if dir {
+				fs.setDescField(g, 0x10, 0x30, false, fs.groupUsedDirs(g)+1)
+			}
+			if fs.metadataCsum() || fs.hasRoCompat(ext4RoCompatGdtCsum) {
+				if used := uint64(ipg) - fs.groupItableUnused(g); uint64(idx+1) > used {
+					fs.setDescField(g, 0x1C, 0x32, false, uint64(ipg-idx-1))
+				}
+			}
+			fs.addFreeInodes(-1)
+			return num, nil
+		}
+	}
+	return 0, syscall.ENOSPC
+}
+
+// freeInode releases the given inode number.
+func (fs *Ext4FS) freeInode(num uint32, dir bool) error {
+	g, idx := (num-1)/fs.inodesPerGroup(), (num-1)%fs.inodesPerGroup()
+	bm, err := fs.inodeBitmap(g)
+	if err != nil {
+		return err
+	}
+	if !bitSet(bm.data, uint64(idx)) {
+		return nil
+	}
+	clearBit(bm.data, uint64(idx))
+	bm.dirty = true
+	fs.setDescField(g, 0xE, 0x2E, false, fs.groupFreeInodes(g)+1)
+	if dir {
+		fs.setDescField(g, 0x10, 0x30, false, fs.groupUsedDirs(g)-1)
+	}
+	fs.addFreeInodes(1)
+	return nil
+}
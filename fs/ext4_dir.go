@@ -0,0 +1,355 @@
+package fs
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Directory entry file types.
+const (
+	ext4FtUnknown = 0
+	ext4FtRegFile = 1
+	ext4FtDir     = 2
+	ext4FtChrdev  = 3
+	ext4FtBlkdev  = 4
+	ext4FtFifo    = 5
+	ext4FtSock    = 6
+	ext4FtSymlink = 7
+
+	ext4DirTailSize = 12
+	ext4MaxSymlinks = 40
+)
+
+type ext4Dirent struct {
+	inode uint32
+	name  string
+	ftype uint8
+}
+
+func direntFileType(mode uint16) uint8 {
+	switch mode & sIFMT {
+	case sIFREG:
+		return ext4FtRegFile
+	case sIFDIR:
+		return ext4FtDir
+	case sIFCHR:
+		return ext4FtChrdev
+	case sIFBLK:
+		return ext4FtBlkdev
+	case sIFIFO:
+		return ext4FtFifo
+	case sIFSOCK:
+		return ext4FtSock
+	case sIFLNK:
+		return ext4FtSymlink
+	}
+	return ext4FtUnknown
+}
+
+// readDir returns all the live entries in the directory.
+func (fs *Ext4FS) readDir(dir *ext4Inode) ([]ext4Dirent, error) {
+	if !dir.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	if dir.flags()&ext4InlineFl != 0 {
+		return nil, syscall.EOPNOTSUPP
+	}
+	data, err := fs.readContents(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []ext4Dirent
+	for blk := uint64(0); blk*fs.blockSize < uint64(len(data)); blk++ {
+		b := data[blk*fs.blockSize : (blk+1)*fs.blockSize]
+		for off := 0; off+8 <= len(b); {
+			recLen := int(binary.LittleEndian.Uint16(b[off+4:]))
+			if recLen < 8 || off+recLen > len(b) {
+				break
+			}
+			ino := binary.LittleEndian.Uint32(b[off:])
+			nameLen, ftype := int(b[off+6]), b[off+7]
+			if !fs.hasIncompat(ext4IncompatFiletype) {
+				nameLen, ftype = int(binary.LittleEndian.Uint16(b[off+6:])), ext4FtUnknown
+			}
+			if ino != 0 && 8+nameLen <= recLen {
+				out = append(out, ext4Dirent{
+					inode: ino,
+					name:  string(b[off+8 : off+8+nameLen]),
+					ftype: ftype,
+				})
+			}
+			off += recLen
+		}
+	}
+	return out, nil
+}
+
+// writeDir replaces the contents of the directory with the given entries,
+// laid out linearly. Any hash-tree index is discarded, so lookups in large
+// directories written this way are linear scans.
+func (fs *Ext4FS) writeDir(dir *ext4Inode, ents []ext4Dirent) error {
+	capacity := int(fs.blockSize)
+	if fs.metadataCsum() {
+		capacity -= ext4DirTailSize
+	}
+
+	var (
+		out     []byte
+		block   = make([]byte, fs.blockSize)
+		off     int
+		lastOff = -1
+	)
+	finish := func() {
+		if lastOff < 0 {
+			binary.LittleEndian.PutUint16(block[4:], uint16(capacity))
+		} else {
+			binary.LittleEndian.PutUint16(block[lastOff+4:], uint16(capacity-lastOff))
+		}
+		if fs.metadataCsum() {
+			tail := block[capacity:]
+			binary.LittleEndian.PutUint16(tail[4:], ext4DirTailSize)
+			tail[7] = 0xDE
+			binary.LittleEndian.PutUint32(tail[8:], crc32c(fs.inodeSeed(dir), block[:capacity]))
+		}
+		out = append(out, block...)
+		block = make([]byte, fs.blockSize)
+		off, lastOff = 0, -1
+	}
+
+	for _, e := range ents {
+		recLen := (8 + len(e.name) + 3) &^ 3
+		if off+recLen > capacity {
+			finish()
+		}
+		binary.LittleEndian.PutUint32(block[off:], e.inode)
+		binary.LittleEndian.PutUint16(block[off+4:], uint16(recLen))
+		if fs.hasIncompat(ext4IncompatFiletype) {
+			block[off+6] = uint8(len(e.name))
+			block[off+7] = e.ftype
+		} else {
+			binary.LittleEndian.PutUint16(block[off+6:], uint16(len(e.name)))
+		}
+		copy(block[off+8:], e.name)
+		lastOff = off
+		off += recLen
+	}
+	finish()
+
+	dir.setFlags(dir.flags() &^ ext4IndexFl)
+	return fs.setContents(dir, out)
+}
+
+// appendDirent adds the entry to the slack at the end of the last block of
+// a linear directory, returning false if there is no room or the directory
+// is indexed. This avoids rewriting the whole directory for each entry
+// added to it.
+func (fs *Ext4FS) appendDirent(dir *ext4Inode, e ext4Dirent) (bool, error) {
+	size := dir.size()
+	if dir.flags()&(ext4IndexFl|ext4InlineFl) != 0 || size == 0 || size%fs.blockSize != 0 {
+		return false, nil
+	}
+	exts, _, err := fs.inodeExtents(dir)
+	if err != nil {
+		return false, err
+	}
+	last := uint32(size/fs.blockSize - 1)
+	var phys uint64
+	for _, ext := range exts {
+		if !ext.uninit && last >= ext.logical && last < ext.logical+ext.length {
+			phys = ext.physical + uint64(last-ext.logical)
+		}
+	}
+	if phys == 0 {
+		return false, nil
+	}
+	block, err := fs.readBlock(phys)
+	if err != nil {
+		return false, err
+	}
+
+	capacity := int(fs.blockSize)
+	if fs.metadataCsum() {
+		capacity -= ext4DirTailSize
+	}
+	// Find the final entry, which spans to the end of the block.
+	off := 0
+	for {
+		recLen := int(binary.LittleEndian.Uint16(block[off+4:]))
+		if recLen < 8 || off+recLen > capacity {
+			return false, nil
+		}
+		if off+recLen == capacity {
+			break
+		}
+		off += recLen
+	}
+	used := 0
+	if binary.LittleEndian.Uint32(block[off:]) != 0 {
+		nameLen := int(block[off+6])
+		if !fs.hasIncompat(ext4IncompatFiletype) {
+			nameLen = int(binary.LittleEndian.Uint16(block[off+6:]))
+		}
+		used = (8 + nameLen + 3) &^ 3
+	}
+	if capacity-off-used < (8+len(e.name)+3)&^3 {
+		return false, nil
+	}
+
+	if used > 0 {
+		binary.LittleEndian.PutUint16(block[off+4:], uint16(used))
+		off += used
+	}
+	binary.LittleEndian.PutUint32(block[off:], e.inode)
+	binary.LittleEndian.PutUint16(block[off+4:], uint16(capacity-off))
+	if fs.hasIncompat(ext4IncompatFiletype) {
+		block[off+6] = uint8(len(e.name))
+		block[off+7] = e.ftype
+	} else {
+		binary.LittleEndian.PutUint16(block[off+6:], uint16(len(e.name)))
+	}
+	copy(block[off+8:], e.name)
+	if fs.metadataCsum() {
+		binary.LittleEndian.PutUint32(block[capacity+8:], crc32c(fs.inodeSeed(dir), block[:capacity]))
+	}
+	return true, fs.writeBlock(phys, block)
+}
+
+// lookup finds the named entry within the directory.
+func (fs *Ext4FS) lookup(dir *ext4Inode, name string) (uint32, error) {
+	ents, err := fs.readDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range ents {
+		if e.name == name {
+			return e.inode, nil
+		}
+	}
+	return 0, syscall.ENOENT
+}
+
+func splitPath(p string) []string {
+	var out []string
+	for _, c := range strings.Split(p, "/") {
+		if c != "" && c != "." {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// resolve walks the given path, returning the inode it refers to. Symlinks
+// are followed (relative to the root of the filesystem), except in the final
+// path component when followLast is false.
+func (fs *Ext4FS) resolve(p string, followLast bool) (*ext4Inode, error) {
+	return fs.resolveFrom(ext4RootInode, p, followLast, 0)
+}
+
+func (fs *Ext4FS) resolveFrom(start uint32, p string, followLast bool, depth int) (*ext4Inode, error) {
+	if strings.HasPrefix(p, "/") {
+		start = ext4RootInode
+	}
+	cur, err := fs.readInode(start)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := splitPath(p)
+	for i, name := range parts {
+		if !cur.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		num, err := fs.lookup(cur, name)
+		if err != nil {
+			return nil, err
+		}
+		next, err := fs.readInode(num)
+		if err != nil {
+			return nil, err
+		}
+		if next.isSymlink() && (i < len(parts)-1 || followLast) {
+			if depth >= ext4MaxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			target, err := fs.readContents(next)
+			if err != nil {
+				return nil, err
+			}
+			if next, err = fs.resolveFrom(cur.num, string(target), true, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// resolveParent returns the directory containing the final component of
+// the path, along with the name of that component.
+func (fs *Ext4FS) resolveParent(p string) (*ext4Inode, string, error) {
+	parts := splitPath(p)
+	if len(parts) == 0 {
+		return nil, "", syscall.EEXIST
+	}
+	name := parts[len(parts)-1]
+	if name == ".." {
+		return nil, "", syscall.EINVAL
+	}
+	dir, err := fs.resolve(path.Join(parts[:len(parts)-1]...), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.isDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return dir, name, nil
+}
+
+// link adds an entry for the inode to the directory.
+func (fs *Ext4FS) link(dir *ext4Inode, name string, ino *ext4Inode) error {
+	if len(name) > 255 {
+		return syscall.ENAMETOOLONG
+	}
+	ents, err := fs.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		if e.name == name {
+			return syscall.EEXIST
+		}
+	}
+	ent := ext4Dirent{inode: ino.num, name: name, ftype: direntFileType(ino.mode())}
+	appended, err := fs.appendDirent(dir, ent)
+	if err != nil {
+		return err
+	}
+	if !appended {
+		if err := fs.writeDir(dir, append(ents, ent)); err != nil {
+			return err
+		}
+	}
+	dir.touch(false)
+	return fs.writeInode(dir)
+}
+
+// unlink removes the named entry from the directory.
+func (fs *Ext4FS) unlink(dir *ext4Inode, name string) error {
+	ents, err := fs.readDir(dir)
+	if err != nil {
+		return err
+	}
+	for i, e := range ents {
+		if e.name == name {
+			if err := fs.writeDir(dir, append(ents[:i], ents[i+1:]...)); err != nil {
+				return err
+			}
+			dir.touch(false)
+			return fs.writeInode(dir)
+		}
+	}
+	return syscall.ENOENT
+}
@@ -0,0 +1,352 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	ext4ExtentMagic     = 0xF30A
+	ext4MaxExtentLen    = 32768
+	ext4MaxExtentDepth  = 5
+	ext4DirectBlocks    = 12
+	ext4IndirectBlock   = 12
+	ext4ExtentEntrySize = 12
+)
+
+// ext4Extent maps a range of logical file blocks to physical blocks.
+type ext4Extent struct {
+	logical  uint32
+	physical uint64
+	length   uint32
+	uninit   bool
+}
+
+func writeExtentHeader(b []byte, entries, max, depth uint16) {
+	binary.LittleEndian.PutUint16(b[0:], ext4ExtentMagic)
+	binary.LittleEndian.PutUint16(b[2:], entries)
+	binary.LittleEndian.PutUint16(b[4:], max)
+	binary.LittleEndian.PutUint16(b[6:], depth)
+	binary.LittleEndian.PutUint32(b[8:], 0)
+}
+
+// inodeExtents returns the block mapping of the inode, along with any
+// blocks used to store the mapping itself.
+func (fs *Ext4FS) inodeExtents(ino *ext4Inode) ([]ext4Extent, []uint64, error) {
+	switch {
+	case ino.flags()&ext4InlineFl != 0:
+		return nil, nil, errors.New("inline data is not supported")
+	case ino.isFastSymlink(fs.blockSize):
+		return nil, nil, nil
+	case ino.flags()&ext4ExtentsFl != 0:
+		var exts []ext4Extent
+		var meta []uint64
+		if err := fs.walkExtentNode(ino.blockArea(), ext4MaxExtentDepth, &exts, &meta); err != nil {
+			return nil, nil, fmt.Errorf("inode %d: %v", ino.num, err)
+		}
+		return exts, meta, nil
+	}
+
+	// Legacy block map.
+	var exts []ext4Extent
+	var meta []uint64
+	nBlocks := (ino.size() + fs.blockSize - 1) / fs.blockSize
+	logical := uint64(0)
+	add := func(phys uint64) {
+		defer func() { logical++ }()
+		if phys == 0 {
+			return
+		}
+		if n := len(exts); n > 0 {
+			last := &exts[n-1]
+			if uint64(last.logical)+uint64(last.length) == logical && last.physical+uint64(last.length) == phys && last.length < ext4MaxExtentLen {
+				last.length++
+				return
+			}
+		}
+		exts = append(exts, ext4Extent{logical: uint32(logical), physical: phys, length: 1})
+	}
+	var walk func(block uint64, level int) error
+	walk = func(block uint64, level int) error {
+		perBlock := fs.blockSize / 4
+		if block == 0 {
+			span := uint64(1)
+			for i := 0; i < level; i++ {
+				span *= perBlock
+			}
+			logical += span
+			return nil
+		}
+		meta = append(meta, block)
+		b, err := fs.readBlock(block)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < perBlock && logical < nBlocks; i++ {
+			ptr := uint64(binary.LittleEndian.Uint32(b[i*4:]))
+			if level == 1 {
+				add(ptr)
+				continue
+			}
+			if err := walk(ptr, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	area := ino.blockArea()
+	for i := 0; i < ext4DirectBlocks && logical < nBlocks; i++ {
+		add(uint64(binary.LittleEndian.Uint32(area[i*4:])))
+	}
+	for i, level := range []int{1, 2, 3} {
+		if logical >= nBlocks {
+			break
+		}
+		if err := walk(uint64(binary.LittleEndian.Uint32(area[(ext4IndirectBlock+i)*4:])), level); err != nil {
+			return nil, nil, err
+		}
+	}
+	return exts, meta, nil
+}
+
+func (fs *Ext4FS) walkExtentNode(b []byte, maxDepth int, exts *[]ext4Extent, meta *[]uint64) error {
+	if binary.LittleEndian.Uint16(b[0:]) != ext4ExtentMagic {
+		return errors.New("bad extent header magic")
+	}
+	entries := int(binary.LittleEndian.Uint16(b[2:]))
+	depth := int(binary.LittleEndian.Uint16(b[6:]))
+	if depth > maxDepth {
+		return errors.New("extent tree too deep")
+	}
+	if 12+entries*ext4ExtentEntrySize > len(b) {
+		return errors.New("extent node overflows its block")
+	}
+
+	for i := 0; i < entries; i++ {
+		e := b[12+i*ext4ExtentEntrySize:]
+		if depth == 0 {
+			ext := ext4Extent{
+				logical:  binary.LittleEndian.Uint32(e[0:]),
+				length:   uint32(binary.LittleEndian.Uint16(e[4:])),
+				physical: uint64(binary.LittleEndian.Uint16(e[6:]))<<32 | uint64(binary.LittleEndian.Uint32(e[8:])),
+			}
+			if ext.length > ext4MaxExtentLen {
+				ext.length -= ext4MaxExtentLen
+				ext.uninit = true
+			}
+			*exts = append(*exts, ext)
+			continue
+		}
+
+		child := uint64(binary.LittleEndian.Uint16(e[8:]))<<32 | uint64(binary.LittleEndian.Uint32(e[4:]))
+		*meta = append(*meta, child)
+		cb, err := fs.readBlock(child)
+		if err != nil {
+			return err
+		}
+		if err := fs.walkExtentNode(cb, depth-1, exts, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExtentTree stores the given extents as the block mapping of the
+// inode, allocating index & leaf blocks as needed. The number of blocks
+// allocated to hold the tree is returned.
+func (fs *Ext4FS) writeExtentTree(ino *ext4Inode, exts []ext4Extent) (uint64, error) {
+	type entry struct {
+		logical uint32
+		raw     [ext4ExtentEntrySize]byte
+	}
+
+	entries := make([]entry, len(exts))
+	for i, ext := range exts {
+		e := &entries[i]
+		e.logical = ext.logical
+		length := uint16(ext.length)
+		if ext.uninit {
+			length += ext4MaxExtentLen
+		}
+		binary.LittleEndian.PutUint32(e.raw[0:], ext.logical)
+		binary.LittleEndian.PutUint16(e.raw[4:], length)
+		binary.LittleEndian.PutUint16(e.raw[6:], uint16(ext.physical>>32))
+		binary.LittleEndian.PutUint32(e.raw[8:], uint32(ext.physical))
+	}
+
+	var (
+		metaBlocks uint64
+		depth      uint16
+		perBlock   = (fs.blockSize - 12) / ext4ExtentEntrySize
+	)
+	for len(entries) > 4 {
+		nodes := (uint64(len(entries)) + perBlock - 1) / perBlock
+		runs, err := fs.allocBlocks(fs.inodeGroup(ino.num), nodes)
+		if err != nil {
+			return metaBlocks, err
+		}
+		var blocks []uint64
+		for _, r := range runs {
+			for b := r.start; b < r.start+r.length; b++ {
+				blocks = append(blocks, b)
+			}
+		}
+
+		var next []entry
+		for n, blk := range blocks {
+			chunk := entries[uint64(n)*perBlock:]
+			if uint64(len(chunk)) > perBlock {
+				chunk = chunk[:perBlock]
+			}
+			b := make([]byte, fs.blockSize)
+			writeExtentHeader(b, uint16(len(chunk)), uint16(perBlock), depth)
+			for i, e := range chunk {
+				copy(b[12+i*ext4ExtentEntrySize:], e.raw[:])
+			}
+			if fs.metadataCsum() {
+				tail := 12 + perBlock*ext4ExtentEntrySize
+				binary.LittleEndian.PutUint32(b[tail:], crc32c(fs.inodeSeed(ino), b[:tail]))
+			}
+			if err := fs.writeBlock(blk, b); err != nil {
+				return metaBlocks, err
+			}
+			metaBlocks++
+
+			idx := entry{logical: chunk[0].logical}
+			binary.LittleEndian.PutUint32(idx.raw[0:], chunk[0].logical)
+			binary.LittleEndian.PutUint32(idx.raw[4:], uint32(blk))
+			binary.LittleEndian.PutUint16(idx.raw[8:], uint16(blk>>32))
+			next = append(next, idx)
+		}
+		entries = next
+		depth++
+	}
+
+	area := ino.blockArea()
+	for i := range area {
+		area[i] = 0
+	}
+	writeExtentHeader(area, uint16(len(entries)), 4, depth)
+	for i, e := range entries {
+		copy(area[12+i*ext4ExtentEntrySize:], e.raw[:])
+	}
+	ino.setFlags(ino.flags() | ext4ExtentsFl)
+	return metaBlocks, nil
+}
+
+// truncate releases all data blocks owned by the inode.
+func (fs *Ext4FS) truncate(ino *ext4Inode) error {
+	if ino.isFastSymlink(fs.blockSize) {
+		return nil
+	}
+	exts, meta, err := fs.inodeExtents(ino)
+	if err != nil {
+		return err
+	}
+	for _, e := range exts {
+		if err := fs.freeBlocks(e.physical, uint64(e.length)); err != nil {
+			return err
+		}
+	}
+	for _, b := range meta {
+		if err := fs.freeBlocks(b, 1); err != nil {
+			return err
+		}
+	}
+	if _, err := fs.writeExtentTree(ino, nil); err != nil {
+		return err
+	}
+	ino.setSize(0)
+	ino.setSectors(fs.xattrSectors(ino))
+	return nil
+}
+
+func (fs *Ext4FS) xattrSectors(ino *ext4Inode) uint64 {
+	if ino.fileACL() != 0 {
+		return fs.blockSize / sectorSize
+	}
+	return 0
+}
+
+// setContents replaces the data stored in the inode.
+func (fs *Ext4FS) setContents(ino *ext4Inode, data []byte) error {
+	if err := fs.truncate(ino); err != nil {
+		return err
+	}
+
+	nBlocks := (uint64(len(data)) + fs.blockSize - 1) / fs.blockSize
+	runs, err := fs.allocBlocks(fs.inodeGroup(ino.num), nBlocks)
+	if err != nil {
+		return err
+	}
+
+	var (
+		exts    []ext4Extent
+		logical uint64
+	)
+	for _, r := range runs {
+		chunk := make([]byte, r.length*fs.blockSize)
+		copy(chunk, data[logical*fs.blockSize:])
+		if _, err := fs.f.WriteAt(chunk, fs.blockOffset(r.start)); err != nil {
+			return fmt.Errorf("writing data: %v", err)
+		}
+		for off := uint64(0); off < r.length; off += ext4MaxExtentLen {
+			l := r.length - off
+			if l > ext4MaxExtentLen {
+				l = ext4MaxExtentLen
+			}
+			exts = append(exts, ext4Extent{
+				logical:  uint32(logical + off),
+				physical: r.start + off,
+				length:   uint32(l),
+			})
+		}
+		logical += r.length
+	}
+
+	metaBlocks, err := fs.writeExtentTree(ino, exts)
+	if err != nil {
+		return err
+	}
+	ino.setSize(uint64(len(data)))
+	ino.setSectors((nBlocks+metaBlocks)*(fs.blockSize/sectorSize) + fs.xattrSectors(ino))
+	return nil
+}
+
+// readContents returns the data stored in the inode.
+func (fs *Ext4FS) readContents(ino *ext4Inode) ([]byte, error) {
+	size := ino.size()
+	if ino.isFastSymlink(fs.blockSize) || ino.flags()&ext4InlineFl != 0 {
+		if size > 60 {
+			return nil, errors.New("inline data stored in extended attributes is not supported")
+		}
+		out := make([]byte, size)
+		copy(out, ino.blockArea())
+		return out, nil
+	}
+
+	exts, _, err := fs.inodeExtents(ino)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	for _, e := range exts {
+		if e.uninit {
+			continue
+		}
+		start := uint64(e.logical) * fs.blockSize
+		if start >= size {
+			continue
+		}
+		end := start + uint64(e.length)*fs.blockSize
+		if end > size {
+			end = size
+		}
+		if _, err := fs.f.ReadAt(out[start:end], fs.blockOffset(e.physical)); err != nil {
+			return nil, fmt.Errorf("reading data: %v", err)
+		}
+	}
+	return out, nil
+}
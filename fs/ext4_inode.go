@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Inode flags.
+const (
+	ext4IndexFl    = 0x1000
+	ext4HugeFileFl = 0x40000
+	ext4ExtentsFl  = 0x80000
+	ext4InlineFl   = 0x10000000
+)
+
+// Unix file type bits, as stored in i_mode.
+const (
+	sIFMT   = 0xF000
+	sIFSOCK = 0xC000
+	sIFLNK  = 0xA000
+	sIFREG  = 0x8000
+	sIFBLK  = 0x6000
+	sIFDIR  = 0x4000
+	sIFCHR  = 0x2000
+	sIFIFO  = 0x1000
+)
+
+// ext4Inode is an in-memory copy of an on-disk inode.
+type ext4Inode struct {
+	num uint32
+	raw []byte
+}
+
+func (i *ext4Inode) u16(off int) uint16 { return binary.LittleEndian.Uint16(i.raw[off:]) }
+func (i *ext4Inode) u32(off int) uint32 { return binary.LittleEndian.Uint32(i.raw[off:]) }
+func (i *ext4Inode) put16(off int, v uint16) {
+	binary.LittleEndian.PutUint16(i.raw[off:], v)
+}
+func (i *ext4Inode) put32(off int, v uint32) {
+	binary.LittleEndian.PutUint32(i.raw[off:], v)
+}
+
+func (i *ext4Inode) mode() uint16       { return i.u16(0x0) }
+func (i *ext4Inode) setMode(m uint16)   { i.put16(0x0, m) }
+func (i *ext4Inode) isDir() bool        { return i.mode()&sIFMT == sIFDIR }
+func (i *ext4Inode) isSymlink() bool    { return i.mode()&sIFMT == sIFLNK }
+func (i *ext4Inode) links() uint16      { return i.u16(0x1A) }
+func (i *ext4Inode) setLinks(n uint16)  { i.put16(0x1A, n) }
+func (i *ext4Inode) flags() uint32      { return i.u32(0x20) }
+func (i *ext4Inode) setFlags(f uint32)  { i.put32(0x20, f) }
+func (i *ext4Inode) generation() uint32 { return i.u32(0x64) }
+func (i *ext4Inode) blockArea() []byte  { return i.raw[0x28:0x64] }
+func (i *ext4Inode) uid() uint32        { return uint32(i.u16(0x2)) | uint32(i.u16(0x78))<<16 }
+func (i *ext4Inode) gid() uint32        { return uint32(i.u16(0x18)) | uint32(i.u16(0x7A))<<16 }
+func (i *ext4Inode) extraIsize() uint16 {
+	if len(i.raw) <= 128 {
+		return 0
+	}
+	return i.u16(0x80)
+}
+
+func (i *ext4Inode) setOwner(uid, gid uint32) {
+	i.put16(0x2, uint16(uid))
+	i.put16(0x78, uint16(uid>>16))
+	i.put16(0x18, uint16(gid))
+	i.put16(0x7A, uint16(gid>>16))
+}
+
+func (i *ext4Inode) size() uint64 {
+	return uint64(i.u32(0x4)) | uint64(i.u32(0x6C))<<32
+}
+
+func (i *ext4Inode) setSize(sz uint64) {
+	i.put32(0x4, uint32(sz))
+	i.put32(0x6C, uint32(sz>>32))
+}
+
+func (i *ext4Inode) fileACL() uint64 {
+	return uint64(i.u32(0x68)) | uint64(i.u16(0x76))<<32
+}
+
+// sectors returns the number of 512-byte sectors accounted to the inode.
+func (i *ext4Inode) sectors(blockSize uint64) uint64 {
+	n := uint64(i.u32(0x1C)) | uint64(i.u16(0x74))<<32
+	if i.flags()&ext4HugeFileFl != 0 {
+		n *= blockSize / sectorSize
+	}
+	return n
+}
+
+func (i *ext4Inode) setSectors(n uint64) {
+	i.setFlags(i.flags() &^ ext4HugeFileFl)
+	i.put32(0x1C, uint32(n))
+	i.put16(0x74, uint16(n>>32))
+}
+
+func (i *ext4Inode) mtime() time.Time {
+	sec := int64(int32(i.u32(0x10)))
+	var nsec int64
+	if i.extraIsize() >= 0x8C-0x80 {
+		extra := i.u32(0x88)
+		sec += int64(extra&3) << 32
+		nsec = int64(extra >> 2)
+	}
+	return time.Unix(sec, nsec)
+}
+
+// touch updates the timestamps in the inode. The access & creation
+// times are additionally set if create is true.
+func (i *ext4Inode) touch(create bool) {
+	now := time.Now()
+	sec, extra := uint32(now.Unix()), uint32(now.Unix()>>32)&3|uint32(now.Nanosecond())<<2
+	offsets := [][2]int{{0xC, 0x84}, {0x10, 0x88}}
+	if create {
+		offsets = append(offsets, [2]int{0x8, 0x8C}, [2]int{0x90, 0x94})
+	}
+	for _, o := range offsets {
+		if o[0] >= 0x80 && int(i.extraIsize()) < o[0]+4-0x80 {
+			continue
+		}
+		i.put32(o[0], sec)
+		if int(i.extraIsize()) >= o[1]+4-0x80 {
+			i.put32(o[1], extra)
+		}
+	}
+}
+
+// isFastSymlink returns true if the inode is a symlink with its target
+// stored inline in the block area.
+func (i *ext4Inode) isFastSymlink(blockSize uint64) bool {
+	if !i.isSymlink() || i.flags()&ext4InlineFl != 0 {
+		return false
+	}
+	aclSectors := uint64(0)
+	if i.fileACL() != 0 {
+		aclSectors = blockSize / sectorSize
+	}
+	return i.size() < 60 && i.sectors(blockSize) == aclSectors
+}
+
+func (fs *Ext4FS) inodeGroup(num uint32) uint32 {
+	return (num - 1) / fs.inodesPerGroup()
+}
+
+func (fs *Ext4FS) inodeOffset(num uint32) int64 {
+	g, idx := fs.inodeGroup(num), (num-1)%fs.inodesPerGroup()
+	return fs.blockOffset(fs.groupInodeTable(g)) + int64(uint64(idx)*fs.inodeSize())
+}
+
+func (fs *Ext4FS) readInode(num uint32) (*ext4Inode, error) {
+	if num == 0 || num > fs.inodesCount() {
+		return nil, fmt.Errorf("inode %d out of range", num)
+	}
+	ino := &ext4Inode{num: num, raw: make([]byte, fs.inodeSize())}
+	if _, err := fs.f.ReadAt(ino.raw, fs.inodeOffset(num)); err != nil {
+		return nil, fmt.Errorf("reading inode %d: %v", num, err)
+	}
+	if fs.metadataCsum() {
+		want := fs.inodeChecksum(ino)
+		got := uint32(ino.u16(0x7C))
+		if ino.hasChecksumHi() {
+			got |= uint32(ino.u16(0x82)) << 16
+		} else {
+			want &= 0xFFFF
+		}
+		if got != want {
+			return nil, fmt.Errorf("inode %d checksum mismatch", num)
+		}
+	}
+	return ino, nil
+}
+
+func (fs *Ext4FS) writeInode(ino *ext4Inode) error {
+	if !fs.writable {
+		return errors.New("filesystem is read-only")
+	}
+	if fs.metadataCsum() {
+		c := fs.inodeChecksum(ino)
+		ino.put16(0x7C, uint16(c))
+		if ino.hasChecksumHi() {
+			ino.put16(0x82, uint16(c>>16))
+		}
+	}
+	if _, err := fs.f.WriteAt(ino.raw, fs.inodeOffset(ino.num)); err != nil {
+		return fmt.Errorf("writing inode %d: %v", ino.num, err)
+	}
+	return nil
+}
+
+func (i *ext4Inode) hasChecksumHi() bool {
+	return i.extraIsize() >= 0x84-0x80
+}
+
+// inodeSeed returns the checksum seed for metadata blocks owned by the inode.
+func (fs *Ext4FS) inodeSeed(ino *ext4Inode) uint32 {
+	var le [4]byte
+	binary.LittleEndian.PutUint32(le[:], ino.num)
+	c := crc32c(fs.csumSeed, le[:])
+	binary.LittleEndian.PutUint32(le[:], ino.generation())
+	return crc32c(c, le[:])
+}
+
+func (fs *Ext4FS) inodeChecksum(ino *ext4Inode) uint32 {
+	raw := make([]byte, len(ino.raw))
+	copy(raw, ino.raw)
+	raw[0x7C], raw[0x7D] = 0, 0
+	if ino.hasChecksumHi() {
+		raw[0x82], raw[0x83] = 0, 0
+	}
+	return crc32c(fs.inodeSeed(ino), raw)
+}
+
+// newInode allocates and initializes a new inode with the given mode.
+func (fs *Ext4FS) newInode(goal uint32, mode uint16) (*ext4Inode, error) {
+	num, err := fs.allocInode(goal, mode&sIFMT == sIFDIR)
+	if err != nil {
+		return nil, err
+	}
+	ino := &ext4Inode{num: num, raw: make([]byte, fs.inodeSize())}
+	ino.setMode(mode)
+	ino.put32(0x64, rand.Uint32())
+	if len(ino.raw) > 128 {
+		extra := binary.LittleEndian.Uint16(fs.sb[0x15E:])
+		if extra < 32 {
+			extra = 32
+		}
+		if uint64(extra)+128 > fs.inodeSize() {
+			extra = uint16(fs.inodeSize() - 128)
+		}
+		ino.put16(0x80, extra)
+	}
+	ino.touch(true)
+	if mode&sIFMT != sIFLNK {
+		ino.setFlags(ext4ExtentsFl)
+		writeExtentHeader(ino.blockArea(), 0, 4, 0)
+	}
+	return ino, nil
+}
+
+// releaseInode frees the inode along with any blocks it owns.
+func (fs *Ext4FS) releaseInode(ino *ext4Inode) error {
+	if err := fs.truncate(ino); err != nil {
+		return err
+	}
+	if acl := ino.fileACL(); acl != 0 {
+		if err := fs.releaseXattrBlock(acl); err != nil {
+			return err
+		}
+	}
+	ino.setLinks(0)
+	ino.put32(0x14, uint32(time.Now().Unix()))
+	if err := fs.writeInode(ino); err != nil {
+		return err
+	}
+	return fs.freeInode(ino.num, ino.isDir())
+}
+
+// releaseXattrBlock drops a reference to a shared extended attribute block,
+// freeing it if no references remain.
+func (fs *Ext4FS) releaseXattrBlock(block uint64) error {
+	b, err := fs.readBlock(block)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b) != 0xEA020000 {
+		return fmt.Errorf("bad xattr block magic at block %d", block)
+	}
+	refs := binary.LittleEndian.Uint32(b[4:])
+	if refs <= 1 {
+		return fs.freeBlocks(block, 1)
+	}
+	binary.LittleEndian.PutUint32(b[4:], refs-1)
+	if fs.metadataCsum() {
+		var le [8]byte
+		binary.LittleEndian.PutUint64(le[:], block)
+		binary.LittleEndian.PutUint32(b[0x10:], 0)
+		binary.LittleEndian.PutUint32(b[0x10:], crc32c(crc32c(fs.csumSeed, le[:]), b))
+	}
+	return fs.writeBlock(block, b)
+}
@@ -0,0 +1,332 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"syscall"
+)
+
+func pathErr(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func (fs *Ext4FS) fileInfo(name string, ino *ext4Inode) os.FileInfo {
+	return &fileInfo{
+		name:    path.Base("/" + name),
+		size:    int64(ino.size()),
+		mode:    fileModeFromUnix(uint32(ino.mode())),
+		modTime: ino.mtime(),
+		stat: &FileStat{
+			Inode: uint64(ino.num),
+			Mode:  uint32(ino.mode()),
+			Uid:   ino.uid(),
+			Gid:   ino.gid(),
+			Nlink: uint32(ino.links()),
+		},
+	}
+}
+
+// Cat implements interpreter.FS.
+func (fs *Ext4FS) Cat(p string) ([]byte, error) {
+	ino, err := fs.resolve(p, true)
+	if err != nil {
+		return nil, pathErr("open", p, err)
+	}
+	if ino.isDir() {
+		return nil, pathErr("read", p, syscall.EISDIR)
+	}
+	d, err := fs.readContents(ino)
+	return d, pathErr("read", p, err)
+}
+
+// Stat implements interpreter.FS.
+func (fs *Ext4FS) Stat(p string) (os.FileInfo, error) {
+	ino, err := fs.resolve(p, true)
+	if err != nil {
+		return nil, pathErr("stat", p, err)
+	}
+	return fs.fileInfo(p, ino), nil
+}
+
+// LStat implements interpreter.FS.
+func (fs *Ext4FS) LStat(p string) (os.FileInfo, error) {
+	ino, err := fs.resolve(p, false)
+	if err != nil {
+		return nil, pathErr("lstat", p, err)
+	}
+	return fs.fileInfo(p, ino), nil
+}
+
+// create makes a new inode with the given mode, and links it into the
+// directory containing p.
+func (fs *Ext4FS) create(p string, mode uint16) (*ext4Inode, *ext4Inode, error) {
+	if !fs.writable {
+		return nil, nil, syscall.EROFS
+	}
+	dir, name, err := fs.resolveParent(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := fs.lookup(dir, name); err == nil {
+		return nil, nil, syscall.EEXIST
+	}
+
+	ino, err := fs.newInode(fs.inodeGroup(dir.num), mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	ino.setLinks(1)
+	if err := fs.writeInode(ino); err != nil {
+		return nil, nil, err
+	}
+	if err := fs.link(dir, name, ino); err != nil {
+		fs.freeInode(ino.num, ino.isDir())
+		return nil, nil, err
+	}
+	return dir, ino, nil
+}
+
+// Symlink implements interpreter.FS.
+func (fs *Ext4FS) Symlink(at, to string) error {
+	_, ino, err := fs.create(at, sIFLNK|0777)
+	if err != nil {
+		return pathErr("symlink", at, err)
+	}
+	if len(to) < 60 {
+		copy(ino.blockArea(), to)
+		ino.setSize(uint64(len(to)))
+	} else if err := fs.setContents(ino, []byte(to)); err != nil {
+		return pathErr("symlink", at, err)
+	}
+	if err := fs.writeInode(ino); err != nil {
+		return pathErr("symlink", at, err)
+	}
+	return pathErr("symlink", at, fs.flush())
+}
+
+// Mkdir implements interpreter.FS.
+func (fs *Ext4FS) Mkdir(at string) error {
+	dir, ino, err := fs.create(at, sIFDIR|0755)
+	if err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	ino.setLinks(2)
+	if err := fs.writeDir(ino, []ext4Dirent{
+		{inode: ino.num, name: ".", ftype: ext4FtDir},
+		{inode: dir.num, name: "..", ftype: ext4FtDir},
+	}); err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	if err := fs.writeInode(ino); err != nil {
+		return pathErr("mkdir", at, err)
+	}
+
+	switch l := dir.links(); {
+	case l >= 65000 && fs.hasRoCompat(ext4RoCompatDirNlink):
+		dir.setLinks(1)
+	case l > 1:
+		dir.setLinks(l + 1)
+	}
+	if err := fs.writeInode(dir); err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	return pathErr("mkdir", at, fs.flush())
+}
+
+// Write implements interpreter.FS.
+func (fs *Ext4FS) Write(p string, data []byte, perms os.FileMode) error {
+	if !fs.writable {
+		return pathErr("open", p, syscall.EROFS)
+	}
+	ino, err := fs.resolve(p, true)
+	switch {
+	case err == syscall.ENOENT:
+		if _, ino, err = fs.create(p, sIFREG|unixPerm(perms)); err != nil {
+			return pathErr("open", p, err)
+		}
+	case err != nil:
+		return pathErr("open", p, err)
+	case ino.isDir():
+		return pathErr("open", p, syscall.EISDIR)
+	}
+
+	if err := fs.setContents(ino, data); err != nil {
+		return pathErr("write", p, err)
+	}
+	ino.touch(false)
+	if err := fs.writeInode(ino); err != nil {
+		return pathErr("write", p, err)
+	}
+	return pathErr("write", p, fs.flush())
+}
+
+// Remove implements interpreter.FS.
+func (fs *Ext4FS) Remove(p string) error {
+	if !fs.writable {
+		return pathErr("remove", p, syscall.EROFS)
+	}
+	dir, name, err := fs.resolveParent(p)
+	if err != nil {
+		return pathErr("remove", p, err)
+	}
+	if name == "." {
+		return pathErr("remove", p, syscall.EINVAL)
+	}
+	num, err := fs.lookup(dir, name)
+	if err != nil {
+		return pathErr("remove", p, err)
+	}
+	ino, err := fs.readInode(num)
+	if err != nil {
+		return pathErr("remove", p, err)
+	}
+
+	if ino.isDir() {
+		ents, err := fs.readDir(ino)
+		if err != nil {
+			return pathErr("remove", p, err)
+		}
+		for _, e := range ents {
+			if e.name != "." && e.name != ".." {
+				return pathErr("remove", p, syscall.ENOTEMPTY)
+			}
+		}
+	}
+
+	if err := fs.unlink(dir, name); err != nil {
+		return pathErr("remove", p, err)
+	}
+	if ino.isDir() {
+		if l := dir.links(); l > 2 {
+			dir.setLinks(l - 1)
+			if err := fs.writeInode(dir); err != nil {
+				return pathErr("remove", p, err)
+			}
+		}
+		if err := fs.releaseInode(ino); err != nil {
+			return pathErr("remove", p, err)
+		}
+		return pathErr("remove", p, fs.flush())
+	}
+
+	if l := ino.links(); l > 1 {
+		ino.setLinks(l - 1)
+		ino.touch(false)
+		if err := fs.writeInode(ino); err != nil {
+			return pathErr("remove", p, err)
+		}
+		return pathErr("remove", p, fs.flush())
+	}
+	if err := fs.releaseInode(ino); err != nil {
+		return pathErr("remove", p, err)
+	}
+	return pathErr("remove", p, fs.flush())
+}
+
+// RemoveAll implements interpreter.FS.
+func (fs *Ext4FS) RemoveAll(p string) error {
+	ino, err := fs.resolve(p, false)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return pathErr("removeall", p, err)
+	}
+	if ino.isDir() {
+		ents, err := fs.readDir(ino)
+		if err != nil {
+			return pathErr("removeall", p, err)
+		}
+		for _, e := range ents {
+			if e.name == "." || e.name == ".." {
+				continue
+			}
+			if err := fs.RemoveAll(path.Join(p, e.name)); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(p)
+}
+
+// Chmod implements interpreter.FS.
+func (fs *Ext4FS) Chmod(p string, mode os.FileMode) error {
+	if !fs.writable {
+		return pathErr("chmod", p, syscall.EROFS)
+	}
+	ino, err := fs.resolve(p, true)
+	if err != nil {
+		return pathErr("chmod", p, err)
+	}
+	ino.setMode(ino.mode()&sIFMT | unixPerm(mode))
+	ino.touch(false)
+	return pathErr("chmod", p, fs.writeInode(ino))
+}
+
+// Chown implements interpreter.FS.
+func (fs *Ext4FS) Chown(p string, uid, gid int) error {
+	if !fs.writable {
+		return pathErr("chown", p, syscall.EROFS)
+	}
+	ino, err := fs.resolve(p, true)
+	if err != nil {
+		return pathErr("chown", p, err)
+	}
+	ino.setOwner(uint32(uid), uint32(gid))
+	ino.touch(false)
+	return pathErr("chown", p, fs.writeInode(ino))
+}
+
+// CopyInto implements interpreter.FS.
+func (fs *Ext4FS) CopyInto(sysPath, p string) error {
+	return copyInto(fs, sysPath, p)
+}
+
+// ReadDir returns the entries of the directory at p, sorted by name. The
+// '.' and '..' entries are omitted.
+func (fs *Ext4FS) ReadDir(p string) ([]os.FileInfo, error) {
+	dir, err := fs.resolve(p, true)
+	if err != nil {
+		return nil, pathErr("open", p, err)
+	}
+	ents, err := fs.readDir(dir)
+	if err != nil {
+		return nil, pathErr("readdirent", p, err)
+	}
+	var out []os.FileInfo
+	for _, e := range ents {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		ino, err := fs.readInode(e.inode)
+		if err != nil {
+			return nil, pathErr("readdirent", p, err)
+		}
+		out = append(out, fs.fileInfo(e.name, ino))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// Readlink implements interpreter.FS.
+func (fs *Ext4FS) Readlink(p string) (string, error) {
+	ino, err := fs.resolve(p, false)
+	if err != nil {
+		return "", pathErr("readlink", p, err)
+	}
+	if !ino.isSymlink() {
+		return "", pathErr("readlink", p, syscall.EINVAL)
+	}
+	d, err := fs.readContents(ino)
+	if err != nil {
+		return "", pathErr("readlink", p, err)
+	}
+	return string(d), nil
+}
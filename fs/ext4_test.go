@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const testPartOffset = 1024 * 1024
+
+// makeExt4Image creates an image containing an ext4 filesystem at
+// testPartOffset, populated from the given directory.
+func makeExt4Image(t *testing.T, populate string, extraArgs ...string) string {
+	t.Helper()
+	return makeExt4ImageBlocks(t, populate, 65536, extraArgs...)
+}
+
+// makeExt4ImageBlocks is like makeExt4Image, but the filesystem is the
+// given number of 4k blocks long.
+func makeExt4ImageBlocks(t *testing.T, populate string, blocks int, extraArgs ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, testPartOffset+64*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"-q", "-F", "-b", "4096", "-E", fmt.Sprintf("offset=%d", testPartOffset)}, extraArgs...)
+	if populate != "" {
+		args = append(args, "-d", populate)
+	}
+	args = append(args, img, fmt.Sprint(blocks))
+	if out, err := exec.Command("mkfs.ext4", args...).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+	return img
+}
+
+func fsckExt4(t *testing.T, img string) {
+	t.Helper()
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		return
+	}
+	if out, err := exec.Command("e2fsck", "-fn", fmt.Sprintf("%s?offset=%d", img, testPartOffset)).CombinedOutput(); err != nil {
+		t.Errorf("e2fsck reported problems: %v\n%s", err, out)
+	}
+}
+
+func TestExt4ConsistentBeforeClose(t *testing.T) {
+	img := makeExt4Image(t, "")
+	fs, err := OpenExt4(img, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+	defer fs.Close()
+
+	if err := fs.Mkdir("/units"); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+	dir, err := fs.resolve("/units", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := fs.Write(fmt.Sprintf("/units/unit-%d.service", i), []byte("[Unit]\n"), 0644); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := fs.Remove("/units/unit-10.service"); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+
+	// Entries which fit in the last block are added in place, so the
+	// directory keeps its first block rather than being rewritten.
+	exts, _, err := fs.inodeExtents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := fs.resolve("/units", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterExts, _, err := fs.inodeExtents(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exts) == 0 || len(afterExts) == 0 || afterExts[0].physical != exts[0].physical {
+		t.Errorf("directory moved from %v to %v", exts, afterExts)
+	}
+
+	// The filesystem has not been closed, but must be consistent as each
+	// operation writes out the metadata it changed.
+	fsckExt4(t, img)
+}
+
+func TestExt4ReadWrite(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc", "many"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("raspberrypi\n"), 0644)
+	for i := 0; i < 400; i++ {
+		ioutil.WriteFile(filepath.Join(src, "etc", "many", fmt.Sprintf("file-with-a-longish-name-%d", i)), []byte{byte(i)}, 0644)
+	}
+	os.Symlink("/etc/hostname", filepath.Join(src, "hostlink"))
+
+	img := makeExt4Image(t, src)
+	if out, err := exec.Command("e2fsck", "-fyD", fmt.Sprintf("%s?offset=%d", img, testPartOffset)).CombinedOutput(); err != nil {
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() > 1 {
+			t.Fatalf("e2fsck -D failed: %v\n%s", err, out)
+		}
+	}
+
+	fs, err := OpenExt4(img, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+
+	d, err := fs.Cat("/etc/hostname")
+	if err != nil || string(d) != "raspberrypi\n" {
+		t.Errorf("Cat(/etc/hostname) = %q, %v", d, err)
+	}
+	if d, err := fs.Cat("hostlink"); err != nil || string(d) != "raspberrypi\n" {
+		t.Errorf("Cat(hostlink) = %q, %v", d, err)
+	}
+	if s, err := fs.LStat("hostlink"); err != nil || s.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("LStat(hostlink) = %v, %v", s, err)
+	}
+	if _, err := fs.Stat("/nope"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/nope) returned %v, want not-exists", err)
+	}
+
+	if err := fs.Write("/etc/hostname", []byte("my-pi\n"), 0644); err != nil {
+		t.Errorf("Write(/etc/hostname) failed: %v", err)
+	}
+	if err := fs.Mkdir("/opt"); err != nil {
+		t.Errorf("Mkdir(/opt) failed: %v", err)
+	}
+	if err := fs.Mkdir("/opt"); !os.IsExist(err) {
+		t.Errorf("Mkdir(/opt) again returned %v, want exists", err)
+	}
+	if err := fs.Write("/opt/script.sh", []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Errorf("Write(/opt/script.sh) failed: %v", err)
+	}
+	if err := fs.Chown("/opt/script.sh", 1000, 1001); err != nil {
+		t.Errorf("Chown() failed: %v", err)
+	}
+	if err := fs.Chmod("/opt/script.sh", 04750); err != nil {
+		t.Errorf("Chmod() failed: %v", err)
+	}
+	if err := fs.Symlink("/opt/short", "script.sh"); err != nil {
+		t.Errorf("Symlink(short) failed: %v", err)
+	}
+	long := "/" + string(bytes.Repeat([]byte("x"), 100))
+	if err := fs.Symlink("/opt/long", long); err != nil {
+		t.Errorf("Symlink(long) failed: %v", err)
+	}
+	if err := fs.Write("/etc/many/added", []byte("new entry"), 0644); err != nil {
+		t.Errorf("Write(/etc/many/added) failed: %v", err)
+	}
+	if err := fs.Remove("/etc/many/file-with-a-longish-name-7"); err != nil {
+		t.Errorf("Remove() failed: %v", err)
+	}
+	if err := fs.Remove("/etc"); err == nil {
+		t.Error("Remove(/etc) succeeded on non-empty directory")
+	}
+
+	// Fragment free space, so the next large write needs an extent tree.
+	for i := 0; i < 200; i++ {
+		if err := fs.Write(fmt.Sprintf("/opt/frag-%d", i), make([]byte, 4096), 0644); err != nil {
+			t.Fatalf("Write(frag) failed: %v", err)
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		if err := fs.Remove(fmt.Sprintf("/opt/frag-%d", i)); err != nil {
+			t.Fatalf("Remove(frag) failed: %v", err)
+		}
+	}
+	big := make([]byte, 20*1024*1024+123)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	if err := fs.Write("/opt/big", big, 0644); err != nil {
+		t.Errorf("Write(/opt/big) failed: %v", err)
+	}
+
+	host := t.TempDir()
+	os.MkdirAll(filepath.Join(host, "conf", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(host, "conf", "sub", "a.txt"), []byte("aaa"), 0600)
+	if err := fs.CopyInto(filepath.Join(host, "conf"), "/opt"); err != nil {
+		t.Errorf("CopyInto() failed: %v", err)
+	}
+	if err := fs.RemoveAll("/etc/many"); err != nil {
+		t.Errorf("RemoveAll(/etc/many) failed: %v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	fsckExt4(t, img)
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fs, err = LoadExt4(f, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("LoadExt4() failed: %v", err)
+	}
+	for p, want := range map[string]string{
+		"/etc/hostname":       "my-pi\n",
+		"/opt/short":          "#!/bin/sh\necho hi\n",
+		"/opt/conf/sub/a.txt": "aaa",
+	} {
+		if d, err := fs.Cat(p); err != nil || string(d) != want {
+			t.Errorf("Cat(%s) = %q, %v, want %q", p, d, err, want)
+		}
+	}
+	if d, err := fs.Cat("/opt/big"); err != nil || !bytes.Equal(d, big) {
+		t.Errorf("Cat(/opt/big) mismatch (err = %v)", err)
+	}
+	s, err := fs.Stat("/opt/script.sh")
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if s.Mode() != os.ModeSetuid|0750 {
+		t.Errorf("mode = %v, want %v", s.Mode(), os.ModeSetuid|0750)
+	}
+	if st := s.Sys().(*FileStat); st.Uid != 1000 || st.Gid != 1001 {
+		t.Errorf("owner = %d:%d, want 1000:1001", st.Uid, st.Gid)
+	}
+	if _, err := fs.Stat("/etc/many"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/etc/many) returned %v, want not-exists", err)
+	}
+	if err := fs.Write("/foo", nil, 0644); err == nil {
+		t.Error("Write() succeeded on read-only filesystem")
+	}
+}
@@ -0,0 +1,383 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const (
+	fatFSInfoLeadSig   = 0x41615252
+	fatFSInfoStructSig = 0x61417272
+)
+
+// FATFS represents access to a FAT12, FAT16 or FAT32 filesystem contained
+// within an image file. Changes to file data and directories are written
+// directly into the image, while the allocation table is written back when
+// the filesystem is closed.
+type FATFS struct {
+	f             *os.File
+	start, length uint64
+	writable      bool
+
+	fatType           int
+	bytesPerSector    uint64
+	sectorsPerCluster uint64
+	reservedSectors   uint64
+	numFATs           uint64
+	fatSectors        uint64
+	rootEntries       uint64
+	rootCluster       uint32
+	fsInfoSector      uint64
+	dataStart         uint64
+	clusterCount      uint32
+
+	fat      []byte
+	fatDirty bool
+	nextFree uint32
+}
+
+// LoadFAT loads a FAT filesystem.
+func LoadFAT(f *os.File, start, length uint64) (*FATFS, error) {
+	bs := make([]byte, 512)
+	if _, err := f.ReadAt(bs, int64(start)); err != nil {
+		return nil, fmt.Errorf("loading boot sector: %v", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, errors.New("bad boot sector signature")
+	}
+
+	fs := &FATFS{
+		f:                 f,
+		start:             start,
+		length:            length,
+		bytesPerSector:    uint64(binary.LittleEndian.Uint16(bs[11:])),
+		sectorsPerCluster: uint64(bs[13]),
+		reservedSectors:   uint64(binary.LittleEndian.Uint16(bs[14:])),
+		numFATs:           uint64(bs[16]),
+		rootEntries:       uint64(binary.LittleEndian.Uint16(bs[17:])),
+		fatSectors:        uint64(binary.LittleEndian.Uint16(bs[22:])),
+	}
+	switch fs.bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid sector size %d", fs.bytesPerSector)
+	}
+	if fs.sectorsPerCluster == 0 || fs.sectorsPerCluster&(fs.sectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster %d", fs.sectorsPerCluster)
+	}
+	if fs.numFATs == 0 || fs.reservedSectors == 0 {
+		return nil, errors.New("invalid BIOS parameter block")
+	}
+
+	totalSectors := uint64(binary.LittleEndian.Uint16(bs[19:]))
+	if totalSectors == 0 {
+		totalSectors = uint64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+	if fs.fatSectors == 0 {
+		fs.fatSectors = uint64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+	if length > 0 && totalSectors*fs.bytesPerSector > length {
+		return nil, fmt.Errorf("filesystem (%d bytes) is larger than the partition (%d bytes)", totalSectors*fs.bytesPerSector, length)
+	}
+
+	rootSectors := (fs.rootEntries*32 + fs.bytesPerSector - 1) / fs.bytesPerSector
+	dataSector := fs.reservedSectors + fs.numFATs*fs.fatSectors + rootSectors
+	if dataSector >= totalSectors {
+		return nil, errors.New("invalid BIOS parameter block")
+	}
+	fs.dataStart = dataSector * fs.bytesPerSector
+	fs.clusterCount = uint32((totalSectors - dataSector) / fs.sectorsPerCluster)
+	switch {
+	case fs.clusterCount < 4085:
+		fs.fatType = 12
+	case fs.clusterCount < 65525:
+		fs.fatType = 16
+	default:
+		fs.fatType = 32
+		fs.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+		fs.fsInfoSector = uint64(binary.LittleEndian.Uint16(bs[48:]))
+	}
+	if (uint64(fs.clusterCount+2)*uint64(fs.fatType)+7)/8 > fs.fatSectors*fs.bytesPerSector {
+		return nil, errors.New("allocation table is too small for the filesystem")
+	}
+
+	// FAT12 entries are accessed 16 bits at a time, so the table is padded
+	// by a byte which is never written back.
+	fatLen := fs.fatSectors * fs.bytesPerSector
+	fs.fat = make([]byte, fatLen+1)[:fatLen]
+	if _, err := f.ReadAt(fs.fat, int64(start+fs.reservedSectors*fs.bytesPerSector)); err != nil {
+		return nil, fmt.Errorf("loading allocation table: %v", err)
+	}
+	fs.nextFree = 2
+	return fs, nil
+}
+
+// OpenFAT opens the FAT filesystem within the given image for reading and
+// writing, entirely in userspace.
+func OpenFAT(img string, start, length uint64) (*FATFS, error) {
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := LoadFAT(f, start, length)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fs.writable = true
+	return fs, nil
+}
+
+// Type returns the FAT variant in use: one of 12, 16 or 32.
+func (fs *FATFS) Type() int {
+	return fs.fatType
+}
+
+func (fs *FATFS) String() string {
+	return fmt.Sprintf("FAT%d{clusters=%d, cluster_size=%d}", fs.fatType, fs.clusterCount, fs.clusterSize())
+}
+
+func (fs *FATFS) clusterSize() uint64 {
+	return fs.bytesPerSector * fs.sectorsPerCluster
+}
+
+// entry returns the allocation table entry for the given cluster.
+func (fs *FATFS) entry(c uint32) uint32 {
+	switch fs.fatType {
+	case 12:
+		v := uint32(binary.LittleEndian.Uint16(fs.fat[c+c/2 : c+c/2+2]))
+		if c&1 != 0 {
+			return v >> 4
+		}
+		return v & 0xFFF
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(fs.fat[2*c:]))
+	default:
+		return binary.LittleEndian.Uint32(fs.fat[4*c:]) & 0x0FFFFFFF
+	}
+}
+
+func (fs *FATFS) setEntry(c, v uint32) {
+	fs.fatDirty = true
+	switch fs.fatType {
+	case 12:
+		off := c + c/2
+		cur := binary.LittleEndian.Uint16(fs.fat[off : off+2])
+		if c&1 != 0 {
+			cur = cur&0x000F | uint16(v&0xFFF)<<4
+		} else {
+			cur = cur&0xF000 | uint16(v&0xFFF)
+		}
+		binary.LittleEndian.PutUint16(fs.fat[off:off+2], cur)
+	case 16:
+		binary.LittleEndian.PutUint16(fs.fat[2*c:], uint16(v))
+	default:
+		cur := binary.LittleEndian.Uint32(fs.fat[4*c:])
+		binary.LittleEndian.PutUint32(fs.fat[4*c:], cur&0xF0000000|v&0x0FFFFFFF)
+	}
+}
+
+// endOfChain returns the value marking the last cluster in a chain.
+func (fs *FATFS) endOfChain() uint32 {
+	switch fs.fatType {
+	case 12:
+		return 0xFFF
+	case 16:
+		return 0xFFFF
+	default:
+		return 0x0FFFFFFF
+	}
+}
+
+func (fs *FATFS) isEndOfChain(v uint32) bool {
+	return v >= fs.endOfChain()&^7
+}
+
+func (fs *FATFS) validCluster(c uint32) bool {
+	return c >= 2 && c < fs.clusterCount+2
+}
+
+// chain returns the clusters making up the chain beginning at c.
+func (fs *FATFS) chain(c uint32) ([]uint32, error) {
+	var out []uint32
+	for c != 0 && !fs.isEndOfChain(c) {
+		if !fs.validCluster(c) {
+			return nil, fmt.Errorf("invalid cluster %d in chain", c)
+		}
+		if uint32(len(out)) > fs.clusterCount {
+			return nil, errors.New("cluster chain contains a loop")
+		}
+		out = append(out, c)
+		c = fs.entry(c)
+	}
+	return out, nil
+}
+
+// allocClusters allocates and links a chain of n clusters, returning the
+// first cluster in the chain.
+func (fs *FATFS) allocClusters(n int) (uint32, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if !fs.writable {
+		return 0, syscall.EROFS
+	}
+	var out []uint32
+	c := fs.nextFree
+	for i := uint32(0); i < fs.clusterCount && len(out) < n; i++ {
+		if !fs.validCluster(c) {
+			c = 2
+		}
+		if fs.entry(c) == 0 {
+			out = append(out, c)
+		}
+		c++
+	}
+	if len(out) < n {
+		return 0, syscall.ENOSPC
+	}
+	for i, c := range out {
+		if i == len(out)-1 {
+			fs.setEntry(c, fs.endOfChain())
+		} else {
+			fs.setEntry(c, out[i+1])
+		}
+	}
+	fs.nextFree = c
+	return out[0], nil
+}
+
+// freeChain releases all clusters in the chain beginning at c.
+func (fs *FATFS) freeChain(c uint32) error {
+	clusters, err := fs.chain(c)
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		fs.setEntry(c, 0)
+	}
+	return nil
+}
+
+func (fs *FATFS) clusterOffset(c uint32) int64 {
+	return int64(fs.start + fs.dataStart + uint64(c-2)*fs.clusterSize())
+}
+
+// readChain reads the contents of the chain beginning at c.
+func (fs *FATFS) readChain(c uint32) ([]byte, error) {
+	clusters, err := fs.chain(c)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, uint64(len(clusters))*fs.clusterSize())
+	for i, c := range clusters {
+		b := out[uint64(i)*fs.clusterSize():][:fs.clusterSize()]
+		if _, err := fs.f.ReadAt(b, fs.clusterOffset(c)); err != nil {
+			return nil, fmt.Errorf("reading cluster %d: %v", c, err)
+		}
+	}
+	return out, nil
+}
+
+// writeChain writes data into the chain beginning at c, which must be long
+// enough to hold it.
+func (fs *FATFS) writeChain(c uint32, data []byte) error {
+	if !fs.writable {
+		return syscall.EROFS
+	}
+	clusters, err := fs.chain(c)
+	if err != nil {
+		return err
+	}
+	if uint64(len(clusters))*fs.clusterSize() < uint64(len(data)) {
+		return errors.New("cluster chain too short")
+	}
+	for _, c := range clusters {
+		if len(data) == 0 {
+			break
+		}
+		b := data
+		if uint64(len(b)) > fs.clusterSize() {
+			b = b[:fs.clusterSize()]
+		}
+		if _, err := fs.f.WriteAt(b, fs.clusterOffset(c)); err != nil {
+			return fmt.Errorf("writing cluster %d: %v", c, err)
+		}
+		data = data[len(b):]
+	}
+	return nil
+}
+
+// extendChain appends n newly-allocated clusters to the chain beginning at c.
+func (fs *FATFS) extendChain(c uint32, n int) error {
+	clusters, err := fs.chain(c)
+	if err != nil {
+		return err
+	}
+	next, err := fs.allocClusters(n)
+	if err != nil {
+		return err
+	}
+	fs.setEntry(clusters[len(clusters)-1], next)
+	return nil
+}
+
+// flush writes the allocation table back to the image.
+// Operations which allocate or free space flush when they finish, so the
+// image is consistent between them even if it is never closed.
+func (fs *FATFS) flush() error {
+	if !fs.writable || !fs.fatDirty {
+		return nil
+	}
+	for i := uint64(0); i < fs.numFATs; i++ {
+		off := fs.start + (fs.reservedSectors+i*fs.fatSectors)*fs.bytesPerSector
+		if _, err := fs.f.WriteAt(fs.fat, int64(off)); err != nil {
+			return fmt.Errorf("writing allocation table: %v", err)
+		}
+	}
+
+	if fs.fatType == 32 && fs.fsInfoSector != 0 && fs.fsInfoSector != 0xFFFF {
+		info := make([]byte, 512)
+		off := int64(fs.start + fs.fsInfoSector*fs.bytesPerSector)
+		if _, err := fs.f.ReadAt(info, off); err != nil {
+			return fmt.Errorf("reading fsinfo: %v", err)
+		}
+		if binary.LittleEndian.Uint32(info) == fatFSInfoLeadSig && binary.LittleEndian.Uint32(info[484:]) == fatFSInfoStructSig {
+			var free uint32
+			for c := uint32(2); c < fs.clusterCount+2; c++ {
+				if fs.entry(c) == 0 {
+					free++
+				}
+			}
+			binary.LittleEndian.PutUint32(info[488:], free)
+			binary.LittleEndian.PutUint32(info[492:], fs.nextFree)
+			if _, err := fs.f.WriteAt(info, off); err != nil {
+				return fmt.Errorf("writing fsinfo: %v", err)
+			}
+		}
+	}
+	fs.fatDirty = false
+	return nil
+}
+
+// Close writes out any pending changes and closes the underlying image.
+func (fs *FATFS) Close() error {
+	err := fs.flush()
+	if err == nil && fs.writable {
+		err = fs.f.Sync()
+	}
+	if err != nil {
+		fs.f.Close()
+		return err
+	}
+	return fs.f.Close()
+}
+
+// Mountpoint implements interpreter.FS. Userspace filesystems are not
+// mounted anywhere, so an empty string is returned.
+func (fs *FATFS) Mountpoint() string {
+	return ""
+}
@@ -0,0 +1,514 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+// Directory entry attributes.
+const (
+	fatAttrReadOnly = 0x01
+	fatAttrHidden   = 0x02
+	fatAttrSystem   = 0x04
+	fatAttrVolumeID = 0x08
+	fatAttrDir      = 0x10
+	fatAttrArchive  = 0x20
+	fatAttrLongName = 0x0F
+)
+
+// Flags stored in the reserved byte of a short entry (as used by Windows NT
+// and Linux), indicating the base name or extension is lowercase.
+const (
+	fatCaseLowerBase = 0x08
+	fatCaseLowerExt  = 0x10
+)
+
+const (
+	fatDirentSize     = 32
+	fatLongNameChars  = 13
+	fatMaxLongNameLen = 255
+	fatDeletedMarker  = 0xE5
+)
+
+// fatDirent describes a file or directory within a FAT directory.
+type fatDirent struct {
+	name    string
+	short   [11]byte
+	attr    byte
+	cluster uint32
+	size    uint32
+	mtime   time.Time
+
+	// first & slot are the indices of the first entry (including any long
+	// name entries) and the short entry within the directory.
+	first, slot int
+}
+
+func (e *fatDirent) isDir() bool {
+	return e.attr&fatAttrDir != 0
+}
+
+// fatDir identifies a directory within a FAT filesystem. A cluster of zero
+// refers to the fixed root directory region of FAT12 & FAT16 filesystems.
+type fatDir struct {
+	cluster uint32
+}
+
+func (fs *FATFS) rootDir() fatDir {
+	if fs.fatType == 32 {
+		return fatDir{cluster: fs.rootCluster}
+	}
+	return fatDir{}
+}
+
+// dirOf returns the directory represented by the given entry. Entries
+// referring to cluster zero (such as '..' in a top-level directory) refer
+// to the root directory.
+func (fs *FATFS) dirOf(e *fatDirent) fatDir {
+	if e.cluster == 0 {
+		return fs.rootDir()
+	}
+	return fatDir{cluster: e.cluster}
+}
+
+func (fs *FATFS) isFixedRoot(d fatDir) bool {
+	return d.cluster == 0
+}
+
+func (fs *FATFS) readDirRaw(d fatDir) ([]byte, error) {
+	if !fs.isFixedRoot(d) {
+		return fs.readChain(d.cluster)
+	}
+	out := make([]byte, fs.rootEntries*fatDirentSize)
+	off := fs.start + (fs.reservedSectors+fs.numFATs*fs.fatSectors)*fs.bytesPerSector
+	if _, err := fs.f.ReadAt(out, int64(off)); err != nil {
+		return nil, fmt.Errorf("reading root directory: %v", err)
+	}
+	return out, nil
+}
+
+// writeDirRaw writes back the contents of a directory, growing it if
+// necessary.
+func (fs *FATFS) writeDirRaw(d fatDir, data []byte) error {
+	if !fs.writable {
+		return syscall.EROFS
+	}
+	if fs.isFixedRoot(d) {
+		if uint64(len(data)) > fs.rootEntries*fatDirentSize {
+			return syscall.ENOSPC
+		}
+		off := fs.start + (fs.reservedSectors+fs.numFATs*fs.fatSectors)*fs.bytesPerSector
+		if _, err := fs.f.WriteAt(data, int64(off)); err != nil {
+			return fmt.Errorf("writing root directory: %v", err)
+		}
+		return nil
+	}
+
+	clusters, err := fs.chain(d.cluster)
+	if err != nil {
+		return err
+	}
+	if have := uint64(len(clusters)) * fs.clusterSize(); have < uint64(len(data)) {
+		need := (uint64(len(data)) - have + fs.clusterSize() - 1) / fs.clusterSize()
+		if err := fs.extendChain(d.cluster, int(need)); err != nil {
+			return err
+		}
+	}
+	return fs.writeChain(d.cluster, data)
+}
+
+// parseDir decodes the entries in the raw contents of a directory. Volume
+// labels are omitted, but the '.' and '..' entries are returned.
+func parseDir(raw []byte) []*fatDirent {
+	var (
+		out      []*fatDirent
+		lfn      []uint16
+		lfnFirst = -1
+		lfnNext  int
+		lfnSum   byte
+	)
+	for i := 0; i+fatDirentSize <= len(raw); i += fatDirentSize {
+		b := raw[i : i+fatDirentSize]
+		if b[0] == 0 {
+			break
+		}
+		if b[0] == fatDeletedMarker {
+			lfnFirst = -1
+			continue
+		}
+
+		if b[11]&0x3F == fatAttrLongName {
+			ord := int(b[0] & 0x3F)
+			if b[0]&0x40 != 0 {
+				lfn = make([]uint16, ord*fatLongNameChars)
+				lfnFirst, lfnNext, lfnSum = i, ord, b[13]
+			}
+			if lfnFirst < 0 || ord == 0 || ord != lfnNext || b[13] != lfnSum {
+				lfnFirst = -1
+				continue
+			}
+			chars := lfn[(ord-1)*fatLongNameChars:]
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[j] = binary.LittleEndian.Uint16(b[off:])
+			}
+			lfnNext--
+			continue
+		}
+
+		if b[11]&fatAttrVolumeID != 0 {
+			lfnFirst = -1
+			continue
+		}
+
+		e := &fatDirent{
+			attr:    b[11],
+			cluster: uint32(binary.LittleEndian.Uint16(b[26:])) | uint32(binary.LittleEndian.Uint16(b[20:]))<<16,
+			size:    binary.LittleEndian.Uint32(b[28:]),
+			mtime:   fatTime(binary.LittleEndian.Uint16(b[24:]), binary.LittleEndian.Uint16(b[22:])),
+			first:   i,
+			slot:    i,
+		}
+		copy(e.short[:], b[:11])
+		e.name = shortNameString(e.short, b[12])
+		if lfnFirst >= 0 && lfnNext == 0 && lfnSum == shortNameChecksum(e.short) {
+			if n := decodeLongName(lfn); n != "" {
+				e.name, e.first = n, lfnFirst
+			}
+		}
+		lfnFirst = -1
+		out = append(out, e)
+	}
+	return out
+}
+
+func decodeLongName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// shortNameString returns the display form of an 8.3 name.
+func shortNameString(short [11]byte, caseFlags byte) string {
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:]), " ")
+	if len(base) > 0 && base[0] == 0x05 {
+		base = "\xE5" + base[1:]
+	}
+	if caseFlags&fatCaseLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if caseFlags&fatCaseLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func shortNameChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatTime decodes a DOS date & time.
+func fatTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
+
+// fatTimestamp encodes t as a DOS date & time.
+func fatTimestamp(t time.Time) (date, tm uint16) {
+	if t.Year() < 1980 {
+		return 0x21, 0
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+// shortNameChars are the characters permitted in an 8.3 name, other than
+// letters & digits.
+const shortNameChars = "!#$%&'()-@^_`{}~"
+
+func validShortChar(c rune) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		strings.ContainsRune(shortNameChars, c)
+}
+
+// validFATName returns an error if name cannot be stored in a FAT directory.
+func validFATName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return syscall.EINVAL
+	}
+	if len(utf16.Encode([]rune(name))) > fatMaxLongNameLen {
+		return syscall.ENAMETOOLONG
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return syscall.EINVAL
+		}
+	}
+	return nil
+}
+
+// exactShortName returns the 8.3 form of name and the case flags needed to
+// represent it, if name can be stored without a long name entry.
+func exactShortName(name string) ([11]byte, byte, bool) {
+	var out [11]byte
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(name, ".") && ext == "" {
+		return out, 0, false
+	}
+
+	var flags byte
+	for i, part := range []string{base, ext} {
+		hasUpper, hasLower := false, false
+		for _, c := range part {
+			if !validShortChar(c) {
+				return out, 0, false
+			}
+			hasUpper = hasUpper || (c >= 'A' && c <= 'Z')
+			hasLower = hasLower || (c >= 'a' && c <= 'z')
+		}
+		if hasUpper && hasLower {
+			return out, 0, false
+		}
+		if hasLower {
+			flags |= []byte{fatCaseLowerBase, fatCaseLowerExt}[i]
+		}
+	}
+
+	copy(out[:], bytes.Repeat([]byte{' '}, 11))
+	copy(out[:8], strings.ToUpper(base))
+	copy(out[8:], strings.ToUpper(ext))
+	if out[0] == fatDeletedMarker {
+		out[0] = 0x05
+	}
+	return out, flags, true
+}
+
+// generateShortName derives a unique 8.3 alias (such as 'LONGFI~1.TXT') for
+// a name which requires a long name entry.
+func generateShortName(name string, existing []*fatDirent) ([11]byte, error) {
+	clean := func(s string) string {
+		var out []byte
+		for _, c := range strings.ToUpper(s) {
+			switch {
+			case c == ' ' || c == '.':
+			case c < 0x80 && validShortChar(c):
+				out = append(out, byte(c))
+			default:
+				out = append(out, '_')
+			}
+		}
+		return string(out)
+	}
+	base, ext := strings.TrimLeft(name, "."), ""
+	if i := strings.LastIndexByte(base, '.'); i > 0 {
+		base, ext = base[:i], base[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	taken := map[[11]byte]bool{}
+	for _, e := range existing {
+		taken[e.short] = true
+	}
+	for n := 1; n < 1000000; n++ {
+		suffix := fmt.Sprintf("~%d", n)
+		b := base
+		if len(b)+len(suffix) > 8 {
+			b = b[:8-len(suffix)]
+		}
+		var out [11]byte
+		copy(out[:], bytes.Repeat([]byte{' '}, 11))
+		copy(out[:8], b+suffix)
+		copy(out[8:], ext)
+		if !taken[out] {
+			return out, nil
+		}
+	}
+	return [11]byte{}, syscall.ENOSPC
+}
+
+// encodeDirents returns the raw directory entries for a file, including any
+// long name entries needed to represent name.
+func encodeDirents(name string, short [11]byte, caseFlags byte, needLFN bool, attr byte, cluster, size uint32, now time.Time) []byte {
+	var out []byte
+	if needLFN {
+		chars := utf16.Encode([]rune(name))
+		n := (len(chars) + fatLongNameChars - 1) / fatLongNameChars
+		padded := make([]uint16, n*fatLongNameChars)
+		for i := range padded {
+			switch {
+			case i < len(chars):
+				padded[i] = chars[i]
+			case i == len(chars):
+				padded[i] = 0
+			default:
+				padded[i] = 0xFFFF
+			}
+		}
+		sum := shortNameChecksum(short)
+		for ord := n; ord > 0; ord-- {
+			b := make([]byte, fatDirentSize)
+			b[0] = byte(ord)
+			if ord == n {
+				b[0] |= 0x40
+			}
+			b[11] = fatAttrLongName
+			b[13] = sum
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				binary.LittleEndian.PutUint16(b[off:], padded[(ord-1)*fatLongNameChars+j])
+			}
+			out = append(out, b...)
+		}
+	}
+
+	b := make([]byte, fatDirentSize)
+	copy(b, short[:])
+	b[11] = attr
+	b[12] = caseFlags
+	date, tm := fatTimestamp(now)
+	binary.LittleEndian.PutUint16(b[14:], tm)
+	binary.LittleEndian.PutUint16(b[16:], date)
+	binary.LittleEndian.PutUint16(b[18:], date)
+	binary.LittleEndian.PutUint16(b[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(b[22:], tm)
+	binary.LittleEndian.PutUint16(b[24:], date)
+	binary.LittleEndian.PutUint16(b[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(b[28:], size)
+	return append(out, b...)
+}
+
+// lookupEntry finds the entry with the given name in a parsed directory.
+// Names are compared case-insensitively, against both the long and short
+// forms of each entry.
+func lookupEntry(ents []*fatDirent, name string) *fatDirent {
+	for _, e := range ents {
+		if strings.EqualFold(e.name, name) || strings.EqualFold(shortNameString(e.short, 0), name) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (fs *FATFS) readDir(d fatDir) ([]*fatDirent, error) {
+	raw, err := fs.readDirRaw(d)
+	if err != nil {
+		return nil, err
+	}
+	return parseDir(raw), nil
+}
+
+// addEntry creates an entry in the directory.
+func (fs *FATFS) addEntry(d fatDir, name string, attr byte, cluster, size uint32) error {
+	if err := validFATName(name); err != nil {
+		return err
+	}
+	raw, err := fs.readDirRaw(d)
+	if err != nil {
+		return err
+	}
+	ents := parseDir(raw)
+	if lookupEntry(ents, name) != nil {
+		return syscall.EEXIST
+	}
+
+	short, caseFlags, ok := exactShortName(name)
+	if !ok {
+		if short, err = generateShortName(name, ents); err != nil {
+			return err
+		}
+	}
+	ent := encodeDirents(name, short, caseFlags, !ok, attr, cluster, size, time.Now())
+
+	// Find a run of free slots large enough to hold the new entries, growing
+	// the directory if there are none.
+	pos, run := -1, 0
+	for i := 0; i+fatDirentSize <= len(raw) && run < len(ent); i += fatDirentSize {
+		switch raw[i] {
+		case 0:
+			// All slots following the end marker are free.
+			if run == 0 {
+				pos = i
+			}
+			run = len(raw) - pos
+			i = len(raw)
+		case fatDeletedMarker:
+			if run == 0 {
+				pos = i
+			}
+			run += fatDirentSize
+		default:
+			run = 0
+		}
+	}
+	if run < len(ent) {
+		if fs.isFixedRoot(d) {
+			return syscall.ENOSPC
+		}
+		if run == 0 {
+			pos = len(raw)
+		}
+		grow := (uint64(pos+len(ent)-len(raw)) + fs.clusterSize() - 1) / fs.clusterSize() * fs.clusterSize()
+		raw = append(raw, make([]byte, grow)...)
+	}
+	copy(raw[pos:], ent)
+	return fs.writeDirRaw(d, raw)
+}
+
+// removeEntry marks the given entry (and its long name entries) as deleted.
+func (fs *FATFS) removeEntry(d fatDir, e *fatDirent) error {
+	raw, err := fs.readDirRaw(d)
+	if err != nil {
+		return err
+	}
+	for i := e.first; i <= e.slot; i += fatDirentSize {
+		raw[i] = fatDeletedMarker
+	}
+	return fs.writeDirRaw(d, raw)
+}
+
+// updateEntry rewrites the short entry for e with its current attributes,
+// cluster & size, updating the modification time.
+func (fs *FATFS) updateEntry(d fatDir, e *fatDirent) error {
+	raw, err := fs.readDirRaw(d)
+	if err != nil {
+		return err
+	}
+	b := raw[e.slot : e.slot+fatDirentSize]
+	b[11] = e.attr
+	binary.LittleEndian.PutUint16(b[20:], uint16(e.cluster>>16))
+	binary.LittleEndian.PutUint16(b[26:], uint16(e.cluster))
+	binary.LittleEndian.PutUint32(b[28:], e.size)
+	date, tm := fatTimestamp(time.Now())
+	binary.LittleEndian.PutUint16(b[18:], date)
+	binary.LittleEndian.PutUint16(b[22:], tm)
+	binary.LittleEndian.PutUint16(b[24:], date)
+	return fs.writeDirRaw(d, raw)
+}
@@ -0,0 +1,363 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// fatRootEntry returns a synthetic entry describing the root directory.
+func (fs *FATFS) fatRootEntry() *fatDirent {
+	return &fatDirent{name: "/", attr: fatAttrDir, cluster: fs.rootDir().cluster}
+}
+
+// resolve walks the given path, returning the entry it refers to along with
+// the directory containing it.
+func (fs *FATFS) resolve(p string) (fatDir, *fatDirent, error) {
+	parent, cur := fs.rootDir(), fs.fatRootEntry()
+	for _, name := range splitPath(p) {
+		if !cur.isDir() {
+			return fatDir{}, nil, syscall.ENOTDIR
+		}
+		dir := fs.dirOf(cur)
+		if name == ".." && dir == fs.rootDir() {
+			continue
+		}
+		ents, err := fs.readDir(dir)
+		if err != nil {
+			return fatDir{}, nil, err
+		}
+		next := lookupEntry(ents, name)
+		if next == nil {
+			return fatDir{}, nil, syscall.ENOENT
+		}
+		if next.cluster == 0 && next.isDir() {
+			// '..' entries in top-level directories.
+			parent, cur = fs.rootDir(), fs.fatRootEntry()
+			continue
+		}
+		parent, cur = dir, next
+	}
+	return parent, cur, nil
+}
+
+// resolveParent returns the directory which contains (or would contain) the
+// given path, along with the final path component.
+func (fs *FATFS) resolveParent(p string) (fatDir, string, error) {
+	parts := splitPath(p)
+	if len(parts) == 0 {
+		return fatDir{}, "", syscall.EEXIST
+	}
+	name := parts[len(parts)-1]
+	if name == ".." {
+		return fatDir{}, "", syscall.EINVAL
+	}
+	_, dir, err := fs.resolve(path.Join(parts[:len(parts)-1]...))
+	if err != nil {
+		return fatDir{}, "", err
+	}
+	if !dir.isDir() {
+		return fatDir{}, "", syscall.ENOTDIR
+	}
+	return fs.dirOf(dir), name, nil
+}
+
+func (fs *FATFS) fileInfo(name string, e *fatDirent) os.FileInfo {
+	// Permissions match those presented by the kernel with the default
+	// umask when mounted by root.
+	mode, unixMode := os.FileMode(0755), uint32(sIFREG|0755)
+	if e.isDir() {
+		mode, unixMode = os.ModeDir|0755, sIFDIR|0755
+	}
+	if e.attr&fatAttrReadOnly != 0 && !e.isDir() {
+		mode, unixMode = mode&^0222, unixMode&^0222
+	}
+	return &fileInfo{
+		name:    path.Base("/" + name),
+		size:    int64(e.size),
+		mode:    mode,
+		modTime: e.mtime,
+		stat: &FileStat{
+			Inode: uint64(e.cluster),
+			Mode:  unixMode,
+			Nlink: 1,
+		},
+	}
+}
+
+// Cat implements interpreter.FS.
+func (fs *FATFS) Cat(p string) ([]byte, error) {
+	_, e, err := fs.resolve(p)
+	if err != nil {
+		return nil, pathErr("open", p, err)
+	}
+	if e.isDir() {
+		return nil, pathErr("read", p, syscall.EISDIR)
+	}
+	d, err := fs.readChain(e.cluster)
+	if err != nil {
+		return nil, pathErr("read", p, err)
+	}
+	if uint64(len(d)) < uint64(e.size) {
+		return nil, pathErr("read", p, syscall.EIO)
+	}
+	return d[:e.size], nil
+}
+
+// Stat implements interpreter.FS.
+func (fs *FATFS) Stat(p string) (os.FileInfo, error) {
+	_, e, err := fs.resolve(p)
+	if err != nil {
+		return nil, pathErr("stat", p, err)
+	}
+	return fs.fileInfo(p, e), nil
+}
+
+// LStat implements interpreter.FS. As FAT filesystems do not support
+// symlinks, this is equivalent to Stat.
+func (fs *FATFS) LStat(p string) (os.FileInfo, error) {
+	_, e, err := fs.resolve(p)
+	if err != nil {
+		return nil, pathErr("lstat", p, err)
+	}
+	return fs.fileInfo(p, e), nil
+}
+
+// Symlink implements interpreter.FS. FAT filesystems do not support
+// symlinks, so an error is always returned.
+func (fs *FATFS) Symlink(at, to string) error {
+	return pathErr("symlink", at, syscall.EPERM)
+}
+
+// Mkdir implements interpreter.FS.
+func (fs *FATFS) Mkdir(at string) error {
+	if !fs.writable {
+		return pathErr("mkdir", at, syscall.EROFS)
+	}
+	dir, name, err := fs.resolveParent(at)
+	if err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	ents, err := fs.readDir(dir)
+	if err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	if lookupEntry(ents, name) != nil {
+		return pathErr("mkdir", at, syscall.EEXIST)
+	}
+
+	c, err := fs.allocClusters(1)
+	if err != nil {
+		return pathErr("mkdir", at, err)
+	}
+	parentCluster := dir.cluster
+	if dir == fs.rootDir() {
+		parentCluster = 0
+	}
+	var dot, dotdot [11]byte
+	copy(dot[:], ".          ")
+	copy(dotdot[:], "..         ")
+	now := time.Now()
+	raw := make([]byte, fs.clusterSize())
+	copy(raw, encodeDirents(".", dot, 0, false, fatAttrDir, c, 0, now))
+	copy(raw[fatDirentSize:], encodeDirents("..", dotdot, 0, false, fatAttrDir, parentCluster, 0, now))
+	if err := fs.writeChain(c, raw); err != nil {
+		fs.freeChain(c)
+		return pathErr("mkdir", at, err)
+	}
+	if err := fs.addEntry(dir, name, fatAttrDir, c, 0); err != nil {
+		fs.freeChain(c)
+		return pathErr("mkdir", at, err)
+	}
+	return pathErr("mkdir", at, fs.flush())
+}
+
+// Write implements interpreter.FS.
+func (fs *FATFS) Write(p string, data []byte, perms os.FileMode) error {
+	if !fs.writable {
+		return pathErr("open", p, syscall.EROFS)
+	}
+	if uint64(len(data)) > 0xFFFFFFFF {
+		return pathErr("write", p, syscall.EFBIG)
+	}
+	dir, e, err := fs.resolve(p)
+	switch {
+	case err == syscall.ENOENT:
+		e = nil
+		if dir, _, err = fs.resolveParent(p); err != nil {
+			return pathErr("open", p, err)
+		}
+	case err != nil:
+		return pathErr("open", p, err)
+	case e.isDir():
+		return pathErr("open", p, syscall.EISDIR)
+	}
+
+	n := (uint64(len(data)) + fs.clusterSize() - 1) / fs.clusterSize()
+	c, err := fs.allocClusters(int(n))
+	if err != nil {
+		return pathErr("write", p, err)
+	}
+	if err := fs.writeChain(c, data); err != nil {
+		fs.freeChain(c)
+		return pathErr("write", p, err)
+	}
+
+	if e == nil {
+		attr := byte(fatAttrArchive)
+		if perms&0222 == 0 {
+			attr |= fatAttrReadOnly
+		}
+		if err := fs.addEntry(dir, path.Base("/"+p), attr, c, uint32(len(data))); err != nil {
+			fs.freeChain(c)
+			return pathErr("open", p, err)
+		}
+		return pathErr("write", p, fs.flush())
+	}
+
+	old := e.cluster
+	e.cluster, e.size = c, uint32(len(data))
+	e.attr |= fatAttrArchive
+	if err := fs.updateEntry(dir, e); err != nil {
+		return pathErr("write", p, err)
+	}
+	if err := fs.freeChain(old); err != nil {
+		return pathErr("write", p, err)
+	}
+	return pathErr("write", p, fs.flush())
+}
+
+// Remove implements interpreter.FS.
+func (fs *FATFS) Remove(p string) error {
+	if !fs.writable {
+		return pathErr("remove", p, syscall.EROFS)
+	}
+	if len(splitPath(p)) == 0 {
+		return pathErr("remove", p, syscall.EBUSY)
+	}
+	dir, e, err := fs.resolve(p)
+	if err != nil {
+		return pathErr("remove", p, err)
+	}
+	if e.isDir() {
+		ents, err := fs.readDir(fs.dirOf(e))
+		if err != nil {
+			return pathErr("remove", p, err)
+		}
+		for _, ent := range ents {
+			if ent.name != "." && ent.name != ".." {
+				return pathErr("remove", p, syscall.ENOTEMPTY)
+			}
+		}
+	}
+	if err := fs.removeEntry(dir, e); err != nil {
+		return pathErr("remove", p, err)
+	}
+	if err := fs.freeChain(e.cluster); err != nil {
+		return pathErr("remove", p, err)
+	}
+	return pathErr("remove", p, fs.flush())
+}
+
+// RemoveAll implements interpreter.FS.
+func (fs *FATFS) RemoveAll(p string) error {
+	_, e, err := fs.resolve(p)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return pathErr("removeall", p, err)
+	}
+	if e.isDir() {
+		ents, err := fs.readDir(fs.dirOf(e))
+		if err != nil {
+			return pathErr("removeall", p, err)
+		}
+		for _, ent := range ents {
+			if ent.name == "." || ent.name == ".." {
+				continue
+			}
+			if err := fs.RemoveAll(path.Join(p, ent.name)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(splitPath(p)) == 0 {
+		return nil
+	}
+	return fs.Remove(p)
+}
+
+// Chmod implements interpreter.FS. Only the write permission bits are
+// meaningful, and are represented using the read-only attribute.
+func (fs *FATFS) Chmod(p string, mode os.FileMode) error {
+	if !fs.writable {
+		return pathErr("chmod", p, syscall.EROFS)
+	}
+	dir, e, err := fs.resolve(p)
+	if err != nil {
+		return pathErr("chmod", p, err)
+	}
+	if len(splitPath(p)) == 0 || e.isDir() {
+		return nil
+	}
+	if mode&0222 == 0 {
+		e.attr |= fatAttrReadOnly
+	} else {
+		e.attr &^= fatAttrReadOnly
+	}
+	return pathErr("chmod", p, fs.updateEntry(dir, e))
+}
+
+// Chown implements interpreter.FS. FAT filesystems have no notion of
+// ownership, so only changes to root ownership are permitted.
+func (fs *FATFS) Chown(p string, uid, gid int) error {
+	if _, _, err := fs.resolve(p); err != nil {
+		return pathErr("chown", p, err)
+	}
+	if uid != 0 || gid != 0 {
+		return pathErr("chown", p, syscall.EPERM)
+	}
+	return nil
+}
+
+// CopyInto implements interpreter.FS.
+func (fs *FATFS) CopyInto(sysPath, p string) error {
+	return copyInto(fs, sysPath, p)
+}
+
+// ReadDir returns the entries of the directory at p, sorted by name. The
+// '.' and '..' entries are omitted.
+func (fs *FATFS) ReadDir(p string) ([]os.FileInfo, error) {
+	_, e, err := fs.resolve(p)
+	if err != nil {
+		return nil, pathErr("open", p, err)
+	}
+	if !e.isDir() {
+		return nil, pathErr("readdirent", p, syscall.ENOTDIR)
+	}
+	ents, err := fs.readDir(fs.dirOf(e))
+	if err != nil {
+		return nil, pathErr("readdirent", p, err)
+	}
+	var out []os.FileInfo
+	for _, e := range ents {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+		out = append(out, fs.fileInfo(e.name, e))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// Readlink implements interpreter.FS. As FAT filesystems do not support
+// symlinks, an error is always returned.
+func (fs *FATFS) Readlink(p string) (string, error) {
+	if _, _, err := fs.resolve(p); err != nil {
+		return "", pathErr("readlink", p, err)
+	}
+	return "", pathErr("readlink", p, syscall.EINVAL)
+}
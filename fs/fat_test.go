@@ -0,0 +1,236 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeFATImage creates an image containing an empty FAT filesystem of the
+// given type at testPartOffset.
+func makeFATImage(t *testing.T, fatType int) (string, uint64) {
+	t.Helper()
+	// FormatFAT chooses the FAT type based on the size of the filesystem.
+	length := map[int]uint64{
+		12: 4 * 1024 * 1024,
+		16: 64 * 1024 * 1024,
+		32: 600 * 1024 * 1024,
+	}[fatType]
+
+	p := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(p, int64(testPartOffset+length)); err != nil {
+		t.Fatal(err)
+	}
+	if err := FormatFAT(p, testPartOffset, length, "", 0); err != nil {
+		t.Fatalf("FormatFAT() failed: %v", err)
+	}
+	return p, length
+}
+
+func TestFATReadWrite(t *testing.T) {
+	for _, fatType := range []int{12, 16, 32} {
+		t.Run(fmt.Sprintf("FAT%d", fatType), func(t *testing.T) {
+			img, length := makeFATImage(t, fatType)
+			fs, err := OpenFAT(img, testPartOffset, length)
+			if err != nil {
+				t.Fatalf("OpenFAT() failed: %v", err)
+			}
+			if fs.Type() != fatType {
+				t.Errorf("Type() = %d, want %d", fs.Type(), fatType)
+			}
+
+			longName := "a rather long file name with spaces.conf"
+			big := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+			for p, data := range map[string][]byte{
+				"/cmdline.txt": []byte("console=serial0,115200 root=PARTUUID=1234-02"),
+				"/ssh":         nil,
+				"/CONFIG.TXT":  []byte("dtparam=audio=on\n"),
+				"/" + longName: big,
+			} {
+				if err := fs.Write(p, data, 0755); err != nil {
+					t.Errorf("Write(%q) failed: %v", p, err)
+				}
+			}
+			if err := fs.Mkdir("/overlays"); err != nil {
+				t.Errorf("Mkdir() failed: %v", err)
+			}
+			// Fill a subdirectory so it spans multiple clusters.
+			for i := 0; i < 100; i++ {
+				if err := fs.Write(fmt.Sprintf("/overlays/overlay-number-%d.dtbo", i), []byte{byte(i)}, 0644); err != nil {
+					t.Fatalf("Write(overlay) failed: %v", err)
+				}
+			}
+			if err := fs.Write("/cmdline.txt", []byte("console=tty1"), 0755); err != nil {
+				t.Errorf("Write(/cmdline.txt) failed: %v", err)
+			}
+			if err := fs.Remove("/overlays/overlay-number-3.dtbo"); err != nil {
+				t.Errorf("Remove() failed: %v", err)
+			}
+			if err := fs.Remove("/overlays"); err == nil {
+				t.Error("Remove(/overlays) succeeded on non-empty directory")
+			}
+			if err := fs.Symlink("/link", "ssh"); err == nil {
+				t.Error("Symlink() succeeded")
+			}
+
+			host := t.TempDir()
+			os.MkdirAll(filepath.Join(host, "extra", "sub"), 0755)
+			ioutil.WriteFile(filepath.Join(host, "extra", "sub", "wpa_supplicant.conf"), []byte("network={}"), 0644)
+			if err := fs.CopyInto(filepath.Join(host, "extra"), "/"); err != nil {
+				t.Errorf("CopyInto() failed: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+
+			f, err := os.Open(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if fs, err = LoadFAT(f, testPartOffset, length); err != nil {
+				t.Fatalf("LoadFAT() failed: %v", err)
+			}
+			for p, want := range map[string]string{
+				"/cmdline.txt":                     "console=tty1",
+				"/CMDLINE.TXT":                     "console=tty1",
+				"/ssh":                             "",
+				"/config.txt":                      "dtparam=audio=on\n",
+				"/" + strings.ToUpper(longName):    string(big),
+				"/overlays/overlay-number-99.dtbo": "\x63",
+				"/overlays/../extra/sub/wpa_supplicant.conf": "network={}",
+			} {
+				if d, err := fs.Cat(p); err != nil || string(d) != want {
+					t.Errorf("Cat(%q) = %d bytes, %v, want %d bytes", p, len(d), err, len(want))
+				}
+			}
+			if _, err := fs.Stat("/overlays/overlay-number-3.dtbo"); !os.IsNotExist(err) {
+				t.Errorf("Stat(removed) returned %v, want not-exists", err)
+			}
+			if s, err := fs.Stat("/overlays"); err != nil || !s.IsDir() {
+				t.Errorf("Stat(/overlays) = %v, %v", s, err)
+			}
+
+			// Verify names are stored as the kernel would store them.
+			ents, err := fs.readDir(fs.rootDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := map[string]string{}
+			for _, e := range ents {
+				names[e.name] = shortNameString(e.short, 0)
+			}
+			for name, short := range map[string]string{
+				"cmdline.txt": "CMDLINE.TXT",
+				"ssh":         "SSH",
+				"CONFIG.TXT":  "CONFIG.TXT",
+				longName:      "ARATHE~1.CON",
+			} {
+				if names[name] != short {
+					t.Errorf("short name for %q = %q, want %q", name, names[name], short)
+				}
+			}
+			if err := fs.Write("/foo", nil, 0644); err == nil {
+				t.Error("Write() succeeded on read-only filesystem")
+			}
+		})
+	}
+}
+
+func TestFATConsistentBeforeClose(t *testing.T) {
+	img, length := makeFATImage(t, 32)
+	fs, err := OpenFAT(img, testPartOffset, length)
+	if err != nil {
+		t.Fatalf("OpenFAT() failed: %v", err)
+	}
+	defer fs.Close()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	if err := fs.Write("/kernel.img", big, 0644); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	// The allocation table must be written out by the Write, as the
+	// filesystem has not been closed.
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	other, err := LoadFAT(f, testPartOffset, length)
+	if err != nil {
+		t.Fatalf("LoadFAT() failed: %v", err)
+	}
+	if d, err := other.Cat("/kernel.img"); err != nil || !bytes.Equal(d, big) {
+		t.Errorf("Cat(/kernel.img) = %d bytes, %v, want %d bytes", len(d), err, len(big))
+	}
+}
+
+// makeTightFAT12Image creates an image containing a FAT12 filesystem with
+// one sector per cluster, whose allocation table of fatSectors sectors holds
+// exactly enough entries for clusters data clusters.
+func makeTightFAT12Image(t *testing.T, fatSectors, clusters uint16) (string, uint64) {
+	t.Helper()
+	total := 1 + fatSectors + 1 + clusters // Boot sector, FAT, root directory.
+	length := uint64(total) * 512
+	bs := make([]byte, 512)
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], 1)
+	bs[16] = 1
+	binary.LittleEndian.PutUint16(bs[17:], 16)
+	binary.LittleEndian.PutUint16(bs[19:], total)
+	bs[21] = 0xF8
+	binary.LittleEndian.PutUint16(bs[22:], fatSectors)
+	bs[510], bs[511] = 0x55, 0xAA
+
+	img := make([]byte, testPartOffset+length)
+	copy(img[testPartOffset:], bs)
+	copy(img[testPartOffset+512:], []byte{0xF8, 0xFF, 0xFF})
+	p := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(p, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, length
+}
+
+func TestFAT12LastCluster(t *testing.T) {
+	// 339 clusters and the two reserved entries fill the 512 byte table.
+	img, length := makeTightFAT12Image(t, 1, 339)
+	fs, err := OpenFAT(img, testPartOffset, length)
+	if err != nil {
+		t.Fatalf("OpenFAT() failed: %v", err)
+	}
+	data := bytes.Repeat([]byte{0xA5}, 339*512)
+	if err := fs.Write("/big", data, 0644); err != nil {
+		t.Fatalf("Write() of every cluster failed: %v", err)
+	}
+	if err := fs.Write("/more", []byte("x"), 0644); err == nil {
+		t.Error("Write() succeeded on a full filesystem")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if fs, err = OpenFAT(img, testPartOffset, length); err != nil {
+		t.Fatalf("OpenFAT() failed: %v", err)
+	}
+	defer fs.Close()
+	if got, err := fs.Cat("/big"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Cat(/big) = %d bytes, %v, want the written data", len(got), err)
+	}
+
+	// The entry of the last of 681 clusters would end half a byte past the
+	// 1024 byte table.
+	img, length = makeTightFAT12Image(t, 2, 681)
+	if _, err := OpenFAT(img, testPartOffset, length); err == nil {
+		t.Error("OpenFAT() succeeded with an allocation table too small for the last cluster")
+	}
+}
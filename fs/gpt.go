@@ -0,0 +1,310 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// GPT partition type GUIDs.
+var (
+	GPTTypeEFISystem      = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	GPTTypeBasicData      = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	GPTTypeLinuxFS        = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	GPTTypeLinuxRootARM   = MustParseGUID("69DAD710-2CE4-4E3C-B16C-21A1D49ABED3")
+	GPTTypeLinuxRootARM64 = MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+	GPTTypeLinuxSwap      = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+)
+
+const (
+	gptSignature    = "EFI PART"
+	gptHeaderSize   = 92
+	gptNameLen      = 36 // UTF-16 code units
+	mbrTypeGPT      = 0xEE
+	mbrTableOffset  = 446
+	mbrDiskIDOffset = 440
+
+	// GPTAttrLegacyBootable is the partition attribute bit which marks a
+	// partition as bootable by legacy BIOSes.
+	GPTAttrLegacyBootable = 1 << 2
+	// MaxGPTEntries is the largest partition array which is read from a
+	// GUID partition table, and so the highest partition number.
+	MaxGPTEntries = 1024
+)
+
+// GUID is a globally unique identifier, stored in the mixed-endian
+// format used by GPT.
+type GUID [16]byte
+
+// ParseGUID parses a GUID in its canonical textual form.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 || len(s) != 36 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	// The first three fields are stored little-endian.
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID, but panics if the GUID is invalid.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:]), binary.LittleEndian.Uint16(g[4:]),
+		binary.LittleEndian.Uint16(g[6:]), g[8:10], g[10:])
+}
+
+// IsZero returns true if the GUID is all zeros.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// GPT describes a GUID partition table.
+type GPT struct {
+	DiskGUID       GUID
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	BackupLBA      uint64
+	EntriesLBA     uint64
+	EntrySize      uint32
+	// Partitions contains every entry in the partition array, including
+	// unused entries.
+	Partitions []GPTPartition
+}
+
+// GPTPartition describes an entry in a GUID partition table.
+type GPTPartition struct {
+	TypeGUID   GUID
+	GUID       GUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       string
+}
+
+// IsEmpty returns true if the entry is unused.
+func (p *GPTPartition) IsEmpty() bool {
+	return p.TypeGUID.IsZero()
+}
+
+// Length returns the number of sectors in the partition.
+func (p *GPTPartition) Length() uint64 {
+	if p.IsEmpty() || p.LastLBA < p.FirstLBA {
+		return 0
+	}
+	return p.LastLBA - p.FirstLBA + 1
+}
+
+// IsProtectiveMBR returns true if the given boot sector is a protective
+// MBR, indicating the disk uses a GUID partition table.
+func IsProtectiveMBR(sector []byte) bool {
+	if len(sector) < sectorSize || sector[510] != 0x55 || sector[511] != 0xAA {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		if sector[mbrTableOffset+i*16+4] == mbrTypeGPT {
+			return true
+		}
+	}
+	return false
+}
+
+// HasGPT returns true if the image read by r uses a GUID partition table.
+func HasGPT(r io.ReaderAt) (bool, error) {
+	sector := make([]byte, sectorSize)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return false, err
+	}
+	return IsProtectiveMBR(sector), nil
+}
+
+// MBRDiskID returns the disk identifier stored in an MBR boot sector.
+func MBRDiskID(sector []byte) uint32 {
+	return binary.LittleEndian.Uint32(sector[mbrDiskIDOffset:])
+}
+
+// ReadGPT reads the primary GUID partition table from r, verifying its
+// checksums.
+func ReadGPT(r io.ReaderAt) (*GPT, error) {
+	hdr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(hdr, sectorSize); err != nil {
+		return nil, fmt.Errorf("reading GPT header: %v", err)
+	}
+	if string(hdr[:8]) != gptSignature {
+		return nil, errors.New("GPT header signature missing")
+	}
+	hdrSize := binary.LittleEndian.Uint32(hdr[12:])
+	if hdrSize < gptHeaderSize || hdrSize > sectorSize {
+		return nil, fmt.Errorf("bad GPT header size %d", hdrSize)
+	}
+	want := binary.LittleEndian.Uint32(hdr[16:])
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if crc32.ChecksumIEEE(hdr[:hdrSize]) != want {
+		return nil, errors.New("GPT header checksum mismatch")
+	}
+
+	t := &GPT{
+		BackupLBA:      binary.LittleEndian.Uint64(hdr[32:]),
+		FirstUsableLBA: binary.LittleEndian.Uint64(hdr[40:]),
+		LastUsableLBA:  binary.LittleEndian.Uint64(hdr[48:]),
+		EntriesLBA:     binary.LittleEndian.Uint64(hdr[72:]),
+		EntrySize:      binary.LittleEndian.Uint32(hdr[84:]),
+	}
+	copy(t.DiskGUID[:], hdr[56:72])
+	numEntries := binary.LittleEndian.Uint32(hdr[80:])
+	if t.EntrySize < 128 || t.EntrySize%8 != 0 || numEntries > MaxGPTEntries {
+		return nil, fmt.Errorf("bad GPT partition array (%d entries of %d bytes)", numEntries, t.EntrySize)
+	}
+
+	entries := make([]byte, uint64(numEntries)*uint64(t.EntrySize))
+	if _, err := r.ReadAt(entries, int64(t.EntriesLBA*sectorSize)); err != nil {
+		return nil, fmt.Errorf("reading GPT partition array: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:]) {
+		return nil, errors.New("GPT partition array checksum mismatch")
+	}
+	for i := uint32(0); i < numEntries; i++ {
+		e := entries[i*t.EntrySize:]
+		p := GPTPartition{
+			FirstLBA:   binary.LittleEndian.Uint64(e[32:]),
+			LastLBA:    binary.LittleEndian.Uint64(e[40:]),
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+		}
+		copy(p.TypeGUID[:], e[0:16])
+		copy(p.GUID[:], e[16:32])
+		name := make([]uint16, 0, gptNameLen)
+		for j := 0; j < gptNameLen; j++ {
+			c := binary.LittleEndian.Uint16(e[56+2*j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		p.Name = string(utf16.Decode(name))
+		t.Partitions = append(t.Partitions, p)
+	}
+	return t, nil
+}
+
+// Used returns the partition entries up to and including the last entry
+// which is in use.
+func (t *GPT) Used() []GPTPartition {
+	n := len(t.Partitions)
+	for n > 0 && t.Partitions[n-1].IsEmpty() {
+		n--
+	}
+	return t.Partitions[:n]
+}
+
+// entrySectors returns the number of sectors occupied by the partition
+// array.
+func (t *GPT) entrySectors() uint64 {
+	return (uint64(len(t.Partitions))*uint64(t.EntrySize) + sectorSize - 1) / sectorSize
+}
+
+// Resize updates the usable area of the table for a disk of the given
+// number of sectors, relocating the backup table to the end of the disk.
+func (t *GPT) Resize(sectors uint64) {
+	t.BackupLBA = sectors - 1
+	t.LastUsableLBA = t.BackupLBA - t.entrySectors() - 1
+}
+
+// Write writes the primary and backup tables to w, along with a protective
+// MBR. Boot code in the existing MBR is preserved.
+func (t *GPT) Write(w io.WriterAt) error {
+	entries := make([]byte, t.entrySectors()*sectorSize)
+	for i, p := range t.Partitions {
+		e := entries[uint32(i)*t.EntrySize:]
+		copy(e[0:], p.TypeGUID[:])
+		copy(e[16:], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > gptNameLen {
+			return fmt.Errorf("partition name %q is too long", p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries[:uint64(len(t.Partitions))*uint64(t.EntrySize)])
+
+	header := func(self, alternate, entriesLBA uint64) []byte {
+		hdr := make([]byte, sectorSize)
+		copy(hdr, gptSignature)
+		binary.LittleEndian.PutUint32(hdr[8:], 0x10000)
+		binary.LittleEndian.PutUint32(hdr[12:], gptHeaderSize)
+		binary.LittleEndian.PutUint64(hdr[24:], self)
+		binary.LittleEndian.PutUint64(hdr[32:], alternate)
+		binary.LittleEndian.PutUint64(hdr[40:], t.FirstUsableLBA)
+		binary.LittleEndian.PutUint64(hdr[48:], t.LastUsableLBA)
+		copy(hdr[56:], t.DiskGUID[:])
+		binary.LittleEndian.PutUint64(hdr[72:], entriesLBA)
+		binary.LittleEndian.PutUint32(hdr[80:], uint32(len(t.Partitions)))
+		binary.LittleEndian.PutUint32(hdr[84:], t.EntrySize)
+		binary.LittleEndian.PutUint32(hdr[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:gptHeaderSize]))
+		return hdr
+	}
+	backupEntriesLBA := t.BackupLBA - t.entrySectors()
+	for _, region := range []struct {
+		data []byte
+		lba  uint64
+	}{
+		{entries, t.EntriesLBA},
+		{header(1, t.BackupLBA, t.EntriesLBA), 1},
+		{entries, backupEntriesLBA},
+		{header(t.BackupLBA, 1, backupEntriesLBA), t.BackupLBA},
+	} {
+		if _, err := w.WriteAt(region.data, int64(region.lba*sectorSize)); err != nil {
+			return err
+		}
+	}
+
+	// Protective MBR, covering the whole disk.
+	pmbr := make([]byte, 16)
+	pmbr[2], pmbr[3] = 0x02, 0x00
+	pmbr[4] = mbrTypeGPT
+	pmbr[5], pmbr[6], pmbr[7] = 0xFF, 0xFF, 0xFF
+	binary.LittleEndian.PutUint32(pmbr[8:], 1)
+	length := t.BackupLBA
+	if length > 0xFFFFFFFF {
+		length = 0xFFFFFFFF
+	}
+	binary.LittleEndian.PutUint32(pmbr[12:], uint32(length))
+	if _, err := w.WriteAt(append(pmbr, make([]byte, 48)...), mbrTableOffset); err != nil {
+		return err
+	}
+	_, err := w.WriteAt([]byte{0x55, 0xAA}, 510)
+	return err
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() (GUID, error) {
+	var g GUID
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0F | 0x40
+	g[8] = g[8]&0x3F | 0x80
+	return g, nil
+}
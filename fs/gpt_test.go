@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+)
+
+// makeGPTImage returns an image containing a protective MBR and a GUID
+// partition table with the given entries.
+func makeGPTImage(t *testing.T, parts []GPTPartition) []byte {
+	t.Helper()
+	const numEntries, sectors = 128, 8192
+	img := make([]byte, sectors*sectorSize)
+
+	mbr := img[:sectorSize]
+	mbr[mbrTableOffset+4] = mbrTypeGPT
+	binary.LittleEndian.PutUint32(mbr[mbrTableOffset+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[mbrTableOffset+12:], sectors-1)
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	entries := img[2*sectorSize : 2*sectorSize+numEntries*128]
+	for i, p := range parts {
+		e := entries[i*128:]
+		copy(e[0:], p.TypeGUID[:])
+		copy(e[16:], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for j, c := range utf16.Encode([]rune(p.Name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+
+	hdr := img[sectorSize:]
+	copy(hdr, gptSignature)
+	binary.LittleEndian.PutUint32(hdr[8:], 0x10000)
+	binary.LittleEndian.PutUint32(hdr[12:], gptHeaderSize)
+	binary.LittleEndian.PutUint64(hdr[24:], 1)
+	binary.LittleEndian.PutUint64(hdr[32:], sectors-1)
+	binary.LittleEndian.PutUint64(hdr[40:], 34)
+	binary.LittleEndian.PutUint64(hdr[48:], sectors-34)
+	disk := MustParseGUID("11223344-5566-7788-99AA-BBCCDDEEFF00")
+	copy(hdr[56:], disk[:])
+	binary.LittleEndian.PutUint64(hdr[72:], 2)
+	binary.LittleEndian.PutUint32(hdr[80:], numEntries)
+	binary.LittleEndian.PutUint32(hdr[84:], 128)
+	binary.LittleEndian.PutUint32(hdr[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:gptHeaderSize]))
+	return img
+}
+
+func TestGUID(t *testing.T) {
+	g, err := ParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B}; !bytes.HasPrefix(g[:], want) {
+		t.Errorf("ParseGUID() = % x, want prefix % x", g[:], want)
+	}
+	if got, want := g.String(), "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	for _, bad := range []string{"", "C12A7328F81F11D2BA4B00A0C93EC93B", "C12A7328-F81F-11D2-BA4B-00A0C93EC93", "Z12A7328-F81F-11D2-BA4B-00A0C93EC93B"} {
+		if _, err := ParseGUID(bad); err == nil {
+			t.Errorf("ParseGUID(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadGPT(t *testing.T) {
+	boot := GPTPartition{
+		TypeGUID:   GPTTypeBasicData,
+		GUID:       MustParseGUID("AAAAAAAA-0000-0000-0000-000000000001"),
+		FirstLBA:   2048,
+		LastLBA:    4095,
+		Attributes: GPTAttrLegacyBootable,
+		Name:       "boot",
+	}
+	root := GPTPartition{
+		TypeGUID: GPTTypeLinuxFS,
+		GUID:     MustParseGUID("AAAAAAAA-0000-0000-0000-000000000002"),
+		FirstLBA: 4096,
+		LastLBA:  8191 - 34,
+		Name:     "rootfs ☃",
+	}
+	img := makeGPTImage(t, []GPTPartition{boot, root})
+
+	if !IsProtectiveMBR(img[:sectorSize]) {
+		t.Error("IsProtectiveMBR() = false, want true")
+	}
+	tab, err := ReadGPT(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("ReadGPT() failed: %v", err)
+	}
+	if len(tab.Partitions) != 128 {
+		t.Errorf("len(Partitions) = %d, want 128", len(tab.Partitions))
+	}
+	used := tab.Used()
+	if len(used) != 2 || used[0] != boot || used[1] != root {
+		t.Errorf("Used() = %+v, want %+v", used, []GPTPartition{boot, root})
+	}
+	if got, want := tab.DiskGUID.String(), "11223344-5566-7788-99aa-bbccddeeff00"; got != want {
+		t.Errorf("DiskGUID = %v, want %v", got, want)
+	}
+	if n := used[1].Length(); n != 8191-34-4096+1 {
+		t.Errorf("Length() = %d", n)
+	}
+	if err := CheckPiPartitionTable(bytes.NewReader(img)); err != nil {
+		t.Errorf("CheckPiPartitionTable() failed: %v", err)
+	}
+	tab.Partitions[1].TypeGUID = GPTTypeLinuxSwap
+	if err := checkPiGPT(tab); err == nil {
+		t.Error("checkPiGPT() succeeded with a swap root partition")
+	}
+
+	img[2*sectorSize+56]++
+	if _, err := ReadGPT(bytes.NewReader(img)); err == nil {
+		t.Error("ReadGPT() succeeded with a corrupt partition array")
+	}
+	if IsProtectiveMBR(make([]byte, sectorSize)) {
+		t.Error("IsProtectiveMBR() = true for an empty sector")
+	}
+}
@@ -50,6 +50,11 @@ func (m *KMount) LStat(path string) (os.FileInfo, error) {
 	return os.Lstat(filepath.Join(m.mntPoint, path))
 }
 
+// Readlink implements interpreter.FS.
+func (m *KMount) Readlink(path string) (string, error) {
+	return os.Readlink(filepath.Join(m.mntPoint, path))
+}
+
 // Stat implements sysd.FS.
 func (m *KMount) Stat(path string) (os.FileInfo, error) {
 	return os.Stat(filepath.Join(m.mntPoint, path))
@@ -0,0 +1,186 @@
+package fs
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// emptyFS is a filesystem containing only an empty root directory.
+type emptyFS struct{}
+
+func (emptyFS) Stat(p string) (os.FileInfo, error) {
+	if cleanPath(p) != "/" {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: syscall.ENOENT}
+	}
+	return &fileInfo{name: "/", mode: os.ModeDir | 0755, stat: &FileStat{Mode: sIFDIR | 0755, Nlink: 2}}, nil
+}
+
+func (e emptyFS) LStat(p string) (os.FileInfo, error) {
+	return e.Stat(p)
+}
+
+func (emptyFS) Cat(p string) ([]byte, error) {
+	if cleanPath(p) == "/" {
+		return nil, &os.PathError{Op: "read", Path: p, Err: syscall.EISDIR}
+	}
+	return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}
+}
+
+func (e emptyFS) Readlink(p string) (string, error) {
+	if _, err := e.LStat(p); err != nil {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.ENOENT}
+	}
+	return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+}
+
+func (emptyFS) Close() error {
+	return nil
+}
+
+// NewMemFS returns an empty filesystem which is kept in memory.
+func NewMemFS() *Overlay {
+	return NewOverlay(emptyFS{}, func(Change) {})
+}
+
+// LoadFixture returns an in-memory filesystem containing the files in the
+// directory or tarball at path. Tarballs may be compressed, and the
+// ownership of files within them is preserved. Files copied from a
+// directory are owned by root.
+func LoadFixture(path string) (*Overlay, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	out := NewMemFS()
+	if st.IsDir() {
+		err = loadFixtureDir(out, path)
+	} else {
+		err = loadFixtureTarball(out, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading fixture %s: %v", path, err)
+	}
+	return out, nil
+}
+
+func loadFixtureDir(o *Overlay, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		dst := cleanPath(filepath.ToSlash(rel))
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return o.Symlink(dst, target)
+		case fi.IsDir():
+			if dst != "/" {
+				if err := o.Mkdir(dst); err != nil {
+					return err
+				}
+			}
+			return o.Chmod(dst, fi.Mode())
+		case fi.Mode().IsRegular():
+			d, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return o.Write(dst, d, fi.Mode())
+		}
+		return fmt.Errorf("%s: unsupported file type %v", p, fi.Mode()&os.ModeType)
+	})
+}
+
+func loadFixtureTarball(o *Overlay, p string) error {
+	format, err := DetectCompression(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if format != CompressionNone {
+		dr, err := newDecompressor(r, format)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		r = dr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dst := cleanPath(hdr.Name)
+		if err := mkdirAll(o, path.Dir(dst)); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = mkdirAll(o, dst)
+		case tar.TypeReg:
+			var d []byte
+			if d, err = ioutil.ReadAll(tr); err == nil {
+				err = o.Write(dst, d, os.FileMode(hdr.Mode))
+			}
+		case tar.TypeSymlink:
+			err = o.Symlink(dst, hdr.Linkname)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return fmt.Errorf("%s has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			// Chmod and Chown would apply to the target of the link.
+			continue
+		}
+		if err := o.Chmod(dst, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+		if err := o.Chown(dst, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+}
+
+// mkdirAll creates the directory p in the overlay, and any missing parents.
+func mkdirAll(o *Overlay, p string) error {
+	if s, err := o.Stat(p); err == nil {
+		if !s.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if err := mkdirAll(o, path.Dir(p)); err != nil {
+		return err
+	}
+	return o.Mkdir(p)
+}
@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkFixture(t *testing.T, o *Overlay, uid uint32) {
+	t.Helper()
+	d, err := o.Cat("/etc/hostname")
+	if err != nil || string(d) != "raspberrypi\n" {
+		t.Errorf("Cat(/etc/hostname) = %q, %v, want %q", d, err, "raspberrypi\n")
+	}
+	if d, err := o.Cat("/etc/hostname.link"); err != nil || string(d) != "raspberrypi\n" {
+		t.Errorf("Cat(/etc/hostname.link) = %q, %v, want %q", d, err, "raspberrypi\n")
+	}
+	st, err := StatFile(o, "/etc/init.d/resize2fs_once", nil)
+	if err != nil {
+		t.Fatalf("StatFile() failed: %v", err)
+	}
+	if st.Mode != 0755 || st.UID != uid || st.Size != 10 {
+		t.Errorf("StatFile() = %+v, want mode 0755, uid %d and size 10", st, uid)
+	}
+	if s, err := o.Stat("/etc/init.d"); err != nil || s.Mode() != os.ModeDir|0700 {
+		t.Errorf("Stat(/etc/init.d) = %v, %v, want mode %v", s, err, os.ModeDir|0700)
+	}
+	if _, err := o.Stat("/boot"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/boot) = %v, want ENOENT", err)
+	}
+	if err := o.Write("/boot/config.txt", nil, 0644); !os.IsNotExist(err) {
+		t.Errorf("Write() into a missing directory = %v, want ENOENT", err)
+	}
+	if err := o.Mkdir("/boot"); err != nil {
+		t.Errorf("Mkdir() failed: %v", err)
+	}
+	if err := o.Write("/boot/config.txt", []byte("dtparam=audio=on\n"), 0644); err != nil {
+		t.Errorf("Write() failed: %v", err)
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc", "init.d"), 0700)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("raspberrypi\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "etc", "init.d", "resize2fs_once"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("hostname", filepath.Join(src, "etc", "hostname.link"))
+
+	t.Run("directory", func(t *testing.T) {
+		o, err := LoadFixture(src)
+		if err != nil {
+			t.Fatalf("LoadFixture() failed: %v", err)
+		}
+		checkFixture(t, o, 0)
+	})
+
+	t.Run("tarball", func(t *testing.T) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		tw.WriteHeader(&tar.Header{Name: "./etc/init.d/", Typeflag: tar.TypeDir, Mode: 0700})
+		tw.WriteHeader(&tar.Header{Name: "./etc/init.d/resize2fs_once", Typeflag: tar.TypeReg, Mode: 0755, Uid: 1000, Gid: 1000, Size: 10})
+		tw.Write([]byte("#!/bin/sh\n"))
+		tw.WriteHeader(&tar.Header{Name: "./etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 12})
+		tw.Write([]byte("raspberrypi\n"))
+		tw.WriteHeader(&tar.Header{Name: "./etc/hostname.link", Typeflag: tar.TypeSymlink, Linkname: "hostname"})
+		tw.Close()
+		gw.Close()
+		p := filepath.Join(t.TempDir(), "rootfs.tar.gz")
+		if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := LoadFixture(p)
+		if err != nil {
+			t.Fatalf("LoadFixture() failed: %v", err)
+		}
+		checkFixture(t, o, 1000)
+	})
+
+	if _, err := LoadFixture(filepath.Join(src, "missing")); !os.IsNotExist(err) {
+		t.Errorf("LoadFixture() of a missing path = %v, want ENOENT", err)
+	}
+}
@@ -0,0 +1,188 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// FormatExt4 creates an empty ext4 filesystem in the given region of an
+// image, using mkfs.ext4. The label and UUID are optional. Discarding is
+// disabled, as mkfs.ext4 may otherwise discard blocks of the image outside
+// the region.
+func FormatExt4(img string, start, length uint64, label, uuid string) error {
+	args := []string{"-q", "-F", "-E", fmt.Sprintf("offset=%d,nodiscard", start)}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	if uuid != "" {
+		args = append(args, "-U", uuid)
+	}
+	args = append(args, img, fmt.Sprintf("%dk", length/1024))
+	if out, err := exec.Command("mkfs.ext4", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// FormatFAT creates an empty FAT filesystem in the given region of an image.
+// The FAT variant and cluster size are chosen based on the size of the
+// region, in the same manner as mkfs.fat. The label is optional.
+func FormatFAT(img string, start, length uint64, label string, volumeID uint32) error {
+	vol, err := fatVolumeLabel(label)
+	if err != nil {
+		return err
+	}
+	totalSectors := length / sectorSize
+	if totalSectors > 0xFFFFFFFF {
+		totalSectors = 0xFFFFFFFF
+	}
+
+	var (
+		fatType                 uint64 = 32
+		spc, rsvd, rootEntries  uint64 = 8, 32, 0
+		maxClusters, fatSectors uint64 = 0x0FFFFFF5, 1
+	)
+	switch size := totalSectors * sectorSize; {
+	case size < 16*1024*1024:
+		fatType, spc, rsvd, rootEntries, maxClusters = 12, 1, 1, 512, 4084
+	case size < 512*1024*1024:
+		fatType, spc, rsvd, rootEntries, maxClusters = 16, 1, 4, 512, 65524
+	case size > 32*1024*1024*1024:
+		spc = 64
+	case size > 16*1024*1024*1024:
+		spc = 32
+	case size > 8*1024*1024*1024:
+		spc = 16
+	}
+	rootSectors := rootEntries * fatDirentSize / sectorSize
+	var clusters uint64
+	for {
+		if totalSectors <= rsvd+2*fatSectors+rootSectors+spc {
+			return fmt.Errorf("partition is too small for a FAT%d filesystem", fatType)
+		}
+		clusters = (totalSectors - rsvd - 2*fatSectors - rootSectors) / spc
+		if need := (((clusters+2)*fatType+7)/8 + sectorSize - 1) / sectorSize; need > fatSectors {
+			fatSectors = need
+			continue
+		}
+		if clusters > maxClusters && spc < 128 {
+			spc *= 2
+			fatSectors = 1
+			continue
+		}
+		break
+	}
+	if clusters > maxClusters || (fatType == 32 && clusters < 65525) {
+		return fmt.Errorf("cannot fit a FAT%d filesystem in %d sectors", fatType, totalSectors)
+	}
+
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Clear the metadata regions: reserved sectors, allocation tables and
+	// the root directory.
+	meta := make([]byte, (rsvd+2*fatSectors+rootSectors)*sectorSize)
+	if fatType == 32 {
+		meta = append(meta, make([]byte, spc*sectorSize)...)
+	}
+
+	bs := meta[:sectorSize]
+	copy(bs, []byte{0xEB, 0x3C, 0x90, 'M', 'S', 'W', 'I', 'N', '4', '.', '1'})
+	binary.LittleEndian.PutUint16(bs[11:], sectorSize)
+	bs[13] = byte(spc)
+	binary.LittleEndian.PutUint16(bs[14:], uint16(rsvd))
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], uint16(rootEntries))
+	if totalSectors < 0x10000 {
+		binary.LittleEndian.PutUint16(bs[19:], uint16(totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(bs[32:], uint32(totalSectors))
+	}
+	bs[21] = 0xF8
+	binary.LittleEndian.PutUint16(bs[24:], 63)
+	binary.LittleEndian.PutUint16(bs[26:], 255)
+	binary.LittleEndian.PutUint32(bs[28:], uint32(start/sectorSize))
+	ebpb := bs[36:]
+	if fatType == 32 {
+		bs[1] = 0x58
+		binary.LittleEndian.PutUint32(bs[36:], uint32(fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:], 2)
+		binary.LittleEndian.PutUint16(bs[48:], 1)
+		binary.LittleEndian.PutUint16(bs[50:], 6)
+		ebpb = bs[64:]
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:], uint16(fatSectors))
+	}
+	ebpb[0] = 0x80
+	ebpb[2] = 0x29
+	binary.LittleEndian.PutUint32(ebpb[3:], volumeID)
+	copy(ebpb[7:18], vol[:])
+	copy(ebpb[18:26], fmt.Sprintf("FAT%-5d", fatType))
+	bs[510], bs[511] = 0x55, 0xAA
+
+	if fatType == 32 {
+		info := meta[sectorSize : 2*sectorSize]
+		binary.LittleEndian.PutUint32(info, fatFSInfoLeadSig)
+		binary.LittleEndian.PutUint32(info[484:], fatFSInfoStructSig)
+		binary.LittleEndian.PutUint32(info[488:], uint32(clusters-1))
+		binary.LittleEndian.PutUint32(info[492:], 3)
+		info[510], info[511] = 0x55, 0xAA
+		copy(meta[6*sectorSize:], meta[:2*sectorSize])
+	}
+
+	for i := uint64(0); i < 2; i++ {
+		fat := meta[(rsvd+i*fatSectors)*sectorSize:]
+		switch fatType {
+		case 12:
+			copy(fat, []byte{0xF8, 0xFF, 0xFF})
+		case 16:
+			copy(fat, []byte{0xF8, 0xFF, 0xFF, 0xFF})
+		case 32:
+			// The root directory occupies cluster 2.
+			copy(fat, []byte{0xF8, 0xFF, 0xFF, 0x0F, 0xFF, 0xFF, 0xFF, 0x0F, 0xFF, 0xFF, 0xFF, 0x0F})
+		}
+	}
+
+	if label != "" {
+		root := meta[(rsvd+2*fatSectors)*sectorSize:]
+		copy(root, vol[:])
+		root[11] = fatAttrVolumeID
+		date, tm := fatTimestamp(time.Now())
+		binary.LittleEndian.PutUint16(root[22:], tm)
+		binary.LittleEndian.PutUint16(root[24:], date)
+	}
+
+	if _, err := f.WriteAt(meta, int64(start)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fatVolumeLabel returns the label as stored in the boot sector and root
+// directory of a FAT filesystem.
+func fatVolumeLabel(label string) ([11]byte, error) {
+	var out [11]byte
+	copy(out[:], "NO NAME    ")
+	if label == "" {
+		return out, nil
+	}
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		return out, fmt.Errorf("FAT label %q is longer than 11 characters", label)
+	}
+	for _, c := range label {
+		if c < 0x20 || c > 0x7E || strings.ContainsRune(`"*+,./:;<=>?[\]|`, c) {
+			return out, fmt.Errorf("FAT label %q contains invalid character %q", label, c)
+		}
+	}
+	copy(out[:], label+strings.Repeat(" ", 11-len(label)))
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatFAT(t *testing.T) {
+	for _, tc := range []struct {
+		size    uint64
+		fatType int
+	}{
+		{4 * 1024 * 1024, 12},
+		{64 * 1024 * 1024, 16},
+		{600 * 1024 * 1024, 32},
+	} {
+		t.Run(fmt.Sprintf("FAT%d", tc.fatType), func(t *testing.T) {
+			img := filepath.Join(t.TempDir(), "test.img")
+			// Start with garbage where the filesystem will be created.
+			if err := ioutil.WriteFile(img, make([]byte, testPartOffset), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(img, int64(testPartOffset+tc.size)); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(img, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteAt([]byte("garbage"), testPartOffset+512*40)
+			f.Close()
+
+			if err := FormatFAT(img, testPartOffset, tc.size, "boot", 0xDEADBEEF); err != nil {
+				t.Fatalf("FormatFAT() failed: %v", err)
+			}
+			fs, err := OpenFAT(img, testPartOffset, tc.size)
+			if err != nil {
+				t.Fatalf("OpenFAT() failed: %v", err)
+			}
+			if fs.Type() != tc.fatType {
+				t.Errorf("Type() = %d, want %d", fs.Type(), tc.fatType)
+			}
+			ents, err := fs.readDir(fs.rootDir())
+			if err != nil || len(ents) != 0 {
+				t.Errorf("readDir(root) = %v, %v, want no entries", ents, err)
+			}
+			if err := fs.Write("/config.txt", []byte("dtparam=audio=on"), 0755); err != nil {
+				t.Errorf("Write() failed: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+
+			f, err = os.Open(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			bs := make([]byte, 512)
+			f.ReadAt(bs, testPartOffset)
+			labelOff := 43
+			if tc.fatType == 32 {
+				labelOff = 71
+			}
+			if got := string(bs[labelOff : labelOff+11]); got != "BOOT       " {
+				t.Errorf("label = %q, want %q", got, "BOOT       ")
+			}
+			if fs, err = LoadFAT(f, testPartOffset, tc.size); err != nil {
+				t.Fatalf("LoadFAT() failed: %v", err)
+			}
+			if d, err := fs.Cat("/CONFIG.TXT"); err != nil || string(d) != "dtparam=audio=on" {
+				t.Errorf("Cat() = %q, %v", d, err)
+			}
+		})
+	}
+
+	img := filepath.Join(t.TempDir(), "test.img")
+	ioutil.WriteFile(img, make([]byte, 1024*1024), 0644)
+	if err := FormatFAT(img, 0, 1024*1024, "this label is too long", 0); err == nil {
+		t.Error("FormatFAT() succeeded with an invalid label")
+	}
+	if err := FormatFAT(img, 0, 8*512, "", 0); err == nil {
+		t.Error("FormatFAT() succeeded with a tiny partition")
+	}
+}
+
+func TestFormatExt4(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, testPartOffset+32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	const uuid = "2b5b2a0e-6e0c-4cfd-9c62-3f6b0d6a5c11"
+	if err := FormatExt4(img, testPartOffset, 32*1024*1024, "data", uuid); err != nil {
+		t.Fatalf("FormatExt4() failed: %v", err)
+	}
+	fs, err := OpenExt4(img, testPartOffset, 32*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+	if err := fs.Mkdir("/db"); err != nil {
+		t.Errorf("Mkdir() failed: %v", err)
+	}
+	if got := string(fs.sb[0x78:0x7C]); got != "data" {
+		t.Errorf("label = %q, want %q", got, "data")
+	}
+	if got := hex.EncodeToString(fs.sb[0x68:0x78]); got != strings.Replace(uuid, "-", "", -1) {
+		t.Errorf("UUID = %s, want %s", got, uuid)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	fsckExt4(t, img)
+
+	if err := FormatExt4(img, testPartOffset, 32*1024*1024, "", "not-a-uuid"); err == nil {
+		t.Error("FormatExt4() succeeded with an invalid UUID")
+	}
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"os"
+	"time"
+)
+
+// FileStat describes ownership and identity information about a file.
+// It is returned from the Sys() method of os.FileInfo values produced by
+// the userspace filesystem implementations.
+type FileStat struct {
+	Inode    uint64
+	Mode     uint32 // Raw unix mode bits, including the file type.
+	Uid, Gid uint32
+	Nlink    uint32
+}
+
+// fileModeFromUnix converts raw unix mode bits into an os.FileMode.
+func fileModeFromUnix(m uint32) os.FileMode {
+	out := os.FileMode(m & 0777)
+	switch m & sIFMT {
+	case sIFDIR:
+		out |= os.ModeDir
+	case sIFLNK:
+		out |= os.ModeSymlink
+	case sIFIFO:
+		out |= os.ModeNamedPipe
+	case sIFSOCK:
+		out |= os.ModeSocket
+	case sIFCHR:
+		out |= os.ModeDevice | os.ModeCharDevice
+	case sIFBLK:
+		out |= os.ModeDevice
+	}
+	if m&04000 != 0 {
+		out |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		out |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		out |= os.ModeSticky
+	}
+	return out
+}
+
+// unixPerm returns the unix permission bits (including the setuid, setgid
+// and sticky bits) described by mode. Both os.FileMode flags and raw unix
+// bits are accepted, as scripts commonly pass the latter.
+func unixPerm(mode os.FileMode) uint16 {
+	out := uint16(mode & 07777)
+	if mode&os.ModeSetuid != 0 {
+		out |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		out |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		out |= 01000
+	}
+	return out
+}
+
+// fileInfo implements os.FileInfo for files within userspace filesystems.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	stat    *FileStat
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *fileInfo) Sys() interface{}   { return i.stat }
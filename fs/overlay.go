@@ -0,0 +1,476 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OverlayBase is the filesystem beneath an Overlay. It is only read from.
+type OverlayBase interface {
+	Cat(path string) ([]byte, error)
+	Stat(path string) (os.FileInfo, error)
+	LStat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
+	Close() error
+}
+
+// Change describes a modification made to a filesystem.
+type Change struct {
+	Op     string      // One of write, mkdir, remove, remove_all, chmod, chown or symlink.
+	Path   string      // Path which was modified.
+	Target string      // Target of a symlink.
+	Mode   os.FileMode // Mode of a written file or the mode set by chmod.
+	UID    int         // Owner set by chown.
+	GID    int         // Group set by chown.
+	Before []byte      // Previous contents of a written file.
+	After  []byte      // Contents of a written file.
+	Exists bool        // Whether a written file existed beforehand.
+	// SHA256 is the hash of a written file whose contents are not held in
+	// After, such as one copied from the host.
+	SHA256 *[32]byte
+}
+
+type overlayKind uint8
+
+const (
+	// overlayAttrs nodes only override the metadata of the underlying file.
+	overlayAttrs overlayKind = iota
+	overlayFile
+	overlayDir
+	overlaySymlink
+	overlayRemoved
+)
+
+type overlayNode struct {
+	kind     overlayKind
+	mode     os.FileMode
+	data     []byte
+	target   string
+	opaque   bool // Contents of the underlying directory are hidden.
+	uid, gid int
+	chowned  bool
+	modTime  time.Time
+}
+
+// Overlay is a copy-on-write view of a filesystem. Modifications are kept in
+// memory and reported to a callback as they are made, leaving the
+// underlying filesystem untouched.
+type Overlay struct {
+	base     OverlayBase
+	nodes    map[string]*overlayNode
+	onChange func(Change)
+}
+
+// NewOverlay returns an overlay over base. onChange is called for every
+// modification, in the order they are made.
+func NewOverlay(base OverlayBase, onChange func(Change)) *Overlay {
+	return &Overlay{
+		base:     base,
+		nodes:    map[string]*overlayNode{},
+		onChange: onChange,
+	}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// lookup returns the overlay node for p, or nil if p should be read from the
+// underlying filesystem. A node of kind overlayRemoved is returned if p or
+// one of its parents has been removed.
+func (o *Overlay) lookup(p string) *overlayNode {
+	if n, ok := o.nodes[p]; ok {
+		return n
+	}
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if n, ok := o.nodes[dir]; ok && (n.kind == overlayRemoved || n.opaque) {
+			return &overlayNode{kind: overlayRemoved}
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+// resolve follows symlinks, whether created in the overlay or present in the
+// underlying filesystem, in any component of p.
+func (o *Overlay) resolve(p string) (string, *overlayNode, error) {
+	for i := 0; i < 40; i++ {
+		target, rest, n := o.firstSymlink(p)
+		if target == "" {
+			return p, n, nil
+		}
+		p = path.Join(target, rest)
+	}
+	return "", nil, syscall.ELOOP
+}
+
+// resolveParent follows overlay symlinks in the directory containing p, but
+// not in its final component.
+func (o *Overlay) resolveParent(p string) (string, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return p, nil
+	}
+	dir, _, err := o.resolve(path.Dir(p))
+	if err != nil {
+		return p, &os.PathError{Op: "lstat", Path: p, Err: err}
+	}
+	return path.Join(dir, path.Base(p)), nil
+}
+
+// firstSymlink finds the first component of p which is a symlink, returning
+// the path it points to and the remainder of p. If there is no such
+// component, the node at p is returned.
+func (o *Overlay) firstSymlink(p string) (string, string, *overlayNode) {
+	var n *overlayNode
+	for i := 1; i <= len(p); i++ {
+		if i < len(p) && p[i] != '/' {
+			continue
+		}
+		prefix := p[:i]
+		var target string
+		switch n = o.lookup(prefix); {
+		case n != nil && n.kind == overlaySymlink:
+			target = n.target
+		case n == nil || n.kind == overlayAttrs:
+			// Symlinks in the underlying filesystem are followed here too,
+			// so paths through them find the nodes of their targets.
+			target = o.baseSymlink(prefix)
+		}
+		if target == "" {
+			continue
+		}
+		if path.IsAbs(target) {
+			return path.Clean(target), p[i:], nil
+		}
+		return path.Join(path.Dir(prefix), target), p[i:], nil
+	}
+	return "", "", n
+}
+
+// baseSymlink returns the target of p if it is a symlink in the underlying
+// filesystem, or the empty string otherwise.
+func (o *Overlay) baseSymlink(p string) string {
+	fi, err := o.base.LStat(p)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+	target, err := o.base.Readlink(p)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+func (o *Overlay) stat(op, p string, follow bool) (os.FileInfo, error) {
+	var n *overlayNode
+	var err error
+	if follow {
+		if p, n, err = o.resolve(cleanPath(p)); err != nil {
+			return nil, &os.PathError{Op: op, Path: p, Err: err}
+		}
+	} else {
+		if p, err = o.resolveParent(p); err != nil {
+			return nil, err
+		}
+		n = o.lookup(p)
+	}
+	if n == nil || n.kind == overlayAttrs {
+		var fi os.FileInfo
+		if follow {
+			fi, err = o.base.Stat(p)
+		} else {
+			fi, err = o.base.LStat(p)
+		}
+		if err != nil || n == nil {
+			return fi, err
+		}
+		return n.fileInfo(p, fi.Size(), fileStat(fi)), nil
+	}
+	if n.kind == overlayRemoved {
+		return nil, &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+	}
+	size := int64(len(n.data))
+	if n.kind == overlaySymlink {
+		size = int64(len(n.target))
+	}
+	return n.fileInfo(p, size, &FileStat{Nlink: 1}), nil
+}
+
+// fileStat returns a copy of the ownership information of a file from the
+// underlying filesystem.
+func fileStat(fi os.FileInfo) *FileStat {
+	switch st := fi.Sys().(type) {
+	case *FileStat:
+		out := *st
+		return &out
+	case *syscall.Stat_t:
+		return &FileStat{Inode: st.Ino, Mode: st.Mode, Uid: st.Uid, Gid: st.Gid, Nlink: uint32(st.Nlink)}
+	}
+	return &FileStat{Nlink: 1}
+}
+
+func (n *overlayNode) fileInfo(p string, size int64, st *FileStat) os.FileInfo {
+	if n.chowned {
+		st.Uid, st.Gid = uint32(n.uid), uint32(n.gid)
+	}
+	typ := st.Mode & sIFMT
+	if typ == 0 {
+		switch {
+		case n.mode.IsDir():
+			typ = sIFDIR
+		case n.mode&os.ModeSymlink != 0:
+			typ = sIFLNK
+		default:
+			typ = sIFREG
+		}
+	}
+	st.Mode = typ | uint32(unixPerm(n.mode))
+	return &fileInfo{name: path.Base(p), size: size, mode: n.mode, modTime: n.modTime, stat: st}
+}
+
+// permBits returns the permission bits of mode as an os.FileMode, accepting
+// raw unix bits in the same manner as unixPerm.
+func permBits(mode os.FileMode) os.FileMode {
+	return fileModeFromUnix(uint32(unixPerm(mode)))
+}
+
+// Stat implements interpreter.FS.
+func (o *Overlay) Stat(p string) (os.FileInfo, error) {
+	return o.stat("stat", p, true)
+}
+
+// LStat implements interpreter.FS.
+func (o *Overlay) LStat(p string) (os.FileInfo, error) {
+	return o.stat("lstat", p, false)
+}
+
+// Readlink implements interpreter.FS.
+func (o *Overlay) Readlink(p string) (string, error) {
+	p, err := o.resolveParent(p)
+	if err != nil {
+		return "", err
+	}
+	switch n := o.lookup(p); {
+	case n == nil || n.kind == overlayAttrs:
+		return o.base.Readlink(p)
+	case n.kind == overlayRemoved:
+		return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.ENOENT}
+	case n.kind == overlaySymlink:
+		return n.target, nil
+	}
+	return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+}
+
+// Cat implements interpreter.FS.
+func (o *Overlay) Cat(p string) ([]byte, error) {
+	p, n, err := o.resolve(cleanPath(p))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	switch {
+	case n == nil || n.kind == overlayAttrs:
+		return o.base.Cat(p)
+	case n.kind == overlayRemoved:
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}
+	case n.kind == overlayDir:
+		return nil, &os.PathError{Op: "read", Path: p, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+// checkParent returns an error if the parent of p is not a directory.
+func (o *Overlay) checkParent(op, p string) error {
+	s, err := o.Stat(path.Dir(p))
+	if err != nil {
+		return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+	}
+	if !s.IsDir() {
+		return &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// set creates or replaces the node at p. Directories replacing a removed
+// path hide the contents of the underlying directory.
+func (o *Overlay) set(p string, n *overlayNode) {
+	if prev := o.lookup(p); prev != nil && prev.kind == overlayRemoved && n.kind == overlayDir {
+		n.opaque = true
+	}
+	n.modTime = time.Now()
+	o.nodes[p] = n
+}
+
+// Write implements interpreter.FS.
+func (o *Overlay) Write(p string, data []byte, perms os.FileMode) error {
+	p, _, err := o.resolve(cleanPath(p))
+	if err != nil {
+		return &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	c := Change{Op: "write", Path: p, Mode: permBits(perms), After: data}
+	n := &overlayNode{kind: overlayFile, data: append([]byte(nil), data...)}
+
+	switch s, err := o.Stat(p); {
+	case err == nil && s.IsDir():
+		return &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+	case err == nil:
+		// As with the underlying filesystems, existing files keep their mode.
+		if c.Before, err = o.Cat(p); err != nil {
+			return err
+		}
+		c.Exists, c.Mode = true, s.Mode()
+		st := fileStat(s)
+		n.uid, n.gid, n.chowned = int(st.Uid), int(st.Gid), true
+	case os.IsNotExist(err):
+		if err := o.checkParent("open", p); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	n.mode = c.Mode
+	o.set(p, n)
+	o.onChange(c)
+	return nil
+}
+
+// Mkdir implements interpreter.FS.
+func (o *Overlay) Mkdir(at string) error {
+	at, err := o.resolveParent(at)
+	if err != nil {
+		return err
+	}
+	if _, err := o.LStat(at); err == nil {
+		return &os.PathError{Op: "mkdir", Path: at, Err: syscall.EEXIST}
+	}
+	if err := o.checkParent("mkdir", at); err != nil {
+		return err
+	}
+	o.set(at, &overlayNode{kind: overlayDir, mode: os.ModeDir | 0755})
+	o.onChange(Change{Op: "mkdir", Path: at, Mode: 0755})
+	return nil
+}
+
+// Symlink implements interpreter.FS.
+func (o *Overlay) Symlink(at, to string) error {
+	at, err := o.resolveParent(at)
+	if err != nil {
+		return err
+	}
+	if _, err := o.LStat(at); err == nil {
+		return &os.PathError{Op: "symlink", Path: at, Err: syscall.EEXIST}
+	}
+	if err := o.checkParent("symlink", at); err != nil {
+		return err
+	}
+	o.set(at, &overlayNode{kind: overlaySymlink, mode: os.ModeSymlink | os.ModePerm, target: to})
+	o.onChange(Change{Op: "symlink", Path: at, Target: to})
+	return nil
+}
+
+// remove marks p as removed, discarding any changes beneath it.
+func (o *Overlay) remove(p string) {
+	for k := range o.nodes {
+		if k != p && (p == "/" || strings.HasPrefix(k, p+"/")) {
+			delete(o.nodes, k)
+		}
+	}
+	o.nodes[p] = &overlayNode{kind: overlayRemoved}
+}
+
+// Remove implements interpreter.FS. As directories cannot be listed, removing
+// a non-empty directory from the underlying filesystem is not detected.
+func (o *Overlay) Remove(p string) error {
+	p, err := o.resolveParent(p)
+	if err != nil {
+		return err
+	}
+	if _, err := o.LStat(p); err != nil {
+		return err
+	}
+	for k, n := range o.nodes {
+		if n.kind != overlayRemoved && path.Dir(k) == p {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+	o.remove(p)
+	o.onChange(Change{Op: "remove", Path: p})
+	return nil
+}
+
+// RemoveAll implements interpreter.FS.
+func (o *Overlay) RemoveAll(p string) error {
+	p, err := o.resolveParent(p)
+	if err != nil {
+		return err
+	}
+	if _, err := o.LStat(p); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	o.remove(p)
+	o.onChange(Change{Op: "remove_all", Path: p})
+	return nil
+}
+
+// attrs returns the node for p which metadata changes should be applied to,
+// creating one if p exists only in the underlying filesystem.
+func (o *Overlay) attrs(op, p string) (string, *overlayNode, error) {
+	p, n, err := o.resolve(cleanPath(p))
+	if err != nil {
+		return "", nil, &os.PathError{Op: op, Path: p, Err: err}
+	}
+	s, err := o.Stat(p)
+	if err != nil {
+		return "", nil, err
+	}
+	if n == nil {
+		n = &overlayNode{kind: overlayAttrs, mode: s.Mode(), modTime: s.ModTime()}
+		o.nodes[p] = n
+	}
+	return p, n, nil
+}
+
+// Chmod implements interpreter.FS.
+func (o *Overlay) Chmod(p string, mode os.FileMode) error {
+	p, n, err := o.attrs("chmod", p)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&^permBits(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | permBits(mode)
+	o.onChange(Change{Op: "chmod", Path: p, Mode: permBits(mode)})
+	return nil
+}
+
+// Chown implements interpreter.FS.
+func (o *Overlay) Chown(p string, uid, gid int) error {
+	p, n, err := o.attrs("chown", p)
+	if err != nil {
+		return err
+	}
+	n.uid, n.gid, n.chowned = uid, gid, true
+	o.onChange(Change{Op: "chown", Path: p, UID: uid, GID: gid})
+	return nil
+}
+
+// CopyInto implements interpreter.FS.
+func (o *Overlay) CopyInto(sysPath, p string) error {
+	return copyInto(o, sysPath, p)
+}
+
+// Close implements interpreter.FS, closing the underlying filesystem.
+func (o *Overlay) Close() error {
+	return o.base.Close()
+}
+
+// Mountpoint implements interpreter.FS. As changes are not visible in the
+// underlying filesystem, an empty string is returned.
+func (o *Overlay) Mountpoint() string {
+	return ""
+}
@@ -0,0 +1,164 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc", "init.d"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("raspberrypi\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "etc", "init.d", "resize2fs_once"), []byte("#!/bin/sh\n"), 0755)
+	img := makeExt4Image(t, src)
+	base, err := OpenExt4(img, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+
+	var changes []Change
+	o := NewOverlay(base, func(c Change) { changes = append(changes, c) })
+	if err := o.Write("/etc/hostname", []byte("mypi\n"), 0600); err != nil {
+		t.Errorf("Write() failed: %v", err)
+	}
+	if err := o.Mkdir("/opt"); err != nil {
+		t.Errorf("Mkdir() failed: %v", err)
+	}
+	if err := o.Mkdir("/opt"); !os.IsExist(err) {
+		t.Errorf("Mkdir() = %v, want EEXIST", err)
+	}
+	if err := o.Write("/opt/app/config", nil, 0644); !os.IsNotExist(err) {
+		t.Errorf("Write() = %v, want ENOENT", err)
+	}
+	if err := o.Write("/opt/run.sh", []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Errorf("Write() failed: %v", err)
+	}
+	if err := o.Chmod("/opt/run.sh", 04755); err != nil {
+		t.Errorf("Chmod() failed: %v", err)
+	}
+	if err := o.Chown("/etc/hostname", 1000, 1000); err != nil {
+		t.Errorf("Chown() failed: %v", err)
+	}
+	if err := o.Symlink("/run", "/opt"); err != nil {
+		t.Errorf("Symlink() failed: %v", err)
+	}
+	if err := o.Symlink("/run/start.sh", "run.sh"); err != nil {
+		t.Errorf("Symlink() through a symlink failed: %v", err)
+	}
+	if err := o.RemoveAll("/etc/init.d"); err != nil {
+		t.Errorf("RemoveAll() failed: %v", err)
+	}
+	if err := o.Remove("/etc/init.d/resize2fs_once"); !os.IsNotExist(err) {
+		t.Errorf("Remove() = %v, want ENOENT", err)
+	}
+	if err := o.Mkdir("/etc/init.d"); err != nil {
+		t.Errorf("Mkdir() failed: %v", err)
+	}
+
+	if d, err := o.Cat("/etc/hostname"); err != nil || string(d) != "mypi\n" {
+		t.Errorf("Cat(/etc/hostname) = %q, %v", d, err)
+	}
+	if d, err := o.Cat("/run/run.sh"); err != nil || string(d) != "#!/bin/sh\n" {
+		t.Errorf("Cat(/run/run.sh) = %q, %v", d, err)
+	}
+	if d, err := o.Cat("/opt/start.sh"); err != nil || string(d) != "#!/bin/sh\n" {
+		t.Errorf("Cat(/opt/start.sh) = %q, %v", d, err)
+	}
+	if _, err := o.Stat("/etc/init.d/resize2fs_once"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a removed file = %v, want ENOENT", err)
+	}
+	st, err := o.Stat("/etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs := st.Sys().(*FileStat); st.Mode() != 0644 || fs.Uid != 1000 || fs.Gid != 1000 {
+		t.Errorf("Stat(/etc/hostname) = %v %d:%d, want -rw-r--r-- 1000:1000", st.Mode(), fs.Uid, fs.Gid)
+	}
+	if st, err := o.Stat("/opt/run.sh"); err != nil || st.Mode() != os.ModeSetuid|0755 {
+		t.Errorf("Stat(/opt/run.sh) = %v, %v", st, err)
+	}
+	if st, err := o.LStat("/run"); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("LStat(/run) = %v, %v, want a symlink", st, err)
+	}
+
+	want := []Change{
+		{Op: "write", Path: "/etc/hostname", Mode: 0644, Before: []byte("raspberrypi\n"), After: []byte("mypi\n"), Exists: true},
+		{Op: "mkdir", Path: "/opt", Mode: 0755},
+		{Op: "write", Path: "/opt/run.sh", Mode: 0644, After: []byte("#!/bin/sh\n")},
+		{Op: "chmod", Path: "/opt/run.sh", Mode: os.ModeSetuid | 0755},
+		{Op: "chown", Path: "/etc/hostname", UID: 1000, GID: 1000},
+		{Op: "symlink", Path: "/run", Target: "/opt"},
+		{Op: "symlink", Path: "/opt/start.sh", Target: "run.sh"},
+		{Op: "remove_all", Path: "/etc/init.d"},
+		{Op: "mkdir", Path: "/etc/init.d", Mode: 0755},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v\nwant %+v", changes, want)
+	}
+
+	// The underlying filesystem must be untouched.
+	if d, err := base.Cat("/etc/hostname"); err != nil || string(d) != "raspberrypi\n" {
+		t.Errorf("base Cat(/etc/hostname) = %q, %v", d, err)
+	}
+	if _, err := base.Stat("/etc/init.d/resize2fs_once"); err != nil {
+		t.Errorf("base Stat() failed: %v", err)
+	}
+	if _, err := base.Stat("/opt"); !os.IsNotExist(err) {
+		t.Errorf("base Stat(/opt) = %v, want ENOENT", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	fsckExt4(t, img)
+}
+
+func TestOverlayBaseSymlinks(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "opt", "conf"), 0755)
+	os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "opt", "conf", "app.conf"), []byte("port=80\n"), 0644)
+	os.Symlink("/opt/conf", filepath.Join(src, "etc", "app"))
+	os.Symlink("../opt/conf", filepath.Join(src, "etc", "app-rel"))
+	img := makeExt4Image(t, src)
+	base, err := OpenExt4(img, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+	o := NewOverlay(base, func(Change) {})
+	defer o.Close()
+
+	// Changes made through a symlink in the underlying filesystem are seen
+	// through its target, and the other way around.
+	if err := o.Write("/etc/app/app.conf", []byte("port=8080\n"), 0644); err != nil {
+		t.Fatalf("Write() through a symlink failed: %v", err)
+	}
+	if err := o.Write("/opt/conf/extra.conf", []byte("debug=1\n"), 0644); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	for p, want := range map[string]string{
+		"/opt/conf/app.conf":      "port=8080\n",
+		"/etc/app/app.conf":       "port=8080\n",
+		"/etc/app/extra.conf":     "debug=1\n",
+		"/etc/app-rel/extra.conf": "debug=1\n",
+		"/etc/app-rel/app.conf":   "port=8080\n",
+	} {
+		if d, err := o.Cat(p); err != nil || string(d) != want {
+			t.Errorf("Cat(%s) = %q, %v, want %q", p, d, err, want)
+		}
+	}
+	if err := o.Remove("/etc/app/extra.conf"); err != nil {
+		t.Errorf("Remove() through a symlink failed: %v", err)
+	}
+	if _, err := o.Stat("/opt/conf/extra.conf"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/opt/conf/extra.conf) = %v, want not-exists", err)
+	}
+	if target, err := o.Readlink("/etc/app"); err != nil || target != "/opt/conf" {
+		t.Errorf("Readlink(/etc/app) = %q, %v, want /opt/conf", target, err)
+	}
+	if s, err := o.LStat("/etc/app"); err != nil || s.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("LStat(/etc/app) = %v, %v, want a symlink", s, err)
+	}
+}
@@ -0,0 +1,337 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rekby/mbr"
+)
+
+// PartitionAlignment is the alignment, in sectors, of partitions which are
+// placed automatically.
+const PartitionAlignment = 2048
+
+// PartitionType identifies the type of a partition. MBR is used in images
+// with an MBR partition table, and GPT in images with a GUID partition
+// table.
+type PartitionType struct {
+	MBR byte
+	GPT GUID
+}
+
+// diskLayout is the partition table of an image, opened for editing.
+// Partitions are numbered from 1.
+type diskLayout struct {
+	f       *os.File
+	sectors uint64
+	mbr     *mbr.MBR
+	gpt     *GPT
+}
+
+type extent struct {
+	num           int
+	start, length uint64
+}
+
+func openLayout(path string, flag int) (*diskLayout, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := &diskLayout{f: f, sectors: uint64(st.Size()) / sectorSize}
+
+	isGPT, err := HasGPT(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading partition table: %v", err)
+	}
+	if isGPT {
+		if l.gpt, err = ReadGPT(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// The image may have been resized since the table was written. The
+		// table is only moved when it is being edited, so reads report it as
+		// it is on disk.
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			l.gpt.Resize(l.sectors)
+		}
+		return l, nil
+	}
+	if l.mbr, err = mbr.Read(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading partition table: %v", err)
+	}
+	return l, nil
+}
+
+// bounds returns the first and last sectors which may be allocated to
+// partitions.
+func (l *diskLayout) bounds() (uint64, uint64) {
+	if l.gpt != nil {
+		return l.gpt.FirstUsableLBA, l.gpt.LastUsableLBA
+	}
+	last := l.sectors - 1
+	if last > 0xFFFFFFFF {
+		last = 0xFFFFFFFF
+	}
+	return 1, last
+}
+
+// extent returns the extent of the given partition, and false if it does not
+// exist.
+func (l *diskLayout) extent(num int) (extent, bool) {
+	if l.gpt != nil {
+		if num < 1 || num > len(l.gpt.Partitions) || l.gpt.Partitions[num-1].IsEmpty() {
+			return extent{}, false
+		}
+		p := l.gpt.Partitions[num-1]
+		return extent{num: num, start: p.FirstLBA, length: p.Length()}, true
+	}
+	p := l.mbr.GetPartition(num)
+	if p == nil || p.IsEmpty() {
+		return extent{}, false
+	}
+	return extent{num: num, start: uint64(p.GetLBAStart()), length: uint64(p.GetLBALen())}, true
+}
+
+func (l *diskLayout) extents() []extent {
+	n := 4
+	if l.gpt != nil {
+		n = len(l.gpt.Partitions)
+	}
+	var out []extent
+	for num := 1; num <= n; num++ {
+		if e, ok := l.extent(num); ok {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// PartitionExtent describes the location of a partition within an image.
+type PartitionExtent struct {
+	Num           int    // Partition number, from 1.
+	Start, Length uint64 // In sectors.
+}
+
+// ReadPartitionExtents returns the location of each used partition in the
+// image at path, which may have an MBR or GUID partition table.
+func ReadPartitionExtents(path string) ([]PartitionExtent, error) {
+	l, err := openLayout(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer l.f.Close()
+	var out []PartitionExtent
+	for _, e := range l.extents() {
+		out = append(out, PartitionExtent{Num: e.num, Start: e.start, Length: e.length})
+	}
+	return out, nil
+}
+
+func (l *diskLayout) validNum(num int) error {
+	n := 4
+	if l.gpt != nil {
+		n = len(l.gpt.Partitions)
+	}
+	if num < 1 || num > n {
+		return fmt.Errorf("partition number must be between 1 and %d", n)
+	}
+	return nil
+}
+
+// checkFits returns an error if partition num cannot occupy the given
+// sectors.
+func (l *diskLayout) checkFits(num int, start, length uint64) error {
+	if length == 0 {
+		return fmt.Errorf("partition %d would be empty", num)
+	}
+	first, last := l.bounds()
+	if start < first || start+length-1 > last {
+		return fmt.Errorf("partition %d (sectors %d-%d) lies outside the usable sectors %d-%d", num, start, start+length-1, first, last)
+	}
+	for _, e := range l.extents() {
+		if e.num != num && start < e.start+e.length && e.start < start+length {
+			return fmt.Errorf("partition %d would overlap partition %d", num, e.num)
+		}
+	}
+	return nil
+}
+
+// freeEnd returns the sector after the end of the free space beginning at
+// start, ignoring partition num.
+func (l *diskLayout) freeEnd(num int, start uint64) uint64 {
+	_, last := l.bounds()
+	end := last + 1
+	for _, e := range l.extents() {
+		if e.num != num && e.start >= start && e.start < end {
+			end = e.start
+		}
+	}
+	return end
+}
+
+func (l *diskLayout) set(num int, start, length uint64) {
+	if l.gpt != nil {
+		p := &l.gpt.Partitions[num-1]
+		p.FirstLBA, p.LastLBA = start, start+length-1
+		return
+	}
+	p := l.mbr.GetPartition(num)
+	p.SetLBAStart(uint32(start))
+	p.SetLBALen(uint32(length))
+}
+
+func (l *diskLayout) setType(num int, t PartitionType) error {
+	if l.gpt != nil {
+		if t.GPT.IsZero() {
+			return errors.New("a partition type GUID is required for images with a GUID partition table")
+		}
+		l.gpt.Partitions[num-1].TypeGUID = t.GPT
+		return nil
+	}
+	if t.MBR == 0 {
+		return errors.New("a numeric partition type is required for images with an MBR partition table")
+	}
+	l.mbr.GetPartition(num).SetType(mbr.PartitionType(t.MBR))
+	return nil
+}
+
+// commit writes the partition table back to the image.
+func (l *diskLayout) commit() error {
+	var err error
+	if l.gpt != nil {
+		err = l.gpt.Write(l.f)
+	} else if _, err = l.f.Seek(0, 0); err == nil {
+		err = l.mbr.Write(l.f)
+	}
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("writing partition table: %v", err)
+	}
+	return nil
+}
+
+// AddPartition creates a partition in the image at path. If start is zero,
+// the partition begins at the first aligned sector after the existing
+// partitions. If length is zero, the partition fills the free space
+// following its start. Names are only supported in GUID partition tables.
+func AddPartition(path string, num int, t PartitionType, start, length uint64, name string) error {
+	l, err := openLayout(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer l.f.Close()
+	if err := l.validNum(num); err != nil {
+		return err
+	}
+	if _, exists := l.extent(num); exists {
+		return fmt.Errorf("partition %d already exists", num)
+	}
+	if name != "" && l.gpt == nil {
+		return errors.New("partition names require a GUID partition table")
+	}
+
+	if start == 0 {
+		start, _ = l.bounds()
+		for _, e := range l.extents() {
+			if e.start+e.length > start {
+				start = e.start + e.length
+			}
+		}
+		start = (start + PartitionAlignment - 1) / PartitionAlignment * PartitionAlignment
+	}
+	if length == 0 {
+		if end := l.freeEnd(num, start); end > start {
+			length = end - start
+		}
+	}
+	if err := l.checkFits(num, start, length); err != nil {
+		return err
+	}
+
+	if l.gpt != nil {
+		id, err := NewGUID()
+		if err != nil {
+			return err
+		}
+		l.gpt.Partitions[num-1] = GPTPartition{GUID: id, Name: name}
+	}
+	if err := l.setType(num, t); err != nil {
+		return err
+	}
+	l.set(num, start, length)
+	return l.commit()
+}
+
+// DeletePartition removes a partition from the image at path. The contents
+// of the partition are left in place.
+func DeletePartition(path string, num int) error {
+	l, err := openLayout(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer l.f.Close()
+	if _, exists := l.extent(num); !exists {
+		return fmt.Errorf("partition %d does not exist", num)
+	}
+
+	if l.gpt != nil {
+		l.gpt.Partitions[num-1] = GPTPartition{}
+	} else {
+		p := l.mbr.GetPartition(num)
+		p.SetType(mbr.PART_EMPTY)
+		p.SetLBAStart(0)
+		p.SetLBALen(0)
+	}
+	return l.commit()
+}
+
+// ResizePartition changes the length of a partition in the image at path.
+// If length is zero, the partition is grown to fill the free space which
+// follows it. The filesystem within the partition is not resized.
+func ResizePartition(path string, num int, length uint64) error {
+	l, err := openLayout(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer l.f.Close()
+	e, exists := l.extent(num)
+	if !exists {
+		return fmt.Errorf("partition %d does not exist", num)
+	}
+
+	if length == 0 {
+		length = l.freeEnd(num, e.start) - e.start
+	}
+	if err := l.checkFits(num, e.start, length); err != nil {
+		return err
+	}
+	l.set(num, e.start, length)
+	return l.commit()
+}
+
+// SetPartitionType changes the type of a partition in the image at path.
+func SetPartitionType(path string, num int, t PartitionType) error {
+	l, err := openLayout(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer l.f.Close()
+	if _, exists := l.extent(num); !exists {
+		return fmt.Errorf("partition %d does not exist", num)
+	}
+	if err := l.setType(num, t); err != nil {
+		return err
+	}
+	return l.commit()
+}
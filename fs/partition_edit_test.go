@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rekby/mbr"
+)
+
+func TestEditMBRPartitions(t *testing.T) {
+	// A 64MiB image laid out like a pi image: a boot partition at 4MiB and
+	// a root partition immediately after it.
+	table := make([]byte, 64*1024*1024)
+	binary.LittleEndian.PutUint32(table[mbrDiskIDOffset:], 0x738a4d67)
+	table[mbrTableOffset+4] = PartitionTypeFAT32LBA
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+8:], 8192)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+12:], 8192)
+	table[mbrTableOffset+16+4] = PartitionTypeLinuxNativePartition
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+8:], 16384)
+	binary.LittleEndian.PutUint32(table[mbrTableOffset+16+12:], 32768)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "mbr.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	linux := PartitionType{MBR: PartitionTypeLinuxNativePartition}
+	if err := AddPartition(img, 2, linux, 0, 0, ""); err == nil {
+		t.Error("AddPartition() succeeded for an existing partition")
+	}
+	if err := AddPartition(img, 3, linux, 40000, 2048, ""); err == nil {
+		t.Error("AddPartition() succeeded with an overlapping partition")
+	}
+	if err := AddPartition(img, 3, linux, 0, 0, "data"); err == nil {
+		t.Error("AddPartition() succeeded with a name in an MBR")
+	}
+	if err := AddPartition(img, 3, PartitionType{GPT: GPTTypeLinuxFS}, 0, 0, ""); err == nil {
+		t.Error("AddPartition() succeeded with a GPT type in an MBR")
+	}
+	if err := AddPartition(img, 3, linux, 0, 2048*8, ""); err != nil {
+		t.Fatalf("AddPartition() failed: %v", err)
+	}
+	if err := AddPartition(img, 4, PartitionType{MBR: 0x82}, 0, 0, ""); err != nil {
+		t.Fatalf("AddPartition() failed: %v", err)
+	}
+	if err := ResizePartition(img, 2, 2048*20); err == nil {
+		t.Error("ResizePartition() succeeded with an overlapping partition")
+	}
+	if err := DeletePartition(img, 4); err != nil {
+		t.Fatalf("DeletePartition() failed: %v", err)
+	}
+	if err := DeletePartition(img, 4); err == nil {
+		t.Error("DeletePartition() succeeded for a deleted partition")
+	}
+	if err := ExpandImage(img, 3); err != nil {
+		t.Fatalf("ExpandImage() failed: %v", err)
+	}
+	if err := SetPartitionType(img, 3, PartitionType{MBR: 0x8E}); err != nil {
+		t.Fatalf("SetPartitionType() failed: %v", err)
+	}
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tab, err := mbr.Read(f)
+	if err != nil {
+		t.Fatalf("mbr.Read() failed: %v", err)
+	}
+	if err := CheckPiPartitionTable(f); err == nil {
+		t.Error("CheckPiPartitionTable() succeeded with a third partition")
+	}
+	for i, want := range []struct {
+		typ           mbr.PartitionType
+		start, length uint32
+	}{
+		{PartitionTypeFAT32LBA, 8192, 8192},
+		{PartitionTypeLinuxNativePartition, 16384, 32768},
+		{0x8E, 49152, 131072 - 49152},
+		{mbr.PART_EMPTY, 0, 0},
+	} {
+		p := tab.GetPartition(i + 1)
+		if p.GetType() != want.typ || p.GetLBAStart() != want.start || p.GetLBALen() != want.length {
+			t.Errorf("partition %d = type %#x, %d+%d, want type %#x, %d+%d", i+1,
+				p.GetType(), p.GetLBAStart(), p.GetLBALen(), want.typ, want.start, want.length)
+		}
+	}
+	sector := make([]byte, sectorSize)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		t.Fatal(err)
+	}
+	if id := MBRDiskID(sector); id != 0x738a4d67 {
+		t.Errorf("disk ID = %#x, want 0x738a4d67", id)
+	}
+}
+
+func TestEditGPTPartitions(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "gpt.img")
+	if err := ioutil.WriteFile(img, makeGPTImage(t, []GPTPartition{
+		{TypeGUID: GPTTypeBasicData, GUID: MustParseGUID("AAAAAAAA-0000-0000-0000-000000000001"), FirstLBA: 2048, LastLBA: 4095, Name: "boot"},
+		{TypeGUID: GPTTypeLinuxFS, GUID: MustParseGUID("AAAAAAAA-0000-0000-0000-000000000002"), FirstLBA: 4096, LastLBA: 6143, Name: "rootfs"},
+	}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Grow the image, leaving the backup table in the middle of the disk.
+	if err := os.Truncate(img, 16384*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading the layout reports the table as it is on disk.
+	l, err := openLayout(img, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("openLayout() failed: %v", err)
+	}
+	l.f.Close()
+	if _, last := l.bounds(); last == 16383-33 {
+		t.Errorf("bounds() of a read-only layout = %d, want the last usable sector on disk", last)
+	}
+
+	if err := ExpandImage(img, 2); err != nil {
+		t.Fatalf("ExpandImage() failed: %v", err)
+	}
+	if err := ResizePartition(img, 2, 4096); err != nil {
+		t.Fatalf("ResizePartition() failed: %v", err)
+	}
+	if err := AddPartition(img, 3, PartitionType{MBR: PartitionTypeLinuxNativePartition}, 0, 0, ""); err == nil {
+		t.Error("AddPartition() succeeded with an MBR type in a GPT")
+	}
+	if err := AddPartition(img, 3, PartitionType{GPT: GPTTypeLinuxFS}, 0, 0, "data"); err != nil {
+		t.Fatalf("AddPartition() failed: %v", err)
+	}
+	if err := SetPartitionType(img, 1, PartitionType{GPT: GPTTypeEFISystem}); err != nil {
+		t.Fatalf("SetPartitionType() failed: %v", err)
+	}
+
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tab, err := ReadGPT(f)
+	if err != nil {
+		t.Fatalf("ReadGPT() failed: %v", err)
+	}
+	if tab.BackupLBA != 16383 || tab.LastUsableLBA != 16383-33 {
+		t.Errorf("BackupLBA, LastUsableLBA = %d, %d, want 16383, %d", tab.BackupLBA, tab.LastUsableLBA, 16383-33)
+	}
+	parts := tab.Used()
+	if len(parts) != 3 {
+		t.Fatalf("got %d partitions, want 3", len(parts))
+	}
+	if p := parts[0]; p.TypeGUID != GPTTypeEFISystem || p.Name != "boot" {
+		t.Errorf("partition 1 = %+v", p)
+	}
+	if p := parts[1]; p.FirstLBA != 4096 || p.LastLBA != 8191 {
+		t.Errorf("partition 2 = sectors %d-%d, want 4096-8191", p.FirstLBA, p.LastLBA)
+	}
+	if p := parts[2]; p.FirstLBA != 8192 || p.LastLBA != tab.LastUsableLBA || p.Name != "data" || p.GUID.IsZero() {
+		t.Errorf("partition 3 = %+v", p)
+	}
+
+	// The backup header must describe the same table.
+	hdr := make([]byte, sectorSize)
+	if _, err := f.ReadAt(hdr, 16383*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr[:8]) != gptSignature || binary.LittleEndian.Uint64(hdr[24:]) != 16383 || binary.LittleEndian.Uint64(hdr[72:]) != 16383-32 {
+		t.Error("backup header is invalid")
+	}
+	sector := make([]byte, sectorSize)
+	f.ReadAt(sector, 0)
+	if !IsProtectiveMBR(sector) || binary.LittleEndian.Uint32(sector[mbrTableOffset+12:]) != 16383 {
+		t.Error("protective MBR does not cover the disk")
+	}
+}
@@ -3,7 +3,7 @@ package fs
 
 import (
 	"fmt"
-	"os/exec"
+	"io"
 
 	"github.com/rekby/mbr"
 )
@@ -14,8 +14,29 @@ const (
 	PartitionTypeLinuxNativePartition = 0x83
 )
 
-// CheckPiPartitionTable returns an error if the pi image has a bad partition table.
-func CheckPiPartitionTable(t *mbr.MBR) error {
+// CheckPiPartitionTable returns an error if the pi image has a bad partition
+// table, which may be an MBR or GUID partition table.
+func CheckPiPartitionTable(img io.ReaderAt) error {
+	isGPT, err := HasGPT(img)
+	if err != nil {
+		return fmt.Errorf("reading partition table: %v", err)
+	}
+	if isGPT {
+		t, err := ReadGPT(img)
+		if err != nil {
+			return err
+		}
+		return checkPiGPT(t)
+	}
+	t, err := mbr.Read(io.NewSectionReader(img, 0, sectorSize))
+	if err != nil {
+		return fmt.Errorf("reading partition table: %v", err)
+	}
+	return checkPiMBR(t)
+}
+
+// checkPiMBR returns an error if the pi image has a bad MBR partition table.
+func checkPiMBR(t *mbr.MBR) error {
 	if err := t.Check(); err != nil {
 		return err
 	}
@@ -43,9 +64,27 @@ func CheckPiPartitionTable(t *mbr.MBR) error {
 	return nil
 }
 
-func ExpandImage(path string, partition int) error {
-	if err := exec.Command("parted", "-s", path, "resizepart", fmt.Sprint(partition), "100%").Run(); err != nil {
-		return fmt.Errorf("parted: %v", err)
+// checkPiGPT returns an error if the pi image has a bad GUID partition table.
+// The first partition must be a FAT boot partition, and the second must be
+// a Linux partition.
+func checkPiGPT(t *GPT) error {
+	parts := t.Used()
+	if len(parts) < 2 {
+		return fmt.Errorf(">=2 partitions expected, got %d", len(parts))
+	}
+	if ty := parts[0].TypeGUID; ty != GPTTypeBasicData && ty != GPTTypeEFISystem {
+		return fmt.Errorf("partition at index 0 has type %v", ty)
+	}
+	switch parts[1].TypeGUID {
+	case GPTTypeLinuxFS, GPTTypeLinuxRootARM, GPTTypeLinuxRootARM64:
+	default:
+		return fmt.Errorf("partition at index 1 has type %v", parts[1].TypeGUID)
 	}
 	return nil
 }
+
+// ExpandImage grows the given partition to fill the free space which
+// follows it. Partitions are numbered from 1.
+func ExpandImage(path string, partition int) error {
+	return ResizePartition(path, partition, 0)
+}
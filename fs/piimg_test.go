@@ -12,8 +12,9 @@ var (
 	imgPath = flag.String("pi-img", "", "Path to a mint raspbian image.")
 )
 
-func init() {
+func TestMain(m *testing.M) {
 	flag.Parse()
+	os.Exit(m.Run())
 }
 
 func TestSoftLoadPiImg(t *testing.T) {
@@ -32,7 +33,7 @@ func TestSoftLoadPiImg(t *testing.T) {
 	}
 	defer f.Close()
 
-	if err := CheckPiPartitionTable(tab); err != nil {
+	if err := CheckPiPartitionTable(f); err != nil {
 		t.Errorf("partition table check failed: %v", err)
 	}
 
@@ -59,7 +60,7 @@ func TestKMountPiImg(t *testing.T) {
 	}
 	defer f.Close()
 
-	if err := CheckPiPartitionTable(tab); err != nil {
+	if err := CheckPiPartitionTable(f); err != nil {
 		t.Errorf("partition table check failed: %v", err)
 	}
 
@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RecorderBase is the filesystem beneath a Recorder.
+type RecorderBase interface {
+	OverlayBase
+	Symlink(at, to string) error
+	Mkdir(at string) error
+	Write(path string, data []byte, perms os.FileMode) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Chmod(path string, mode os.FileMode) error
+	Chown(path string, uid, gid int) error
+	CopyInto(sysPath, path string) error
+	Mountpoint() string
+}
+
+// Recorder passes modifications through to a filesystem, reporting each one
+// to a callback once it has been made. Unlike Overlay, the contents of
+// files which are overwritten are not reported.
+type Recorder struct {
+	base     RecorderBase
+	onChange func(Change)
+}
+
+// NewRecorder returns a recorder for base. onChange is called for every
+// successful modification, in the order they are made.
+func NewRecorder(base RecorderBase, onChange func(Change)) *Recorder {
+	return &Recorder{base: base, onChange: onChange}
+}
+
+// Cat implements interpreter.FS.
+func (r *Recorder) Cat(p string) ([]byte, error) {
+	return r.base.Cat(p)
+}
+
+// Stat implements interpreter.FS.
+func (r *Recorder) Stat(p string) (os.FileInfo, error) {
+	return r.base.Stat(p)
+}
+
+// LStat implements interpreter.FS.
+func (r *Recorder) LStat(p string) (os.FileInfo, error) {
+	return r.base.LStat(p)
+}
+
+// Readlink implements interpreter.FS.
+func (r *Recorder) Readlink(p string) (string, error) {
+	return r.base.Readlink(p)
+}
+
+// Write implements interpreter.FS.
+func (r *Recorder) Write(p string, data []byte, perms os.FileMode) error {
+	p = cleanPath(p)
+	c := Change{Op: "write", Path: p, Mode: permBits(perms), After: data}
+	if s, err := r.base.Stat(p); err == nil {
+		// Existing files keep their mode.
+		c.Exists, c.Mode = true, s.Mode()
+	}
+	if err := r.base.Write(p, data, perms); err != nil {
+		return err
+	}
+	r.onChange(c)
+	return nil
+}
+
+// Mkdir implements interpreter.FS.
+func (r *Recorder) Mkdir(at string) error {
+	at = cleanPath(at)
+	if err := r.base.Mkdir(at); err != nil {
+		return err
+	}
+	r.onChange(Change{Op: "mkdir", Path: at, Mode: 0755})
+	return nil
+}
+
+// Symlink implements interpreter.FS.
+func (r *Recorder) Symlink(at, to string) error {
+	at = cleanPath(at)
+	if err := r.base.Symlink(at, to); err != nil {
+		return err
+	}
+	r.onChange(Change{Op: "symlink", Path: at, Target: to})
+	return nil
+}
+
+// Remove implements interpreter.FS.
+func (r *Recorder) Remove(p string) error {
+	p = cleanPath(p)
+	if err := r.base.Remove(p); err != nil {
+		return err
+	}
+	r.onChange(Change{Op: "remove", Path: p})
+	return nil
+}
+
+// RemoveAll implements interpreter.FS. Nothing is reported if p does not
+// exist.
+func (r *Recorder) RemoveAll(p string) error {
+	p = cleanPath(p)
+	_, err := r.base.LStat(p)
+	exists := err == nil
+	if err := r.base.RemoveAll(p); err != nil {
+		return err
+	}
+	if exists {
+		r.onChange(Change{Op: "remove_all", Path: p})
+	}
+	return nil
+}
+
+// Chmod implements interpreter.FS.
+func (r *Recorder) Chmod(p string, mode os.FileMode) error {
+	p = cleanPath(p)
+	if err := r.base.Chmod(p, mode); err != nil {
+		return err
+	}
+	r.onChange(Change{Op: "chmod", Path: p, Mode: permBits(mode)})
+	return nil
+}
+
+// Chown implements interpreter.FS.
+func (r *Recorder) Chown(p string, uid, gid int) error {
+	p = cleanPath(p)
+	if err := r.base.Chown(p, uid, gid); err != nil {
+		return err
+	}
+	r.onChange(Change{Op: "chown", Path: p, UID: uid, GID: gid})
+	return nil
+}
+
+// CopyInto implements interpreter.FS. The copy is made by the underlying
+// filesystem, then each file, directory and symlink copied is reported.
+func (r *Recorder) CopyInto(sysPath, p string) error {
+	dst := cleanPath(p)
+	if s, err := r.base.Stat(dst); err == nil && s.IsDir() {
+		dst = path.Join(dst, filepath.Base(sysPath))
+	}
+	// The source is walked before copying, to know which files existed.
+	var changes []Change
+	if err := r.copyChanges(sysPath, dst, &changes); err != nil {
+		return err
+	}
+	if err := r.base.CopyInto(sysPath, p); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		r.onChange(c)
+	}
+	return nil
+}
+
+// copyChanges appends the changes made by copying the file or directory at
+// sysPath on the host to dst, following the semantics of cp -R.
+func (r *Recorder) copyChanges(sysPath, dst string, changes *[]Change) error {
+	s, err := os.Lstat(sysPath)
+	if err != nil {
+		return err
+	}
+	existing, err := r.base.Stat(dst)
+	exists := err == nil
+
+	switch {
+	case s.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(sysPath)
+		if err != nil {
+			return err
+		}
+		*changes = append(*changes, Change{Op: "symlink", Path: dst, Target: target})
+
+	case s.IsDir():
+		if !exists {
+			*changes = append(*changes, Change{Op: "mkdir", Path: dst, Mode: 0755})
+		}
+		entries, err := ioutil.ReadDir(sysPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := r.copyChanges(filepath.Join(sysPath, e.Name()), path.Join(dst, e.Name()), changes); err != nil {
+				return err
+			}
+		}
+
+	default:
+		// Only the hash is kept, as the tree being copied may be large.
+		sum, err := hashFile(sysPath)
+		if err != nil {
+			return err
+		}
+		c := Change{Op: "write", Path: dst, Mode: permBits(s.Mode()), SHA256: &sum}
+		if exists {
+			// Existing files keep their mode.
+			c.Exists, c.Mode = true, existing.Mode()
+		}
+		*changes = append(*changes, c)
+	}
+	return nil
+}
+
+func hashFile(sysPath string) ([32]byte, error) {
+	var sum [32]byte
+	f, err := os.Open(sysPath)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// Close implements interpreter.FS, closing the underlying filesystem.
+func (r *Recorder) Close() error {
+	return r.base.Close()
+}
+
+// Mountpoint implements interpreter.FS.
+func (r *Recorder) Mountpoint() string {
+	return r.base.Mountpoint()
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("raspberrypi\n"), 0644)
+	img := makeExt4Image(t, src)
+	base, err := OpenExt4(img, testPartOffset, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("OpenExt4() failed: %v", err)
+	}
+
+	host := t.TempDir()
+	os.MkdirAll(filepath.Join(host, "app", "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(host, "app", "bin", "run"), []byte("#!/bin/sh\n"), 0755)
+
+	var changes []Change
+	r := NewRecorder(base, func(c Change) { changes = append(changes, c) })
+	if err := r.Write("/etc/hostname", []byte("mypi\n"), 0600); err != nil {
+		t.Errorf("Write() failed: %v", err)
+	}
+	if err := r.Mkdir("/etc"); err == nil {
+		t.Error("Mkdir() of an existing directory succeeded")
+	}
+	if err := r.Chown("etc/hostname", 1000, 1000); err != nil {
+		t.Errorf("Chown() failed: %v", err)
+	}
+	if err := r.CopyInto(filepath.Join(host, "app"), "/opt"); err != nil {
+		t.Errorf("CopyInto() failed: %v", err)
+	}
+	if err := r.Symlink("/usr/bin/run", "/opt/bin/run"); err == nil {
+		t.Error("Symlink() into a missing directory succeeded")
+	}
+	if err := r.RemoveAll("/tmp"); err != nil {
+		t.Errorf("RemoveAll() of a missing path failed: %v", err)
+	}
+	if err := r.Remove("/opt/bin/run"); err != nil {
+		t.Errorf("Remove() failed: %v", err)
+	}
+
+	runSum := sha256.Sum256([]byte("#!/bin/sh\n"))
+	want := []Change{
+		{Op: "write", Path: "/etc/hostname", Mode: 0644, After: []byte("mypi\n"), Exists: true},
+		{Op: "chown", Path: "/etc/hostname", UID: 1000, GID: 1000},
+		{Op: "mkdir", Path: "/opt", Mode: 0755},
+		{Op: "mkdir", Path: "/opt/bin", Mode: 0755},
+		{Op: "write", Path: "/opt/bin/run", Mode: 0755, SHA256: &runSum},
+		{Op: "remove", Path: "/opt/bin/run"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v\nwant %+v", changes, want)
+	}
+
+	// Changes are made to the underlying filesystem.
+	st, err := StatFile(base, "/etc/hostname", nil)
+	if err != nil {
+		t.Fatalf("StatFile() failed: %v", err)
+	}
+	if want := (FileState{Mode: 0644, UID: 1000, GID: 1000, Size: 5, SHA256: sha256.Sum256([]byte("mypi\n"))}); *st != want {
+		t.Errorf("StatFile() = %+v, want %+v", *st, want)
+	}
+	if _, err := base.Stat("/opt/bin"); err != nil {
+		t.Errorf("Stat(/opt/bin) failed: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	fsckExt4(t, img)
+}
@@ -0,0 +1,209 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/rekby/mbr"
+	"golang.org/x/sys/unix"
+)
+
+// partitionAlignment is the granularity, in sectors, that shrunk partitions
+// are rounded up to.
+const partitionAlignment = 8
+
+var minSizeRe = regexp.MustCompile(`Estimated minimum size of the filesystem: (\d+)`)
+
+// ShrinkImage shrinks the ext4 filesystem in the given partition to its
+// minimum size plus headroom bytes, updates the partition table to match,
+// and truncates the image so it ends with the partition. Free space in the
+// filesystem is zeroed so the image compresses well. The partition must be
+// the last in the image, and partitions are numbered from 1.
+func ShrinkImage(path string, partition int, headroom uint64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if gpt, err := HasGPT(f); err != nil {
+		return err
+	} else if gpt {
+		return errors.New("shrinking images with a GUID partition table is not supported")
+	}
+	table, err := mbr.Read(f)
+	if err != nil {
+		return fmt.Errorf("reading partition table: %v", err)
+	}
+	part := table.GetPartition(partition)
+	if part == nil || part.IsEmpty() {
+		return fmt.Errorf("partition %d does not exist", partition)
+	}
+	for _, p := range table.GetAllPartitions() {
+		if !p.IsEmpty() && p.Num != partition && p.GetLBALast() > part.GetLBALast() {
+			return fmt.Errorf("partition %d is not the last partition in the image", partition)
+		}
+	}
+	start := uint64(part.GetLBAStart()) * sectorSize
+
+	sb, err := LoadExt4(f, start, uint64(part.GetLBALen())*sectorSize)
+	if err != nil {
+		return fmt.Errorf("partition %d: %v", partition, err)
+	}
+	blockSize := sb.blockSize
+
+	dev := fmt.Sprintf("%s?offset=%d", path, start)
+	if err := repairExt4(dev); err != nil {
+		return err
+	}
+	out, err := exec.Command("resize2fs", "-P", dev).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resize2fs: %v: %s", err, bytes.TrimSpace(out))
+	}
+	m := minSizeRe.FindSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("resize2fs: could not determine minimum size: %s", bytes.TrimSpace(out))
+	}
+	minBlocks, err := strconv.ParseUint(string(m[1]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("resize2fs: %v", err)
+	}
+	blocks := minBlocks + (headroom+blockSize-1)/blockSize
+	if blocks < sb.blocksCount() {
+		if err := resizeExt4(f, start, uint64(part.GetLBALen())*sectorSize, blocks*blockSize); err != nil {
+			return err
+		}
+	} else {
+		blocks = sb.blocksCount()
+	}
+
+	fs, err := LoadExt4(f, start, blocks*blockSize)
+	if err != nil {
+		return fmt.Errorf("partition %d: %v", partition, err)
+	}
+	if err := fs.ZeroFreeBlocks(); err != nil {
+		return fmt.Errorf("zeroing free space: %v", err)
+	}
+
+	sectors := (blocks*blockSize/sectorSize + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+	if sectors < uint64(part.GetLBALen()) {
+		part.SetLBALen(uint32(sectors))
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		if err := table.Write(f); err != nil {
+			return fmt.Errorf("writing partition table: %v", err)
+		}
+	}
+	if err := f.Truncate(int64(uint64(part.GetLBAStart())+uint64(part.GetLBALen())) * sectorSize); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// resizeExt4 shrinks the ext4 filesystem of length bytes at offset start in
+// f so it is size bytes long. resize2fs truncates a regular file to the new
+// size of the filesystem without regard to the offset, so the filesystem is
+// resized in a temporary copy and then copied back.
+func resizeExt4(f *os.File, start, length, size uint64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Name()), ".shrink-*.img")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := sparseCopy(tmp, f, int64(start), int64(length)); err != nil {
+		return err
+	}
+	if out, err := exec.Command("resize2fs", tmp.Name(), fmt.Sprintf("%dK", size/1024)).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	// Copy every byte back, so nothing of the old filesystem is left where
+	// the copy has holes.
+	if _, err := f.Seek(int64(start), io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(tmp, 0, int64(size)))
+	return err
+}
+
+// repairExt4 checks and repairs the ext4 filesystem at dev, which may use the
+// img?offset=N syntax understood by e2fsprogs.
+func repairExt4(dev string) error {
+	out, err := exec.Command("e2fsck", "-fy", dev).CombinedOutput()
+	var exitErr *exec.ExitError
+	// Exit status 1 indicates errors were corrected.
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("e2fsck: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// ZeroFreeBlocks zeroes all blocks which are not in use by the filesystem,
+// punching holes in the image where possible.
+func (fs *Ext4FS) ZeroFreeBlocks() error {
+	var run blockRun
+	flush := func() error {
+		if run.length == 0 {
+			return nil
+		}
+		err := fs.zeroBlocks(run)
+		run = blockRun{}
+		return err
+	}
+
+	for g := uint32(0); g < fs.groupCount; g++ {
+		bm, err := fs.blockBitmap(g)
+		if err != nil {
+			return err
+		}
+		first := fs.groupFirstBlock(g)
+		for bit := uint64(0); bit < uint64(fs.blocksPerGroup()) && first+bit < fs.blocksCount(); bit++ {
+			if bitSet(bm.data, bit) {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			if run.length == 0 {
+				run.start = first + bit
+			}
+			run.length++
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return fs.f.Sync()
+}
+
+func (fs *Ext4FS) zeroBlocks(r blockRun) error {
+	off, length := fs.blockOffset(r.start), int64(r.length*fs.blockSize)
+	err := unix.Fallocate(int(fs.f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+	if err == nil {
+		return nil
+	}
+	if !isErrno(err, unix.EOPNOTSUPP) && !isErrno(err, unix.ENOSYS) {
+		return err
+	}
+	zero := make([]byte, fs.blockSize)
+	for b := uint64(0); b < r.length; b++ {
+		if _, err := fs.f.WriteAt(zero, fs.blockOffset(r.start+b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
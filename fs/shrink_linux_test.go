@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rekby/mbr"
+)
+
+func TestShrinkImage(t *testing.T) {
+	if _, err := exec.LookPath("resize2fs"); err != nil {
+		t.Skip("resize2fs not available")
+	}
+	src := t.TempDir()
+	data := bytes.Repeat([]byte("raspberry-box"), 300000)
+	ioutil.WriteFile(filepath.Join(src, "data"), data, 0644)
+	// The filesystem fills the 64Mb partition described below.
+	img := makeExt4ImageBlocks(t, src, 64*1024*1024/4096)
+
+	// Write a partition table describing the filesystem.
+	table := make([]byte, 512)
+	table[446+4] = PartitionTypeLinuxNativePartition
+	binary.LittleEndian.PutUint32(table[446+8:], testPartOffset/sectorSize)
+	binary.LittleEndian.PutUint32(table[446+12:], 64*1024*1024/sectorSize)
+	table[510], table[511] = 0x55, 0xAA
+	f, err := os.OpenFile(img, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(table, 0)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The headroom is less than the offset of the partition, so data at the
+	// end of the shrunk filesystem would be lost if the image was truncated
+	// to the size of the filesystem.
+	const headroom = 512 * 1024
+	if err := ShrinkImage(img, 2, headroom); err == nil {
+		t.Error("ShrinkImage() succeeded on a non-existent partition")
+	}
+	if err := ShrinkImage(img, 1, headroom); err != nil {
+		t.Fatalf("ShrinkImage() failed: %v", err)
+	}
+	fsckExt4(t, img)
+
+	f, err = os.Open(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tab, err := mbr.Read(f)
+	if err != nil {
+		t.Fatalf("mbr.Read() failed: %v", err)
+	}
+	part := tab.GetPartition(1)
+	end := int64(part.GetLBAStart()+part.GetLBALen()) * sectorSize
+	if st, err := f.Stat(); err != nil || st.Size() != end {
+		t.Errorf("image size = %v, %v, want %d", st.Size(), err, end)
+	}
+	length := uint64(part.GetLBALen()) * sectorSize
+	if length >= 32*1024*1024 || length < uint64(len(data))+headroom {
+		t.Errorf("partition length = %d, want between %d and %d", length, len(data)+headroom, 32*1024*1024)
+	}
+
+	fs, err := LoadExt4(f, testPartOffset, length)
+	if err != nil {
+		t.Fatalf("LoadExt4() failed: %v", err)
+	}
+	if fs.blocksCount()*fs.blockSize > length {
+		t.Errorf("filesystem is %d bytes, larger than the %d byte partition", fs.blocksCount()*fs.blockSize, length)
+	}
+	if d, err := fs.Cat("/data"); err != nil || !bytes.Equal(d, data) {
+		t.Errorf("Cat(/data) = %d bytes, %v, want %d bytes", len(d), err, len(data))
+	}
+}
@@ -2,7 +2,6 @@ package interpreter
 
 import (
 	"errors"
-	"io/ioutil"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -21,9 +20,11 @@ func generateEnvironment(s *Script) (starlark.StringDict, error) {
 		"fs":        starlarkstruct.FromStringDict(starlarkstruct.Default, fsBuiltins(s)),
 		"systemd":   starlarkstruct.FromStringDict(starlarkstruct.Default, sysdBuiltins(s)),
 		"net":       starlarkstruct.FromStringDict(starlarkstruct.Default, netBuiltins(s)),
+		"unix":      starlarkstruct.FromStringDict(starlarkstruct.Default, unixBuiltins(s)),
 		"compiler":  starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{"version": starlark.MakeInt64(starlark.CompilerVersion)}),
 		"crypt":     starlarkstruct.FromStringDict(starlarkstruct.Default, cryptBuiltins(s)),
 		"container": starlarkstruct.FromStringDict(starlarkstruct.Default, containerBuiltins(s)),
+		"assert":    starlarkstruct.FromStringDict(starlarkstruct.Default, assertBuiltins(s)),
 	}
 
 	if s.testHook != nil {
@@ -33,18 +34,6 @@ func generateEnvironment(s *Script) (starlark.StringDict, error) {
 	return g, nil
 }
 
-// WDLoader loads scripts relative to the working directory.
-type WDLoader struct{}
-
-func (l *WDLoader) resolveImport(name string) ([]byte, error) {
-	return ioutil.ReadFile(name)
-}
-
-// ScriptLoader provides a means for arbitrary imports to be resolved.
-type ScriptLoader interface {
-	resolveImport(name string) ([]byte, error)
-}
-
 func (s *Script) loadScript(script []byte, fname string, loader ScriptLoader) (*starlark.Thread, starlark.StringDict, error) {
 	var moduleCache = map[string]starlark.StringDict{}
 	var load func(_ *starlark.Thread, module string) (starlark.StringDict, error)
@@ -52,8 +41,16 @@ func (s *Script) loadScript(script []byte, fname string, loader ScriptLoader) (*
 	if err != nil {
 		return nil, nil, err
 	}
+	s.predeclared = predeclared
 
-	load = func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+	load = func(t *starlark.Thread, module string) (starlark.StringDict, error) {
+		// Modules are cached by their canonical name, which is also the
+		// name of the thread loading them, so that loads within them are
+		// resolved relative to the module.
+		module, d, err2 := loader.resolveImport(module, t.Name)
+		if err2 != nil {
+			return nil, err2
+		}
 		m, ok := moduleCache[module]
 		if m == nil && ok {
 			return nil, errors.New("cycle in dependency graph when loading " + module)
@@ -64,30 +61,32 @@ func (s *Script) loadScript(script []byte, fname string, loader ScriptLoader) (*
 
 		// loading in progress
 		moduleCache[module] = nil
-		d, err2 := loader.resolveImport(module)
-		if err2 != nil {
-			return nil, err2
-		}
 		thread := &starlark.Thread{
+			Name:  module,
 			Print: s.printFromSkylark,
 			Load:  load,
 		}
 		mod, err2 := starlark.ExecFile(thread, module, d, predeclared)
 		if err2 != nil {
-			return nil, err2
+			// The error is reported as a string by the load statement, so
+			// the backtrace within the module is included in its message.
+			return nil, errors.New(Backtrace(annotate(err2)))
 		}
 		moduleCache[module] = mod
 		return mod, nil
 	}
 
 	thread := &starlark.Thread{
+		Name:  fname,
 		Print: s.printFromSkylark,
 		Load:  load,
 	}
+	// Set early so mutations made by top-level statements can be attributed.
+	s.thread = thread
 
 	globals, err := starlark.ExecFile(thread, fname, script, predeclared)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, annotate(err)
 	}
 
 	return thread, globals, nil
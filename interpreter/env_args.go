@@ -3,6 +3,8 @@ package interpreter
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"strings"
 
 	"go.starlark.net/starlark"
 )
@@ -11,9 +13,15 @@ func argBuiltins(s *Script) starlark.StringDict {
 	return starlark.StringDict{
 		"verbose": starlark.Bool(s.verbose),
 		"num_args": starlark.NewBuiltin("num_args", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := s.parseFlags(); err != nil {
+				return starlark.None, err
+			}
 			return starlark.MakeInt(s.fs.NArg()), nil
 		}),
 		"args": starlark.NewBuiltin("args", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := s.parseFlags(); err != nil {
+				return starlark.None, err
+			}
 			var elements []starlark.Value
 			for _, e := range s.fs.Args() {
 				elements = append(elements, starlark.String(e))
@@ -29,19 +37,185 @@ func argBuiltins(s *Script) starlark.StringDict {
 			if !ok {
 				return starlark.None, errors.New("cannot represent position as integer")
 			}
+			if err := s.parseFlags(); err != nil {
+				return starlark.None, err
+			}
 			return starlark.String(s.fs.Arg(int(i))), nil
 		}),
+		"string": starlark.NewBuiltin("string", s.declareFlag),
+		"int":    starlark.NewBuiltin("int", s.declareFlag),
+		"bool":   starlark.NewBuiltin("bool", s.declareFlag),
+		"list":   starlark.NewBuiltin("list", s.declareFlag),
 	}
 }
 
-func (s *Script) initFlags() error {
-	s.fs = flag.NewFlagSet("raspberry-box", flag.ContinueOnError)
+func (s *Script) initFlags(fname string) {
+	s.fs = flag.NewFlagSet(fname, flag.ContinueOnError)
+}
+
+// parseFlags parses the arguments to the script against the flags declared
+// so far. Arguments are parsed once, either when they are first read or
+// after the script has loaded.
+func (s *Script) parseFlags() error {
+	if !s.fs.Parsed() {
+		s.flagErr = s.fs.Parse(s.args)
+	}
+	return s.flagErr
+}
 
-	if len(s.args) > 0 {
-		if err := s.fs.Parse(s.args); err != nil {
-			return err
+// declareFlag implements args.string(), args.int(), args.bool() and
+// args.list(), which declare a flag of the type named by the builtin.
+func (s *Script) declareFlag(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name, help string
+		def        starlark.Value
+	)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "default?", &def, "help?", &help); err != nil {
+		return starlark.None, err
+	}
+	if name == "" || strings.HasPrefix(name, "-") || strings.Contains(name, "=") {
+		return starlark.None, fmt.Errorf("invalid flag name %q", name)
+	}
+	if s.fs.Parsed() {
+		return starlark.None, fmt.Errorf("flag %q declared after arguments were read", name)
+	}
+	if s.fs.Lookup(name) != nil {
+		return starlark.None, fmt.Errorf("flag %q is already declared", name)
+	}
+
+	switch fn.Name() {
+	case "string":
+		var d string
+		if def != nil {
+			v, ok := starlark.AsString(def)
+			if !ok {
+				return starlark.None, fmt.Errorf("default for flag %q must be a string, got %s", name, def.Type())
+			}
+			d = v
 		}
+		s.fs.String(name, d, help)
+	case "int":
+		var d int
+		if def != nil {
+			var err error
+			if d, err = starlark.AsInt32(def); err != nil {
+				return starlark.None, fmt.Errorf("default for flag %q: %v", name, err)
+			}
+		}
+		s.fs.Int(name, d, help)
+	case "bool":
+		var d bool
+		if def != nil {
+			b, ok := def.(starlark.Bool)
+			if !ok {
+				return starlark.None, fmt.Errorf("default for flag %q must be a bool, got %s", name, def.Type())
+			}
+			d = bool(b)
+		}
+		s.fs.Bool(name, d, help)
+	case "list":
+		v := &listFlag{}
+		if def != nil {
+			l, ok := def.(*starlark.List)
+			if !ok {
+				return starlark.None, fmt.Errorf("default for flag %q must be a list, got %s", name, def.Type())
+			}
+			for i := 0; i < l.Len(); i++ {
+				e, ok := starlark.AsString(l.Index(i))
+				if !ok {
+					return starlark.None, fmt.Errorf("default for flag %q: element %d must be a string, got %s", name, i, l.Index(i).Type())
+				}
+				v.values = append(v.values, e)
+			}
+		}
+		s.fs.Var(v, name, help)
+	}
+	return &FlagProxy{s: s, name: name}, nil
+}
+
+// listFlag is a flag.Value which collects each occurrence of a flag. The
+// first occurrence replaces the default.
+type listFlag struct {
+	values []string
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
 	}
+	return strings.Join(l.values, ",")
+}
 
+func (l *listFlag) Set(v string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+	l.values = append(l.values, v)
 	return nil
 }
+
+func (l *listFlag) Get() interface{} {
+	return l.values
+}
+
+// FlagProxy proxies access to a flag declared by a script.
+type FlagProxy struct {
+	s    *Script
+	name string
+}
+
+func (p *FlagProxy) String() string {
+	return fmt.Sprintf("flag(%q)", p.name)
+}
+
+// Type implements starlark.Value.
+func (p *FlagProxy) Type() string {
+	return "flag"
+}
+
+// Freeze implements starlark.Value.
+func (p *FlagProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *FlagProxy) Truth() starlark.Bool {
+	return true
+}
+
+// Hash implements starlark.Value.
+func (p *FlagProxy) Hash() (uint32, error) {
+	return starlark.String(p.name).Hash()
+}
+
+// AttrNames implements starlark.Value.
+func (p *FlagProxy) AttrNames() []string {
+	return []string{"help", "name", "value"}
+}
+
+// Attr implements starlark.Value.
+func (p *FlagProxy) Attr(name string) (starlark.Value, error) {
+	f := p.s.fs.Lookup(p.name)
+	switch name {
+	case "name":
+		return starlark.String(p.name), nil
+	case "help":
+		return starlark.String(f.Usage), nil
+	case "value":
+		if err := p.s.parseFlags(); err != nil {
+			return starlark.None, err
+		}
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case string:
+			return starlark.String(v), nil
+		case int:
+			return starlark.MakeInt(v), nil
+		case bool:
+			return starlark.Bool(v), nil
+		case []string:
+			return cvStrListToStarlark(v), nil
+		}
+	}
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
@@ -0,0 +1,79 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	sd "github.com/twitchyliquid64/raspberry-box/sysd"
+	"go.starlark.net/starlark"
+)
+
+// assertionFailed returns the error reported when an assertion fails,
+// prefixed with the message given by the script if there is one.
+func assertionFailed(msg starlark.String, format string, args ...interface{}) error {
+	if msg != "" {
+		return fmt.Errorf("assertion failed: %s: %s", string(msg), fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("assertion failed: %s", fmt.Sprintf(format, args...))
+}
+
+func assertBuiltins(s *Script) starlark.StringDict {
+	return starlark.StringDict{
+		"eq": starlark.NewBuiltin("eq", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var got, want starlark.Value
+			var msg starlark.String
+			if err := starlark.UnpackArgs("eq", args, kwargs, "got", &got, "want", &want, "msg?", &msg); err != nil {
+				return starlark.None, err
+			}
+			eq, err := starlark.Equal(got, want)
+			if err != nil {
+				return starlark.None, err
+			}
+			if !eq {
+				return starlark.None, assertionFailed(msg, "%s != %s", got, want)
+			}
+			return starlark.None, nil
+		}),
+		"file_contains": starlark.NewBuiltin("file_contains", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var f starlark.Value
+			var path, substr, msg starlark.String
+			if err := starlark.UnpackArgs("file_contains", args, kwargs, "fs", &f, "path", &path, "substr", &substr, "msg?", &msg); err != nil {
+				return starlark.None, err
+			}
+			fs, ok := f.(*FSMountProxy)
+			if !ok {
+				return starlark.None, fmt.Errorf("fs parameter must be of type fs.Mount, got %T", f)
+			}
+			d, err := fs.fs.Cat(string(path))
+			if err != nil {
+				return starlark.None, assertionFailed(msg, "%v", err)
+			}
+			if !strings.Contains(string(d), string(substr)) {
+				return starlark.None, assertionFailed(msg, "%s does not contain %s, it contains %s", string(path), substr, starlark.String(d))
+			}
+			return starlark.None, nil
+		}),
+		"unit_enabled": starlark.NewBuiltin("unit_enabled", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var f starlark.Value
+			var unit, target, msg starlark.String
+			if err := starlark.UnpackArgs("unit_enabled", args, kwargs, "fs", &f, "unit", &unit, "target?", &target, "msg?", &msg); err != nil {
+				return starlark.None, err
+			}
+			if target == "" {
+				target = starlark.String(sd.DefaultTarget(string(unit)))
+			}
+			fs, ok := f.(*FSMountProxy)
+			if !ok {
+				return starlark.None, fmt.Errorf("fs parameter must be of type fs.Mount, got %T", f)
+			}
+			enabled, err := sd.IsEnabledOnTarget(fs.fs, string(unit), string(target))
+			if err != nil {
+				return starlark.None, err
+			}
+			if !enabled {
+				return starlark.None, assertionFailed(msg, "%s is not enabled on %s", string(unit), string(target))
+			}
+			return starlark.None, nil
+		}),
+	}
+}
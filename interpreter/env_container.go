@@ -24,6 +24,15 @@ func containerBuiltins(s *Script) starlark.StringDict {
 				return starlark.None, err
 			}
 
+			if s.plan {
+				// Images are pulled directly into the mounted filesystem, so
+				// cannot be pulled into an overlay.
+				s.record(fs, "pull", string(ref), "")
+				return starlark.String(""), nil
+			}
+			if fs.fs.Mountpoint() == "" {
+				return nil, fmt.Errorf("%s is not mounted by the kernel backend", fs.Type())
+			}
 			if string(arch) == "" {
 				arch = "arm64"
 			}
@@ -65,6 +74,7 @@ func containerBuiltins(s *Script) starlark.StringDict {
 				return nil, fmt.Errorf("pulling image: %v", err)
 			}
 
+			s.record(fs, "pull", string(ref), "")
 			return starlark.String(newImage.ID()), nil
 		}),
 	}
@@ -1,11 +1,17 @@
 package interpreter
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/rekby/mbr"
 	"github.com/twitchyliquid64/raspberry-box/fs"
@@ -18,6 +24,14 @@ var (
 		0xc:  "FAT32-LBA",
 		0x83: "Native Linux",
 	}
+	knownGPTPartTypes = map[fs.GUID]string{
+		fs.GPTTypeEFISystem:      "EFI System",
+		fs.GPTTypeBasicData:      "Microsoft basic data",
+		fs.GPTTypeLinuxFS:        "Linux filesystem",
+		fs.GPTTypeLinuxRootARM:   "Linux root (ARM)",
+		fs.GPTTypeLinuxRootARM64: "Linux root (ARM64)",
+		fs.GPTTypeLinuxSwap:      "Linux swap",
+	}
 )
 
 func fsBuiltins(s *Script) starlark.StringDict {
@@ -25,6 +39,10 @@ func fsBuiltins(s *Script) starlark.StringDict {
 	for b, name := range knownPartTypes {
 		partEnums[name] = starlark.MakeInt64(int64(b))
 	}
+	gptEnums := starlark.StringDict{}
+	for g, name := range knownGPTPartTypes {
+		gptEnums[name] = starlark.String(g.String())
+	}
 
 	return starlark.StringDict{
 		"exists": starlark.NewBuiltin("exists", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -55,7 +73,8 @@ func fsBuiltins(s *Script) starlark.StringDict {
 			return starlark.String(d), nil
 		}),
 		"enums": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-			"partitions": starlarkstruct.FromStringDict(starlarkstruct.Default, partEnums),
+			"partitions":     starlarkstruct.FromStringDict(starlarkstruct.Default, partEnums),
+			"gpt_partitions": starlarkstruct.FromStringDict(starlarkstruct.Default, gptEnums),
 		}),
 		"perms": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 			"set_uid": starlark.MakeInt64(1 << (12 - 1 - 0)),
@@ -81,11 +100,7 @@ func fsBuiltins(s *Script) starlark.StringDict {
 
 			s, err := os.Stat(string(path))
 			if err != nil {
-				return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-					"success":    starlark.Bool(false),
-					"error":      starlark.String(err.Error()),
-					"not_exists": starlark.Bool(os.IsNotExist(err)),
-				}), nil
+				return failure(err), nil
 			}
 			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 				"success":    starlark.Bool(true),
@@ -103,14 +118,24 @@ func fsBuiltins(s *Script) starlark.StringDict {
 			if err := starlark.UnpackArgs("truncate", args, kwargs, "path", &path, "size", &size); err != nil {
 				return starlark.None, err
 			}
+			if err := s.checkNotPlan("truncate"); err != nil {
+				return starlark.None, err
+			}
 
 			sz, _ := size.Int64()
 			if err := os.Truncate(string(path), sz); err != nil {
-				return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-					"success":    starlark.Bool(false),
-					"error":      starlark.String(err.Error()),
-					"not_exists": starlark.Bool(os.IsNotExist(err)),
-				}), nil
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"decompress": starlark.NewBuiltin("decompress", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var src, dst starlark.String
+			if err := starlark.UnpackArgs("decompress", args, kwargs, "src", &src, "dst", &dst); err != nil {
+				return starlark.None, err
+			}
+
+			if err := fs.Decompress(string(src), string(dst)); err != nil {
+				return failure(err), nil
 			}
 			return starlark.None, nil
 		}),
@@ -120,113 +145,616 @@ func fsBuiltins(s *Script) starlark.StringDict {
 			if err := starlark.UnpackArgs("expand_partition", args, kwargs, "path", &path, "partition", &partition); err != nil {
 				return starlark.None, err
 			}
+			if err := s.checkNotPlan("expand_partition"); err != nil {
+				return starlark.None, err
+			}
 
-			p, _ := partition.Int64()
-			if err := fs.ExpandImage(string(path), int(p)); err != nil {
-				return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-					"success":    starlark.Bool(false),
-					"error":      starlark.String(err.Error()),
-					"not_exists": starlark.Bool(os.IsNotExist(err)),
-				}), nil
+			p, err := partitionNumber(partition)
+			if err != nil {
+				return starlark.None, err
+			}
+			if err := fs.ExpandImage(string(path), p); err != nil {
+				return failure(err), nil
 			}
 			return starlark.None, nil
 		}),
-		"mnt_ext4": starlark.NewBuiltin("mnt_ext4", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-			var path starlark.String
-			var part *starlarkstruct.Struct
-			var doResize starlark.Bool
-			if err := starlark.UnpackPositionalArgs("mnt_ext4", args, kwargs, 2, &path, &part, &doResize); err != nil {
+		"partition_add": starlark.NewBuiltin("partition_add", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path, name starlark.String
+			var partition starlark.Int
+			var typ starlark.Value
+			var sizeMB, startMB starlark.Int = starlark.MakeInt(0), starlark.MakeInt(0)
+			if err := starlark.UnpackArgs("partition_add", args, kwargs, "path", &path, "partition", &partition, "type", &typ,
+				"size_mb?", &sizeMB, "start_mb?", &startMB, "name?", &name); err != nil {
 				return starlark.None, err
 			}
-			if part == nil {
-				return starlark.None, errors.New("no partition information provided")
+			if err := s.checkNotPlan("partition_add"); err != nil {
+				return starlark.None, err
 			}
-
-			// Unpack partition information.
-			tmp, err := part.Attr("lba")
+			t, err := partitionType(typ)
 			if err != nil {
 				return starlark.None, err
 			}
-			lba := tmp.(*starlarkstruct.Struct)
-			start, err := lba.Attr("start")
+			size, ok := sizeMB.Uint64()
+			if !ok {
+				return starlark.None, errors.New("size_mb must be an unsigned integer")
+			}
+			start, ok := startMB.Uint64()
+			if !ok {
+				return starlark.None, errors.New("start_mb must be an unsigned integer")
+			}
+
+			p, err := partitionNumber(partition)
 			if err != nil {
 				return starlark.None, err
 			}
-			length, err := lba.Attr("length")
+			mounted, err := s.freeSpaceMounted(string(path), start*sectorsPerMB, size*sectorsPerMB)
 			if err != nil {
+				return failure(err), nil
+			}
+			if mounted {
+				return starlark.None, fmt.Errorf("partition_add: the space for partition %d of %s is mounted, and must be closed first", p, string(path))
+			}
+			if err := fs.AddPartition(string(path), p, t, start*sectorsPerMB, size*sectorsPerMB, string(name)); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"partition_delete": starlark.NewBuiltin("partition_delete", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path starlark.String
+			var partition starlark.Int
+			if err := starlark.UnpackArgs("partition_delete", args, kwargs, "path", &path, "partition", &partition); err != nil {
+				return starlark.None, err
+			}
+			if err := s.checkNotPlan("partition_delete"); err != nil {
 				return starlark.None, err
 			}
 
-			st, ok := start.(starlark.Int).Int64()
-			if !ok {
-				return starlark.None, errors.New("start is not an integer")
+			p, err := partitionNumber(partition)
+			if err != nil {
+				return starlark.None, err
+			}
+			if mounted, err := s.partitionMounted(string(path), p, false); err != nil {
+				return failure(err), nil
+			} else if mounted {
+				return starlark.None, fmt.Errorf("partition_delete: partition %d of %s is mounted, and must be closed first", p, string(path))
 			}
-			l, ok := length.(starlark.Int).Int64()
+			if err := fs.DeletePartition(string(path), p); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"partition_resize": starlark.NewBuiltin("partition_resize", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path starlark.String
+			var partition starlark.Int
+			var sizeMB starlark.Int = starlark.MakeInt(0)
+			if err := starlark.UnpackArgs("partition_resize", args, kwargs, "path", &path, "partition", &partition, "size_mb?", &sizeMB); err != nil {
+				return starlark.None, err
+			}
+			if err := s.checkNotPlan("partition_resize"); err != nil {
+				return starlark.None, err
+			}
+			size, ok := sizeMB.Uint64()
 			if !ok {
-				return starlark.None, errors.New("length is not an integer")
+				return starlark.None, errors.New("size_mb must be an unsigned integer")
 			}
 
-			mnt, err := fs.KMountExt4(string(path), uint64(st)*512, uint64(l)*512, bool(doResize))
+			p, err := partitionNumber(partition)
 			if err != nil {
 				return starlark.None, err
 			}
-			out := &FSMountProxy{
-				Kind: "Ext4",
-				Path: string(path),
-				fs:   mnt,
+			if mounted, err := s.partitionMounted(string(path), p, false); err != nil {
+				return failure(err), nil
+			} else if mounted {
+				return starlark.None, fmt.Errorf("partition_resize: partition %d of %s is mounted, and must be closed first", p, string(path))
+			}
+			if err := fs.ResizePartition(string(path), p, size*sectorsPerMB); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"partition_set_type": starlark.NewBuiltin("partition_set_type", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path starlark.String
+			var partition starlark.Int
+			var typ starlark.Value
+			if err := starlark.UnpackArgs("partition_set_type", args, kwargs, "path", &path, "partition", &partition, "type", &typ); err != nil {
+				return starlark.None, err
+			}
+			if err := s.checkNotPlan("partition_set_type"); err != nil {
+				return starlark.None, err
+			}
+			t, err := partitionType(typ)
+			if err != nil {
+				return starlark.None, err
 			}
 
-			s.resources = append(s.resources, out)
-			return out, nil
+			p, err := partitionNumber(partition)
+			if err != nil {
+				return starlark.None, err
+			}
+			if mounted, err := s.partitionMounted(string(path), p, false); err != nil {
+				return failure(err), nil
+			} else if mounted {
+				return starlark.None, fmt.Errorf("partition_set_type: partition %d of %s is mounted, and must be closed first", p, string(path))
+			}
+			if err := fs.SetPartitionType(string(path), p, t); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
 		}),
-		"mnt_vfat": starlark.NewBuiltin("mnt_vfat", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		"set_disk_id": starlark.NewBuiltin("set_disk_id", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var path starlark.String
-			var part *starlarkstruct.Struct
-			if err := starlark.UnpackPositionalArgs("mnt_vfat", args, kwargs, 2, &path, &part); err != nil {
+			var id starlark.Value = starlark.None
+			if err := starlark.UnpackArgs("set_disk_id", args, kwargs, "path", &path, "id?", &id); err != nil {
+				return starlark.None, err
+			}
+			if err := s.checkNotPlan("set_disk_id"); err != nil {
+				return starlark.None, err
+			}
+			d, err := diskID(id)
+			if err != nil {
 				return starlark.None, err
 			}
-			if part == nil {
-				return starlark.None, errors.New("no partition information provided")
+			if s.hasOpenMount(string(path), 0, math.MaxUint64) {
+				return starlark.None, fmt.Errorf("set_disk_id: %s has mounted partitions, which must be closed first", string(path))
 			}
 
-			// Unpack partition information.
-			tmp, err := part.Attr("lba")
+			if err := fs.SetDiskID(string(path), d); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"shrink_partition": starlark.NewBuiltin("shrink_partition", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path starlark.String
+			var partition starlark.Int
+			var headroomMB starlark.Int = starlark.MakeInt(0)
+			if err := starlark.UnpackArgs("shrink_partition", args, kwargs, "path", &path, "partition", &partition, "headroom_mb?", &headroomMB); err != nil {
+				return starlark.None, err
+			}
+			if err := s.checkNotPlan("shrink_partition"); err != nil {
+				return starlark.None, err
+			}
+			headroom, ok := headroomMB.Uint64()
+			if !ok {
+				return starlark.None, errors.New("headroom_mb must be an unsigned integer")
+			}
+
+			p, err := partitionNumber(partition)
 			if err != nil {
 				return starlark.None, err
 			}
-			lba := tmp.(*starlarkstruct.Struct)
-			start, err := lba.Attr("start")
+			// The image is truncated after the partition, so mounts of any
+			// later partitions are also affected.
+			mounted, err := s.partitionMounted(string(path), p, true)
 			if err != nil {
+				return failure(err), nil
+			}
+			if mounted {
+				return starlark.None, fmt.Errorf("shrink_partition: partition %d of %s is mounted, and must be closed first", p, string(path))
+			}
+			if err := fs.ShrinkImage(string(path), p, headroom*1024*1024); err != nil {
+				return failure(err), nil
+			}
+			return starlark.None, nil
+		}),
+		"mkfs": starlark.NewBuiltin("mkfs", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path, label, uuid, backend starlark.String
+			var part *starlarkstruct.Struct
+			var typ starlark.String = "ext4"
+			if err := starlark.UnpackArgs("mkfs", args, kwargs, "path", &path, "partition", &part, "type?", &typ,
+				"label?", &label, "uuid?", &uuid, "backend?", &backend); err != nil {
 				return starlark.None, err
 			}
-			length, err := lba.Attr("length")
+			if err := s.checkNotPlan("mkfs"); err != nil {
+				return starlark.None, err
+			}
+			start, length, err := partitionExtent(part)
 			if err != nil {
 				return starlark.None, err
 			}
+			if s.hasOpenMount(string(path), start, length) {
+				return starlark.None, fmt.Errorf("mkfs: the partition in %s is mounted, and must be closed first", string(path))
+			}
 
-			st, ok := start.(starlark.Int).Int64()
-			if !ok {
-				return starlark.None, errors.New("start is not an integer")
+			var mnt *FSMountProxy
+			switch typ {
+			case "ext4":
+				if err := fs.FormatExt4(string(path), start, length, string(label), string(uuid)); err != nil {
+					return starlark.None, err
+				}
+				mnt, err = s.mountExt4(string(path), start, length, false, string(backend))
+			case "vfat":
+				var id uint32
+				if id, err = fatVolumeID(string(uuid)); err != nil {
+					return starlark.None, err
+				}
+				if err := fs.FormatFAT(string(path), start, length, string(label), id); err != nil {
+					return starlark.None, err
+				}
+				mnt, err = s.mountVFAT(string(path), start, length, string(backend))
+			default:
+				return starlark.None, fmt.Errorf("unknown filesystem type %q, expected ext4 or vfat", typ)
 			}
-			l, ok := length.(starlark.Int).Int64()
-			if !ok {
-				return starlark.None, errors.New("length is not an integer")
+			if err != nil {
+				return starlark.None, err
+			}
+			return mnt, nil
+		}),
+		"mnt_ext4": starlark.NewBuiltin("mnt_ext4", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path, backend starlark.String
+			var part *starlarkstruct.Struct
+			var doResize starlark.Bool
+			if err := starlark.UnpackArgs("mnt_ext4", args, kwargs, "path", &path, "partition", &part, "resize?", &doResize, "backend?", &backend); err != nil {
+				return starlark.None, err
+			}
+			start, length, err := partitionExtent(part)
+			if err != nil {
+				return starlark.None, err
+			}
+			if doResize {
+				if err := s.checkNotPlan("mnt_ext4 with resize"); err != nil {
+					return starlark.None, err
+				}
 			}
 
-			mnt, err := fs.KMountVFat(string(path), uint64(st)*512, uint64(l)*512)
+			mnt, err := s.mountExt4(string(path), start, length, bool(doResize), string(backend))
 			if err != nil {
 				return starlark.None, err
 			}
-			out := &FSMountProxy{
-				Kind: "VFAT",
-				Path: string(path),
-				fs:   mnt,
+			return mnt, nil
+		}),
+		"mnt_vfat": starlark.NewBuiltin("mnt_vfat", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var path, backend starlark.String
+			var part *starlarkstruct.Struct
+			if err := starlark.UnpackArgs("mnt_vfat", args, kwargs, "path", &path, "partition", &part, "backend?", &backend); err != nil {
+				return starlark.None, err
+			}
+			start, length, err := partitionExtent(part)
+			if err != nil {
+				return starlark.None, err
 			}
 
-			s.resources = append(s.resources, out)
-			return out, nil
+			mnt, err := s.mountVFAT(string(path), start, length, string(backend))
+			if err != nil {
+				return starlark.None, err
+			}
+			return mnt, nil
 		}),
+		"mnt_memory": starlark.NewBuiltin("mnt_memory", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var fixture starlark.String
+			if err := starlark.UnpackArgs("mnt_memory", args, kwargs, "fixture?", &fixture); err != nil {
+				return starlark.None, err
+			}
+			path := string(fixture)
+			if path != "" && !filepath.IsAbs(path) {
+				// Fixtures live alongside the tests which use them.
+				caller := thread.CallStack().At(1).Pos.Filename()
+				path = filepath.Join(filepath.Dir(caller), path)
+			}
+
+			mnt, err := s.mountMemory(path)
+			if err != nil {
+				return starlark.None, err
+			}
+			return mnt, nil
+		}),
+	}
+}
+
+// failure returns the structure builtins return when an operation on a
+// file fails.
+func failure(err error) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"success":    starlark.Bool(false),
+		"error":      starlark.String(err.Error()),
+		"not_exists": starlark.Bool(os.IsNotExist(err)),
+	})
+}
+
+// partitionNumber converts a partition number passed to a builtin.
+// Partitions are numbered from 1.
+func partitionNumber(v starlark.Int) (int, error) {
+	n, ok := v.Int64()
+	if !ok || n < 1 || n > fs.MaxGPTEntries {
+		return 0, fmt.Errorf("invalid partition number %v", v)
+	}
+	return int(n), nil
+}
+
+// sectorsPerMB is the number of sectors in a megabyte.
+const sectorsPerMB = 1024 * 1024 / 512
+
+// partitionType converts a partition type passed to a builtin: either an
+// MBR partition type number, or a GPT partition type GUID.
+func partitionType(v starlark.Value) (fs.PartitionType, error) {
+	switch t := v.(type) {
+	case starlark.Int:
+		n, ok := t.Uint64()
+		if !ok || n == 0 || n > 0xFF {
+			return fs.PartitionType{}, fmt.Errorf("invalid MBR partition type %v", t)
+		}
+		return fs.PartitionType{MBR: byte(n)}, nil
+	case starlark.String:
+		g, err := fs.ParseGUID(string(t))
+		if err != nil {
+			return fs.PartitionType{}, err
+		}
+		return fs.PartitionType{GPT: g}, nil
+	}
+	return fs.PartitionType{}, fmt.Errorf("partition type must be an int or GUID string, got %s", v.Type())
+}
+
+// diskID converts a disk identifier passed to a builtin: either an integer,
+// or a string of 8 hex digits as it appears in a PARTUUID. A random
+// identifier is returned for None.
+func diskID(v starlark.Value) (uint32, error) {
+	switch t := v.(type) {
+	case starlark.NoneType:
+		return fs.NewDiskID()
+	case starlark.Int:
+		n, ok := t.Uint64()
+		if !ok || n == 0 || n > 0xFFFFFFFF {
+			return 0, fmt.Errorf("invalid disk identifier %v", t)
+		}
+		return uint32(n), nil
+	case starlark.String:
+		s := strings.TrimPrefix(strings.ToLower(string(t)), "0x")
+		n, err := strconv.ParseUint(s, 16, 32)
+		if err != nil || len(s) != 8 || n == 0 {
+			return 0, fmt.Errorf("invalid disk identifier %q, expected 8 hex digits", string(t))
+		}
+		return uint32(n), nil
+	}
+	return 0, fmt.Errorf("disk identifier must be an int or string, got %s", v.Type())
+}
+
+// hasOpenMount returns true if the script has a filesystem mounted which
+// overlaps length bytes at start in the image at path, and has not been
+// closed.
+func (s *Script) hasOpenMount(path string, start, length uint64) bool {
+	end := start + length
+	if end < start {
+		end = math.MaxUint64
+	}
+	for _, r := range s.resources {
+		p, ok := r.(*FSMountProxy)
+		if !ok || p.Kind == "Memory" || p.isClosed || filepath.Clean(p.Path) != filepath.Clean(path) {
+			continue
+		}
+		if p.start < end && start < p.start+p.length {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionMounted returns true if an open mount overlaps partition num of
+// the image at path. If toEnd is true, mounts between the partition and the
+// end of the image are included.
+func (s *Script) partitionMounted(path string, num int, toEnd bool) (bool, error) {
+	extents, err := fs.ReadPartitionExtents(path)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range extents {
+		if e.Num != num {
+			continue
+		}
+		length := e.Length * 512
+		if toEnd {
+			length = math.MaxUint64
+		}
+		return s.hasOpenMount(path, e.Start*512, length), nil
+	}
+	return false, nil
+}
+
+// freeSpaceMounted returns true if an open mount overlaps the space a new
+// partition of the image at path could occupy: length sectors at start, or
+// if start is zero, anything after the existing partitions. A length of
+// zero extends to the end of the image.
+func (s *Script) freeSpaceMounted(path string, start, length uint64) (bool, error) {
+	if start == 0 {
+		extents, err := fs.ReadPartitionExtents(path)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range extents {
+			if e.Start+e.Length > start {
+				start = e.Start + e.Length
+			}
+		}
+	}
+	size := uint64(math.MaxUint64)
+	if length != 0 {
+		size = length * 512
+	}
+	return s.hasOpenMount(path, start*512, size), nil
+}
+
+// mountExt4 provides access to the ext4 filesystem in the given region of
+// an image, using the requested backend.
+func (s *Script) mountExt4(path string, start, length uint64, resize bool, backend string) (*FSMountProxy, error) {
+	var mnt FS
+	switch b, err := mountBackend(backend); {
+	case err != nil:
+		return nil, err
+	case s.plan:
+		// Changes are kept in an overlay, so the image is only read.
+		if mnt, err = openReadOnly(path, func(f *os.File) (FS, error) {
+			return fs.LoadExt4(f, start, length)
+		}); err != nil {
+			return nil, err
+		}
+	case b == "kernel":
+		if mnt, err = fs.KMountExt4(path, start, length, resize); err != nil {
+			return nil, err
+		}
+	default:
+		if resize {
+			return nil, errors.New("resize requires the kernel backend")
+		}
+		if mnt, err = fs.OpenExt4(path, start, length); err != nil {
+			return nil, err
+		}
+	}
+	out := &FSMountProxy{
+		Kind:   "Ext4",
+		Path:   path,
+		fs:     mnt,
+		start:  start,
+		length: length,
+	}
+	s.wrapMount(out)
+
+	s.resources = append(s.resources, out)
+	return out, nil
+}
+
+// mountVFAT provides access to the FAT filesystem in the given region of
+// an image, using the requested backend.
+func (s *Script) mountVFAT(path string, start, length uint64, backend string) (*FSMountProxy, error) {
+	var mnt FS
+	switch b, err := mountBackend(backend); {
+	case err != nil:
+		return nil, err
+	case s.plan:
+		if mnt, err = openReadOnly(path, func(f *os.File) (FS, error) {
+			return fs.LoadFAT(f, start, length)
+		}); err != nil {
+			return nil, err
+		}
+	case b == "kernel":
+		if mnt, err = fs.KMountVFat(path, start, length); err != nil {
+			return nil, err
+		}
+	default:
+		if mnt, err = fs.OpenFAT(path, start, length); err != nil {
+			return nil, err
+		}
+	}
+	out := &FSMountProxy{
+		Kind:   "VFAT",
+		Path:   path,
+		fs:     mnt,
+		start:  start,
+		length: length,
+	}
+	s.wrapMount(out)
+
+	s.resources = append(s.resources, out)
+	return out, nil
+}
+
+// openReadOnly opens the image at path for reading, and loads the filesystem
+// within it with load.
+func openReadOnly(path string, load func(f *os.File) (FS, error)) (FS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := load(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mnt, nil
+}
+
+// mountMemory provides an in-memory filesystem, containing the files in the
+// directory or tarball at fixture if it is not empty.
+func (s *Script) mountMemory(fixture string) (*FSMountProxy, error) {
+	mnt := fs.NewMemFS()
+	if fixture != "" {
+		var err error
+		if mnt, err = fs.LoadFixture(fixture); err != nil {
+			return nil, err
+		}
+	}
+	out := &FSMountProxy{
+		Kind: "Memory",
+		Path: fixture,
+		fs:   mnt,
+	}
+	s.wrapMount(out)
+
+	s.resources = append(s.resources, out)
+	return out, nil
+}
+
+// fatVolumeID parses a FAT volume ID in the XXXX-XXXX form. A random ID is
+// returned if none is provided.
+func fatVolumeID(s string) (uint32, error) {
+	if s == "" {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(b[:]), nil
+	}
+	var hi, lo uint32
+	if n, err := fmt.Sscanf(s, "%4X-%4X", &hi, &lo); err != nil || n != 2 || len(s) != 9 {
+		return 0, fmt.Errorf("invalid FAT volume ID %q, expected the form XXXX-XXXX", s)
+	}
+	return hi<<16 | lo, nil
+}
+
+// partitionExtent returns the byte offset and length of the partition
+// described by part, a value returned from fs.read_partitions().
+func partitionExtent(part *starlarkstruct.Struct) (uint64, uint64, error) {
+	if part == nil {
+		return 0, 0, errors.New("no partition information provided")
 	}
+	tmp, err := part.Attr("lba")
+	if err != nil {
+		return 0, 0, err
+	}
+	lba, ok := tmp.(*starlarkstruct.Struct)
+	if !ok {
+		return 0, 0, errors.New("lba is not a struct")
+	}
+	start, err := lba.Attr("start")
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := lba.Attr("length")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	st, ok := start.(starlark.Int)
+	if !ok {
+		return 0, 0, errors.New("start is not an integer")
+	}
+	l, ok := length.(starlark.Int)
+	if !ok {
+		return 0, 0, errors.New("length is not an integer")
+	}
+	stI, ok := st.Uint64()
+	if !ok {
+		return 0, 0, errors.New("start is not an unsigned integer")
+	}
+	lI, ok := l.Uint64()
+	if !ok {
+		return 0, 0, errors.New("length is not an unsigned integer")
+	}
+	return stI * 512, lI * 512, nil
+}
+
+// mountBackend resolves the backend used to mount a filesystem. The kernel
+// backend loop-mounts the partition and requires root, whereas the
+// userspace backend manipulates the image directly. If no backend is
+// specified, the kernel backend is used when running as root.
+func mountBackend(backend string) (string, error) {
+	switch backend {
+	case "":
+		if os.Geteuid() == 0 {
+			return "kernel", nil
+		}
+		return "userspace", nil
+	case "kernel", "userspace":
+		return backend, nil
+	}
+	return "", fmt.Errorf("unknown backend %q (want kernel or userspace)", backend)
 }
 
 func makeReadPartitions(s *Script) *starlark.Builtin {
@@ -240,20 +768,37 @@ func makeReadPartitions(s *Script) *starlark.Builtin {
 		if err != nil {
 			return starlark.None, err
 		}
+		defer f.Close()
+		sector := make([]byte, 512)
+		if _, err := f.ReadAt(sector, 0); err != nil {
+			return starlark.None, err
+		}
+		if fs.IsProtectiveMBR(sector) {
+			tab, err := fs.ReadGPT(f)
+			if err != nil {
+				return starlark.None, err
+			}
+			return gptPartitions(tab), nil
+		}
+
 		tab, err := mbr.Read(f)
 		if err != nil {
 			return starlark.None, err
 		}
-		defer f.Close()
+		diskID := fs.MBRDiskID(sector)
 
 		var parts []starlark.Value
 		for idx, p := range tab.GetAllPartitions() {
 			parts = append(parts, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"table":     starlark.String("mbr"),
 				"empty":     starlark.Bool(p.IsEmpty()),
 				"bootable":  starlark.Bool(p.IsBootable()),
 				"type_name": starlark.String(knownPartTypes[byte(p.GetType())]),
 				"type":      starlark.MakeInt64(int64(p.GetType())),
 				"index":     starlark.MakeInt64(int64(idx)),
+				"number":    starlark.MakeInt64(int64(idx + 1)),
+				"name":      starlark.String(""),
+				"partuuid":  starlark.String(fs.MBRPartUUID(diskID, idx+1)),
 				"lba": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 					"length": starlark.MakeInt64(int64(p.GetLBALen())),
 					"start":  starlark.MakeInt64(int64(p.GetLBAStart())),
@@ -265,12 +810,39 @@ func makeReadPartitions(s *Script) *starlark.Builtin {
 	})
 }
 
+// gptPartitions returns the used entries of a GUID partition table, in the
+// same form as MBR partitions are returned from fs.read_partitions(). Empty
+// entries before the last used entry are included, so each partition is
+// returned with the number of its slot in the table.
+func gptPartitions(tab *fs.GPT) *starlark.List {
+	var parts []starlark.Value
+	for idx, p := range tab.Used() {
+		parts = append(parts, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"table":     starlark.String("gpt"),
+			"empty":     starlark.Bool(p.IsEmpty()),
+			"bootable":  starlark.Bool(p.Attributes&fs.GPTAttrLegacyBootable != 0),
+			"type_name": starlark.String(knownGPTPartTypes[p.TypeGUID]),
+			"type":      starlark.String(p.TypeGUID.String()),
+			"index":     starlark.MakeInt64(int64(idx)),
+			"number":    starlark.MakeInt64(int64(idx + 1)),
+			"name":      starlark.String(p.Name),
+			"partuuid":  starlark.String(p.GUID.String()),
+			"lba": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"length": starlark.MakeInt64(int64(p.Length())),
+				"start":  starlark.MakeInt64(int64(p.FirstLBA)),
+			}),
+		}))
+	}
+	return starlark.NewList(parts)
+}
+
 // FS describes an interface to the filesystem.
 type FS interface {
 	Close() error
 	Cat(path string) ([]byte, error)
 	Stat(path string) (os.FileInfo, error)
 	LStat(path string) (os.FileInfo, error)
+	Readlink(path string) (string, error)
 	Symlink(at, to string) error
 	Mkdir(at string) error
 	Write(path string, data []byte, perms os.FileMode) error
@@ -288,6 +860,9 @@ type FSMountProxy struct {
 	Path     string
 	fs       FS
 	isClosed bool
+
+	// start and length locate the filesystem within the image, in bytes.
+	start, length uint64
 }
 
 // Close implements io.Closer.
@@ -326,7 +901,7 @@ func (p *FSMountProxy) Hash() (uint32, error) {
 // AttrNames implements starlark.Value.
 func (p *FSMountProxy) AttrNames() []string {
 	return []string{"base", "cat", "exists", "stat", "mkdir", "write",
-		"remove", "remove_all", "chmod", "chown", "copy_into"}
+		"remove", "remove_all", "chmod", "chown", "copy_into", "close"}
 }
 
 // Attr implements starlark.Value.
@@ -357,11 +932,7 @@ func (p *FSMountProxy) Attr(name string) (starlark.Value, error) {
 
 			s, err := p.fs.Stat(string(path))
 			if err != nil {
-				return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
-					"success":    starlark.Bool(false),
-					"error":      starlark.String(err.Error()),
-					"not_exists": starlark.Bool(os.IsNotExist(err)),
-				}), nil
+				return failure(err), nil
 			}
 			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 				"success":    starlark.Bool(true),
@@ -461,6 +1032,13 @@ func (p *FSMountProxy) Attr(name string) (starlark.Value, error) {
 			}
 			return starlark.None, p.fs.Chown(string(path), int(uidI), int(gidI))
 		}), nil
+	case "close":
+		return starlark.NewBuiltin("close", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs("close", args, kwargs); err != nil {
+				return starlark.None, err
+			}
+			return starlark.None, p.Close()
+		}), nil
 	case "base":
 		return starlark.String(p.Path), nil
 	}
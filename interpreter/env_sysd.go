@@ -2,6 +2,8 @@ package interpreter
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/twitchyliquid64/raspberry-box/conf/sysd"
@@ -34,6 +36,10 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 			"notifymode_main": starlark.String(sysd.NotifyMainProc),
 			"notifymode_exec": starlark.String(sysd.NotifyExecProcs),
 			"notifymode_all":  starlark.String(sysd.NotifyAllProcs),
+
+			"bind_ipv6_default": starlark.String(sysd.BindIPv6Default),
+			"bind_ipv6_both":    starlark.String(sysd.BindIPv6Both),
+			"bind_ipv6_only":    starlark.String(sysd.BindIPv6Only),
 		}),
 		"out": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 			"console": starlark.MakeInt64(int64(sysd.OutputConsole)),
@@ -46,11 +52,21 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 		"Unit": starlark.NewBuiltin("Unit", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var description starlark.String
 			var after, wantedBy, requiredBy *starlark.List
-			var service starlark.Value
+			var service, timer, socket, path starlark.Value
 			if err := starlark.UnpackArgs("Unit", args, kwargs, "description?", &description, "after", &after, "wanted_by",
-				&wantedBy, "required_by", &requiredBy, "service", &service); err != nil {
+				&wantedBy, "required_by", &requiredBy, "service", &service, "timer?", &timer, "socket?", &socket,
+				"path?", &path); err != nil {
 				return starlark.None, err
 			}
+			var sections int
+			for _, v := range []starlark.Value{service, timer, socket, path} {
+				if v != nil {
+					sections++
+				}
+			}
+			if sections > 1 {
+				return starlark.None, errUnitSections
+			}
 
 			out := sysd.Unit{
 				Description: string(description),
@@ -64,6 +80,27 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 				out.Service = serv.Service
 				serv.Unit = &out
 			}
+			if timer != nil {
+				t, ok := timer.(*SystemdTimerProxy)
+				if !ok {
+					return starlark.None, fmt.Errorf("timer parameter must be of type systemd.Timer, got %T", timer)
+				}
+				out.Timer = t.Conf
+			}
+			if socket != nil {
+				sock, ok := socket.(*SystemdSocketProxy)
+				if !ok {
+					return starlark.None, fmt.Errorf("socket parameter must be of type systemd.Socket, got %T", socket)
+				}
+				out.Socket = sock.Conf
+			}
+			if path != nil {
+				p, ok := path.(*SystemdPathProxy)
+				if !ok {
+					return starlark.None, fmt.Errorf("path parameter must be of type systemd.Path, got %T", path)
+				}
+				out.Path = p.Conf
+			}
 
 			// Unpack after.
 			if after != nil {
@@ -117,6 +154,128 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 			}, nil
 		}),
 
+		"Timer": starlark.NewBuiltin("Timer", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var onCalendar, unit starlark.String
+			var onBootSec, onUnitActiveSec, randomizedDelaySec, accuracySec starlark.Value
+			var persistent starlark.Bool
+			if err := starlark.UnpackArgs("Timer", args, kwargs, "on_calendar?", &onCalendar, "on_boot_sec", &onBootSec,
+				"on_unit_active_sec", &onUnitActiveSec, "persistent", &persistent, "randomized_delay_sec", &randomizedDelaySec,
+				"accuracy_sec", &accuracySec, "unit", &unit); err != nil {
+				return starlark.None, err
+			}
+
+			out := sysd.Timer{
+				OnCalendar: string(onCalendar),
+				Persistent: bool(persistent),
+				Unit:       string(unit),
+			}
+			for _, d := range []struct {
+				name string
+				val  starlark.Value
+				out  *time.Duration
+			}{
+				{"on_boot_sec", onBootSec, &out.OnBootSec},
+				{"on_unit_active_sec", onUnitActiveSec, &out.OnUnitActiveSec},
+				{"randomized_delay_sec", randomizedDelaySec, &out.RandomizedDelaySec},
+				{"accuracy_sec", accuracySec, &out.AccuracySec},
+			} {
+				if d.val == nil {
+					continue
+				}
+				var err error
+				if *d.out, err = decodeDuration(d.val); err != nil {
+					return starlark.None, fmt.Errorf("decoding %s: %v", d.name, err)
+				}
+			}
+			if err := out.Validate(); err != nil {
+				return starlark.None, err
+			}
+			return &SystemdTimerProxy{
+				Conf: &out,
+			}, nil
+		}),
+
+		"Socket": starlark.NewBuiltin("Socket", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var listenStream, listenDatagram, listenFIFO *starlark.List
+			var usr, grp, bindIPv6Only, service starlark.String
+			var accept starlark.Bool
+			var mode starlark.Int
+			if err := starlark.UnpackArgs("Socket", args, kwargs, "listen_stream?", &listenStream, "listen_datagram", &listenDatagram,
+				"listen_fifo", &listenFIFO, "accept", &accept, "socket_user", &usr, "socket_group", &grp, "socket_mode", &mode,
+				"bind_ipv6_only", &bindIPv6Only, "service", &service); err != nil {
+				return starlark.None, err
+			}
+
+			out := sysd.Socket{
+				Accept:       bool(accept),
+				SocketUser:   string(usr),
+				SocketGroup:  string(grp),
+				BindIPv6Only: sysd.BindIPv6Mode(bindIPv6Only),
+				Service:      string(service),
+			}
+			for _, l := range []struct {
+				name string
+				val  *starlark.List
+				out  *[]string
+			}{
+				{"listen_stream", listenStream, &out.ListenStream},
+				{"listen_datagram", listenDatagram, &out.ListenDatagram},
+				{"listen_fifo", listenFIFO, &out.ListenFIFO},
+			} {
+				var err error
+				if *l.out, err = unpackStringList(l.name, l.val); err != nil {
+					return starlark.None, err
+				}
+			}
+			if m, ok := mode.Int64(); ok {
+				out.SocketMode = os.FileMode(m)
+			}
+			if err := out.Validate(); err != nil {
+				return starlark.None, err
+			}
+			return &SystemdSocketProxy{
+				Conf: &out,
+			}, nil
+		}),
+
+		"Path": starlark.NewBuiltin("Path", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var pathExists, pathExistsGlob, pathChanged, pathModified, directoryNotEmpty *starlark.List
+			var makeDirectory starlark.Bool
+			var unit starlark.String
+			if err := starlark.UnpackArgs("Path", args, kwargs, "path_exists?", &pathExists, "path_exists_glob", &pathExistsGlob,
+				"path_changed", &pathChanged, "path_modified", &pathModified, "directory_not_empty", &directoryNotEmpty,
+				"make_directory", &makeDirectory, "unit", &unit); err != nil {
+				return starlark.None, err
+			}
+
+			out := sysd.Path{
+				MakeDirectory: bool(makeDirectory),
+				Unit:          string(unit),
+			}
+			for _, l := range []struct {
+				name string
+				val  *starlark.List
+				out  *[]string
+			}{
+				{"path_exists", pathExists, &out.PathExists},
+				{"path_exists_glob", pathExistsGlob, &out.PathExistsGlob},
+				{"path_changed", pathChanged, &out.PathChanged},
+				{"path_modified", pathModified, &out.PathModified},
+				{"directory_not_empty", directoryNotEmpty, &out.DirectoryNotEmpty},
+			} {
+				var err error
+				if *l.out, err = unpackStringList(l.name, l.val); err != nil {
+					return starlark.None, err
+				}
+			}
+			if err := out.Validate(); err != nil {
+				return starlark.None, err
+			}
+			return &SystemdPathProxy{
+				Conf: &out,
+			}, nil
+		}),
+
 		"Service": starlark.NewBuiltin("Service", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var (
 				t, execStart, rootDir, usr, grp  starlark.String
@@ -241,8 +400,30 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 				return starlark.None, fmt.Errorf("unit parameter must be of type systemd.Unit, got %T", u)
 			}
 
+			if unit.Path != "" && filepath.Base(unit.Path) == string(name) {
+				return starlark.None, sd.InstallAt(fs.fs, unit.Path, unit.Unit)
+			}
 			return starlark.None, sd.Install(fs.fs, string(name), unit.Unit, true)
 		}),
+		"install_dropin": starlark.NewBuiltin("install_dropin", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var unit, name starlark.String
+			var f, u starlark.Value
+			if err := starlark.UnpackArgs("install_dropin", args, kwargs, "fs", &f, "unit", &unit, "name", &name, "unit_fragment", &u); err != nil {
+				return starlark.None, err
+			}
+
+			fs, ok := f.(*FSMountProxy)
+			if !ok {
+				return starlark.None, fmt.Errorf("fs parameter must be of type fs.Mount, got %T", f)
+			}
+			fragment, ok := u.(*SystemdUnitProxy)
+			if !ok {
+				return starlark.None, fmt.Errorf("unit_fragment parameter must be of type systemd.Unit, got %T", u)
+			}
+
+			return starlark.None, sd.InstallDropIn(fs.fs, string(unit), string(name), fragment.Unit)
+		}),
+		"load_unit": starlark.NewBuiltin("load_unit", sysdLoadUnit),
 		"is_installed": starlark.NewBuiltin("is_installed", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var unit starlark.String
 			var f starlark.Value
@@ -263,7 +444,7 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 		"enable_target": starlark.NewBuiltin("enable_target", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var unit, target starlark.String
 			var f starlark.Value
-			if err := starlark.UnpackArgs("enable_target", args, kwargs, "fs", &f, "unit", &unit, "target", &target); err != nil {
+			if err := starlark.UnpackArgs("enable_target", args, kwargs, "fs", &f, "unit", &unit, "target?", &target); err != nil {
 				return starlark.None, err
 			}
 
@@ -271,7 +452,20 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 			if !ok {
 				return starlark.None, fmt.Errorf("fs parameter must be of type fs.Mount, got %T", f)
 			}
-			return starlark.None, sd.Enable(fs.fs, string(unit), string(target))
+			if target == "" {
+				target = starlark.String(sd.DefaultTarget(string(unit)))
+			}
+			enabled, err := sd.IsEnabledOnTarget(fs.fs, string(unit), string(target))
+			if err != nil {
+				return starlark.None, err
+			}
+			if err := sd.Enable(fs.fs, string(unit), string(target)); err != nil {
+				return starlark.None, err
+			}
+			if !enabled {
+				s.record(fs, "enable", string(unit), string(target))
+			}
+			return starlark.None, nil
 		}),
 		"is_enabled_on_target": starlark.NewBuiltin("is_enabled_on_target", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 			var unit, target starlark.String
@@ -293,6 +487,22 @@ func sysdBuiltins(s *Script) starlark.StringDict {
 	}
 }
 
+// unpackStringList returns the strings in the list l, which may be nil.
+func unpackStringList(name string, l *starlark.List) ([]string, error) {
+	if l == nil {
+		return nil, nil
+	}
+	out := make([]string, l.Len())
+	for i := range out {
+		s, ok := l.Index(i).(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] is not a string", name, i)
+		}
+		out[i] = string(s)
+	}
+	return out, nil
+}
+
 func decodeDuration(v starlark.Value) (time.Duration, error) {
 	if num, ok := v.(starlark.Int); ok {
 		uVal, _ := num.Uint64()
@@ -303,3 +513,27 @@ func decodeDuration(v starlark.Value) (time.Duration, error) {
 	}
 	return time.Duration(0), fmt.Errorf("cannot represent type %T as a duration", v)
 }
+
+// sysdLoadUnit implements systemd.load_unit. The unit remembers the file it
+// was read from, so installing it again under the same name replaces that
+// file rather than one shadowed by it.
+func sysdLoadUnit(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name starlark.String
+	var f starlark.Value
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "fs", &f, "name", &name); err != nil {
+		return starlark.None, err
+	}
+
+	fs, ok := f.(*FSMountProxy)
+	if !ok {
+		return starlark.None, fmt.Errorf("fs parameter must be of type fs.Mount, got %T", f)
+	}
+	unit, path, err := sd.Load(fs.fs, string(name))
+	if err != nil {
+		return starlark.None, err
+	}
+	return &SystemdUnitProxy{
+		Unit: unit,
+		Path: path,
+	}, nil
+}
@@ -4,15 +4,43 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/twitchyliquid64/raspberry-box/conf/sysd"
 	"go.starlark.net/starlark"
 )
 
+// errUnitSections is returned if a unit is given more than one of the
+// sections which determine its type.
+var errUnitSections = errors.New("a unit can only have one of a service, timer, socket or path")
+
+// hasSectionOtherThan returns true if the unit has a service, timer, socket
+// or path section other than the named one.
+func hasSectionOtherThan(u *sysd.Unit, name string) bool {
+	for section, set := range map[string]bool{
+		"service": u.Service != nil,
+		"timer":   u.Timer != nil,
+		"socket":  u.Socket != nil,
+		"path":    u.Path != nil,
+	} {
+		if set && section != name {
+			return true
+		}
+	}
+	return false
+}
+
 // SystemdUnitProxy proxies access to a unit structure.
 type SystemdUnitProxy struct {
-	Unit      *sysd.Unit
-	servProxy *SystemdServiceProxy
+	Unit *sysd.Unit
+	// Path is the file the unit was loaded from, if any. Installing the
+	// unit under the same name writes it back there.
+	Path        string
+	servProxy   *SystemdServiceProxy
+	timerProxy  *SystemdTimerProxy
+	socketProxy *SystemdSocketProxy
+	pathProxy   *SystemdPathProxy
+	mountProxy  *SystemdMountProxy
 }
 
 func (p *SystemdUnitProxy) String() string {
@@ -44,11 +72,53 @@ func (p *SystemdUnitProxy) setService(thread *starlark.Thread, fn *starlark.Buil
 	if !ok {
 		return starlark.None, fmt.Errorf("cannot handle argument 0 which has type %T", args[0])
 	}
+	if hasSectionOtherThan(p.Unit, "service") {
+		return starlark.None, errUnitSections
+	}
 	p.servProxy = s
 	p.Unit.Service = s.Service
 	return starlark.None, nil
 }
 
+func (p *SystemdUnitProxy) setTimer(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t, ok := args[0].(*SystemdTimerProxy)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has type %T", args[0])
+	}
+	if hasSectionOtherThan(p.Unit, "timer") {
+		return starlark.None, errUnitSections
+	}
+	p.timerProxy = t
+	p.Unit.Timer = t.Conf
+	return starlark.None, nil
+}
+
+func (p *SystemdUnitProxy) setSocket(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(*SystemdSocketProxy)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has type %T", args[0])
+	}
+	if hasSectionOtherThan(p.Unit, "socket") {
+		return starlark.None, errUnitSections
+	}
+	p.socketProxy = s
+	p.Unit.Socket = s.Conf
+	return starlark.None, nil
+}
+
+func (p *SystemdUnitProxy) setPath(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	path, ok := args[0].(*SystemdPathProxy)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has type %T", args[0])
+	}
+	if hasSectionOtherThan(p.Unit, "path") {
+		return starlark.None, errUnitSections
+	}
+	p.pathProxy = path
+	p.Unit.Path = path.Conf
+	return starlark.None, nil
+}
+
 func (p *SystemdUnitProxy) setDescription(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	s, ok := args[0].(starlark.String)
 	if !ok {
@@ -157,6 +227,48 @@ func (p *SystemdUnitProxy) Attr(name string) (starlark.Value, error) {
 		return p.servProxy, nil
 	case "set_service":
 		return starlark.NewBuiltin("set_service", p.setService), nil
+
+	case "timer":
+		if p.Unit.Timer == nil {
+			return starlark.None, nil
+		}
+		if p.timerProxy == nil {
+			p.timerProxy = &SystemdTimerProxy{Conf: p.Unit.Timer}
+		}
+		return p.timerProxy, nil
+	case "set_timer":
+		return starlark.NewBuiltin("set_timer", p.setTimer), nil
+
+	case "socket":
+		if p.Unit.Socket == nil {
+			return starlark.None, nil
+		}
+		if p.socketProxy == nil {
+			p.socketProxy = &SystemdSocketProxy{Conf: p.Unit.Socket}
+		}
+		return p.socketProxy, nil
+	case "set_socket":
+		return starlark.NewBuiltin("set_socket", p.setSocket), nil
+
+	case "path":
+		if p.Unit.Path == nil {
+			return starlark.None, nil
+		}
+		if p.pathProxy == nil {
+			p.pathProxy = &SystemdPathProxy{Conf: p.Unit.Path}
+		}
+		return p.pathProxy, nil
+	case "set_path":
+		return starlark.NewBuiltin("set_path", p.setPath), nil
+
+	case "mount":
+		if p.Unit.Mount == nil {
+			return starlark.None, nil
+		}
+		if p.mountProxy == nil {
+			p.mountProxy = &SystemdMountProxy{Conf: p.Unit.Mount}
+		}
+		return p.mountProxy, nil
 	}
 
 	return nil, starlark.NoSuchAttrError(
@@ -166,7 +278,8 @@ func (p *SystemdUnitProxy) Attr(name string) (starlark.Value, error) {
 // AttrNames implements starlark.Value.
 func (p *SystemdUnitProxy) AttrNames() []string {
 	return []string{"description", "set_description", "required_by", "append_required_by", "after", "append_after",
-		"wanted_by", "append_wanted_by", "service", "set_service"}
+		"wanted_by", "append_wanted_by", "service", "set_service", "timer", "set_timer",
+		"socket", "set_socket", "path", "set_path", "mount"}
 }
 
 // SetField implements starlark.HasSetField.
@@ -180,9 +293,26 @@ func (p *SystemdUnitProxy) SetField(name string, val starlark.Value) error {
 		if !ok {
 			return fmt.Errorf("cannot assign value with type %T to a systemd.Service", val)
 		}
-		p.servProxy = s
-		p.Unit.Service = s.Service
-		return nil
+		_, err := p.setService(nil, nil, starlark.Tuple([]starlark.Value{s}), nil)
+		return err
+	case "timer":
+		if _, ok := val.(*SystemdTimerProxy); !ok {
+			return fmt.Errorf("cannot assign value with type %T to a systemd.Timer", val)
+		}
+		_, err := p.setTimer(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "socket":
+		if _, ok := val.(*SystemdSocketProxy); !ok {
+			return fmt.Errorf("cannot assign value with type %T to a systemd.Socket", val)
+		}
+		_, err := p.setSocket(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "path":
+		if _, ok := val.(*SystemdPathProxy); !ok {
+			return fmt.Errorf("cannot assign value with type %T to a systemd.Path", val)
+		}
+		_, err := p.setPath(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
 	}
 	return errors.New("no such assignable field: " + name)
 }
@@ -736,3 +866,563 @@ func (p *SystemdMountProxy) SetField(name string, val starlark.Value) error {
 	}
 	return errors.New("no such assignable field: " + name)
 }
+
+// SystemdTimerProxy proxies access to a timer structure.
+type SystemdTimerProxy struct {
+	Conf *sysd.Timer
+}
+
+func (p *SystemdTimerProxy) String() string {
+	return fmt.Sprintf("systemd.Timer{%p}", p)
+}
+
+// Type implements starlark.Value.
+func (p *SystemdTimerProxy) Type() string {
+	return "systemd.Timer"
+}
+
+// Freeze implements starlark.Value.
+func (p *SystemdTimerProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *SystemdTimerProxy) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+// Hash implements starlark.Value.
+func (p *SystemdTimerProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(p.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.Value.
+func (p *SystemdTimerProxy) AttrNames() []string {
+	return []string{"on_calendar", "set_on_calendar", "on_boot_sec", "set_on_boot_sec", "on_unit_active_sec",
+		"set_on_unit_active_sec", "persistent", "set_persistent", "randomized_delay_sec", "set_randomized_delay_sec",
+		"accuracy_sec", "set_accuracy_sec", "unit", "set_unit"}
+}
+
+func (p *SystemdTimerProxy) setOnCalendar(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.OnCalendar = string(s)
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setOnBootSec(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	d, err := decodeDuration(args[0])
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.OnBootSec = d
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setOnUnitActiveSec(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	d, err := decodeDuration(args[0])
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.OnUnitActiveSec = d
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setPersistent(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b, ok := args[0].(starlark.Bool)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.Persistent = bool(b)
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setRandomizedDelaySec(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	d, err := decodeDuration(args[0])
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.RandomizedDelaySec = d
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setAccuracySec(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	d, err := decodeDuration(args[0])
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.AccuracySec = d
+	return starlark.None, nil
+}
+
+func (p *SystemdTimerProxy) setUnit(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.Unit = string(s)
+	return starlark.None, nil
+}
+
+// Attr implements starlark.Value.
+func (p *SystemdTimerProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "on_calendar":
+		return starlark.String(p.Conf.OnCalendar), nil
+	case "set_on_calendar":
+		return starlark.NewBuiltin("set_on_calendar", p.setOnCalendar), nil
+	case "on_boot_sec":
+		return starlark.MakeUint64(uint64(p.Conf.OnBootSec)), nil
+	case "set_on_boot_sec":
+		return starlark.NewBuiltin("set_on_boot_sec", p.setOnBootSec), nil
+	case "on_unit_active_sec":
+		return starlark.MakeUint64(uint64(p.Conf.OnUnitActiveSec)), nil
+	case "set_on_unit_active_sec":
+		return starlark.NewBuiltin("set_on_unit_active_sec", p.setOnUnitActiveSec), nil
+	case "persistent":
+		return starlark.Bool(p.Conf.Persistent), nil
+	case "set_persistent":
+		return starlark.NewBuiltin("set_persistent", p.setPersistent), nil
+	case "randomized_delay_sec":
+		return starlark.MakeUint64(uint64(p.Conf.RandomizedDelaySec)), nil
+	case "set_randomized_delay_sec":
+		return starlark.NewBuiltin("set_randomized_delay_sec", p.setRandomizedDelaySec), nil
+	case "accuracy_sec":
+		return starlark.MakeUint64(uint64(p.Conf.AccuracySec)), nil
+	case "set_accuracy_sec":
+		return starlark.NewBuiltin("set_accuracy_sec", p.setAccuracySec), nil
+	case "unit":
+		return starlark.String(p.Conf.Unit), nil
+	case "set_unit":
+		return starlark.NewBuiltin("set_unit", p.setUnit), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+// SetField implements starlark.HasSetField.
+func (p *SystemdTimerProxy) SetField(name string, val starlark.Value) error {
+	switch name {
+	case "on_calendar":
+		_, err := p.setOnCalendar(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "on_boot_sec":
+		_, err := p.setOnBootSec(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "on_unit_active_sec":
+		_, err := p.setOnUnitActiveSec(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "persistent":
+		_, err := p.setPersistent(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "randomized_delay_sec":
+		_, err := p.setRandomizedDelaySec(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "accuracy_sec":
+		_, err := p.setAccuracySec(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "unit":
+		_, err := p.setUnit(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	}
+	return errors.New("no such assignable field: " + name)
+}
+
+// SystemdSocketProxy proxies access to a socket structure.
+type SystemdSocketProxy struct {
+	Conf *sysd.Socket
+}
+
+func (p *SystemdSocketProxy) String() string {
+	return fmt.Sprintf("systemd.Socket{%p}", p)
+}
+
+// Type implements starlark.Value.
+func (p *SystemdSocketProxy) Type() string {
+	return "systemd.Socket"
+}
+
+// Freeze implements starlark.Value.
+func (p *SystemdSocketProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *SystemdSocketProxy) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+// Hash implements starlark.Value.
+func (p *SystemdSocketProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(p.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.Value.
+func (p *SystemdSocketProxy) AttrNames() []string {
+	return []string{"listen_stream", "set_listen_stream", "listen_datagram", "set_listen_datagram", "listen_fifo",
+		"set_listen_fifo", "accept", "set_accept", "socket_user", "set_socket_user", "socket_group", "set_socket_group",
+		"socket_mode", "set_socket_mode", "bind_ipv6_only", "set_bind_ipv6_only", "service", "set_service"}
+}
+
+func (p *SystemdSocketProxy) setListenStream(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("listen_stream", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.ListenStream = out
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setListenDatagram(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("listen_datagram", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.ListenDatagram = out
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setListenFIFO(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("listen_fifo", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.ListenFIFO = out
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setAccept(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b, ok := args[0].(starlark.Bool)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.Accept = bool(b)
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setSocketUser(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.SocketUser = string(s)
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setSocketGroup(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.SocketGroup = string(s)
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setSocketMode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b, ok := args[0].(starlark.Int)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	i, ok := b.Int64()
+	if !ok {
+		return starlark.None, errors.New("cannot represent argument as 64bit integer")
+	}
+	p.Conf.SocketMode = os.FileMode(i)
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setBindIPv6Only(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.BindIPv6Only = sysd.BindIPv6Mode(s)
+	return starlark.None, nil
+}
+
+func (p *SystemdSocketProxy) setService(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.Service = string(s)
+	return starlark.None, nil
+}
+
+// Attr implements starlark.Value.
+func (p *SystemdSocketProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "listen_stream":
+		return cvStrListToStarlark(p.Conf.ListenStream), nil
+	case "set_listen_stream":
+		return starlark.NewBuiltin("set_listen_stream", p.setListenStream), nil
+	case "listen_datagram":
+		return cvStrListToStarlark(p.Conf.ListenDatagram), nil
+	case "set_listen_datagram":
+		return starlark.NewBuiltin("set_listen_datagram", p.setListenDatagram), nil
+	case "listen_fifo":
+		return cvStrListToStarlark(p.Conf.ListenFIFO), nil
+	case "set_listen_fifo":
+		return starlark.NewBuiltin("set_listen_fifo", p.setListenFIFO), nil
+	case "accept":
+		return starlark.Bool(p.Conf.Accept), nil
+	case "set_accept":
+		return starlark.NewBuiltin("set_accept", p.setAccept), nil
+	case "socket_user":
+		return starlark.String(p.Conf.SocketUser), nil
+	case "set_socket_user":
+		return starlark.NewBuiltin("set_socket_user", p.setSocketUser), nil
+	case "socket_group":
+		return starlark.String(p.Conf.SocketGroup), nil
+	case "set_socket_group":
+		return starlark.NewBuiltin("set_socket_group", p.setSocketGroup), nil
+	case "socket_mode":
+		return starlark.MakeUint64(uint64(p.Conf.SocketMode)), nil
+	case "set_socket_mode":
+		return starlark.NewBuiltin("set_socket_mode", p.setSocketMode), nil
+	case "bind_ipv6_only":
+		return starlark.String(p.Conf.BindIPv6Only), nil
+	case "set_bind_ipv6_only":
+		return starlark.NewBuiltin("set_bind_ipv6_only", p.setBindIPv6Only), nil
+	case "service":
+		return starlark.String(p.Conf.Service), nil
+	case "set_service":
+		return starlark.NewBuiltin("set_service", p.setService), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+// SetField implements starlark.HasSetField.
+func (p *SystemdSocketProxy) SetField(name string, val starlark.Value) error {
+	switch name {
+	case "listen_stream":
+		_, err := p.setListenStream(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "listen_datagram":
+		_, err := p.setListenDatagram(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "listen_fifo":
+		_, err := p.setListenFIFO(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "accept":
+		_, err := p.setAccept(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "socket_user":
+		_, err := p.setSocketUser(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "socket_group":
+		_, err := p.setSocketGroup(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "socket_mode":
+		_, err := p.setSocketMode(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "bind_ipv6_only":
+		_, err := p.setBindIPv6Only(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "service":
+		_, err := p.setService(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	}
+	return errors.New("no such assignable field: " + name)
+}
+
+// SystemdPathProxy proxies access to a path structure.
+type SystemdPathProxy struct {
+	Conf *sysd.Path
+}
+
+func (p *SystemdPathProxy) String() string {
+	return fmt.Sprintf("systemd.Path{%p}", p)
+}
+
+// Type implements starlark.Value.
+func (p *SystemdPathProxy) Type() string {
+	return "systemd.Path"
+}
+
+// Freeze implements starlark.Value.
+func (p *SystemdPathProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *SystemdPathProxy) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+// Hash implements starlark.Value.
+func (p *SystemdPathProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(p.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.Value.
+func (p *SystemdPathProxy) AttrNames() []string {
+	return []string{"path_exists", "set_path_exists", "path_exists_glob", "set_path_exists_glob", "path_changed",
+		"set_path_changed", "path_modified", "set_path_modified", "directory_not_empty", "set_directory_not_empty",
+		"make_directory", "set_make_directory", "unit", "set_unit"}
+}
+
+func (p *SystemdPathProxy) setPathExists(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("path_exists", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.PathExists = out
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setPathExistsGlob(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("path_exists_glob", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.PathExistsGlob = out
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setPathChanged(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("path_changed", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.PathChanged = out
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setPathModified(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("path_modified", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.PathModified = out
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setDirectoryNotEmpty(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	l, ok := args[0].(*starlark.List)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	out, err := unpackStringList("directory_not_empty", l)
+	if err != nil {
+		return starlark.None, err
+	}
+	p.Conf.DirectoryNotEmpty = out
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setMakeDirectory(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b, ok := args[0].(starlark.Bool)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.MakeDirectory = bool(b)
+	return starlark.None, nil
+}
+
+func (p *SystemdPathProxy) setUnit(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	s, ok := args[0].(starlark.String)
+	if !ok {
+		return starlark.None, fmt.Errorf("cannot handle argument 0 which has unhandled type %T", args[0])
+	}
+	p.Conf.Unit = string(s)
+	return starlark.None, nil
+}
+
+// Attr implements starlark.Value.
+func (p *SystemdPathProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "path_exists":
+		return cvStrListToStarlark(p.Conf.PathExists), nil
+	case "set_path_exists":
+		return starlark.NewBuiltin("set_path_exists", p.setPathExists), nil
+	case "path_exists_glob":
+		return cvStrListToStarlark(p.Conf.PathExistsGlob), nil
+	case "set_path_exists_glob":
+		return starlark.NewBuiltin("set_path_exists_glob", p.setPathExistsGlob), nil
+	case "path_changed":
+		return cvStrListToStarlark(p.Conf.PathChanged), nil
+	case "set_path_changed":
+		return starlark.NewBuiltin("set_path_changed", p.setPathChanged), nil
+	case "path_modified":
+		return cvStrListToStarlark(p.Conf.PathModified), nil
+	case "set_path_modified":
+		return starlark.NewBuiltin("set_path_modified", p.setPathModified), nil
+	case "directory_not_empty":
+		return cvStrListToStarlark(p.Conf.DirectoryNotEmpty), nil
+	case "set_directory_not_empty":
+		return starlark.NewBuiltin("set_directory_not_empty", p.setDirectoryNotEmpty), nil
+	case "make_directory":
+		return starlark.Bool(p.Conf.MakeDirectory), nil
+	case "set_make_directory":
+		return starlark.NewBuiltin("set_make_directory", p.setMakeDirectory), nil
+	case "unit":
+		return starlark.String(p.Conf.Unit), nil
+	case "set_unit":
+		return starlark.NewBuiltin("set_unit", p.setUnit), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+// SetField implements starlark.HasSetField.
+func (p *SystemdPathProxy) SetField(name string, val starlark.Value) error {
+	switch name {
+	case "path_exists":
+		_, err := p.setPathExists(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "path_exists_glob":
+		_, err := p.setPathExistsGlob(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "path_changed":
+		_, err := p.setPathChanged(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "path_modified":
+		_, err := p.setPathModified(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "directory_not_empty":
+		_, err := p.setDirectoryNotEmpty(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "make_directory":
+		_, err := p.setMakeDirectory(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	case "unit":
+		_, err := p.setUnit(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+		return err
+	}
+	return errors.New("no such assignable field: " + name)
+}
@@ -0,0 +1,322 @@
+package interpreter
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/twitchyliquid64/raspberry-box/conf/unix"
+	"go.starlark.net/starlark"
+)
+
+func unixBuiltins(s *Script) starlark.StringDict {
+	return starlark.StringDict{
+		"Fstab": starlark.NewBuiltin("Fstab", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var data starlark.String
+			if err := starlark.UnpackArgs("Fstab", args, kwargs, "data?", &data); err != nil {
+				return starlark.None, err
+			}
+			return &FstabProxy{Conf: unix.ParseFstab(string(data))}, nil
+		}),
+		"FstabEntry": starlark.NewBuiltin("FstabEntry", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var source, partuuid, label, uuid, mountpoint, typ starlark.String
+			var options *starlark.List
+			var dump, pass int
+			if err := starlark.UnpackArgs("FstabEntry", args, kwargs, "source?", &source, "partuuid?", &partuuid,
+				"label?", &label, "uuid?", &uuid, "mountpoint", &mountpoint, "type", &typ, "options?", &options,
+				"dump?", &dump, "passno?", &pass); err != nil {
+				return starlark.None, err
+			}
+			p := &FstabEntryProxy{
+				Entry: &unix.FstabEntry{
+					Source:     string(source),
+					Mountpoint: string(mountpoint),
+					Type:       string(typ),
+					Dump:       dump,
+					Pass:       pass,
+				},
+			}
+			for _, tag := range []struct {
+				name string
+				val  starlark.String
+			}{
+				{unix.SourcePartUUID, partuuid},
+				{unix.SourceLabel, label},
+				{unix.SourceUUID, uuid},
+			} {
+				if tag.val == "" {
+					continue
+				}
+				if p.Entry.Source != "" {
+					return starlark.None, errors.New("only one of source, partuuid, label or uuid may be specified")
+				}
+				p.Entry.Source = tag.name + "=" + string(tag.val)
+			}
+			if p.Entry.Source == "" {
+				return starlark.None, errors.New("one of source, partuuid, label or uuid must be specified")
+			}
+			if options != nil {
+				if _, err := p.setOptions(nil, nil, starlark.Tuple([]starlark.Value{options}), nil); err != nil {
+					return starlark.None, err
+				}
+			}
+			return p, nil
+		}),
+	}
+}
+
+// FstabProxy proxies access to an unix.Fstab structure.
+type FstabProxy struct {
+	Conf *unix.Fstab
+}
+
+func (p *FstabProxy) String() string {
+	return p.Conf.String()
+}
+
+// Type implements starlark.Value.
+func (p *FstabProxy) Type() string {
+	return "unix.Fstab"
+}
+
+// Freeze implements starlark.Value.
+func (p *FstabProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *FstabProxy) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+// Hash implements starlark.Value.
+func (p *FstabProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(p.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.Value.
+func (p *FstabProxy) AttrNames() []string {
+	return []string{"entries", "get", "add", "replace", "remove"}
+}
+
+// Attr implements starlark.Value.
+func (p *FstabProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "entries":
+		var out []starlark.Value
+		for _, e := range p.Conf.Entries() {
+			out = append(out, &FstabEntryProxy{Entry: e})
+		}
+		return starlark.NewList(out), nil
+	case "get":
+		return starlark.NewBuiltin("get", p.get), nil
+	case "add":
+		return starlark.NewBuiltin("add", p.add), nil
+	case "replace":
+		return starlark.NewBuiltin("replace", p.replace), nil
+	case "remove":
+		return starlark.NewBuiltin("remove", p.remove), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+func (p *FstabProxy) get(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var mountpoint, source starlark.String
+	if err := starlark.UnpackArgs("get", args, kwargs, "mountpoint", &mountpoint, "source?", &source); err != nil {
+		return starlark.None, err
+	}
+	if e := p.Conf.Get(string(mountpoint), string(source)); e != nil {
+		return &FstabEntryProxy{Entry: e}, nil
+	}
+	return starlark.None, nil
+}
+
+func (p *FstabProxy) add(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var e *FstabEntryProxy
+	if err := starlark.UnpackArgs("add", args, kwargs, "entry", &e); err != nil {
+		return starlark.None, err
+	}
+	entry := *e.Entry
+	return starlark.None, p.Conf.Add(&entry)
+}
+
+func (p *FstabProxy) replace(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var e *FstabEntryProxy
+	if err := starlark.UnpackArgs("replace", args, kwargs, "entry", &e); err != nil {
+		return starlark.None, err
+	}
+	entry := *e.Entry
+	return starlark.None, p.Conf.Replace(&entry)
+}
+
+func (p *FstabProxy) remove(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var mountpoint, source starlark.String
+	if err := starlark.UnpackArgs("remove", args, kwargs, "mountpoint", &mountpoint, "source?", &source); err != nil {
+		return starlark.None, err
+	}
+	return starlark.Bool(p.Conf.Remove(string(mountpoint), string(source))), nil
+}
+
+// FstabEntryProxy proxies access to an unix.FstabEntry structure.
+type FstabEntryProxy struct {
+	Entry *unix.FstabEntry
+}
+
+func (p *FstabEntryProxy) String() string {
+	return p.Entry.String()
+}
+
+// Type implements starlark.Value.
+func (p *FstabEntryProxy) Type() string {
+	return "unix.FstabEntry"
+}
+
+// Freeze implements starlark.Value.
+func (p *FstabEntryProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *FstabEntryProxy) Truth() starlark.Bool {
+	return starlark.Bool(true)
+}
+
+// Hash implements starlark.Value.
+func (p *FstabEntryProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(p.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.Value.
+func (p *FstabEntryProxy) AttrNames() []string {
+	return []string{"source", "source_tag", "source_value", "mountpoint", "type", "options", "dump", "passno",
+		"set_source", "set_mountpoint", "set_type", "set_options", "set_dump", "set_passno"}
+}
+
+// Attr implements starlark.Value.
+func (p *FstabEntryProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "source":
+		return starlark.String(p.Entry.Source), nil
+	case "source_tag":
+		tag, _ := p.Entry.SourceTag()
+		return starlark.String(tag), nil
+	case "source_value":
+		_, val := p.Entry.SourceTag()
+		return starlark.String(val), nil
+	case "set_source":
+		return starlark.NewBuiltin("set_source", p.setSource), nil
+	case "mountpoint":
+		return starlark.String(p.Entry.Mountpoint), nil
+	case "set_mountpoint":
+		return starlark.NewBuiltin("set_mountpoint", p.setMountpoint), nil
+	case "type":
+		return starlark.String(p.Entry.Type), nil
+	case "set_type":
+		return starlark.NewBuiltin("set_type", p.setType), nil
+	case "options":
+		var out []starlark.Value
+		for _, o := range p.Entry.Options {
+			out = append(out, starlark.String(o))
+		}
+		return starlark.NewList(out), nil
+	case "set_options":
+		return starlark.NewBuiltin("set_options", p.setOptions), nil
+	case "dump":
+		return starlark.MakeInt(p.Entry.Dump), nil
+	case "set_dump":
+		return starlark.NewBuiltin("set_dump", p.setDump), nil
+	case "passno":
+		return starlark.MakeInt(p.Entry.Pass), nil
+	case "set_passno":
+		return starlark.NewBuiltin("set_passno", p.setPassno), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+func (p *FstabEntryProxy) setSource(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s starlark.String
+	if err := starlark.UnpackPositionalArgs("set_source", args, kwargs, 1, &s); err != nil {
+		return starlark.None, err
+	}
+	p.Entry.Source = string(s)
+	return starlark.None, nil
+}
+
+func (p *FstabEntryProxy) setMountpoint(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s starlark.String
+	if err := starlark.UnpackPositionalArgs("set_mountpoint", args, kwargs, 1, &s); err != nil {
+		return starlark.None, err
+	}
+	p.Entry.Mountpoint = string(s)
+	return starlark.None, nil
+}
+
+func (p *FstabEntryProxy) setType(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s starlark.String
+	if err := starlark.UnpackPositionalArgs("set_type", args, kwargs, 1, &s); err != nil {
+		return starlark.None, err
+	}
+	p.Entry.Type = string(s)
+	return starlark.None, nil
+}
+
+func (p *FstabEntryProxy) setOptions(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var options *starlark.List
+	if err := starlark.UnpackPositionalArgs("set_options", args, kwargs, 1, &options); err != nil {
+		return starlark.None, err
+	}
+	var out []string
+	for i := 0; i < options.Len(); i++ {
+		s, ok := options.Index(i).(starlark.String)
+		if !ok {
+			return starlark.None, fmt.Errorf("options[%d] is not a string", i)
+		}
+		out = append(out, string(s))
+	}
+	p.Entry.Options = out
+	return starlark.None, nil
+}
+
+func (p *FstabEntryProxy) setDump(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var i int
+	if err := starlark.UnpackPositionalArgs("set_dump", args, kwargs, 1, &i); err != nil {
+		return starlark.None, err
+	}
+	p.Entry.Dump = i
+	return starlark.None, nil
+}
+
+func (p *FstabEntryProxy) setPassno(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var i int
+	if err := starlark.UnpackPositionalArgs("set_passno", args, kwargs, 1, &i); err != nil {
+		return starlark.None, err
+	}
+	p.Entry.Pass = i
+	return starlark.None, nil
+}
+
+// SetField implements starlark.HasSetField.
+func (p *FstabEntryProxy) SetField(name string, val starlark.Value) error {
+	var err error
+	switch name {
+	case "source":
+		_, err = p.setSource(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	case "mountpoint":
+		_, err = p.setMountpoint(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	case "type":
+		_, err = p.setType(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	case "options":
+		_, err = p.setOptions(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	case "dump":
+		_, err = p.setDump(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	case "passno":
+		_, err = p.setPassno(nil, nil, starlark.Tuple([]starlark.Value{val}), nil)
+	default:
+		return errors.New("no such assignable field: " + name)
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// annotate prefixes errors returned from builtins with the position of the
+// starlark code which called the builtin, and the name of the builtin.
+func annotate(err error) error {
+	e, ok := err.(*starlark.EvalError)
+	if !ok || len(e.CallStack) < 2 {
+		return err
+	}
+	top, caller := e.CallStack.At(0), e.CallStack.At(1)
+	if top.Pos.Filename() != "<builtin>" || strings.HasPrefix(e.Msg, caller.Pos.String()+": ") {
+		return err
+	}
+	if strings.HasPrefix(e.Msg, top.Name+": ") {
+		e.Msg = fmt.Sprintf("%s: %s", caller.Pos, e.Msg)
+	} else {
+		e.Msg = fmt.Sprintf("%s: %s: %s", caller.Pos, top.Name, e.Msg)
+	}
+	return e
+}
+
+// Backtrace returns a description of an error returned from running a
+// script. If the error was raised while executing starlark code, the stack
+// of calls which led to it is included, innermost last.
+func Backtrace(err error) string {
+	if e, ok := err.(*starlark.EvalError); ok {
+		return e.Backtrace()
+	}
+	return err.Error()
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/twitchyliquid64/raspberry-box/interpreter/lib"
 	"go.starlark.net/starlark"
@@ -17,24 +18,34 @@ type Script struct {
 
 	args    []string
 	fs      *flag.FlagSet
+	flagErr error
 	verbose bool
 
-	thread   *starlark.Thread
-	globals  starlark.StringDict
-	setupVal starlark.Value
+	thread      *starlark.Thread
+	predeclared starlark.StringDict
+	globals     starlark.StringDict
+	setupVal    starlark.Value
 
 	resources []io.Closer
 
+	plan      bool
+	mutations []Mutation
+
 	// testHook is only accessible and populated from unit tests.
 	testHook func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
 }
 
-// Close shuts down all resources associated with the script.
+// Close shuts down all resources associated with the script, returning
+// the first error encountered.
 func (s *Script) Close() error {
+	var err error
 	for _, r := range s.resources {
-		r.Close()
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	return nil
+	s.resources = nil
+	return err
 }
 
 // NewScript initializes a new raspberry-box script environment.
@@ -51,13 +62,19 @@ func makeScript(data []byte, fname string, loader ScriptLoader, args []string, v
 		verbose:  verbose,
 	}
 
-	if err := out.initFlags(); err != nil {
-		return nil, err
-	}
+	out.initFlags(fname)
 
 	var err error
 	out.thread, out.globals, err = out.loadScript(data, fname, out)
 	if err != nil {
+		if out.flagErr != nil {
+			return nil, out.flagErr
+		}
+		return nil, err
+	}
+	// Flags are declared as the script loads, so arguments can only be
+	// parsed once it has finished.
+	if err := out.parseFlags(); err != nil {
 		return nil, err
 	}
 
@@ -68,15 +85,15 @@ func (s *Script) printFromSkylark(_ *starlark.Thread, msg string) {
 	fmt.Println(msg)
 }
 
-func (s *Script) resolveImport(path string) ([]byte, error) {
+func (s *Script) resolveImport(path, from string) (string, []byte, error) {
 	d, exists := lib.Libs[path]
 	if exists {
-		return d, nil
+		return path, d, nil
 	}
 	if s.loader == nil {
-		return nil, errors.New("no such import: " + path)
+		return "", nil, errors.New("no such import: " + path)
 	}
-	return s.loader.resolveImport(path)
+	return s.loader.resolveImport(path, from)
 }
 
 func cvStrListToStarlark(in []string) *starlark.List {
@@ -92,7 +109,7 @@ func (s *Script) Setup(templatePath string) error {
 	if fn, exists := s.globals["setup"]; exists {
 		setupVal, err := starlark.Call(s.thread, fn, starlark.Tuple{starlark.String(templatePath)}, nil)
 		if err != nil {
-			return err
+			return annotate(err)
 		}
 		s.setupVal = setupVal
 	} else {
@@ -108,7 +125,7 @@ func (s *Script) Build() error {
 		return errors.New("build() function not present")
 	}
 	if _, err := starlark.Call(s.thread, fn, starlark.Tuple{s.setupVal}, nil); err != nil {
-		return err
+		return annotate(err)
 	}
 	return nil
 }
@@ -121,7 +138,7 @@ func (s *Script) CallFn(fname string) (string, error) {
 	}
 	ret, err := starlark.Call(s.thread, fn, starlark.Tuple{}, nil)
 	if err != nil {
-		return "", err
+		return "", annotate(err)
 	}
 	result, ok := ret.(starlark.String)
 	if !ok {
@@ -129,3 +146,27 @@ func (s *Script) CallFn(fname string) (string, error) {
 	}
 	return string(result), nil
 }
+
+// Tests returns the names of the test functions defined by the script, which
+// are those with names starting with test_, in sorted order.
+func (s *Script) Tests() []string {
+	var out []string
+	for _, name := range s.globals.Keys() {
+		if _, ok := s.globals[name].(starlark.Callable); ok && strings.HasPrefix(name, "test_") {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// RunTest calls the named test function in the script.
+func (s *Script) RunTest(name string) error {
+	fn, exists := s.globals[name]
+	if !exists {
+		return fmt.Errorf("%s() function not present", name)
+	}
+	if _, err := starlark.Call(s.thread, fn, nil, nil); err != nil {
+		return annotate(err)
+	}
+	return nil
+}
@@ -1,16 +1,29 @@
 package interpreter
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	cnet "github.com/twitchyliquid64/raspberry-box/conf/net"
 	"github.com/twitchyliquid64/raspberry-box/conf/sysd"
+	"github.com/twitchyliquid64/raspberry-box/fs"
 	"go.starlark.net/starlark"
 )
 
@@ -18,8 +31,9 @@ var (
 	imgPath = flag.String("pi-img", "", "Path to a mint raspbian image.")
 )
 
-func init() {
+func TestMain(m *testing.M) {
 	flag.Parse()
+	os.Exit(m.Run())
 }
 
 func TestNewScript(t *testing.T) {
@@ -204,6 +218,75 @@ func TestScriptArgs(t *testing.T) {
 	}
 }
 
+func TestScriptFlags(t *testing.T) {
+	script := `
+hostname = args.string("hostname", default="raspberrypi", help="Hostname of the pi.")
+port = args.int("port", default=22)
+ssh = args.bool("ssh", help="Enables SSH.")
+pkgs = args.list("pkg", default=["vim"])
+
+def build(setup):
+  test_hook(hostname.value, port.value, ssh.value, pkgs.value, args.args())
+`
+	tcs := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "defaults",
+			want: `("raspberrypi", 22, False, ["vim"], [])`,
+		},
+		{
+			name: "set",
+			args: []string{"--hostname", "mypi", "-port=2222", "--ssh", "--pkg", "git", "--pkg=curl", "a.img"},
+			want: `("mypi", 2222, True, ["git", "curl"], ["a.img"])`,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				got = args.String()
+				return starlark.None, nil
+			}
+			s, err := makeScript([]byte(script), "testScriptFlags.box", nil, tc.args, false, testCb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Build(); err != nil {
+				t.Fatalf("Build() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("test_hook() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	noop := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(script), "testScriptFlags.box", nil, []string{"--port", "ssh"}, false, noop); err == nil || !strings.Contains(err.Error(), "invalid value") {
+		t.Errorf("makeScript() with an invalid int flag returned %v, want invalid value error", err)
+	}
+	if _, err := makeScript([]byte(script), "testScriptFlags.box", nil, []string{"--help"}, false, noop); err != flag.ErrHelp {
+		t.Errorf("makeScript() with --help returned %v, want %v", err, flag.ErrHelp)
+	}
+	for _, bad := range []string{
+		`args.string("a")
+args.int("a")`,
+		`args.arg(0)
+args.string("a")`,
+		`args.int("a", default="1")`,
+		`args.list("a", default=[1])`,
+	} {
+		if _, err := makeScript([]byte(bad), "testScriptFlags.box", nil, nil, false, nil); err == nil {
+			t.Errorf("makeScript(%q) succeeded, want error", bad)
+		}
+	}
+}
+
 func TestScriptFsPartitionsPiImage(t *testing.T) {
 	if *imgPath == "" {
 		t.SkipNow()
@@ -229,6 +312,492 @@ test_hook(str(fs.read_partitions(args.arg(0))))`), "testScriptFsPartitionsPiImag
 	}
 }
 
+func TestScriptFsMountExt4Userspace(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, 2048*512+32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", "offset=1048576", img, "32M").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	s, err := makeScript([]byte(`
+part = struct(lba=struct(start=2048, length=65536))
+m = fs.mnt_ext4(args.arg(0), part, backend='userspace')
+m.mkdir('/etc')
+m.write('/etc/hostname', 'my-pi', fs.perms.default)
+test_hook(m.cat('/etc/hostname') + ' ' + str(m.stat('/etc').dir))`), "testScriptFsMountExt4Userspace.box", nil, []string{img}, false, testCb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if want := "my-pi True"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+	if _, err := makeScript([]byte(`fs.mnt_ext4(args.arg(0), struct(lba=struct(start=2048, length=65536)), backend='fuse')`),
+		"testScriptFsMountExt4Userspace.box", nil, []string{img}, false, testCb); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+}
+
+func TestScriptFsShrinkMounted(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, 2048*512+32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", "offset=1048576", img, "32M").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+	table := make([]byte, 512)
+	table[446+4] = 0x83
+	binary.LittleEndian.PutUint32(table[446+8:], 2048)
+	binary.LittleEndian.PutUint32(table[446+12:], 65536)
+	table[510], table[511] = 0x55, 0xAA
+	f, err := os.OpenFile(img, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(table, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = makeScript([]byte(`
+img = args.arg(0)
+m = fs.mnt_ext4(img, fs.read_partitions(img)[0], backend='userspace')
+fs.shrink_partition(img, partition=1)`), "testScriptFsShrinkMounted.box", nil, []string{img}, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "must be closed first") {
+		t.Errorf("shrink_partition() of a mounted partition returned %v, want error", err)
+	}
+	after, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("image was modified by shrink_partition() of a mounted partition")
+	}
+}
+
+func TestScriptPlan(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, 2048*512+32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", "offset=1048576", img, "32M").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+	before, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	s, err := makeScript([]byte(`
+def build(img):
+  m = fs.mnt_ext4(args.arg(0), struct(lba=struct(start=2048, length=65536)), backend='userspace')
+  m.mkdir('/etc')
+  m.write('/etc/hostname', 'my-pi', fs.perms.default)
+  m.chown('/etc/hostname', 1000, 1000)
+  for d in ['/lib', '/lib/systemd', '/lib/systemd/system']:
+    m.mkdir(d)
+  systemd.install(m, 'ssh.service', systemd.Unit(description='OpenSSH'))
+  systemd.enable_target(m, 'ssh.service', 'multi-user.target')
+  test_hook(m.cat('/etc/hostname'))`), "testScriptPlan.box", nil, []string{img}, false, testCb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnablePlan()
+	if err := s.Setup(img); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "my-pi"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+	var got []string
+	for _, m := range s.Mutations() {
+		got = append(got, m.Mount+" "+m.Op+" "+m.Path)
+	}
+	want := []string{
+		"ext4 mkdir /etc",
+		"ext4 write /etc/hostname",
+		"ext4 chown /etc/hostname",
+		"ext4 mkdir /lib",
+		"ext4 mkdir /lib/systemd",
+		"ext4 mkdir /lib/systemd/system",
+		"ext4 write /lib/systemd/system/ssh.service",
+		"ext4 mkdir /lib/systemd/system/multi-user.target.wants",
+		"ext4 symlink /lib/systemd/system/multi-user.target.wants/ssh.service",
+		"ext4 enable ssh.service",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mutations = %q, want %q", got, want)
+	}
+	after, err := ioutil.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("image was modified in plan mode")
+	}
+
+	// Builtins which change the image itself cannot be planned.
+	for _, script := range []string{
+		`fs.partition_add(args.arg(0), partition=2, type=0x83)`,
+		`fs.set_disk_id(args.arg(0))`,
+		`fs.shrink_partition(args.arg(0), partition=1)`,
+		`fs.mkfs(args.arg(0), struct(lba=struct(start=2048, length=65536)), type='vfat')`,
+		`fs.mnt_ext4(args.arg(0), struct(lba=struct(start=2048, length=65536)), resize=True)`,
+	} {
+		s, err := makeScript([]byte("def build(img):\n  "+script), "testScriptPlan.box", nil, []string{img}, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.EnablePlan()
+		if err := s.Setup(img); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Build(); err == nil || !strings.Contains(err.Error(), "cannot be used in plan mode") {
+			t.Errorf("%s in plan mode returned %v, want error", script, err)
+		}
+		s.Close()
+	}
+	if after, err = ioutil.ReadFile(img); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("image was modified in plan mode")
+	}
+}
+
+func TestScriptMutations(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(img, 2048*512+32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", "offset=1048576", img, "32M").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, out)
+	}
+
+	s, err := makeScript([]byte(`
+def set_hostname(m, name):
+  m.write('/etc/hostname', name, fs.perms.default)
+
+m = fs.mnt_ext4(args.arg(0), struct(lba=struct(start=2048, length=65536)), backend='userspace')
+m.mkdir('/etc')
+set_hostname(m, 'my-pi')
+m.chown('/etc/hostname', 1000, 1000)
+m.remove('/etc/hostname')`), "testScriptMutations.box", nil, []string{img}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	muts := s.Mutations()
+	if len(muts) != 4 {
+		t.Fatalf("got %d mutations, want 4: %+v", len(muts), muts)
+	}
+	if m := muts[0]; m.Op != "mkdir" || m.Result == nil || !m.Result.Mode.IsDir() {
+		t.Errorf("muts[0] = %+v, want mkdir of a directory", m)
+	}
+	if m := muts[1]; m.Op != "write" || m.After != nil || m.Result == nil || m.Result.SHA256 != sha256.Sum256([]byte("my-pi")) || m.Result.Mode != 0755 {
+		t.Errorf("muts[1] = %+v, want write of my-pi with mode 0755", m)
+	}
+	if want := []string{"testScriptMutations.box:7:13 in <toplevel>", "testScriptMutations.box:3:10 in set_hostname"}; !reflect.DeepEqual(muts[1].Stack, want) {
+		t.Errorf("muts[1].Stack = %q, want %q", muts[1].Stack, want)
+	}
+	if m := muts[2]; m.Op != "chown" || m.Result == nil || m.Result.UID != 1000 || m.Result.GID != 1000 {
+		t.Errorf("muts[2] = %+v, want chown to 1000:1000", m)
+	}
+	if m := muts[3]; m.Op != "remove" || m.Result != nil {
+		t.Errorf("muts[3] = %+v, want remove", m)
+	}
+}
+
+func TestScriptFsDecompress(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "base.img.gz"), filepath.Join(dir, "base.img")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("image contents"))
+	w.Close()
+	if err := ioutil.WriteFile(src, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].String()
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(`
+test_hook(str(fs.decompress(args.arg(0), args.arg(1))) + ' ' + fs.cat(args.arg(1)) + ' ' + str(fs.decompress(args.arg(1), args.arg(0)).success))`),
+		"testScriptFsDecompress.box", nil, []string{src, dst}, false, testCb); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `"None image contents False"`; a != want {
+		t.Errorf("a = %v, want %v", a, want)
+	}
+}
+
+func TestScriptFsPartitionEdit(t *testing.T) {
+	table := make([]byte, 16*1024*1024)
+	table[446+4] = 0x0c
+	binary.LittleEndian.PutUint32(table[446+8:], 2048)
+	binary.LittleEndian.PutUint32(table[446+12:], 2048)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+fs.partition_add(img, partition=2, type=getattr(fs.enums.partitions, "Native Linux"), size_mb=4)
+fs.partition_add(img, partition=3, type=0x83)
+fs.partition_resize(img, partition=2, size_mb=2)
+fs.partition_set_type(img, partition=3, type=0x82)
+fs.partition_delete(img, partition=1)
+overlap = fs.partition_add(img, partition=4, type=0x83, start_mb=2, size_mb=8)
+parts = fs.read_partitions(img)
+test_hook(' '.join(['%d:%d+%d' % (p.type, p.lba.start, p.lba.length) for p in parts]) + ' ' + str(overlap.success))`),
+		"testScriptFsPartitionEdit.box", nil, []string{img}, false, testCb); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "0:0+0 131:4096+4096 130:12288+20480 0:0+0 False"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+
+	for _, script := range []string{
+		`fs.partition_delete(args.arg(0), partition=0)`,
+		`fs.partition_resize(args.arg(0), partition=-2)`,
+		`fs.shrink_partition(args.arg(0), partition=1 << 40)`,
+	} {
+		_, err := makeScript([]byte(script), "testScriptFsPartitionEdit.box", nil, []string{img}, false, nil)
+		if err == nil || !strings.Contains(err.Error(), "invalid partition number") {
+			t.Errorf("makeScript(%q) returned %v, want invalid partition number error", script, err)
+		}
+	}
+}
+
+func TestScriptFsPartitionNumbers(t *testing.T) {
+	const sectors = 8192
+	img := filepath.Join(t.TempDir(), "test.img")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(sectors * 512); err != nil {
+		t.Fatal(err)
+	}
+	// The second slot of the table is empty, so the root partition is the
+	// second in use but is numbered 3.
+	tab := &fs.GPT{FirstUsableLBA: 34, EntriesLBA: 2, EntrySize: 128, Partitions: make([]fs.GPTPartition, 128)}
+	tab.Resize(sectors)
+	tab.Partitions[0] = fs.GPTPartition{TypeGUID: fs.GPTTypeBasicData, FirstLBA: 2048, LastLBA: 4095}
+	tab.Partitions[2] = fs.GPTPartition{TypeGUID: fs.GPTTypeLinuxFS, FirstLBA: 4096, LastLBA: 6143}
+	if err := tab.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+used = [p for p in fs.read_partitions(img) if not p.empty]
+fs.partition_resize(img, partition=used[1].number)
+test_hook(' '.join(['%d:%d+%d' % (p.number, p.lba.start, p.lba.length) for p in fs.read_partitions(img)]))`),
+		"testScriptFsPartitionNumbers.box", nil, []string{img}, false, testCb); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "1:2048+2048 2:0+0 3:4096+4063"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+}
+
+func TestScriptFsSetDiskID(t *testing.T) {
+	table := make([]byte, 4*1024*1024)
+	table[446+4] = 0x0c
+	binary.LittleEndian.PutUint32(table[446+8:], 2048)
+	binary.LittleEndian.PutUint32(table[446+12:], 2048)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+fs.set_disk_id(img, id='0xDEADBEEF')
+p1 = fs.read_partitions(img)[0].partuuid
+fs.set_disk_id(img, id=0x1234)
+p2 = fs.read_partitions(img)[0].partuuid
+fs.set_disk_id(img)
+p3 = fs.read_partitions(img)[0].partuuid
+test_hook(' '.join([p1, p2, str(p3 != p2)]))`),
+		"testScriptFsSetDiskID.box", nil, []string{img}, false, testCb); err != nil {
+		t.Fatal(err)
+	}
+	if want := "deadbeef-01 00001234-01 True"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+
+	if _, err := makeScript([]byte(`fs.set_disk_id(args.arg(0), id='xyz')`),
+		"testScriptFsSetDiskIDBad.box", nil, []string{img}, false, testCb); err == nil {
+		t.Error("makeScript() succeeded with an invalid disk identifier")
+	}
+
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+m = fs.mkfs(img, fs.read_partitions(img)[0], type='vfat', backend='userspace')
+fs.set_disk_id(img)`),
+		"testScriptFsSetDiskIDMounted.box", nil, []string{img}, false, testCb); err == nil {
+		t.Error("makeScript() succeeded setting the disk identifier of a mounted image")
+	}
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+fs.mkfs(img, fs.read_partitions(img)[0], type='vfat', backend='userspace').close()
+fs.set_disk_id(img)`),
+		"testScriptFsSetDiskIDClosed.box", nil, []string{img}, false, testCb); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScriptFsMkfs(t *testing.T) {
+	table := make([]byte, 32*1024*1024)
+	table[446+4] = 0x0c
+	binary.LittleEndian.PutUint32(table[446+8:], 2048)
+	binary.LittleEndian.PutUint32(table[446+12:], 16384)
+	table[510], table[511] = 0x55, 0xAA
+	img := filepath.Join(t.TempDir(), "test.img")
+	if err := ioutil.WriteFile(img, table, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var a string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		a = args[0].(starlark.String).GoString()
+		return starlark.None, nil
+	}
+	s, err := makeScript([]byte(`
+img = args.arg(0)
+m = fs.mkfs(img, fs.read_partitions(img)[0], type='vfat', label='boot', uuid='ABCD-1234', backend='userspace')
+m.write('/cmdline.txt', 'console=tty1', fs.perms.default)
+m.close()
+m2 = fs.mnt_vfat(img, fs.read_partitions(img)[0], backend='userspace')
+test_hook(m2.cat('/CMDLINE.TXT'))`), "testScriptFsMkfs.box", nil, []string{img}, false, testCb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if want := "console=tty1"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+	// Partitions cannot be edited while mounted.
+	for _, script := range []string{
+		`fs.partition_resize(img, partition=1, size_mb=4)`,
+		`fs.partition_delete(img, partition=1)`,
+		`fs.partition_set_type(img, partition=1, type=0x83)`,
+		`fs.partition_add(img, partition=2, type=0x83, start_mb=4)`,
+	} {
+		_, err := makeScript([]byte("img = args.arg(0)\nm = fs.mnt_vfat(img, fs.read_partitions(img)[0], backend='userspace')\n"+script),
+			"testScriptFsPartitionMounted.box", nil, []string{img}, false, nil)
+		if err == nil || !strings.Contains(err.Error(), "must be closed first") {
+			t.Errorf("%s with the partition mounted returned %v, want error", script, err)
+		}
+	}
+
+	// A new partition can be formatted while another is mounted.
+	if _, err := makeScript([]byte(`
+img = args.arg(0)
+root = fs.mnt_vfat(img, fs.read_partitions(img)[0], backend='userspace')
+fs.partition_add(img, partition=2, type=0x0c, size_mb=8)
+data = fs.mkfs(img, fs.read_partitions(img)[1], type='vfat', label='data', backend='userspace')
+data.write('/hello.txt', 'hi', fs.perms.default)
+root.write('/fstab', 'LABEL=data /data vfat defaults 0 2', fs.perms.default)
+test_hook(root.cat('/FSTAB') + ' ' + data.cat('/HELLO.TXT'))`), "testScriptFsMkfsMounted.box", nil, []string{img}, false, testCb); err != nil {
+		t.Fatal(err)
+	}
+	if want := "LABEL=data /data vfat defaults 0 2 hi"; a != want {
+		t.Errorf("a = %q, want %q", a, want)
+	}
+
+	for _, bad := range []string{
+		`fs.mkfs(args.arg(0), fs.read_partitions(args.arg(0))[0], type='btrfs')`,
+		`fs.mkfs(args.arg(0), fs.read_partitions(args.arg(0))[0], type='vfat', uuid='nope')`,
+		`m = fs.mnt_vfat(args.arg(0), fs.read_partitions(args.arg(0))[0], backend='userspace')
+fs.mkfs(args.arg(0), fs.read_partitions(args.arg(0))[0], type='vfat', backend='userspace')`,
+	} {
+		if _, err := makeScript([]byte(bad), "testScriptFsMkfs.box", nil, []string{img}, false, testCb); err == nil {
+			t.Errorf("%s succeeded", bad)
+		}
+	}
+}
+
 func TestBuildSysdUnit(t *testing.T) {
 	var out starlark.Tuple
 	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -443,6 +1012,294 @@ test_hook(m)`), "testBuildSysdCondition.box", nil, nil, false, testCb)
 	}
 }
 
+func TestBuildSysdTimer(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+root = fs.mnt_memory()
+root.mkdir('/lib')
+root.mkdir('/lib/systemd')
+root.mkdir('/lib/systemd/system')
+
+t = systemd.Timer(on_calendar='daily', randomized_delay_sec='30m')
+t.persistent = True
+t.set_on_boot_sec(5 * 60 * 1000 * 1000 * 1000)
+unit = systemd.Unit(description='Nightly backup', wanted_by=['timers.target'], timer=t)
+
+systemd.install(root, 'backup.service', systemd.Unit(service=systemd.Service(type=systemd.const.service_oneshot, exec_start='/bin/backup')))
+systemd.install(root, 'backup.timer', unit)
+systemd.enable_target(root, 'backup.timer')
+assert.unit_enabled(root, 'backup.timer')
+
+test_hook(unit.timer, root.cat('/lib/systemd/system/backup.timer'), systemd.is_enabled_on_target(root, 'backup.timer', 'multi-user.target'))`), "testBuildSysdTimer.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := *out[0].(*SystemdTimerProxy).Conf, (sysd.Timer{
+		OnCalendar:         "daily",
+		OnBootSec:          5 * time.Minute,
+		Persistent:         true,
+		RandomizedDelaySec: 30 * time.Minute,
+	}); got != want {
+		t.Errorf("unit.timer = %+v, want %+v", got, want)
+	}
+	if got, want := string(out[1].(starlark.String)), "[Unit]\nDescription=Nightly backup\n\n[Timer]\nOnCalendar=daily\nOnBootSec=5m0s\nPersistent=true\nRandomizedDelaySec=30m0s\n\n[Install]\nWantedBy=timers.target\n\n"; got != want {
+		t.Errorf("backup.timer = %q, want %q", got, want)
+	}
+	if out[2] != starlark.False {
+		t.Error("backup.timer is enabled on multi-user.target, want only timers.target")
+	}
+
+	for _, tc := range []struct {
+		script, want string
+	}{
+		{"systemd.Unit(service=systemd.Service(), timer=systemd.Timer(on_calendar='daily'))", "a unit can only have one of a service, timer, socket or path"},
+		{"u = systemd.Unit(service=systemd.Service())\nu.timer = systemd.Timer(on_calendar='daily')", "a unit can only have one of a service, timer, socket or path"},
+		{"systemd.Timer(accuracy_sec='soon')", `decoding accuracy_sec: time: invalid duration "soon"`},
+		{"systemd.Timer(persistent=True)", "timer must have at least one of OnCalendar, OnBootSec or OnUnitActiveSec"},
+		{"systemd.install(fs.mnt_memory(), 'backup.service', systemd.Unit(timer=systemd.Timer(on_calendar='daily')))", "timer unit backup.service must be named with a .timer suffix"},
+	} {
+		_, err := makeScript([]byte(tc.script), "testBuildSysdTimer.box", nil, nil, false, nil)
+		if err == nil || !strings.HasSuffix(err.Error(), tc.want) {
+			t.Errorf("makeScript(%q) returned %v, want error ending in %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestBuildSysdSocket(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+root = fs.mnt_memory()
+root.mkdir('/lib')
+root.mkdir('/lib/systemd')
+root.mkdir('/lib/systemd/system')
+
+sock = systemd.Socket(listen_stream=['8080'], bind_ipv6_only=systemd.const.bind_ipv6_both)
+sock.listen_stream = sock.listen_stream + ['/run/app.sock']
+sock.socket_user = 'app'
+sock.set_socket_mode(0o660)
+unit = systemd.Unit(description='App socket', wanted_by=['sockets.target'])
+unit.socket = sock
+
+systemd.install(root, 'app.socket', unit)
+systemd.enable_target(root, 'app.socket')
+assert.unit_enabled(root, 'app.socket', target='sockets.target')
+
+test_hook(unit.socket, root.cat('/lib/systemd/system/app.socket'))`), "testBuildSysdSocket.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := out[0].(*SystemdSocketProxy).Conf, (&sysd.Socket{
+		ListenStream: []string{"8080", "/run/app.sock"},
+		SocketUser:   "app",
+		SocketMode:   0660,
+		BindIPv6Only: sysd.BindIPv6Both,
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unit.socket = %+v, want %+v", got, want)
+	}
+	if got, want := string(out[1].(starlark.String)), "[Unit]\nDescription=App socket\n\n[Socket]\nListenStream=8080\nListenStream=/run/app.sock\nSocketUser=app\nSocketMode=0660\nBindIPv6Only=both\n\n[Install]\nWantedBy=sockets.target\n\n"; got != want {
+		t.Errorf("app.socket = %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		script, want string
+	}{
+		{"systemd.Socket()", "socket must listen on at least one address"},
+		{"systemd.Socket(listen_stream=['app.sock'])", `ListenStream: invalid address "app.sock": "app.sock" is not a port number`},
+		{"systemd.Socket(listen_fifo=[1])", "listen_fifo[0] is not a string"},
+		{"systemd.Unit(timer=systemd.Timer(on_calendar='daily'), socket=systemd.Socket(listen_stream=['80']))", "a unit can only have one of a service, timer, socket or path"},
+		{"s = systemd.Socket(listen_stream=['80'])\ns.listen_stream = []\nsystemd.install(fs.mnt_memory(), 'app.socket', systemd.Unit(socket=s))", "socket unit app.socket: socket must listen on at least one address"},
+	} {
+		_, err := makeScript([]byte(tc.script), "testBuildSysdSocket.box", nil, nil, false, nil)
+		if err == nil || !strings.HasSuffix(err.Error(), tc.want) {
+			t.Errorf("makeScript(%q) returned %v, want error ending in %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestBuildSysdPath(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+root = fs.mnt_memory()
+root.mkdir('/lib')
+root.mkdir('/lib/systemd')
+root.mkdir('/lib/systemd/system')
+
+path = systemd.Path(directory_not_empty=['/boot/firmware/provision'], make_directory=True)
+path.path_exists_glob = ['/boot/firmware/provision/*.json']
+path.set_unit('provision.service')
+unit = systemd.Unit(description='Watches for provisioning files', wanted_by=['multi-user.target'], path=path)
+
+systemd.install(root, 'provision.path', unit)
+systemd.enable_target(root, 'provision.path')
+assert.unit_enabled(root, 'provision.path')
+
+test_hook(unit.path, root.cat('/lib/systemd/system/provision.path'))`), "testBuildSysdPath.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := out[0].(*SystemdPathProxy).Conf, (&sysd.Path{
+		PathExistsGlob:    []string{"/boot/firmware/provision/*.json"},
+		DirectoryNotEmpty: []string{"/boot/firmware/provision"},
+		MakeDirectory:     true,
+		Unit:              "provision.service",
+	}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unit.path = %+v, want %+v", got, want)
+	}
+	if got, want := string(out[1].(starlark.String)), "[Unit]\nDescription=Watches for provisioning files\n\n[Path]\nPathExistsGlob=/boot/firmware/provision/*.json\nDirectoryNotEmpty=/boot/firmware/provision\nMakeDirectory=yes\nUnit=provision.service\n\n[Install]\nWantedBy=multi-user.target\n\n"; got != want {
+		t.Errorf("provision.path = %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		script, want string
+	}{
+		{"systemd.Path()", "path unit must watch at least one path"},
+		{"systemd.Path(path_changed=['app.conf'])", `PathChanged: "app.conf" is not an absolute path`},
+		{"u = systemd.Unit(timer=systemd.Timer(on_calendar='daily'))\nu.path = systemd.Path(path_exists=['/a'])", "a unit can only have one of a service, timer, socket or path"},
+		{"systemd.install(fs.mnt_memory(), 'provision.service', systemd.Unit(path=systemd.Path(path_exists=['/a'])))", "path unit provision.service must be named with a .path suffix"},
+	} {
+		_, err := makeScript([]byte(tc.script), "testBuildSysdPath.box", nil, nil, false, nil)
+		if err == nil || !strings.HasSuffix(err.Error(), tc.want) {
+			t.Errorf("makeScript(%q) returned %v, want error ending in %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestScriptSysdInstallDropIn(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+root = fs.mnt_memory()
+root.mkdir('/etc')
+root.mkdir('/etc/systemd')
+root.mkdir('/etc/systemd/system')
+
+systemd.install_dropin(root, 'ssh.service', 'restart', systemd.Unit(
+	service=systemd.Service(restart=systemd.const.restart_always, restart_sec='5s'),
+))
+systemd.install_dropin(root, 'getty@tty1.service', 'autologin.conf', systemd.Unit(
+	service=systemd.Service(exec_start='-/sbin/agetty --autologin pi --noclear %I $TERM'),
+))
+
+test_hook(root.cat('/etc/systemd/system/ssh.service.d/restart.conf'), root.cat('/etc/systemd/system/getty@tty1.service.d/autologin.conf'))`), "testScriptSysdInstallDropIn.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := string(out[0].(starlark.String)), "[Service]\nRestart=always\nRestartSec=5s\n"; got != want {
+		t.Errorf("restart.conf = %q, want %q", got, want)
+	}
+	if got, want := string(out[1].(starlark.String)), "[Service]\nExecStart=\nExecStart=-/sbin/agetty --autologin pi --noclear %I $TERM\n"; got != want {
+		t.Errorf("autologin.conf = %q, want %q", got, want)
+	}
+}
+
+func TestScriptSysdLoadUnit(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+root = fs.mnt_memory()
+root.mkdir('/lib')
+root.mkdir('/lib/systemd')
+root.mkdir('/lib/systemd/system')
+root.write('/lib/systemd/system/ssh.service', """[Unit]
+Description=OpenBSD Secure Shell server
+After=network.target auditd.service
+
+[Service]
+ExecStartPre=/usr/sbin/sshd -t
+ExecStartPre=/bin/mkdir -p /run/sshd
+ExecStart=/usr/sbin/sshd -D $SSHD_OPTS
+RuntimeDirectory=sshd
+
+[Install]
+WantedBy=multi-user.target
+Alias=sshd.service
+""", 0o644)
+root.write('/lib/systemd/system/boot-firmware.mount', "[Mount]\nWhat=/dev/mmcblk0p1\nWhere=/boot/firmware\n", 0o644)
+
+ssh = systemd.load_unit(root, 'ssh.service')
+ssh.service.restart = systemd.const.restart_always
+systemd.install(root, 'ssh.service', ssh)
+
+boot = systemd.load_unit(root, 'boot-firmware.mount')
+
+root.mkdir('/etc')
+root.mkdir('/etc/systemd')
+root.mkdir('/etc/systemd/system')
+root.write('/lib/systemd/system/app.service', "[Service]\nExecStart=/bin/app\n", 0o644)
+root.write('/etc/systemd/system/app.service', "[Service]\nExecStart=/usr/local/bin/app\n", 0o644)
+app = systemd.load_unit(root, 'app.service')
+app.service.restart = systemd.const.restart_always
+systemd.install(root, 'app.service', app)
+
+test_hook(ssh.description, ssh.service.exec_start, root.cat('/lib/systemd/system/ssh.service'), boot.mount.where_path, ssh.mount,
+    root.cat('/etc/systemd/system/app.service'), root.cat('/lib/systemd/system/app.service'))`), "testScriptSysdLoadUnit.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	if got, want := string(out[0].(starlark.String)), "OpenBSD Secure Shell server"; got != want {
+		t.Errorf("ssh.description = %q, want %q", got, want)
+	}
+	if got, want := string(out[1].(starlark.String)), "/usr/sbin/sshd -D $SSHD_OPTS"; got != want {
+		t.Errorf("ssh.service.exec_start = %q, want %q", got, want)
+	}
+	if got, want := string(out[2].(starlark.String)), "[Unit]\nDescription=OpenBSD Secure Shell server\nAfter=network.target auditd.service\n\n"+
+		"[Service]\nExecStart=/usr/sbin/sshd -D $SSHD_OPTS\nRestart=always\nIgnoreSIGPIPE=yes\n"+
+		"ExecStartPre=/usr/sbin/sshd -t\nExecStartPre=/bin/mkdir -p /run/sshd\nRuntimeDirectory=sshd\n\n"+
+		"[Install]\nWantedBy=multi-user.target\nAlias=sshd.service\n\n"; got != want {
+		t.Errorf("ssh.service = %q, want %q", got, want)
+	}
+	if got, want := string(out[3].(starlark.String)), "/boot/firmware"; got != want {
+		t.Errorf("boot.mount.where_path = %q, want %q", got, want)
+	}
+	if out[4] != starlark.None {
+		t.Errorf("ssh.mount = %v, want None", out[4])
+	}
+	if got := string(out[5].(starlark.String)); !strings.Contains(got, "ExecStart=/usr/local/bin/app\nRestart=always\n") {
+		t.Errorf("/etc/systemd/system/app.service = %q, want the edited unit", got)
+	}
+	if got, want := string(out[6].(starlark.String)), "[Service]\nExecStart=/bin/app\n"; got != want {
+		t.Errorf("/lib/systemd/system/app.service = %q, want %q", got, want)
+	}
+
+	_, err = makeScript([]byte("systemd.load_unit(fs.mnt_memory(), 'missing.service')"), "testScriptSysdLoadUnit.box", nil, nil, false, nil)
+	if err == nil || !strings.HasSuffix(err.Error(), "cannot perform action on uninstalled unit") {
+		t.Errorf("systemd.load_unit() of a missing unit returned %v, want error", err)
+	}
+}
+
 func TestBuildNetDHCPProfile(t *testing.T) {
 	var out starlark.Tuple
 	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -698,3 +1555,420 @@ test_hook(c)`), "testBuildNetWifiConfig.box", nil, nil, false, testCb)
 		t.Errorf("out.Networks = %v, want %v", got, want)
 	}
 }
+
+func TestBuildUnixFstab(t *testing.T) {
+	var out starlark.Tuple
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		out = args
+		return starlark.None, nil
+	}
+
+	s, err := makeScript([]byte(`
+f = unix.Fstab("""# static file system information
+proc            /proc           proc    defaults          0       0
+PARTUUID=738a4d67-02  /               ext4    defaults,noatime  0       1
+""")
+
+root = f.get('/')
+root.options = root.options + ['ro']
+root.set_passno(root.passno)
+
+f.add(unix.FstabEntry(label='data', mountpoint='/data', type='ext4', options=["nofail"], passno=2))
+f.replace(unix.FstabEntry(source='tmpfs', mountpoint='/var/log', type='tmpfs'))
+f.remove('/proc')
+f.add(unix.FstabEntry(source='/dev/sda3', mountpoint='none', type='swap'))
+f.add(unix.FstabEntry(source='/dev/sdb3', mountpoint='none', type='swap'))
+f.remove('none', source='/dev/sda3')
+
+test_hook(f, root.source_tag, root.source_value, f.get('/nope'), len(f.entries))`), "testBuildUnixFstab.box", nil, nil, false, testCb)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	if s == nil {
+		t.Error("script is nil")
+	}
+
+	want := "# static file system information\n" +
+		"PARTUUID=738a4d67-02\t/\text4\tdefaults,noatime,ro\t0\t1\n" +
+		"LABEL=data\t/data\text4\tnofail\t0\t2\n" +
+		"tmpfs\t/var/log\ttmpfs\tdefaults\t0\t0\n" +
+		"/dev/sdb3\tnone\tswap\tdefaults\t0\t0\n"
+	if got := out[0].(*FstabProxy).Conf.String(); got != want {
+		t.Errorf("fstab = %q, want %q", got, want)
+	}
+	if got, want := out[1:], (starlark.Tuple{starlark.String("PARTUUID"), starlark.String("738a4d67-02"), starlark.None, starlark.MakeInt(4)}); !reflect.DeepEqual(got, want) {
+		t.Errorf("out = %v, want %v", got, want)
+	}
+
+	if _, err := makeScript([]byte(`unix.FstabEntry(source='tmpfs', uuid='1234', mountpoint='/tmp', type='tmpfs')`),
+		"testBuildUnixFstabBad.box", nil, nil, false, testCb); err == nil {
+		t.Error("makeScript() succeeded with multiple sources")
+	}
+}
+
+type testLoader map[string]string
+
+func (l testLoader) resolveImport(name, from string) (string, []byte, error) {
+	d, ok := l[name]
+	if !ok {
+		return "", nil, errors.New("no such import: " + name)
+	}
+	return name, []byte(d), nil
+}
+
+func TestScriptErrorPositions(t *testing.T) {
+	s, err := makeScript([]byte(`
+def mount(img):
+  return fs.mnt_ext4(img, struct(lba=struct(start=2048, length=65536)), backend='userspace')
+
+def build(img):
+  mount('/nonexistent.img')`), "testScriptErrorPositions.box", nil, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Build()
+	if err == nil {
+		t.Fatal("Build() succeeded")
+	}
+	if want := "testScriptErrorPositions.box:3:21: mnt_ext4: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("err = %q, want prefix %q", err, want)
+	}
+	want := "Traceback (most recent call last):\n" +
+		"  testScriptErrorPositions.box:6:8: in build\n" +
+		"  testScriptErrorPositions.box:3:21: in mount\n" +
+		"  <builtin>: in mnt_ext4\n" +
+		"Error: testScriptErrorPositions.box:3:21: mnt_ext4: "
+	if bt := Backtrace(err); !strings.HasPrefix(bt, want) {
+		t.Errorf("Backtrace() = %q, want prefix %q", bt, want)
+	}
+
+	// Errors in load()ed modules include the backtrace within the module.
+	loader := testLoader{"lib.box": "def f():\n  return unix.Fstab(1)\n\nx = f()\n"}
+	_, err = makeScript([]byte(`load('lib.box', 'x')`), "testScriptErrorPositions.box", loader, nil, false, nil)
+	if err == nil {
+		t.Fatal("makeScript() succeeded")
+	}
+	for _, want := range []string{
+		"testScriptErrorPositions.box:1:1: in <toplevel>\n",
+		"Error: cannot load lib.box: Traceback (most recent call last):\n",
+		"  lib.box:4:6: in <toplevel>\n  lib.box:2:20: in f\n  <builtin>: in Fstab\n",
+		"Error: lib.box:2:20: Fstab: ",
+	} {
+		if bt := Backtrace(err); !strings.Contains(bt, want) {
+			t.Errorf("Backtrace() = %q, want it to contain %q", bt, want)
+		}
+	}
+}
+
+func TestFileLoader(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"ws/WORKSPACE":           "",
+		"ws/team/wifi.box":       "load('helpers.box', 'h')\nssid = h + '-wifi'\n",
+		"ws/team/helpers.box":    "h = 'team'\n",
+		"ws/proj/pi/local.box":   "load('//team/helpers.box', 'h')\nlocal = h + '-local'\n",
+		"ws/proj/pi/mypi.box":    "",
+		"lib/shared.box":         "shared = 'lib'\n",
+		"env/shared.box":         "shared = 'env'\n",
+		"env/env_only.box":       "env_only = 'env'\n",
+		"other/team/helpers.box": "h = 'other'\n",
+	}
+	writeTestFiles(t, dir, files)
+	t.Setenv("RBOX_PATH", filepath.Join(dir, "env"))
+
+	script := filepath.Join(dir, "ws", "proj", "pi", "mypi.box")
+	loader, err := NewFileLoader(script, "", filepath.Join(dir, "lib"))
+	if err != nil {
+		t.Fatalf("NewFileLoader() failed: %v", err)
+	}
+	if want := filepath.Join(dir, "ws"); loader.Workspace != want {
+		t.Errorf("loader.Workspace = %q, want %q", loader.Workspace, want)
+	}
+
+	var got string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		got = args.String()
+		return starlark.None, nil
+	}
+	if _, err := makeScript([]byte(`
+load('local.box', 'local')
+load('//team/wifi.box', 'ssid')
+load('shared.box', 'shared')
+load('env_only.box', 'env_only')
+test_hook(local, ssid, shared, env_only)`), script, loader, nil, false, testCb); err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	if want := `("team-local", "team-wifi", "lib", "env")`; got != want {
+		t.Errorf("test_hook() = %v, want %v", got, want)
+	}
+
+	// An explicit workspace takes precedence.
+	loader, err = NewFileLoader(script, filepath.Join(dir, "other"), "")
+	if err != nil {
+		t.Fatalf("NewFileLoader() failed: %v", err)
+	}
+	if _, err := makeScript([]byte(`load('//team/helpers.box', 'h')
+test_hook(h)`), script, loader, nil, false, testCb); err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	if want := `("other",)`; got != want {
+		t.Errorf("test_hook() = %v, want %v", got, want)
+	}
+
+	if _, err := makeScript([]byte(`load('missing.box', 'x')`), script, loader, nil, false, nil); err == nil || !strings.Contains(err.Error(), "missing.box not found") {
+		t.Errorf("makeScript() with a missing import returned %v, want not found error", err)
+	}
+	for _, imp := range []string{"//../lib/shared.box", "//team/../../lib/shared.box"} {
+		_, err := makeScript([]byte(`load('`+imp+`', 'shared')`), script, loader, nil, false, nil)
+		if err == nil || !strings.Contains(err.Error(), "is outside") {
+			t.Errorf("makeScript() importing %s returned %v, want outside error", imp, err)
+		}
+	}
+
+	// WDLoader resolves imports relative to the working directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "ws", "team")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := makeScript([]byte(`load('helpers.box', 'h')
+test_hook(h)`), script, &WDLoader{}, nil, false, testCb); err != nil {
+		t.Fatalf("makeScript() with WDLoader failed: %v", err)
+	}
+	if want := `("team",)`; got != want {
+		t.Errorf("test_hook() = %v, want %v", got, want)
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for p, d := range files {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVendorPackages(t *testing.T) {
+	ws := t.TempDir()
+	writeTestFiles(t, ws, map[string]string{
+		"WORKSPACE":            "",
+		"mypi.box":             "",
+		"src/mylib/.git/HEAD":  "ref: refs/heads/main\n",
+		"src/mylib/wifi.box":   "load('//util.box', 'prefix')\nssid = prefix + 'wifi'\n",
+		"src/mylib/util.box":   "prefix = 'mylib-'\n",
+		"src/net-1.0/dhcp.box": "lease = 3600\n",
+		"src/net-1.0/README":   "net\n",
+	})
+
+	// Package the net library as a tarball, with a top-level directory.
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "net-1.0/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range []string{"dhcp.box", "README"} {
+		d, _ := ioutil.ReadFile(filepath.Join(ws, "src", "net-1.0", f))
+		tw.WriteHeader(&tar.Header{Name: "net-1.0/" + f, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(d))})
+		tw.Write(d)
+	}
+	tw.Close()
+	gw.Close()
+	if err := ioutil.WriteFile(filepath.Join(ws, "net-1.0.tar.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mylibSum, err := HashPackage(filepath.Join(ws, "src", "mylib"))
+	if err != nil {
+		t.Fatalf("HashPackage() failed: %v", err)
+	}
+	netSum, err := HashPackage(filepath.Join(ws, "src", "net-1.0"))
+	if err != nil {
+		t.Fatalf("HashPackage() failed: %v", err)
+	}
+	writeManifest := func(pkgs map[string]Package) {
+		d, _ := json.Marshal(pkgs)
+		if err := ioutil.WriteFile(filepath.Join(ws, PackageManifest), d, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeManifest(map[string]Package{"mylib": {Source: "src/mylib"}})
+	if _, err := Vendor(ws); err == nil || !strings.Contains(err.Error(), mylibSum) {
+		t.Errorf("Vendor() without a pinned hash returned %v, want error containing %s", err, mylibSum)
+	}
+	writeManifest(map[string]Package{"mylib": {Source: "src/mylib", SHA256: netSum}})
+	if _, err := Vendor(ws); err == nil || !strings.Contains(err.Error(), "is pinned") {
+		t.Errorf("Vendor() with the wrong hash returned %v, want error", err)
+	}
+
+	manifest := map[string]Package{
+		"mylib": {Source: filepath.Join(ws, "src", "mylib"), SHA256: mylibSum},
+		"net":   {Source: "net-1.0.tar.gz", Subdir: "net-1.0", SHA256: netSum},
+	}
+	writeManifest(manifest)
+	pkgs, err := Vendor(ws)
+	if err != nil {
+		t.Fatalf("Vendor() failed: %v", err)
+	}
+	if !reflect.DeepEqual(pkgs, manifest) {
+		t.Errorf("Vendor() = %+v, want %+v", pkgs, manifest)
+	}
+	if _, err := os.Stat(filepath.Join(ws, ".rbox", "packages", "mylib", ".git")); !os.IsNotExist(err) {
+		t.Errorf(".git directory was vendored: %v", err)
+	}
+
+	var got string
+	testCb := func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		got = args.String()
+		return starlark.None, nil
+	}
+	script := `
+load('@mylib//wifi.box', 'ssid')
+load('@net//dhcp.box', 'lease')
+test_hook(ssid, lease)`
+	loader, err := NewFileLoader(filepath.Join(ws, "mypi.box"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeScript([]byte(script), filepath.Join(ws, "mypi.box"), loader, nil, false, testCb); err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	if want := `("mylib-wifi", 3600)`; got != want {
+		t.Errorf("test_hook() = %v, want %v", got, want)
+	}
+	if _, err := makeScript([]byte(`load('@mylib//../../../mypi.box', 'x')`), filepath.Join(ws, "mypi.box"), loader, nil, false, nil); err == nil || !strings.Contains(err.Error(), "is outside") {
+		t.Errorf("makeScript() importing from outside a package returned %v, want error", err)
+	}
+
+	// The cache is verified against the lockfile, which must match the manifest.
+	if err := ioutil.WriteFile(filepath.Join(ws, ".rbox", "packages", "net", "dhcp.box"), []byte("lease = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader, _ = NewFileLoader(filepath.Join(ws, "mypi.box"), "", "")
+	if _, err := makeScript([]byte(script), filepath.Join(ws, "mypi.box"), loader, nil, false, testCb); err == nil || !strings.Contains(err.Error(), "package net has been modified") {
+		t.Errorf("makeScript() with a modified package returned %v, want error", err)
+	}
+	manifest["mylib"] = Package{Source: "elsewhere", SHA256: mylibSum}
+	writeManifest(manifest)
+	loader, _ = NewFileLoader(filepath.Join(ws, "mypi.box"), "", "")
+	if _, err := makeScript([]byte(script), filepath.Join(ws, "mypi.box"), loader, nil, false, testCb); err == nil || !strings.Contains(err.Error(), "package mylib has changed") {
+		t.Errorf("makeScript() with a changed manifest returned %v, want error", err)
+	}
+}
+
+func TestScriptAsserts(t *testing.T) {
+	s, err := makeScript([]byte(`
+def build(setup):
+  root = fs.mnt_memory()
+  root.mkdir('/lib')
+  root.mkdir('/lib/systemd')
+  root.mkdir('/lib/systemd/system')
+  root.write('/etc', 'not a directory', 0o644)
+  systemd.install(root, 'app.service', systemd.Unit(description='App', service=systemd.Service(exec_start='/bin/true')))
+  systemd.enable_target(root, 'app.service', 'multi-user.target')
+  return root
+
+root = build(None)
+assert.eq(1 + 1, 2)
+assert.file_contains(root, '/etc', 'not a')
+assert.unit_enabled(root, 'app.service')
+assert.unit_enabled(root, unit='app.service', target='multi-user.target')
+`), "testScriptAsserts.box", nil, nil, false, nil)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, tc := range []struct {
+		script, want string
+	}{
+		{`assert.eq([1], [2], msg='lists')`, "eq: assertion failed: lists: [1] != [2]"},
+		{`assert.file_contains(fs.mnt_memory(), '/etc/hostname', 'pi')`, "file_contains: assertion failed: open /etc/hostname: no such file or directory"},
+		{`assert.file_contains(fs.mnt_memory(), '/', 'pi')`, "file_contains: assertion failed: read /: is a directory"},
+		{"m = fs.mnt_memory()\nm.write('/a', 'x', 0o644)\nassert.file_contains(m, '/a', 'y')", `file_contains: assertion failed: /a does not contain "y", it contains "x"`},
+		{`assert.unit_enabled(fs.mnt_memory(), 'ssh.service')`, "unit_enabled: assertion failed: ssh.service is not enabled on multi-user.target"},
+		{`fs.mnt_memory('testdata/missing')`, "mnt_memory: stat testdata/missing: no such file or directory"},
+	} {
+		_, err := makeScript([]byte(tc.script), "testScriptAsserts.box", nil, nil, false, nil)
+		if err == nil || !strings.HasSuffix(err.Error(), tc.want) {
+			t.Errorf("makeScript(%q) returned %v, want error ending in %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestREPL(t *testing.T) {
+	s, err := makeScript([]byte(`
+image = struct(ext4=fs.mnt_memory(), fat=fs.mnt_memory())
+`), replFilename, nil, nil, false, nil)
+	if err != nil {
+		t.Fatalf("makeScript() failed: %v", err)
+	}
+	defer s.Close()
+	s.startREPL()
+
+	eval := func(lines ...string) (starlark.Value, error) {
+		return s.EvalREPL(func() ([]byte, error) {
+			if len(lines) == 0 {
+				return nil, io.EOF
+			}
+			line := lines[0]
+			lines = lines[1:]
+			return []byte(line + "\n"), nil
+		})
+	}
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"image.ext4.write('/hostname', 'pi', fs.perms.default)"}, "None"},
+		{[]string{"image.ext4.cat('/hostname')"}, `"pi"`},
+		{[]string{"def greet(name):", "  return 'hi ' + name", ""}, "None"},
+		{[]string{"greeting = greet(image.ext4.cat('/hostname'))"}, "None"},
+		{[]string{"greeting"}, `"hi pi"`},
+	} {
+		v, err := eval(tc.lines...)
+		if err != nil {
+			t.Fatalf("EvalREPL(%q) failed: %v", tc.lines, err)
+		}
+		if got := v.String(); got != tc.want {
+			t.Errorf("EvalREPL(%q) = %s, want %s", tc.lines, got, tc.want)
+		}
+	}
+
+	if _, err := eval("image.ext4.cat('/missing')"); err == nil || !strings.Contains(err.Error(), "cat: open /missing") {
+		t.Errorf("EvalREPL() returned %v, want error from cat", err)
+	}
+	if _, err := eval("1 +"); err == nil || err == io.EOF {
+		t.Errorf("EvalREPL() returned %v, want syntax error", err)
+	}
+	if _, err := eval(); err != io.EOF {
+		t.Errorf("EvalREPL() at end of input returned %v, want io.EOF", err)
+	}
+
+	for _, tc := range []struct {
+		line, partial string
+		want          []string
+	}{
+		{"gree", "gree", []string{"greet", "greeting"}},
+		{"print(ima", "ima", []string{"image"}},
+		{"le", "le", []string{"len"}},
+		{"fs.mnt_m", "mnt_m", []string{"mnt_memory"}},
+		{"image.ext4.ca", "ca", []string{"cat"}},
+		{"image.e", "e", []string{"ext4"}},
+		{"image.missing.", "", nil},
+		{"greet().", "", nil},
+		{"1.", "", nil},
+	} {
+		partial, got := s.Complete(tc.line)
+		if partial != tc.partial || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Complete(%q) = %q, %v, want %q, %v", tc.line, partial, got, tc.partial, tc.want)
+		}
+	}
+}
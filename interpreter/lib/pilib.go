@@ -5,6 +5,15 @@ load("unix.lib", "configure_hostname", "set_shadow_password")
 library_version = 2
 
 def assert_valid_partitions(parts):
+  if len(parts) > 0 and parts[0].table == "gpt":
+    if len(parts) < 2:
+      crash("expected >=2 partitions, got " + str(len(parts)))
+    if parts[0].type_name not in ["Microsoft basic data", "EFI System"]:
+      crash("expected first partition to be a FAT partition, got " + (parts[0].type_name or parts[0].type))
+    if parts[1].type_name not in ["Linux filesystem", "Linux root (ARM)", "Linux root (ARM64)"]:
+      crash("expected second partition to be a Linux partition, got " + (parts[1].type_name or parts[1].type))
+    return
+
   if len(parts) < 3:
     crash("expected >=3 partitions, got " + str(len(parts)))
 
@@ -13,7 +22,7 @@ def assert_valid_partitions(parts):
   if parts[1].type_name != "Native Linux":
     crash("expected second partition to be Native Linux, got " + parts[1].type_name)
 
-def load_img(img, min_mb=None):
+def load_img(img, min_mb=None, backend=''):
   do_resize = False
   if min_mb:
     cur_size = fs.stat(img).size
@@ -25,10 +34,25 @@ def load_img(img, min_mb=None):
 
   partitions = fs.read_partitions(img)
   assert_valid_partitions(partitions)
-  ext4 = fs.mnt_ext4(img, partitions[1], do_resize)
-  fat = fs.mnt_vfat(img, partitions[0])
+  ext4 = fs.mnt_ext4(img, partitions[1], do_resize, backend=backend)
+  fat = fs.mnt_vfat(img, partitions[0], backend=backend)
   return struct(ext4=ext4,fat=fat)
 
+def root_partition(img):
+  for p in fs.read_partitions(img):
+    if not p.empty and p.type_name in ["Native Linux", "Linux filesystem", "Linux root (ARM)", "Linux root (ARM64)"]:
+      return p
+  crash("no Linux partition found in " + img)
+
+def shrink_img(image, headroom_mb=64, partition=None):
+  image.ext4.close()
+  image.fat.close()
+  if partition == None:
+    partition = root_partition(image.ext4.base).number
+  result = fs.shrink_partition(image.ext4.base, partition=partition, headroom_mb=headroom_mb)
+  if result:
+    crash("failed to shrink image: " + result.error)
+
 
 
 def configure_pi_hostname(image, hostname):
@@ -116,6 +140,7 @@ pi = struct(
   library_version=library_version,
   assert_valid_partitions=assert_valid_partitions,
   load_img=load_img,
+  shrink_img=shrink_img,
   configure_static_ethernet=configure_static_ethernet,
   configure_dynamic_ethernet=configure_dynamic_ethernet,
   configure_hostname=configure_pi_hostname,
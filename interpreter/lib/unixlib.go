@@ -1,7 +1,7 @@
 package lib
 
 var unixLib = []byte(`
-library_version = 1
+library_version = 2
 
 def user_list(mount):
   out = []
@@ -36,4 +36,15 @@ def set_shadow_password(mount, user, password):
     else:
       new_shadow_data += line
   mount.write('/etc/shadow', new_shadow_data, shadow_perm)
+
+def read_fstab(mount):
+  if not mount.exists('/etc/fstab'):
+    return unix.Fstab()
+  return unix.Fstab(mount.cat('/etc/fstab'))
+
+def write_fstab(mount, fstab):
+  perm = fs.perms.default
+  if mount.exists('/etc/fstab'):
+    perm = mount.stat('/etc/fstab').mode
+  mount.write('/etc/fstab', str(fstab), perm)
 `)
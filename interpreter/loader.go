@@ -0,0 +1,196 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ScriptLoader provides a means for arbitrary imports to be resolved.
+type ScriptLoader interface {
+	// resolveImport returns the canonical name and contents of the module
+	// named by a load() statement in the module from.
+	resolveImport(name, from string) (string, []byte, error)
+}
+
+// workspaceMarker is the name of the file which marks the root of a
+// workspace, when one is not specified explicitly.
+const workspaceMarker = "WORKSPACE"
+
+// WDLoader loads scripts relative to the working directory.
+//
+// Deprecated: Use FileLoader, which resolves imports relative to the
+// importing script.
+type WDLoader struct {
+	l *FileLoader
+}
+
+func (l *WDLoader) resolveImport(name, from string) (string, []byte, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", nil, err
+	}
+	if l.l == nil {
+		l.l = &FileLoader{Workspace: wd}
+	}
+	// Resolve relative imports as if every script were in the working
+	// directory.
+	return l.l.resolveImport(name, filepath.Join(wd, filepath.Base(from)))
+}
+
+// FileLoader loads scripts from the filesystem. Imports are resolved
+// relative to the importing script, and then against each of the search
+// paths in order. Imports starting with // are resolved relative to the
+// root of the workspace, or of the package containing the importing script.
+// Imports of the form @<package>//<path> are resolved from the packages
+// vendored into the workspace.
+type FileLoader struct {
+	Workspace string
+	Paths     []string
+
+	// packages maps the name of each package which has been loaded to its
+	// directory in the package cache, once verified.
+	packages map[string]string
+}
+
+// NewFileLoader returns a loader for the script at path. libPath is a list
+// of directories to search, separated by os.PathListSeparator, which is
+// followed by the directories in the RBOX_PATH environment variable. If
+// workspace is empty, the nearest directory containing the script which
+// also contains a WORKSPACE file is used, or the directory of the script
+// if there is none.
+func NewFileLoader(path, workspace, libPath string) (*FileLoader, error) {
+	l := &FileLoader{Workspace: workspace}
+	for _, list := range []string{libPath, os.Getenv("RBOX_PATH")} {
+		for _, dir := range filepath.SplitList(list) {
+			if dir != "" {
+				l.Paths = append(l.Paths, dir)
+			}
+		}
+	}
+	if l.Workspace == "" {
+		var err error
+		if l.Workspace, err = FindWorkspace(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// FindWorkspace returns the nearest directory containing dir which has a
+// WORKSPACE file, or dir itself if there is none.
+func FindWorkspace(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, workspaceMarker)); err == nil {
+			return d, nil
+		}
+		if d == filepath.Dir(d) {
+			return dir, nil
+		}
+	}
+}
+
+func (l *FileLoader) resolveImport(name, from string) (string, []byte, error) {
+	var candidates []string
+	switch {
+	case strings.HasPrefix(name, "@"):
+		i := strings.Index(name, "//")
+		if i < 2 {
+			return "", nil, fmt.Errorf("invalid import %s, want @<package>//<path>", name)
+		}
+		dir, err := l.packageDir(name[1:i])
+		if err != nil {
+			return "", nil, err
+		}
+		p, err := joinWithin(dir, name[i+2:])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid import %s: %v", name, err)
+		}
+		candidates = []string{p}
+	case strings.HasPrefix(name, "//"):
+		root := l.packageRoot(from)
+		if root == "" {
+			return "", nil, errors.New("no workspace to resolve " + name)
+		}
+		p, err := joinWithin(root, name[2:])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid import %s: %v", name, err)
+		}
+		candidates = []string{p}
+	case filepath.IsAbs(name):
+		candidates = []string{name}
+	default:
+		candidates = []string{filepath.Join(filepath.Dir(from), name)}
+		for _, dir := range l.Paths {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+
+	for _, p := range candidates {
+		d, err := ioutil.ReadFile(p)
+		if err == nil {
+			return p, d, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+	if len(candidates) == 1 {
+		return "", nil, fmt.Errorf("%s does not exist", candidates[0])
+	}
+	return "", nil, fmt.Errorf("%s not found, tried: %s", name, strings.Join(candidates, ", "))
+}
+
+// joinWithin joins the slash-separated path p to root, returning an error
+// if the result is not inside root.
+func joinWithin(root, p string) (string, error) {
+	out := filepath.Join(root, filepath.FromSlash(p))
+	rel, err := filepath.Rel(root, out)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside %s", out, root)
+	}
+	return out, nil
+}
+
+func (l *FileLoader) packageDir(name string) (string, error) {
+	if dir, ok := l.packages[name]; ok {
+		return dir, nil
+	}
+	if l.Workspace == "" {
+		return "", errors.New("no workspace to load package " + name + " from")
+	}
+	dir, err := packageDir(l.Workspace, name)
+	if err != nil {
+		return "", err
+	}
+	if l.packages == nil {
+		l.packages = map[string]string{}
+	}
+	l.packages[name] = dir
+	return dir, nil
+}
+
+// packageRoot returns the directory which // imports from the script at
+// from are relative to: the root of its package if it is in the package
+// cache, otherwise the workspace.
+func (l *FileLoader) packageRoot(from string) string {
+	if l.Workspace == "" {
+		return ""
+	}
+	cache := filepath.Join(l.Workspace, filepath.FromSlash(packageCache)) + string(filepath.Separator)
+	if !strings.HasPrefix(from, cache) {
+		return l.Workspace
+	}
+	pkg := strings.SplitN(strings.TrimPrefix(from, cache), string(filepath.Separator), 2)[0]
+	return filepath.Join(cache, pkg)
+}
@@ -0,0 +1,108 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+// Mutation describes a change made to an image by a script. In addition to
+// the filesystem operations described by fs.Change, Op may be enable (Path
+// is the unit and Target the systemd target) or pull (Path is the container
+// image reference).
+type Mutation struct {
+	Mount string // Type of the filesystem which was changed, such as ext4.
+	fs.Change
+	// Result describes the file after the change. It is nil if the file was
+	// removed, or for operations which are not filesystem changes.
+	Result *fs.FileState
+	// Stack lists the positions of the calls which made the change, as
+	// <file>:<line>:<column> in <function>, outermost first.
+	Stack []string
+}
+
+// EnablePlan puts the script in plan mode: filesystems mounted by the script
+// are opened read-only and wrapped in a copy-on-write overlay, so changes are
+// recorded rather than written to the image. Builtins which change the image
+// itself, such as partitioning, return an error.
+func (s *Script) EnablePlan() {
+	s.plan = true
+}
+
+// checkNotPlan returns an error if the script is in plan mode, for builtins
+// which change the image itself rather than a mounted filesystem.
+func (s *Script) checkNotPlan(builtin string) error {
+	if s.plan {
+		return fmt.Errorf("%s cannot be used in plan mode, as it changes the image itself", builtin)
+	}
+	return nil
+}
+
+// Mutations returns the changes made by the script, in the order they were
+// made. The previous and new contents of written files are only retained in
+// plan mode.
+func (s *Script) Mutations() []Mutation {
+	return s.mutations
+}
+
+// wrapMount wraps the filesystem of a mount so changes made through it are
+// recorded. In plan mode, changes are kept in an overlay rather than written
+// to the image.
+func (s *Script) wrapMount(p *FSMountProxy) {
+	onChange := func(c fs.Change) {
+		s.recordChange(p, c)
+	}
+	if s.plan {
+		p.fs = fs.NewOverlay(p.fs, onChange)
+	} else {
+		p.fs = fs.NewRecorder(p.fs, onChange)
+	}
+}
+
+func (s *Script) recordChange(p *FSMountProxy, c fs.Change) {
+	m := Mutation{Mount: strings.ToLower(p.Kind), Change: c, Stack: s.callStack()}
+	if c.Op != "remove" && c.Op != "remove_all" {
+		var (
+			st  *fs.FileState
+			err error
+		)
+		if c.SHA256 != nil {
+			st, err = fs.StatFileSum(p.fs, c.Path, *c.SHA256)
+		} else {
+			st, err = fs.StatFile(p.fs, c.Path, c.After)
+		}
+		if err == nil {
+			st.Target = c.Target
+			m.Result = st
+		}
+	}
+	if !s.plan {
+		// Contents are only needed to show diffs in plan mode.
+		m.Before, m.After = nil, nil
+	}
+	s.mutations = append(s.mutations, m)
+}
+
+// record notes an operation on a mount which is not a filesystem change,
+// such as enabling a systemd unit.
+func (s *Script) record(p *FSMountProxy, op, path, target string) {
+	s.mutations = append(s.mutations, Mutation{
+		Mount:  strings.ToLower(p.Kind),
+		Change: fs.Change{Op: op, Path: path, Target: target},
+		Stack:  s.callStack(),
+	})
+}
+
+// callStack returns the positions of the starlark calls currently being
+// executed, omitting builtins.
+func (s *Script) callStack() []string {
+	var out []string
+	for _, fr := range s.thread.CallStack() {
+		if fr.Pos.Filename() == "<builtin>" {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s in %s", fr.Pos, fr.Name))
+	}
+	return out
+}
@@ -0,0 +1,312 @@
+package interpreter
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files within a workspace which describe its packages.
+const (
+	PackageManifest = "packages.json"
+	PackageLockfile = "packages.lock"
+	packageCache    = ".rbox/packages"
+)
+
+// Package describes a library of scripts which is vendored into a
+// workspace, and can then be loaded as @<name>//<path>.
+type Package struct {
+	// Source is the path to a directory, such as a git checkout, or a tarball
+	// containing the package. Relative paths are relative to the workspace.
+	Source string `json:"source"`
+	// Subdir is the directory within the source containing the package.
+	Subdir string `json:"subdir,omitempty"`
+	// SHA256 is the hash of the contents of the package, as computed by
+	// HashPackage.
+	SHA256 string `json:"sha256"`
+}
+
+func readPackages(p string) (map[string]Package, error) {
+	d, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]Package
+	if err := json.Unmarshal(d, &out); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", p, err)
+	}
+	for name := range out {
+		if name == "" || strings.ContainsAny(name, "/\\@.") {
+			return nil, fmt.Errorf("%s: invalid package name %q", p, name)
+		}
+	}
+	return out, nil
+}
+
+// Vendor copies each package listed in the manifest of the workspace into
+// its package cache, and writes the lockfile. The contents of each package
+// must match the hash pinned in the manifest. Packages which are no longer
+// listed are removed from the cache.
+func Vendor(workspace string) (map[string]Package, error) {
+	pkgs, err := readPackages(filepath.Join(workspace, PackageManifest))
+	if err != nil {
+		return nil, err
+	}
+	cache := filepath.Join(workspace, filepath.FromSlash(packageCache))
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := vendorPackage(workspace, cache, name, pkgs[name]); err != nil {
+			return nil, fmt.Errorf("package %s: %v", name, err)
+		}
+	}
+
+	existing, err := ioutil.ReadDir(cache)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range existing {
+		if _, ok := pkgs[fi.Name()]; !ok {
+			if err := os.RemoveAll(filepath.Join(cache, fi.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	d, err := json.MarshalIndent(pkgs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(workspace, PackageLockfile), append(d, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+// vendorPackage copies a package into a staging directory in the cache,
+// and replaces the cached copy once its hash has been verified.
+func vendorPackage(workspace, cache, name string, pkg Package) error {
+	src := pkg.Source
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(workspace, src)
+	}
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(cache, "."+name+".")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if st.IsDir() {
+		err = copyPackageDir(filepath.Join(src, pkg.Subdir), staging)
+	} else {
+		err = extractPackageTarball(src, pkg.Subdir, staging)
+	}
+	if err != nil {
+		return err
+	}
+	sum, err := HashPackage(staging)
+	if err != nil {
+		return err
+	}
+	switch {
+	case pkg.SHA256 == "":
+		return fmt.Errorf("no sha256 is pinned in %s, the contents of %s hash to %s", PackageManifest, pkg.Source, sum)
+	case pkg.SHA256 != sum:
+		return fmt.Errorf("contents of %s hash to %s, but %s is pinned in %s", pkg.Source, sum, pkg.SHA256, PackageManifest)
+	}
+
+	dst := filepath.Join(cache, name)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Rename(staging, dst)
+}
+
+// copyPackageDir copies the regular files in the directory src to dst,
+// skipping any .git directories.
+func copyPackageDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir() && fi.Name() == ".git":
+			return filepath.SkipDir
+		case fi.IsDir():
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		case !fi.Mode().IsRegular():
+			return fmt.Errorf("%s: unsupported file type %v", p, fi.Mode()&os.ModeType)
+		}
+		d, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), d, 0644)
+	})
+}
+
+// extractPackageTarball extracts the files under subdir in the tarball at
+// src, which may be gzip-compressed, to dst.
+func extractPackageTarball(src, subdir, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gr, err := gzip.NewReader(f); err == nil {
+		defer gr.Close()
+		r = gr
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	prefix := ""
+	if subdir != "" {
+		prefix = path.Clean(filepath.ToSlash(subdir)) + "/"
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", src, err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%s: invalid path %q", src, hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+		if !strings.HasPrefix(name, prefix) || strings.Contains("/"+name, "/.git/") {
+			continue
+		}
+		p := filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(name, prefix)))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			var d []byte
+			if d, err = ioutil.ReadAll(tr); err != nil {
+				return fmt.Errorf("reading %s: %v", src, err)
+			}
+			err = ioutil.WriteFile(p, d, 0644)
+		case tar.TypeXGlobalHeader:
+		default:
+			return fmt.Errorf("%s: %s has unsupported type %q", src, hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// HashPackage returns the hash of the files in the package at dir, in hex.
+// The hash covers the path and contents of each regular file, so it does not
+// depend on whether the package was vendored from a directory or tarball.
+func HashPackage(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir() && fi.Name() == ".git":
+			return filepath.SkipDir
+		case fi.IsDir():
+			return nil
+		case !fi.Mode().IsRegular():
+			return fmt.Errorf("%s: unsupported file type %v", p, fi.Mode()&os.ModeType)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		d, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", sha256.Sum256(d), f)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// packageDir returns the directory in the package cache of the workspace
+// containing the named package, after checking that the cached copy matches
+// both the lockfile and the manifest.
+func packageDir(workspace, name string) (string, error) {
+	lock, err := readPackages(filepath.Join(workspace, PackageLockfile))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s does not exist, run rbox vendor", filepath.Join(workspace, PackageLockfile))
+	}
+	if err != nil {
+		return "", err
+	}
+	manifest, err := readPackages(filepath.Join(workspace, PackageManifest))
+	if err != nil {
+		return "", err
+	}
+	want, ok := manifest[name]
+	if !ok {
+		return "", fmt.Errorf("package %s is not listed in %s", name, filepath.Join(workspace, PackageManifest))
+	}
+	if lock[name] != want {
+		return "", fmt.Errorf("package %s has changed since it was vendored, run rbox vendor", name)
+	}
+
+	dir := filepath.Join(workspace, filepath.FromSlash(packageCache), name)
+	sum, err := HashPackage(dir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("package %s has not been vendored, run rbox vendor", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if sum != want.SHA256 {
+		return "", fmt.Errorf("package %s has been modified since it was vendored, run rbox vendor", name)
+	}
+	return dir, nil
+}
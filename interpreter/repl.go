@@ -0,0 +1,154 @@
+package interpreter
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// replFilename is the name statements entered into the REPL are attributed
+// to. Loads are resolved relative to the working directory.
+const replFilename = "<repl>"
+
+// replPrelude mounts the image passed as the first argument, using the
+// backend passed as the second.
+const replPrelude = `load('pi.lib', 'pi')
+image = pi.load_img(args.arg(0), backend=args.arg(1))
+`
+
+// NewREPL initializes a script for evaluating statements interactively, with
+// the partitions of the image at img mounted and bound as image. backend is
+// passed to pi.load_img.
+func NewREPL(img, backend string, verbose bool, loader ScriptLoader) (*Script, error) {
+	s, err := NewScript([]byte(replPrelude), replFilename, verbose, loader, []string{img, backend})
+	if err != nil {
+		return nil, err
+	}
+	s.startREPL()
+	return s, nil
+}
+
+// startREPL merges the predeclared modules into the globals of the script,
+// so that both are visible to statements and completion.
+func (s *Script) startREPL() {
+	env := make(starlark.StringDict, len(s.predeclared)+len(s.globals))
+	for name, v := range s.predeclared {
+		env[name] = v
+	}
+	for name, v := range s.globals {
+		env[name] = v
+	}
+	s.globals = env
+}
+
+// EvalREPL reads a single statement using readline, which is called again
+// for each continuation line of a compound statement, and executes it. If
+// the statement is an expression its value is returned, otherwise None is
+// returned. io.EOF is returned once readline reaches the end of its input.
+func (s *Script) EvalREPL(readline func() ([]byte, error)) (starlark.Value, error) {
+	eof := false
+	f, err := syntax.ParseCompoundStmt(replFilename, func() ([]byte, error) {
+		line, err := readline()
+		if err == io.EOF {
+			eof = true
+		}
+		return line, err
+	})
+	if err != nil {
+		if eof {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	if expr := soleExpr(f); expr != nil {
+		v, err := starlark.EvalExpr(s.thread, expr, s.globals)
+		if err != nil {
+			return nil, annotate(err)
+		}
+		return v, nil
+	}
+
+	prog, err := starlark.FileProgram(f, s.globals.Has)
+	if err != nil {
+		return nil, err
+	}
+	g, err := prog.Init(s.thread, s.globals)
+	if err != nil {
+		return nil, annotate(err)
+	}
+	for name, v := range g {
+		s.globals[name] = v
+	}
+	return starlark.None, nil
+}
+
+func soleExpr(f *syntax.File) syntax.Expr {
+	if len(f.Stmts) == 1 {
+		if stmt, ok := f.Stmts[0].(*syntax.ExprStmt); ok {
+			return stmt.X
+		}
+	}
+	return nil
+}
+
+// Complete returns the partial name or attribute at the end of line, such
+// as the ca in image.ext4.ca, and the names which could complete it in
+// sorted order. Attributes are listed using the AttrNames of the value
+// the partial attribute is selected from.
+func (s *Script) Complete(line string) (string, []string) {
+	start := len(line)
+	for start > 0 && isIdentOrDot(line[start-1]) {
+		start--
+	}
+	parts := strings.Split(line[start:], ".")
+	partial := parts[len(parts)-1]
+	if parts[0] != "" && parts[0][0] >= '0' && parts[0][0] <= '9' {
+		return partial, nil // A number.
+	}
+
+	var names []string
+	if len(parts) == 1 {
+		names = append(s.globals.Keys(), starlark.Universe.Keys()...)
+	} else {
+		v, ok := s.globals[parts[0]]
+		if !ok {
+			if v, ok = starlark.Universe[parts[0]]; !ok {
+				return partial, nil
+			}
+		}
+		for _, attr := range parts[1 : len(parts)-1] {
+			x, ok := v.(starlark.HasAttrs)
+			if !ok {
+				return partial, nil
+			}
+			var err error
+			if v, err = x.Attr(attr); err != nil || v == nil {
+				return partial, nil
+			}
+		}
+		x, ok := v.(starlark.HasAttrs)
+		if !ok {
+			return partial, nil
+		}
+		names = x.AttrNames()
+	}
+
+	var out []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if strings.HasPrefix(name, partial) && !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return partial, out
+}
+
+func isIdentOrDot(c byte) bool {
+	return c == '.' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+// testOptions configures how test scripts are run.
+type testOptions struct {
+	run       *regexp.Regexp // Only tests with matching names are run, if set.
+	verbose   bool           // Lists passing tests as well as failures.
+	workspace string
+	libPath   string
+}
+
+// runTest implements the test subcommand, which runs the test_ functions in
+// *_test.box files.
+func runTest(args []string) error {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	run := flags.String("run", "", "Only runs tests with names matching this regular expression.")
+	verbose := flags.Bool("v", false, "Lists every test which is run.")
+	workspace := flags.String("workspace", "", "Directory which loads starting with // are relative to. Defaults to the nearest directory containing each script with a WORKSPACE file.")
+	libPath := flags.String("lib-path", "", "List of directories to search for loaded scripts, separated by ':'. Searched before RBOX_PATH.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s test [flags] [<file or directory>...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	opts := testOptions{verbose: *verbose, workspace: *workspace, libPath: *libPath}
+	if *run != "" {
+		var err error
+		if opts.run, err = regexp.Compile(*run); err != nil {
+			return fmt.Errorf("invalid --run: %v", err)
+		}
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := findTestScripts(paths)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no *_test.box files found in %s", strings.Join(paths, ", "))
+	}
+	return runTestScripts(os.Stdout, files, opts)
+}
+
+// findTestScripts returns the files named by paths, and the *_test.box files
+// within any directories, skipping hidden directories.
+func findTestScripts(paths []string) ([]string, error) {
+	var out []string
+	for _, p := range paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			out = append(out, p)
+			continue
+		}
+		err = filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() && path != p && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !fi.IsDir() && strings.HasSuffix(fi.Name(), "_test.box") {
+				out = append(out, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// runTestScripts runs the tests in each file, writing the results to w. An
+// error is returned if any test failed.
+func runTestScripts(w io.Writer, files []string, opts testOptions) error {
+	var total, failed int
+	for _, f := range files {
+		n, nFailed := runTestScript(w, f, opts)
+		total += n
+		failed += nFailed
+	}
+	if failed > 0 {
+		fmt.Fprintln(w, "FAIL")
+		return fmt.Errorf("%d of %d tests failed", failed, total)
+	}
+	fmt.Fprintln(w, "PASS")
+	return nil
+}
+
+// runTestScript runs the tests in a single file, returning the number of
+// tests run and the number which failed. A script which fails to load
+// counts as a single failed test.
+func runTestScript(w io.Writer, file string, opts testOptions) (int, int) {
+	s, err := loadTestScript(file, opts)
+	if err != nil {
+		fmt.Fprintf(w, "--- FAIL: %s\n%s\n", file, indent(interpreter.Backtrace(err)))
+		return 1, 1
+	}
+	defer s.Close()
+
+	var total, failed int
+	start := time.Now()
+	for _, name := range s.Tests() {
+		if opts.run != nil && !opts.run.MatchString(name) {
+			continue
+		}
+		total++
+		testStart := time.Now()
+		if err := s.RunTest(name); err != nil {
+			failed++
+			fmt.Fprintf(w, "--- FAIL: %s (%.2fs)\n%s\n", name, time.Since(testStart).Seconds(), indent(interpreter.Backtrace(err)))
+		} else if opts.verbose {
+			fmt.Fprintf(w, "--- PASS: %s (%.2fs)\n", name, time.Since(testStart).Seconds())
+		}
+	}
+	status := "ok  "
+	if failed > 0 {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s\t%s\t%.2fs\n", status, file, time.Since(start).Seconds())
+	return total, failed
+}
+
+func loadTestScript(file string, opts testOptions) (*interpreter.Script, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	loader, err := interpreter.NewFileLoader(file, opts.workspace, opts.libPath)
+	if err != nil {
+		return nil, err
+	}
+	return interpreter.NewScript(d, file, opts.verbose, loader, nil)
+}
+
+// indent indents each line of s by four spaces.
+func indent(s string) string {
+	return "    " + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n    ", -1)
+}
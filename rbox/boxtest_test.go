@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRunTestScripts(t *testing.T) {
+	dir := t.TempDir()
+	for p, d := range map[string]string{
+		"fixtures/root/etc/hostname": "raspberrypi\n",
+		"lib/pi.box":                 "def set_hostname(root, name):\n    root.write('/etc/hostname', name + '\\n', 0o644)\n",
+		"lib/pi_test.box": `load('pi.box', 'set_hostname')
+
+def test_set_hostname():
+    root = fs.mnt_memory('../fixtures/root')
+    set_hostname(root, 'kitchen')
+    assert.file_contains(root, '/etc/hostname', 'kitchen')
+
+def test_wrong_hostname():
+    root = fs.mnt_memory('../fixtures/root')
+    assert.eq(root.cat('/etc/hostname'), 'kitchen\n')
+`,
+		"broken_test.box":        "load('missing.box', 'x')\n",
+		".rbox/ignored_test.box": "",
+	} {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := findTestScripts([]string{dir})
+	if err != nil {
+		t.Fatalf("findTestScripts() failed: %v", err)
+	}
+	want := []string{filepath.Join(dir, "broken_test.box"), filepath.Join(dir, "lib", "pi_test.box")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("findTestScripts() = %v, want %v", files, want)
+	}
+
+	var buf bytes.Buffer
+	err = runTestScripts(&buf, files, testOptions{})
+	if err == nil || err.Error() != "2 of 3 tests failed" {
+		t.Errorf("runTestScripts() = %v, want 2 of 3 tests failed", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"--- FAIL: " + filepath.Join(dir, "broken_test.box") + "\n",
+		"--- FAIL: test_wrong_hostname (",
+		`eq: assertion failed: "raspberrypi\n" != "kitchen\n"`,
+		"FAIL\t" + filepath.Join(dir, "lib", "pi_test.box"),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "test_set_hostname") {
+		t.Errorf("passing test listed without verbose output:\n%s", out)
+	}
+
+	buf.Reset()
+	err = runTestScripts(&buf, files[1:], testOptions{run: regexp.MustCompile("set"), verbose: true})
+	if err != nil {
+		t.Errorf("runTestScripts() failed: %v\n%s", err, buf.String())
+	}
+	if out := buf.String(); !strings.Contains(out, "--- PASS: test_set_hostname (") || !strings.HasSuffix(out, "\nPASS\n") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
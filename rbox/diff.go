@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+// runDiff implements the diff subcommand, which compares the filesystems in
+// two images.
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Writes the differences as JSON.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s diff [--json] <a.img> <b.img>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("diff requires two images")
+	}
+
+	diffs, err := fs.DiffImages(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printDiffJSON(os.Stdout, diffs)
+	}
+	return printDiff(os.Stdout, diffs)
+}
+
+// fileType returns a short name for the type of a file.
+func fileType(m os.FileMode) string {
+	switch {
+	case m.IsRegular():
+		return "file"
+	case m.IsDir():
+		return "directory"
+	case m&os.ModeSymlink != 0:
+		return "symlink"
+	case m&os.ModeDevice != 0:
+		return "device"
+	case m&os.ModeNamedPipe != 0:
+		return "fifo"
+	case m&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "other"
+}
+
+// unixPerms returns the permission bits of a mode, including the setuid,
+// setgid and sticky bits, in the form used by chmod.
+func unixPerms(m os.FileMode) uint32 {
+	out := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		out |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		out |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		out |= 01000
+	}
+	return out
+}
+
+// changes returns the aspects of a modified file which differ, with a
+// description of each.
+func changes(d fs.FileDiff) ([]string, []string) {
+	var kinds, desc []string
+	add := func(kind, format string, args ...interface{}) {
+		kinds = append(kinds, kind)
+		desc = append(desc, fmt.Sprintf(format, args...))
+	}
+	o, n := d.Old, d.New
+	if fileType(o.Mode) != fileType(n.Mode) {
+		add("type", "type %s -> %s", fileType(o.Mode), fileType(n.Mode))
+	} else if d.ContentChanged() {
+		add("contents", "contents (%d -> %d bytes)", o.Size, n.Size)
+	}
+	if unixPerms(o.Mode) != unixPerms(n.Mode) {
+		add("mode", "mode %04o -> %04o", unixPerms(o.Mode), unixPerms(n.Mode))
+	}
+	if o.UID != n.UID || o.GID != n.GID {
+		add("owner", "owner %d:%d -> %d:%d", o.UID, o.GID, n.UID, n.GID)
+	}
+	if o.Target != n.Target {
+		add("target", "target %s -> %s", o.Target, n.Target)
+	}
+	return kinds, desc
+}
+
+// describeFile returns a summary of a file for added and removed files.
+func describeFile(s *fs.FileState) string {
+	switch {
+	case s.Mode.IsRegular():
+		return fmt.Sprintf("file, %d bytes, mode %04o, owner %d:%d", s.Size, unixPerms(s.Mode), s.UID, s.GID)
+	case s.Mode&os.ModeSymlink != 0:
+		return fmt.Sprintf("symlink to %s", s.Target)
+	}
+	return fmt.Sprintf("%s, mode %04o, owner %d:%d", fileType(s.Mode), unixPerms(s.Mode), s.UID, s.GID)
+}
+
+// diffContents returns a unified diff of the contents of a file, or a note
+// explaining why one cannot be shown. Both are empty if the contents did not
+// change.
+func diffContents(d fs.FileDiff) (string, string, error) {
+	if !d.ContentChanged() {
+		return "", "", nil
+	}
+	before, after := d.Old != nil && d.Old.Mode.IsRegular(), d.New != nil && d.New.Mode.IsRegular()
+	if (before && d.Old.Size > fs.MaxDiffSize) || (after && d.New.Size > fs.MaxDiffSize) {
+		return "", "too large to show contents", nil
+	}
+	if !isText(d.OldData) || !isText(d.NewData) {
+		return "", "binary contents not shown", nil
+	}
+	var buf strings.Builder
+	if err := writeDiff(&buf, d.Path, d.OldData, d.NewData, before, after); err != nil {
+		return "", "", err
+	}
+	return buf.String(), "", nil
+}
+
+// printDiff writes a summary of the differences between two images to w.
+func printDiff(w io.Writer, diffs []fs.FileDiff) error {
+	for _, d := range diffs {
+		prefix := fmt.Sprintf("[%d %s]", d.Partition, d.FS)
+		switch {
+		case d.Old == nil:
+			fmt.Fprintf(w, "%s added %s (%s)\n", prefix, d.Path, describeFile(d.New))
+		case d.New == nil:
+			fmt.Fprintf(w, "%s removed %s (%s)\n", prefix, d.Path, describeFile(d.Old))
+		default:
+			_, desc := changes(d)
+			fmt.Fprintf(w, "%s modified %s: %s\n", prefix, d.Path, strings.Join(desc, ", "))
+		}
+		diff, note, err := diffContents(d)
+		if err != nil {
+			return err
+		}
+		if note != "" {
+			fmt.Fprintf(w, "   (%s)\n", note)
+		}
+		io.WriteString(w, diff)
+	}
+	fmt.Fprintf(w, "%d differences.\n", len(diffs))
+	return nil
+}
+
+type jsonFileState struct {
+	Type   string `json:"type"`
+	Mode   string `json:"mode"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+type jsonFileDiff struct {
+	Partition int            `json:"partition"`
+	FS        string         `json:"fs"`
+	Path      string         `json:"path"`
+	Change    string         `json:"change"`
+	Changes   []string       `json:"changes,omitempty"`
+	Old       *jsonFileState `json:"old,omitempty"`
+	New       *jsonFileState `json:"new,omitempty"`
+	Diff      string         `json:"diff,omitempty"`
+}
+
+func toJSONFileState(s *fs.FileState) *jsonFileState {
+	if s == nil {
+		return nil
+	}
+	out := &jsonFileState{
+		Type:   fileType(s.Mode),
+		Mode:   fmt.Sprintf("%04o", unixPerms(s.Mode)),
+		UID:    s.UID,
+		GID:    s.GID,
+		Size:   s.Size,
+		Target: s.Target,
+	}
+	if s.Mode.IsRegular() {
+		out.SHA256 = hex.EncodeToString(s.SHA256[:])
+	}
+	return out
+}
+
+// printDiffJSON writes the differences between two images to w as a JSON
+// array.
+func printDiffJSON(w io.Writer, diffs []fs.FileDiff) error {
+	out := make([]jsonFileDiff, 0, len(diffs))
+	for _, d := range diffs {
+		j := jsonFileDiff{
+			Partition: d.Partition,
+			FS:        d.FS,
+			Path:      d.Path,
+			Old:       toJSONFileState(d.Old),
+			New:       toJSONFileState(d.New),
+		}
+		switch {
+		case d.Old == nil:
+			j.Change = "added"
+		case d.New == nil:
+			j.Change = "removed"
+		default:
+			j.Change = "modified"
+			j.Changes, _ = changes(d)
+		}
+		var err error
+		if j.Diff, _, err = diffContents(d); err != nil {
+			return err
+		}
+		out = append(out, j)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
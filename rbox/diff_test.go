@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+var testDiffs = []fs.FileDiff{
+	{
+		Partition: 1, FS: "vfat", Path: "/ssh",
+		New: &fs.FileState{Mode: 0755},
+	},
+	{
+		Partition: 2, FS: "ext4", Path: "/etc/hostname",
+		Old:     &fs.FileState{Mode: 0644, Size: 12, SHA256: [32]byte{1}},
+		New:     &fs.FileState{Mode: 0600, UID: 1000, GID: 1000, Size: 5, SHA256: [32]byte{2}},
+		OldData: []byte("raspberrypi\n"),
+		NewData: []byte("mypi\n"),
+	},
+	{
+		Partition: 2, FS: "ext4", Path: "/etc/localtime",
+		Old: &fs.FileState{Mode: os.ModeSymlink | 0777, Size: 23, Target: "/usr/share/zoneinfo/UTC"},
+		New: &fs.FileState{Mode: os.ModeSymlink | 0777, Size: 33, Target: "/usr/share/zoneinfo/Europe/London"},
+	},
+	{
+		Partition: 2, FS: "ext4", Path: "/usr/bin/app",
+		Old:     &fs.FileState{Mode: 0755, Size: 4, SHA256: [32]byte{3}},
+		OldData: []byte{0x7f, 'E', 'L', 'F', 0},
+	},
+}
+
+func TestPrintDiff(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printDiff(&buf, testDiffs); err != nil {
+		t.Fatalf("printDiff() failed: %v", err)
+	}
+
+	want := `[1 vfat] added /ssh (file, 0 bytes, mode 0755, owner 0:0)
+[2 ext4] modified /etc/hostname: contents (12 -> 5 bytes), mode 0644 -> 0600, owner 0:0 -> 1000:1000
+--- a/etc/hostname
++++ b/etc/hostname
+@@ -1 +1 @@
+-raspberrypi
++mypi
+[2 ext4] modified /etc/localtime: target /usr/share/zoneinfo/UTC -> /usr/share/zoneinfo/Europe/London
+[2 ext4] removed /usr/bin/app (file, 4 bytes, mode 0755, owner 0:0)
+   (binary contents not shown)
+4 differences.
+`
+	if got := buf.String(); got != want {
+		t.Errorf("printDiff() output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrintDiffJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printDiffJSON(&buf, testDiffs); err != nil {
+		t.Fatalf("printDiffJSON() failed: %v", err)
+	}
+	var got []jsonFileDiff
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, buf.String())
+	}
+	if len(got) != len(testDiffs) {
+		t.Fatalf("got %d differences, want %d", len(got), len(testDiffs))
+	}
+
+	if got[0].Change != "added" || got[0].Old != nil || got[0].New.Type != "file" || got[0].Diff != "" {
+		t.Errorf("got[0] = %+v, want an added empty file", got[0])
+	}
+	if want := []string{"contents", "mode", "owner"}; got[1].Change != "modified" || !reflect.DeepEqual(got[1].Changes, want) {
+		t.Errorf("got[1] = %+v, want changes %q", got[1], want)
+	}
+	if got[1].New.Mode != "0600" || got[1].New.SHA256 != "02"+strings.Repeat("0", 62) {
+		t.Errorf("got[1].New = %+v", got[1].New)
+	}
+	if want := "--- a/etc/hostname\n+++ b/etc/hostname\n@@ -1 +1 @@\n-raspberrypi\n+mypi\n"; got[1].Diff != want {
+		t.Errorf("got[1].Diff = %q, want %q", got[1].Diff, want)
+	}
+	if want := []string{"target"}; !reflect.DeepEqual(got[2].Changes, want) || got[2].New.Target != "/usr/share/zoneinfo/Europe/London" {
+		t.Errorf("got[2] = %+v, want a changed symlink target", got[2])
+	}
+	if got[3].Change != "removed" || got[3].New != nil || got[3].Diff != "" {
+		t.Errorf("got[3] = %+v, want a removed binary file", got[3])
+	}
+
+	buf.Reset()
+	if err := printDiffJSON(&buf, nil); err != nil || buf.String() != "[]\n" {
+		t.Errorf("printDiffJSON(nil) = %q, %v, want an empty array", buf.String(), err)
+	}
+}
@@ -1,21 +1,39 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	"github.com/containers/storage/pkg/reexec"
+	"github.com/twitchyliquid64/raspberry-box/fs"
 	"github.com/twitchyliquid64/raspberry-box/interpreter"
 )
 
 var (
 	script  = flag.String("script", "build.box", "Path to the box build file.")
 	img     = flag.String("img", "", "Path to the base image file.")
+	out     = flag.String("out", "", "Path to write the built image to. If unset, the base image is modified in-place.")
+	outFmt  = flag.String("out-format", "", "Format of the output image: one of img, img.xz, img.zst or img.gz. Inferred from --out if unset.")
+	plan    = flag.Bool("plan", false, "Lists the changes the script would make, without modifying the image.")
 	verbose = flag.Bool("verbose", false, "Enables verbose logging.")
+
+	libPath   = flag.String("lib-path", "", "List of directories to search for loaded scripts, separated by ':'. Searched before RBOX_PATH.")
+	workspace = flag.String("workspace", "", "Directory which loads starting with // are relative to. Defaults to the nearest directory containing the script with a WORKSPACE file.")
 )
 
+// subcommands are invoked as the first argument to rbox, and are passed the
+// remaining arguments.
+var subcommands = map[string]func(args []string) error{
+	"diff":   runDiff,
+	"repl":   runREPL,
+	"test":   runTest,
+	"vendor": runVendor,
+}
+
 func loadScript() ([]byte, error) {
 	d, err := os.Stat(*script)
 	if err != nil {
@@ -31,6 +49,15 @@ func main() {
 	if reexec.Init() {
 		return
 	}
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
 	flag.Parse()
 	sData, err := loadScript()
@@ -39,9 +66,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	script, err := interpreter.NewScript(sData, *script, *verbose, &interpreter.WDLoader{}, flag.Args())
+	loader, err := interpreter.NewFileLoader(*script, *workspace, *libPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Initialization failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to initialize loader: %v\n", err)
+		os.Exit(1)
+	}
+	script, err := interpreter.NewScript(sData, *script, *verbose, loader, flag.Args())
+	if err == flag.ErrHelp {
+		return // The script's usage has been printed.
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Initialization failed: %s\n", interpreter.Backtrace(err))
 		os.Exit(1)
 	}
 
@@ -57,15 +92,112 @@ func run(s *interpreter.Script) error {
 		var err error
 		*img, err = s.CallFn("fallback_img")
 		if err != nil {
-			return fmt.Errorf("fallback_img() failed: %v", err)
+			return fmt.Errorf("fallback_img() failed: %s", interpreter.Backtrace(err))
 		}
 	}
+	compression, err := fs.DetectCompression(*img)
+	if err != nil {
+		return err
+	}
+	if *plan {
+		if *out != "" || *outFmt != "" {
+			return errors.New("--plan cannot be combined with --out or --out-format")
+		}
+		return runPlan(s, compression)
+	}
+	if *out == "" {
+		if compression != fs.CompressionNone {
+			return fmt.Errorf("%s is compressed, so --out must be specified", *img)
+		}
+		if *outFmt != "" {
+			return errors.New("--out-format requires --out")
+		}
+		if err := build(s, *img); err != nil {
+			return err
+		}
+		// The manifest is only written once the image has been flushed.
+		if err := s.Close(); err != nil {
+			return fmt.Errorf("closing image: %v", err)
+		}
+		return writeManifest(*img, *script, s.Mutations())
+	}
+	outPath, outCompression, err := outputPath(*out, *outFmt)
+	if err != nil {
+		return err
+	}
+
+	// Build against a clone of the base image, which is only moved to the
+	// output path once the build has succeeded.
+	tmp, err := cloneImage(*img, outPath, compression)
+	if err != nil {
+		return err
+	}
+	if err := build(s, tmp); err != nil {
+		s.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// Filesystems within the image must be unmounted before it is moved.
+	if err := s.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("closing image: %v", err)
+	}
+	if err := writeOutput(tmp, outPath, outCompression); err != nil {
+		return err
+	}
+	return writeManifest(outPath, *script, s.Mutations())
+}
+
+// runPlan runs the script in plan mode and prints the changes it would make.
+// Changes to files are kept in memory, and the image is only read. A
+// compressed image is decompressed to a temporary file first.
+func runPlan(s *interpreter.Script, compression string) error {
+	path := *img
+	if compression != fs.CompressionNone {
+		tmp, err := cloneImage(*img, *img, compression)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp)
+		path = tmp
+	}
+	s.EnablePlan()
+	if err := build(s, path); err != nil {
+		s.Close()
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("closing image: %v", err)
+	}
+	return printPlan(os.Stdout, s.Mutations())
+}
+
+// cloneImage copies the image at img to a temporary file alongside near,
+// decompressing it if necessary.
+func cloneImage(img, near, compression string) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(near), "."+filepath.Base(near)+".")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary image: %v", err)
+	}
+	tmp.Close()
+	if compression != fs.CompressionNone {
+		err = fs.Decompress(img, tmp.Name())
+	} else {
+		err = fs.CloneFile(img, tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("copying base image: %v", err)
+	}
+	return tmp.Name(), nil
+}
 
-	if err := s.Setup(*img); err != nil {
-		return fmt.Errorf("setup() failed: %v", err)
+func build(s *interpreter.Script, img string) error {
+	if err := s.Setup(img); err != nil {
+		return fmt.Errorf("setup() failed: %s", interpreter.Backtrace(err))
 	}
 	if err := s.Build(); err != nil {
-		return fmt.Errorf("build() failed: %v", err)
+		return fmt.Errorf("build() failed: %s", interpreter.Backtrace(err))
 	}
 	return nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+type manifestEntry struct {
+	Mount    string         `json:"mount"`
+	Op       string         `json:"op"`
+	Path     string         `json:"path"`
+	Target   string         `json:"target,omitempty"`
+	Result   *jsonFileState `json:"result,omitempty"`
+	Location string         `json:"location,omitempty"`
+	Stack    []string       `json:"stack,omitempty"`
+}
+
+type manifest struct {
+	Image     string          `json:"image"`
+	Script    string          `json:"script"`
+	Mutations []manifestEntry `json:"mutations"`
+}
+
+// writeManifest writes a JSON description of every change made to the image
+// at path by the script to <path>.manifest.json.
+func writeManifest(path, script string, mutations []interpreter.Mutation) error {
+	m := manifest{
+		Image:     filepath.Base(path),
+		Script:    script,
+		Mutations: make([]manifestEntry, 0, len(mutations)),
+	}
+	for _, mu := range mutations {
+		e := manifestEntry{
+			Mount:  mu.Mount,
+			Op:     mu.Op,
+			Path:   mu.Path,
+			Target: mu.Target,
+			Result: toJSONFileState(mu.Result),
+			Stack:  mu.Stack,
+		}
+		if len(mu.Stack) > 0 {
+			e.Location = mu.Stack[len(mu.Stack)-1]
+		}
+		m.Mutations = append(m.Mutations, e)
+	}
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".manifest.json", append(d, '\n'), 0644)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+func TestWriteManifest(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "mypi.img")
+	sum := sha256.Sum256([]byte("mypi\n"))
+	mutations := []interpreter.Mutation{
+		{
+			Mount:  "ext4",
+			Change: fs.Change{Op: "write", Path: "/etc/hostname"},
+			Result: &fs.FileState{Mode: 0644, UID: 1000, GID: 1000, Size: 5, SHA256: sum},
+			Stack:  []string{"mypi.box:10:5 in build", "pilib.box:40:3 in configure_pi_hostname"},
+		},
+		{
+			Mount:  "ext4",
+			Change: fs.Change{Op: "remove", Path: "/etc/init.d/resize2fs_once"},
+			Stack:  []string{"mypi.box:11:5 in build"},
+		},
+		{
+			Mount:  "ext4",
+			Change: fs.Change{Op: "enable", Path: "ssh.service", Target: "multi-user.target"},
+		},
+	}
+	if err := writeManifest(img, "mypi.box", mutations); err != nil {
+		t.Fatalf("writeManifest() failed: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(img + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got manifest
+	if err := json.Unmarshal(d, &got); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v\n%s", err, d)
+	}
+	want := manifest{
+		Image:  "mypi.img",
+		Script: "mypi.box",
+		Mutations: []manifestEntry{
+			{
+				Mount:    "ext4",
+				Op:       "write",
+				Path:     "/etc/hostname",
+				Result:   &jsonFileState{Type: "file", Mode: "0644", UID: 1000, GID: 1000, Size: 5, SHA256: hex.EncodeToString(sum[:])},
+				Location: "pilib.box:40:3 in configure_pi_hostname",
+				Stack:    []string{"mypi.box:10:5 in build", "pilib.box:40:3 in configure_pi_hostname"},
+			},
+			{
+				Mount:    "ext4",
+				Op:       "remove",
+				Path:     "/etc/init.d/resize2fs_once",
+				Location: "mypi.box:11:5 in build",
+				Stack:    []string{"mypi.box:11:5 in build"},
+			},
+			{
+				Mount:  "ext4",
+				Op:     "enable",
+				Path:   "ssh.service",
+				Target: "multi-user.target",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+var outputFormats = map[string]string{
+	"img":     fs.CompressionNone,
+	"img.xz":  fs.CompressionXZ,
+	"img.zst": fs.CompressionZstd,
+	"img.gz":  fs.CompressionGzip,
+}
+
+// outputPath returns the path the finished image should be written to, and
+// the compression format it should be written in. If no format is
+// specified, it is inferred from the extension of out. Otherwise, the
+// extension for the format is appended to out if not already present: the
+// whole extension, such as .img.xz, if out has none, or just that of the
+// compression, such as .xz, if it does.
+func outputPath(out, format string) (string, string, error) {
+	if format == "" {
+		for _, c := range outputFormats {
+			if c != fs.CompressionNone && strings.HasSuffix(out, "."+c) {
+				return out, c, nil
+			}
+		}
+		return out, fs.CompressionNone, nil
+	}
+
+	c, ok := outputFormats[format]
+	if !ok {
+		return "", "", fmt.Errorf("unknown output format %q", format)
+	}
+	switch {
+	case filepath.Ext(out) == "":
+		out += "." + format
+	case c != fs.CompressionNone && !strings.HasSuffix(out, "."+c):
+		out += "." + c
+	}
+	return out, c, nil
+}
+
+// writeOutput moves the built image at tmp to the output path, compressing
+// it if necessary, and writes a SHA-256 checksum file alongside it.
+func writeOutput(tmp, out, compression string) error {
+	defer os.Remove(tmp)
+	if compression == fs.CompressionNone {
+		if err := os.Rename(tmp, out); err != nil {
+			return err
+		}
+		return writeChecksum(out)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(out), "."+filepath.Base(out)+".")
+	if err != nil {
+		return fmt.Errorf("creating output image: %v", err)
+	}
+	f.Close()
+	if err := fs.Compress(tmp, f.Name(), compression); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("compressing image: %v", err)
+	}
+	if err := os.Rename(f.Name(), out); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return writeChecksum(out)
+}
+
+// writeChecksum writes the SHA-256 digest of the file at path to
+// <path>.sha256, in the format used by sha256sum.
+func writeChecksum(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".sha256", []byte(fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(path))), 0644)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+func TestOutputPath(t *testing.T) {
+	tcs := []struct {
+		out, format        string
+		wantPath, wantComp string
+		wantErr            bool
+	}{
+		{out: "custom.img", wantPath: "custom.img", wantComp: fs.CompressionNone},
+		{out: "custom.img.xz", wantPath: "custom.img.xz", wantComp: fs.CompressionXZ},
+		{out: "custom.img.zst", wantPath: "custom.img.zst", wantComp: fs.CompressionZstd},
+		{out: "custom.img", format: "img.gz", wantPath: "custom.img.gz", wantComp: fs.CompressionGzip},
+		{out: "custom.img.xz", format: "img.xz", wantPath: "custom.img.xz", wantComp: fs.CompressionXZ},
+		{out: "custom.img", format: "img", wantPath: "custom.img", wantComp: fs.CompressionNone},
+		{out: "custom", format: "img", wantPath: "custom.img", wantComp: fs.CompressionNone},
+		{out: "out/custom", format: "img.zst", wantPath: "out/custom.img.zst", wantComp: fs.CompressionZstd},
+		{out: "custom.raw", format: "img", wantPath: "custom.raw", wantComp: fs.CompressionNone},
+		{out: "custom.img", format: "zip", wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		p, c, err := outputPath(tc.out, tc.format)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("outputPath(%q, %q) returned err = %v, wantErr = %v", tc.out, tc.format, err, tc.wantErr)
+			continue
+		}
+		if p != tc.wantPath || c != tc.wantComp {
+			t.Errorf("outputPath(%q, %q) = %q, %q, want %q, %q", tc.out, tc.format, p, c, tc.wantPath, tc.wantComp)
+		}
+	}
+}
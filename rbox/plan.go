@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+// isText returns true if data looks like the contents of a text file.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// splitLines splits data into lines for diffing, each ending in a newline.
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+// writeDiff writes a unified diff between two versions of a file to w.
+// Versions which do not exist are shown as /dev/null.
+func writeDiff(w io.Writer, p string, before, after []byte, beforeExists, afterExists bool) error {
+	from, to := "a"+p, "b"+p
+	if !beforeExists {
+		from = "/dev/null"
+	}
+	if !afterExists {
+		to = "/dev/null"
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(before),
+		B:        splitLines(after),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, diff)
+	return err
+}
+
+// describeMutation returns a one-line summary of a mutation.
+func describeMutation(m interpreter.Mutation) string {
+	switch m.Op {
+	case "write":
+		if m.Exists {
+			return fmt.Sprintf("[%s] write %s (%d bytes)", m.Mount, m.Path, len(m.After))
+		}
+		return fmt.Sprintf("[%s] create %s (%d bytes, mode %04o)", m.Mount, m.Path, len(m.After), m.Mode.Perm())
+	case "mkdir":
+		return fmt.Sprintf("[%s] mkdir %s", m.Mount, m.Path)
+	case "remove":
+		return fmt.Sprintf("[%s] remove %s", m.Mount, m.Path)
+	case "remove_all":
+		return fmt.Sprintf("[%s] remove recursively %s", m.Mount, m.Path)
+	case "chmod":
+		return fmt.Sprintf("[%s] chmod %s %04o", m.Mount, m.Path, m.Mode.Perm())
+	case "chown":
+		return fmt.Sprintf("[%s] chown %s %d:%d", m.Mount, m.Path, m.UID, m.GID)
+	case "symlink":
+		return fmt.Sprintf("[%s] symlink %s -> %s", m.Mount, m.Path, m.Target)
+	case "enable":
+		return fmt.Sprintf("[%s] enable %s on %s", m.Mount, m.Path, m.Target)
+	case "pull":
+		return fmt.Sprintf("[%s] pull container image %s", m.Mount, m.Path)
+	}
+	return fmt.Sprintf("[%s] %s %s", m.Mount, m.Op, m.Path)
+}
+
+// printPlan writes the mutations recorded in plan mode to w, with a unified
+// diff for each text file which is written.
+func printPlan(w io.Writer, mutations []interpreter.Mutation) error {
+	for i, m := range mutations {
+		fmt.Fprintf(w, "%d. %s\n", i+1, describeMutation(m))
+		if m.Op != "write" {
+			continue
+		}
+		if m.Exists && bytes.Equal(m.Before, m.After) {
+			fmt.Fprintln(w, "   (contents unchanged)")
+			continue
+		}
+		if !isText(m.Before) || !isText(m.After) {
+			fmt.Fprintln(w, "   (binary contents not shown)")
+			continue
+		}
+		if err := writeDiff(w, m.Path, m.Before, m.After, m.Exists, true); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "%d changes planned; the image was not modified.\n", len(mutations))
+	return nil
+}
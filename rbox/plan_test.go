@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/twitchyliquid64/raspberry-box/fs"
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+func TestPrintPlan(t *testing.T) {
+	mutations := []interpreter.Mutation{
+		{Mount: "ext4", Change: fs.Change{Op: "write", Path: "/etc/hostname", Mode: 0644, Before: []byte("raspberrypi\n"), After: []byte("mypi\n"), Exists: true}},
+		{Mount: "vfat", Change: fs.Change{Op: "write", Path: "/ssh", Mode: 0755}},
+		{Mount: "ext4", Change: fs.Change{Op: "write", Path: "/usr/bin/app", Mode: 0755, After: []byte{0x7f, 'E', 'L', 'F', 0}}},
+		{Mount: "ext4", Change: fs.Change{Op: "chown", Path: "/home/pi", UID: 1000, GID: 1000}},
+		{Mount: "ext4", Change: fs.Change{Op: "enable", Path: "ssh.service", Target: "multi-user.target"}},
+	}
+	var buf bytes.Buffer
+	if err := printPlan(&buf, mutations); err != nil {
+		t.Fatalf("printPlan() failed: %v", err)
+	}
+
+	want := `1. [ext4] write /etc/hostname (5 bytes)
+--- a/etc/hostname
++++ b/etc/hostname
+@@ -1 +1 @@
+-raspberrypi
++mypi
+2. [vfat] create /ssh (0 bytes, mode 0755)
+3. [ext4] create /usr/bin/app (5 bytes, mode 0755)
+   (binary contents not shown)
+4. [ext4] chown /home/pi 1000:1000
+5. [ext4] enable ssh.service on multi-user.target
+5 changes planned; the image was not modified.
+`
+	if got := buf.String(); got != want {
+		t.Errorf("printPlan() output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// runREPL implements the repl subcommand, which mounts an image and reads
+// statements to execute against it interactively.
+func runREPL(args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	img := flags.String("img", "", "Path to the image to mount.")
+	backend := flags.String("backend", "", "How partitions are mounted: kernel or userspace. Defaults to kernel when running as root.")
+	verbose := flags.Bool("verbose", false, "Enables verbose logging.")
+	workspace := flags.String("workspace", "", "Directory which loads starting with // are relative to. Defaults to the nearest directory containing the working directory with a WORKSPACE file.")
+	libPath := flags.String("lib-path", "", "List of directories to search for loaded scripts, separated by ':'. Searched before RBOX_PATH.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s repl --img <image> [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *img == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("repl requires --img and takes no arguments")
+	}
+
+	// Each statement is executed as a new file, so loads must bind
+	// globally and names must be reassignable for it to behave as though
+	// statements continue from the previous one.
+	resolve.LoadBindsGlobally = true
+	resolve.AllowGlobalReassign = true
+
+	loader, err := interpreter.NewFileLoader(".", *workspace, *libPath)
+	if err != nil {
+		return err
+	}
+	s, err := interpreter.NewREPL(*img, *backend, *verbose, loader)
+	if err != nil {
+		return fmt.Errorf("loading %s: %s", *img, interpreter.Backtrace(err))
+	}
+	in := newREPLInput(s)
+
+	// evalMu is held while statements are evaluated, so an interrupt
+	// unmounts the image only once the statement in progress finishes. A
+	// second interrupt exits immediately.
+	var evalMu sync.Mutex
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		in.restore()
+		fmt.Fprintln(os.Stderr, "\nInterrupted, unmounting image.")
+		evalMu.Lock()
+		if err := s.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "closing image: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(130)
+	}()
+
+	if in.term != nil {
+		fmt.Fprintf(os.Stderr, "%s is mounted as image. Press Ctrl-D to exit.\n", *img)
+	}
+	evalMu.Lock()
+	defer evalMu.Unlock()
+	for {
+		prompt := ">>> "
+		v, err := s.EvalREPL(func() ([]byte, error) {
+			evalMu.Unlock()
+			defer evalMu.Lock()
+			line, err := in.readLine(prompt)
+			prompt = "... "
+			return line, err
+		})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, interpreter.Backtrace(err))
+			continue
+		}
+		if v != starlark.None {
+			fmt.Println(v)
+		}
+	}
+	if in.term != nil {
+		fmt.Println()
+	}
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("closing image: %v", err)
+	}
+	return nil
+}
+
+// replInput reads the lines entered into the REPL. If stdin is a terminal,
+// lines can be edited, and names and attributes completed with tab.
+type replInput struct {
+	r *bufio.Reader
+
+	fd     int
+	term   *terminal.Terminal // nil if stdin is not a terminal.
+	prompt string
+
+	// rawState is the state to restore the terminal to while it is in raw
+	// mode, otherwise nil.
+	mu       sync.Mutex
+	rawState *terminal.State
+}
+
+func newREPLInput(s *interpreter.Script) *replInput {
+	in := &replInput{r: bufio.NewReader(os.Stdin), fd: int(os.Stdin.Fd())}
+	if !terminal.IsTerminal(in.fd) {
+		return in
+	}
+	in.term = terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	in.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return in.complete(s, line, pos)
+	}
+	return in
+}
+
+// readLine reads a line, including the trailing newline. The terminal is
+// only put in raw mode while reading, so output from statements and
+// interrupts are handled normally while they are evaluated.
+func (in *replInput) readLine(prompt string) ([]byte, error) {
+	if in.term == nil {
+		line, err := in.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return append(line, '\n'), nil
+		}
+		return line, err
+	}
+
+	state, err := terminal.MakeRaw(in.fd)
+	if err != nil {
+		return nil, err
+	}
+	in.mu.Lock()
+	in.rawState = state
+	in.mu.Unlock()
+	defer in.restore()
+
+	if w, h, err := terminal.GetSize(in.fd); err == nil && w > 0 {
+		in.term.SetSize(w, h)
+	}
+	in.prompt = prompt
+	in.term.SetPrompt(prompt)
+	line, err := in.term.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(line + "\n"), nil
+}
+
+// restore takes the terminal out of raw mode, if it is in raw mode.
+func (in *replInput) restore() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.rawState != nil {
+		terminal.Restore(in.fd, in.rawState)
+		in.rawState = nil
+	}
+}
+
+// complete completes the name or attribute before the cursor to the longest
+// prefix shared by its candidates. If that adds nothing, the candidates are
+// listed below the line. A tab at the start of a line indents it.
+func (in *replInput) complete(s *interpreter.Script, line string, pos int) (string, int, bool) {
+	if strings.TrimSpace(line[:pos]) == "" {
+		return line[:pos] + "    " + line[pos:], pos + 4, true
+	}
+	partial, names := s.Complete(line[:pos])
+	if len(names) == 0 {
+		return "", 0, false
+	}
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if prefix == partial {
+		// The terminal redraws the line being edited after the listing.
+		fmt.Fprintf(in.term, "%s%s\n%s\n", in.prompt, line, strings.Join(names, "  "))
+		return "", 0, false
+	}
+	start := pos - len(partial)
+	return line[:start] + prefix + line[pos:], start + len(prefix), true
+}
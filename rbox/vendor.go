@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/twitchyliquid64/raspberry-box/interpreter"
+)
+
+// runVendor implements the vendor subcommand, which copies the packages
+// listed in the manifest of a workspace into its package cache.
+func runVendor(args []string) error {
+	flags := flag.NewFlagSet("vendor", flag.ExitOnError)
+	workspace := flags.String("workspace", "", "Root of the workspace. Defaults to the nearest directory containing the working directory with a WORKSPACE file.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s vendor [--workspace <dir>]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("vendor takes no arguments")
+	}
+
+	ws := *workspace
+	if ws == "" {
+		var err error
+		if ws, err = interpreter.FindWorkspace("."); err != nil {
+			return err
+		}
+	}
+	pkgs, err := interpreter.Vendor(ws)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("@%s\t%s\t%s\n", name, pkgs[name].Source, pkgs[name].SHA256)
+	}
+	return nil
+}
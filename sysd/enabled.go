@@ -38,8 +38,25 @@ func IsEnabledOnTarget(fs FS, unit, target string) (bool, error) {
 	return false, nil
 }
 
-// Enable enables the given unit as a WantedBy target.
+// DefaultTarget returns the target units of the given kind are normally
+// enabled on: timers.target for timers, sockets.target for sockets, and
+// multi-user.target otherwise.
+func DefaultTarget(unit string) string {
+	switch filepath.Ext(unit) {
+	case ".timer":
+		return "timers.target"
+	case ".socket":
+		return "sockets.target"
+	}
+	return "multi-user.target"
+}
+
+// Enable enables the given unit as a WantedBy target. If target is empty,
+// the default target for the unit is used.
 func Enable(fs FS, unit, target string) error {
+	if target == "" {
+		target = DefaultTarget(unit)
+	}
 	enabled, err := IsEnabledOnTarget(fs, unit, target)
 	if err != nil {
 		return err
@@ -1,8 +1,10 @@
 package sysd
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/twitchyliquid64/raspberry-box/conf/sysd"
 )
@@ -20,8 +22,52 @@ func Exists(fs FS, unit string) (bool, error) {
 	}
 }
 
-// Install installs the specified unit using the given name.
+// unitSuffix returns the suffix the name of a unit must have, based on its
+// sections, or the empty string if any suffix is allowed.
+func unitSuffix(conf *sysd.Unit) string {
+	switch {
+	case conf.Timer != nil:
+		return ".timer"
+	case conf.Socket != nil:
+		return ".socket"
+	case conf.Path != nil:
+		return ".path"
+	}
+	return ""
+}
+
+// checkUnit returns an error if conf cannot be installed as a unit named
+// unitName. Units containing a timer, socket or path section must be named
+// with the matching suffix, and sockets and paths must be valid.
+func checkUnit(unitName string, conf *sysd.Unit) error {
+	if suffix := unitSuffix(conf); suffix != "" && filepath.Ext(unitName) != suffix {
+		return fmt.Errorf("%s unit %s must be named with a %s suffix", suffix[1:], unitName, suffix)
+	}
+	if conf.Timer != nil {
+		if err := conf.Timer.Validate(); err != nil {
+			return fmt.Errorf("timer unit %s: %v", unitName, err)
+		}
+	}
+	if conf.Socket != nil {
+		if err := conf.Socket.Validate(); err != nil {
+			return fmt.Errorf("socket unit %s: %v", unitName, err)
+		}
+	}
+	if conf.Path != nil {
+		if err := conf.Path.Validate(); err != nil {
+			return fmt.Errorf("path unit %s: %v", unitName, err)
+		}
+	}
+	return nil
+}
+
+// Install installs the specified unit using the given name. Units containing
+// a timer, socket or path section must be named with the matching suffix,
+// and timers, sockets and paths must be valid.
 func Install(fs FS, unitName string, conf *sysd.Unit, overwrite bool) error {
+	if err := checkUnit(unitName, conf); err != nil {
+		return err
+	}
 	exists, err := Exists(fs, unitName)
 	if err != nil {
 		return err
@@ -34,3 +80,75 @@ func Install(fs FS, unitName string, conf *sysd.Unit, overwrite bool) error {
 
 	return fs.Write(filepath.Join("/lib/systemd/system", unitName), b, 0644)
 }
+
+// InstallAt replaces the unit file at unitPath, such as one returned by
+// Load, with the given unit.
+func InstallAt(fs FS, unitPath string, conf *sysd.Unit) error {
+	if err := checkUnit(filepath.Base(unitPath), conf); err != nil {
+		return err
+	}
+	return fs.Write(unitPath, []byte(conf.String()), 0644)
+}
+
+// Load reads and parses the specified unit, returning it along with the path
+// it was read from. As with systemd, a unit in /etc/systemd/system takes
+// precedence over one in /lib/systemd/system, where Install writes it.
+// ErrNotInstalled is returned if the unit does not exist in either. Units
+// which are symlinks, such as aliases, or which are masked are refused, as
+// writing them back would not change the unit systemd runs.
+func Load(fs FS, unitName string) (*sysd.Unit, string, error) {
+	for _, dir := range []string{"/etc/systemd/system", "/lib/systemd/system"} {
+		p := filepath.Join(dir, unitName)
+		st, err := fs.LStat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		switch {
+		case st.Mode()&os.ModeSymlink != 0:
+			return nil, "", fmt.Errorf("unit %s is a symlink or masked: %s", unitName, p)
+		case !st.Mode().IsRegular():
+			return nil, "", fmt.Errorf("unit %s is not a regular file: %s", unitName, p)
+		case st.Size() == 0:
+			return nil, "", fmt.Errorf("unit %s is masked: %s is empty", unitName, p)
+		}
+
+		d, err := fs.Cat(p)
+		if err != nil {
+			return nil, "", err
+		}
+		u, err := sysd.Parse(d)
+		if err != nil {
+			return nil, "", fmt.Errorf("parsing %s: %v", unitName, err)
+		}
+		return u, p, nil
+	}
+	return nil, "", ErrNotInstalled
+}
+
+// InstallDropIn writes a drop-in file named name.conf for the specified
+// unit into /etc/systemd/system/<unit>.d, which overrides the keys set by
+// conf in the existing unit. Sections of conf without any keys set are
+// omitted. Any existing drop-in with the same name is replaced.
+func InstallDropIn(fs FS, unitName, name string, conf *sysd.Unit) error {
+	if suffix := unitSuffix(conf); suffix != "" && filepath.Ext(unitName) != suffix {
+		return fmt.Errorf("%s unit %s must be named with a %s suffix", suffix[1:], unitName, suffix)
+	}
+	name = strings.TrimSuffix(name, ".conf")
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid drop-in name %q", name)
+	}
+
+	dir := filepath.Join("/etc/systemd/system", unitName+".d")
+	if _, err := fs.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := fs.Mkdir(dir); err != nil {
+			return err
+		}
+	}
+	return fs.Write(filepath.Join(dir, name+".conf"), []byte(conf.DropIn()), 0644)
+}
@@ -0,0 +1,230 @@
+package sysd
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/twitchyliquid64/raspberry-box/conf/sysd"
+	"github.com/twitchyliquid64/raspberry-box/fs"
+)
+
+// newUnitFS returns an in-memory filesystem containing the given
+// directories and their parents.
+func newUnitFS(t *testing.T, dirs ...string) *fs.Overlay {
+	t.Helper()
+	m := fs.NewMemFS()
+	for _, dir := range dirs {
+		p := "/"
+		for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+			p = path.Join(p, name)
+			if _, err := m.Stat(p); err == nil {
+				continue
+			}
+			if err := m.Mkdir(p); err != nil {
+				t.Fatalf("Mkdir(%q) failed: %v", p, err)
+			}
+		}
+	}
+	return m
+}
+
+func TestInstallTimer(t *testing.T) {
+	m := newUnitFS(t, "/lib/systemd/system")
+
+	if err := Install(m, "backup.timer", &sysd.Unit{Timer: &sysd.Timer{Persistent: true}}, false); err == nil {
+		t.Error("Install() of a timer with no trigger succeeded, want error")
+	}
+	timer := &sysd.Unit{Timer: &sysd.Timer{OnCalendar: "daily"}, WantedBy: []string{"timers.target"}}
+	if err := Install(m, "backup.service", timer, false); err == nil {
+		t.Error("Install() of a timer without a .timer suffix succeeded, want error")
+	}
+	if err := Install(m, "backup.service", &sysd.Unit{Service: &sysd.Service{ExecStart: "/bin/backup"}}, false); err != nil {
+		t.Fatalf("Install(backup.service) failed: %v", err)
+	}
+	if err := Install(m, "backup.timer", timer, false); err != nil {
+		t.Fatalf("Install(backup.timer) failed: %v", err)
+	}
+
+	if err := Enable(m, "backup.timer", ""); err != nil {
+		t.Fatalf("Enable(backup.timer) failed: %v", err)
+	}
+	for _, tc := range []struct {
+		target string
+		want   bool
+	}{
+		{"timers.target", true},
+		{"multi-user.target", false},
+	} {
+		enabled, err := IsEnabledOnTarget(m, "backup.timer", tc.target)
+		if err != nil {
+			t.Fatalf("IsEnabledOnTarget(%q) failed: %v", tc.target, err)
+		}
+		if enabled != tc.want {
+			t.Errorf("IsEnabledOnTarget(%q) = %v, want %v", tc.target, enabled, tc.want)
+		}
+	}
+}
+
+func TestInstallSocket(t *testing.T) {
+	m := newUnitFS(t, "/lib/systemd/system")
+
+	if err := Install(m, "app.socket", &sysd.Unit{Socket: &sysd.Socket{}}, false); err == nil {
+		t.Error("Install() of a socket which listens on nothing succeeded, want error")
+	}
+	socket := &sysd.Unit{Socket: &sysd.Socket{ListenStream: []string{"8080"}}, WantedBy: []string{"sockets.target"}}
+	if err := Install(m, "app.service", socket, false); err == nil {
+		t.Error("Install() of a socket without a .socket suffix succeeded, want error")
+	}
+	if err := Install(m, "app.socket", socket, false); err != nil {
+		t.Fatalf("Install(app.socket) failed: %v", err)
+	}
+
+	if err := Enable(m, "app.socket", ""); err != nil {
+		t.Fatalf("Enable(app.socket) failed: %v", err)
+	}
+	enabled, err := IsEnabledOnTarget(m, "app.socket", "sockets.target")
+	if err != nil {
+		t.Fatalf("IsEnabledOnTarget() failed: %v", err)
+	}
+	if !enabled {
+		t.Error("app.socket is not enabled on sockets.target")
+	}
+}
+
+func TestInstallPath(t *testing.T) {
+	m := newUnitFS(t, "/lib/systemd/system")
+
+	if err := Install(m, "provision.path", &sysd.Unit{Path: &sysd.Path{}}, false); err == nil {
+		t.Error("Install() of a path unit which watches nothing succeeded, want error")
+	}
+	path := &sysd.Unit{Path: &sysd.Path{DirectoryNotEmpty: []string{"/boot/firmware/provision"}}}
+	if err := Install(m, "provision.service", path, false); err == nil {
+		t.Error("Install() of a path unit without a .path suffix succeeded, want error")
+	}
+	if err := Install(m, "provision.path", path, false); err != nil {
+		t.Fatalf("Install(provision.path) failed: %v", err)
+	}
+
+	if err := Enable(m, "provision.path", ""); err != nil {
+		t.Fatalf("Enable(provision.path) failed: %v", err)
+	}
+	enabled, err := IsEnabledOnTarget(m, "provision.path", "multi-user.target")
+	if err != nil {
+		t.Fatalf("IsEnabledOnTarget() failed: %v", err)
+	}
+	if !enabled {
+		t.Error("provision.path is not enabled on multi-user.target")
+	}
+}
+
+func TestInstallDropIn(t *testing.T) {
+	m := newUnitFS(t, "/etc/systemd/system")
+
+	if err := InstallDropIn(m, "ssh.service", "../restart", &sysd.Unit{}); err == nil {
+		t.Error("InstallDropIn() with a name containing a slash succeeded, want error")
+	}
+	timer := &sysd.Unit{Timer: &sysd.Timer{OnCalendar: "daily"}}
+	if err := InstallDropIn(m, "apt-daily.service", "schedule", timer); err == nil {
+		t.Error("InstallDropIn() of a timer for a unit without a .timer suffix succeeded, want error")
+	}
+	for _, name := range []string{"restart", "restart.conf"} {
+		conf := &sysd.Unit{Service: &sysd.Service{Restart: sysd.RestartAlways}}
+		if err := InstallDropIn(m, "ssh.service", name, conf); err != nil {
+			t.Fatalf("InstallDropIn(%q) failed: %v", name, err)
+		}
+	}
+
+	d, err := m.Cat("/etc/systemd/system/ssh.service.d/restart.conf")
+	if err != nil {
+		t.Fatalf("Cat() failed: %v", err)
+	}
+	if got, want := string(d), "[Service]\nRestart=always\n"; got != want {
+		t.Errorf("restart.conf = %q, want %q", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	m := newUnitFS(t, "/etc/systemd/system", "/lib/systemd/system")
+
+	if _, _, err := Load(m, "app.service"); err != ErrNotInstalled {
+		t.Errorf("Load() of a missing unit returned %v, want %v", err, ErrNotInstalled)
+	}
+	want := &sysd.Unit{
+		Description: "Runs the app.",
+		After:       []string{"network-online.target"},
+		Service: &sysd.Service{
+			Type:       sysd.ExecService,
+			ExecStart:  "/usr/local/bin/app",
+			Restart:    sysd.RestartAlways,
+			RestartSec: 5 * time.Second,
+			Stdout:     sysd.OutputJournal,
+		},
+		WantedBy: []string{"multi-user.target"},
+	}
+	if err := Install(m, "app.service", want, false); err != nil {
+		t.Fatalf("Install(app.service) failed: %v", err)
+	}
+	got, p, err := Load(m, "app.service")
+	if err != nil {
+		t.Fatalf("Load(app.service) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load(app.service) = %+v, want %+v", got, want)
+	}
+	if p != "/lib/systemd/system/app.service" {
+		t.Errorf("Load(app.service) path = %q, want /lib/systemd/system/app.service", p)
+	}
+
+	// Units in /etc/systemd/system take precedence.
+	if err := m.Write("/etc/systemd/system/app.service", []byte("[Unit]\nDescription=Runs the local app.\n"), 0644); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if got, p, err = Load(m, "app.service"); err != nil {
+		t.Fatalf("Load(app.service) failed: %v", err)
+	}
+	if got.Description != "Runs the local app." || p != "/etc/systemd/system/app.service" {
+		t.Errorf("Load(app.service) = %q from %q, want the unit in /etc/systemd/system", got.Description, p)
+	}
+
+	// Editing a loaded unit writes it back where it was read from, so the
+	// copy in /etc/systemd/system does not shadow the edit.
+	got.Description = "Runs the edited app."
+	if err := InstallAt(m, p, got); err != nil {
+		t.Fatalf("InstallAt(%q) failed: %v", p, err)
+	}
+	if got, _, err = Load(m, "app.service"); err != nil {
+		t.Fatalf("Load(app.service) failed: %v", err)
+	}
+	if got.Description != "Runs the edited app." {
+		t.Errorf("Load(app.service).Description = %q after editing, want %q", got.Description, "Runs the edited app.")
+	}
+	if lib, _ := m.Cat("/lib/systemd/system/app.service"); !strings.Contains(string(lib), "Description=Runs the app.\n") {
+		t.Errorf("/lib/systemd/system/app.service = %q, want it unchanged", lib)
+	}
+
+	// Aliases and masks are refused.
+	if err := m.Symlink("/etc/systemd/system/masked.service", "/dev/null"); err != nil {
+		t.Fatalf("Symlink() failed: %v", err)
+	}
+	if err := m.Write("/etc/systemd/system/empty.service", nil, 0644); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := m.Symlink("/etc/systemd/system/alias.service", "/lib/systemd/system/app.service"); err != nil {
+		t.Fatalf("Symlink() failed: %v", err)
+	}
+	for _, name := range []string{"masked.service", "empty.service", "alias.service"} {
+		if _, _, err := Load(m, name); err == nil {
+			t.Errorf("Load(%s) succeeded, want error", name)
+		}
+	}
+
+	if err := m.Write("/lib/systemd/system/broken.service", []byte("ExecStart=/bin/true\n"), 0644); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if _, _, err := Load(m, "broken.service"); err == nil {
+		t.Error("Load() of a unit with a key outside a section succeeded, want error")
+	}
+}
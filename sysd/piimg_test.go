@@ -30,7 +30,7 @@ func TestKMountPiImgUnitExists(t *testing.T) {
 	}
 	defer f.Close()
 
-	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize))
+	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize), false)
 	if err != nil {
 		t.Fatalf("KMountExt4() failed: %v", err)
 	}
@@ -61,7 +61,7 @@ func TestKMountPiImgUnitEnable(t *testing.T) {
 	}
 	defer f.Close()
 
-	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize))
+	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize), false)
 	if err != nil {
 		t.Fatalf("KMountExt4() failed: %v", err)
 	}
@@ -97,7 +97,7 @@ func TestKMountPiImgEnabled(t *testing.T) {
 	}
 	defer f.Close()
 
-	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize))
+	m, err := fs.KMountExt4(*imgPath, uint64(tab.GetPartition(2).GetLBAStart()*sectorSize), uint64(tab.GetPartition(2).GetLBALen()*sectorSize), false)
 	if err != nil {
 		t.Fatalf("KMountExt4() failed: %v", err)
 	}
@@ -8,6 +8,7 @@ import (
 // FS describes an interface which must be provided, so the package
 // can interact with the filesystem.
 type FS interface {
+	Cat(path string) ([]byte, error)
 	Stat(path string) (os.FileInfo, error)
 	LStat(path string) (os.FileInfo, error)
 	Symlink(at, to string) error